@@ -0,0 +1,34 @@
+#!/usr/bin/env bash
+# Runs the benchmarks with the tree-walker, with the bytecode VM('--vm') and
+# with the VM after the optimizer('--vm -O'), checks that they all print the
+# same output, and reports the timings.
+cd "$(dirname "$0")/.."
+export GOPATH=$(pwd)
+export GO111MODULE=off
+
+go build -o /tmp/magpie-bench main.go || exit 1
+
+now() { date +%s.%N; }
+
+printf "%-14s %12s %12s %8s %12s\n" "benchmark" "tree-walker" "vm" "speedup" "vm -O"
+for file in benchmarks/*.mp; do
+    name=$(basename $file .mp)
+
+    start=$(now)
+    tree_out=$(/tmp/magpie-bench run $file 2>&1)
+    tree_time=$(awk "BEGIN { print $(now) - $start }")
+
+    start=$(now)
+    vm_out=$(/tmp/magpie-bench run --vm $file 2>&1)
+    vm_time=$(awk "BEGIN { print $(now) - $start }")
+
+    start=$(now)
+    opt_out=$(/tmp/magpie-bench run --vm -O $file 2>&1)
+    opt_time=$(awk "BEGIN { print $(now) - $start }")
+
+    if [ "$tree_out" != "$vm_out" ] || [ "$tree_out" != "$opt_out" ]; then
+        echo "$name: the outputs are different"
+        exit 1
+    fi
+    printf "%-14s %11.2fs %11.2fs %7.2fx %11.2fs\n" $name $tree_time $vm_time $(awk "BEGIN { print $tree_time / $vm_time }") $opt_time
+done
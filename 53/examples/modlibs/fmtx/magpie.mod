@@ -0,0 +1,5 @@
+module fmtx
+version 1.0.0
+
+# 需要greet 1.2.0中新增的'Bye'
+require greet 1.2.0 ../greet-1.2.0
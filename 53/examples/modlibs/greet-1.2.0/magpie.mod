@@ -0,0 +1,2 @@
+module greet
+version 1.2.0
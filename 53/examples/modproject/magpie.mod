@@ -0,0 +1,9 @@
+# 模块的清单文件
+module app
+version 0.1.0
+
+require (
+    greet 1.0.0 ../modlibs/greet-1.0.0
+    fmtx 1.0.0 ../modlibs/fmtx
+    colors 0.1.0 ../modlibs/colors-0.1.0.tar.gz
+)
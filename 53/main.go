@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"github.com/maja42/ember"
+	"magpie/checker"
 	"magpie/eval"
 	"magpie/lexer"
+	"magpie/mod"
+	"magpie/optimizer"
 	"magpie/parser"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 )
 
 /*
@@ -142,6 +150,20 @@ func TestEval() {
 		//do
 		{`x = 3; do { x--; println(x) if x == 1 { break } };  println()`, "nil"},
 
+		//switch in loops, break and continue go to the loop
+		{`out = []; outer: for i in 1..3 { for j in 1..3 { switch j { case 2 { continue outer } }; out.push(i * 10 + j) } } out`, "[11, 21, 31]"},
+		{`out = []; outer: for i in 1..3 { for j in 1..3 { switch i { case 2 { break outer } }; out.push(i * 10 + j) } } out`, "[11, 12, 13]"},
+		{`out = []; for i in 1..5 { switch i { case 2 { continue } case 4 { break } } out.push(i) } out`, "[1, 3]"},
+		{`fn f(x) { switch x { case 1 { return "one" } }; "other" } f(1) + f(2)`, "oneother"},
+
+		//'x<-1' is a comparison, even as the block's last expression
+		{`fn f(x) { x<-1 } f(-5)`, "true"},
+		{`fn f(x) { if x<-1 { "less" } else { "not less" } } f(0)`, "not less"},
+		{`ch = chan(1); ch <- 2; <-ch`, "2"},
+
+		//leaving a generator loop closes the generator
+		{`log = []; fn gen() { defer log.push("defer"); try { yield 1; yield 2 } finally { log.push("finally") } } for x in gen() { log.push(x); break } log.push("after"); log`, `[1, "finally", "defer", "after"]`},
+
 		//multiple assignment & return-values
 		{`a, b, c = 1, true, "hello"; println(a) println(b) println(c)`, "nil"},
 		{`a, b, c = 2, false, ["x", "y", "z"]; println(a) println(b) println(c[1])`, "nil"},
@@ -159,8 +181,23 @@ func TestEval() {
 		{`if 10 == 11 || 10 > 12 { printf("10 == 11 || 10 > 12\n") } else { println(" 10 not equal 11 and 10 not larger than 12") }`, "nil"},
 
 		//import
-		{`import examples.sub_package.calc; println(Add(2,3))`, "nil"},
-		{`import examples.sub_package.calc; println(_add(2,3))`, "error"},
+		{`import examples.sub_package.calc; println(calc.Add(2,3))`, "nil"},
+		{`import examples.sub_package.calc; println(calc._add(2,3))`, "error"},
+		{`import examples.sub_package.calc as c; println(c.Add(2,3))`, "nil"},
+		{`from examples.sub_package.calc import Add, Minus; println(Add(2,3) + Minus(3,2))`, "nil"},
+		{`from examples.sub_package.calc import _add`, "error"},
+		{`import examples.sub_package.calc; println(Add(2,3))`, "error"},
+		{`import ./examples/sub_package/calc; println(calc.Add(2,3))`, "nil"},
+		{`import examples.sub_package.shapes; println(shapes.Area(shapes.Rect(2,3)))`, "nil"},
+
+		//macros are expanded only in the defining module and where they are imported by name
+		{`from examples.sub_package.macros import Unless, Twice; let r = ""; Unless(1 > 2) { r = "ok" }; [r, Twice(3)]`, `["ok", 12]`},
+		{`import examples.sub_package.macros; fn show(x) { "fn " + x } show("a")`, "fn a"},
+		{`from examples.sub_package.macros import Twice; fn Twice(x) { x } Twice(1)`, "1"},
+		{`import examples.sub_package.macros; double(1)`, "error"},
+		{`from examples.sub_package.macros import show`, "error"},
+		{`from examples.sub_package.macros import Unless; macro Unless(x) { x }`, "error"},
+		{`macro m(x) { x }; macro m(x) { x }`, "error"},
 
 		//regexp
 		{`name = "Huang HaiFeng"; if name =~ /huang/i { println("Hello Huang") }`, "nil"},
@@ -177,6 +214,9 @@ func TestEval() {
 
 		//anonymous functions(lambdas)
 		{`let add = fn (x, factor) { x + factor(x) } result = add(5, (x) => x * 2) println(result)`, "nil"},
+
+		//recursion depth
+		{`fn fact(n) { n * fact(n - 1) }; let m = ""; try { fact(1) } catch (e) { m = e.message } m`, "maximum recursion depth exceeded(10000), call chain: fact (repeated 10000 times)"},
 	}
 
 	for _, tt := range tests {
@@ -191,7 +231,10 @@ func TestEval() {
 		}
 
 		scope := eval.NewScope(nil, os.Stdout)
-		evaluated := eval.Eval(program, scope)
+		evaluated := eval.ExpandMacros(program)
+		if evaluated == nil {
+			evaluated = eval.Eval(program, scope)
+		}
 		if evaluated != nil {
 			if evaluated.Inspect() != tt.expected {
 				fmt.Printf("%s", evaluated.Inspect())
@@ -239,6 +282,29 @@ func RegisterGoGlobals() (err error) {
 	return
 }
 
+var optimize bool //'magpie run -O'
+
+// the execution's limits: 'magpie run --timeout --max-steps --max-alloc --deny'
+var (
+	timeout  time.Duration
+	maxSteps int64
+	maxAlloc int64
+	denied   eval.Capability
+)
+
+// the options of the execution, nil if it has no limits
+func runOptions() (*eval.Options, context.CancelFunc) {
+	if timeout == 0 && maxSteps == 0 && maxAlloc == 0 && denied == 0 {
+		return nil, func() {}
+	}
+	opts := &eval.Options{Context: context.Background(), MaxSteps: maxSteps, MaxAlloc: maxAlloc, Deny: denied}
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		opts.Context, cancel = context.WithTimeout(opts.Context, timeout)
+	}
+	return opts, cancel
+}
+
 func runProgram(filename string) {
 	l, err := lexer.NewFileLexer(filename)
 	if err != nil {
@@ -254,12 +320,192 @@ func runProgram(filename string) {
 		}
 		os.Exit(1)
 	}
-	scope := eval.NewScope(nil, os.Stdout)
+	opts, cancel := runOptions()
+	defer cancel()
+	if errObj := eval.ExpandMacrosWithOptions(program, opts); errObj != nil {
+		fmt.Println(errObj.Inspect())
+		os.Exit(1)
+	}
+	if optimize {
+		optimizer.Optimize(program)
+	}
+	scope := eval.NewScopeWithOptions(os.Stdout, opts)
 
 	result := eval.Eval(program, scope)
-	if result.Type() == eval.ERROR_OBJ {
-		fmt.Println(result.Inspect())
+	if errObj, ok := result.(*eval.Error); ok {
+		fmt.Print(errObj.Traceback())
+		fmt.Println(errObj.Inspect())
+	}
+}
+
+// magpie check file1.mp file2.mp ...
+func checkProgram(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: magpie check file.mp ...")
+		return 2
+	}
+
+	failed := false
+	for _, filename := range args {
+		l, err := lexer.NewFileLexer(filename)
+		if err != nil {
+			fmt.Printf("error reading %s\n", filename)
+			return 1
+		}
+
+		p := parser.NewParser(l)
+		program := p.ParseProgram()
+		errors := p.Errors()
+		if len(errors) == 0 {
+			if errObj := eval.ExpandMacros(program); errObj != nil {
+				errors = []string{errObj.Inspect()}
+			} else {
+				errors = checker.Check(program)
+			}
+		}
+		for _, err := range errors {
+			fmt.Println(err)
+		}
+		if len(errors) > 0 {
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// magpie ast [--expand] [-O] [--bytecode] file.mp
+func printAst(args []string) int {
+	flags := flag.NewFlagSet("ast", flag.ExitOnError)
+	expand := flags.Bool("expand", false, "expand the macros before printing")
+	optimized := flags.Bool("O", false, "expand the macros and optimize the program before printing")
+	bytecode := flags.Bool("bytecode", false, "print the bytecode which the VM runs")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("usage: magpie ast [--expand] [-O] [--bytecode] file.mp")
+		return 2
+	}
+
+	filename := flags.Arg(0)
+	l, err := lexer.NewFileLexer(filename)
+	if err != nil {
+		fmt.Printf("error reading %s\n", filename)
+		return 1
+	}
+
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		for _, err := range p.Errors() {
+			fmt.Println(err)
+		}
+		return 1
+	}
+	if *expand || *optimized {
+		if errObj := eval.ExpandMacros(program); errObj != nil {
+			fmt.Println(errObj.Inspect())
+			return 1
+		}
+	}
+	if *optimized {
+		optimizer.Optimize(program)
+	}
+
+	if *bytecode {
+		fmt.Print(eval.Disassemble(program))
+		return 0
+	}
+
+	for _, is := range program.Imports {
+		fmt.Println(is.String())
+	}
+	for _, stmt := range program.Statements {
+		fmt.Println(stmt.String())
 	}
+	return 0
+}
+
+// magpie env [file.mp]: print the module search path
+func printEnv(args []string) int {
+	dirs := []string{"<vendor directories>", "<importing file's directory>"}
+	if len(args) > 0 {
+		abs, err := filepath.Abs(args[0])
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		dir := filepath.Dir(abs)
+		dirs = append(mod.VendorDirs(dir), dir)
+	}
+
+	fmt.Printf("MAGPIE_PATH=%q\n", os.Getenv("MAGPIE_PATH"))
+	fmt.Printf("MAGPIE_ROOT=%q\n", os.Getenv("MAGPIE_ROOT"))
+	fmt.Println("search path:")
+	for _, root := range append(dirs, parser.SearchPath()...) {
+		fmt.Printf("\t%s\n", root)
+	}
+	fmt.Printf("package entry: %s\n", parser.PackageEntry)
+	fmt.Printf("standard libs: %s\n", strings.Join(parser.StdLibs(), ", "))
+	return 0
+}
+
+// magpie mod init|list|vendor|verify
+func modCommand(args []string) int {
+	usage := "usage: magpie mod init <name> | list | vendor | verify"
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return 2
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if args[0] == "init" {
+		if len(args) != 2 {
+			fmt.Println("usage: magpie mod init <name>")
+			return 2
+		}
+		if err := mod.Init(wd, args[1]); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	root, ok := mod.FindRoot(wd)
+	if !ok {
+		fmt.Printf("%s not found in the current directory or any parent directory\n", mod.ModFile)
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		var mf *mod.File
+		var list []mod.Module
+		if mf, list, err = mod.BuildList(root); err == nil {
+			fmt.Printf("%s %s\n", mf.Module, mf.Version)
+			for _, m := range list {
+				fmt.Printf("%s %s %s\n", m.Name, m.Version, m.Source)
+			}
+		}
+	case "vendor":
+		err = mod.Vendor(root, os.Stdout)
+	case "verify":
+		err = mod.Verify(root, os.Stdout)
+	default:
+		fmt.Println(usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
 }
 
 func runWithEmbedFile() bool {
@@ -303,11 +549,16 @@ func runWithEmbedFile() bool {
 		}
 		os.Exit(1)
 	}
+	if errObj := eval.ExpandMacros(program); errObj != nil {
+		fmt.Println(errObj.Inspect())
+		os.Exit(1)
+	}
 	scope := eval.NewScope(nil, os.Stdout)
 
 	result := eval.Eval(program, scope)
-	if result.Type() == eval.ERROR_OBJ {
-		fmt.Println(result.Inspect())
+	if errObj, ok := result.(*eval.Error); ok {
+		fmt.Print(errObj.Traceback())
+		fmt.Println(errObj.Inspect())
 		os.Exit(1)
 	}
 
@@ -327,8 +578,39 @@ func main() {
 		os.Exit(1)
 	}
 
-	if len(args) == 1 {
-		runProgram(args[0])
+	if len(args) > 0 {
+		switch args[0] {
+		case "check":
+			os.Exit(checkProgram(args[1:]))
+		case "ast":
+			os.Exit(printAst(args[1:]))
+		case "env":
+			os.Exit(printEnv(args[1:]))
+		case "mod":
+			os.Exit(modCommand(args[1:]))
+		case "run":
+			args = args[1:]
+		}
+	}
+
+	//magpie [run] [options] file.mp
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.BoolVar(&eval.StrictTypes, "strict-types", false, "check the annotated types at function boundaries")
+	flags.BoolVar(&eval.UseVM, "vm", false, "run with the bytecode VM instead of the tree-walker, see 'magpie ast --bytecode'")
+	flags.BoolVar(&optimize, "O", false, "optimize the program: fold the constants, remove the dead code, inline the trivial lambdas")
+	flags.IntVar(&eval.MaxDepth, "max-depth", eval.MaxDepth, "the maximum depth of the nested function calls, 0 for no limit")
+	flags.DurationVar(&timeout, "timeout", 0, "stop the program after the duration, e.g. '2s'")
+	flags.Int64Var(&maxSteps, "max-steps", 0, "the maximum number of the evaluated nodes, 0 for no limit")
+	flags.Int64Var(&maxAlloc, "max-alloc", 0, "the approximate maximum bytes of the created strings and collections, 0 for no limit")
+	flags.Func("deny", "deny the operations, a comma separated list of: command, file, env, exit, go, all", func(s string) error {
+		caps, err := eval.ParseCapabilities(s)
+		denied |= caps
+		return err
+	})
+	flags.Parse(args)
+
+	if flags.NArg() == 1 {
+		runProgram(flags.Arg(0))
 	} else {
 		TestEval()
 	}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"magpie/token"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"unicode/utf8"
 )
@@ -28,7 +30,9 @@ type Expression interface {
 
 type Program struct {
 	Statements []Statement
-	Imports    map[string]*ImportStatement
+	Imports    []*ImportStatement //in declaration order
+
+	Resolved bool //the resolver has assigned the variables' slots
 }
 
 func (p *Program) Pos() token.Position {
@@ -63,9 +67,16 @@ func (p *Program) String() string {
 	return out.String()
 }
 
+//import a.b.c
+//import a.b.c as alias
+//from a.b.c import Name1, Name2
 type ImportStatement struct {
 	Token      token.Token
-	ImportPath string
+	ImportPath string          //the path as written, e.g. 'a/b/c', './helpers'
+	Path       string          //the resolved absolute path of the module(stdlib's name for standard libs)
+	Alias      *Identifier     //'import a.b.c as alias'
+	Names      []*Identifier   //'from a.b.c import Name1, Name2'
+	Macros     map[string]bool //the names in 'Names' which are the module's macros, set by the macro expansion
 	Program    *Program
 }
 
@@ -74,26 +85,58 @@ func (is *ImportStatement) Pos() token.Position {
 }
 
 func (is *ImportStatement) End() token.Position {
-	length := utf8.RuneCountInString(is.ImportPath)
+	length := utf8.RuneCountInString(is.String())
 	return token.Position{Filename: is.Token.Pos.Filename, Line: is.Token.Pos.Line, Col: is.Token.Pos.Col + length}
 }
 
 func (is *ImportStatement) statementNode()       {}
 func (is *ImportStatement) TokenLiteral() string { return is.Token.Literal }
+
+// Name returns the name which the module object is bound to.
+func (is *ImportStatement) Name() string {
+	if is.Alias != nil {
+		return is.Alias.Value
+	}
+	return filepath.Base(is.ImportPath)
+}
+
+// IsRelativeImport reports whether the path is relative to the importing
+// file's directory, e.g. './helpers', '../shared/log'
+func IsRelativeImport(path string) bool {
+	return strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../")
+}
+
 func (is *ImportStatement) String() string {
 	var out bytes.Buffer
 
-	out.WriteString(is.TokenLiteral())
-	out.WriteString(" ")
-	out.WriteString(is.ImportPath)
+	path := is.ImportPath
+	if !IsRelativeImport(path) {
+		path = strings.Replace(path, "/", ".", -1)
+	}
+	if len(is.Names) > 0 {
+		names := []string{}
+		for _, name := range is.Names {
+			names = append(names, name.String())
+		}
+		out.WriteString("from " + path + " import " + strings.Join(names, ", "))
+		return out.String()
+	}
+
+	out.WriteString("import ")
+	out.WriteString(path)
+	if is.Alias != nil {
+		out.WriteString(" as " + is.Alias.String())
+	}
 
 	return out.String()
 }
 
 //let <identifier1>,<identifier2>,... = <expression1>,<expression2>,...
+//let <identifier1>: <type1>, ... = <expression1>, ...
 type LetStatement struct {
 	Token  token.Token
 	Names  []*Identifier
+	Types  []*Identifier //optional type annotations, nil if not annotated
 	Values []Expression
 }
 
@@ -118,8 +161,8 @@ func (ls *LetStatement) String() string {
 	out.WriteString(ls.TokenLiteral() + " ")
 
 	names := []string{}
-	for _, name := range ls.Names {
-		names = append(names, name.String())
+	for i, name := range ls.Names {
+		names = append(names, name.String()+typeString(ls.Types, i))
 	}
 	out.WriteString(strings.Join(names, ", "))
 
@@ -143,6 +186,8 @@ type ReturnStatement struct {
 	Token        token.Token // the 'return' token
 	ReturnValue  Expression  //for old campatibility
 	ReturnValues []Expression
+
+	IsTailCall bool //'return f(x)' in a tail position, which is run like 'tailcall f(x)', set by the resolver
 }
 
 func (rs *ReturnStatement) Pos() token.Position {
@@ -372,6 +417,14 @@ func (nl *NumberLiteral) String() string       { return nl.Token.Literal }
 type Identifier struct {
 	Token token.Token
 	Value string
+
+	//set by the resolver: the variable is in slot 'Slot' of the function
+	//scope 'Depth' scopes up, or if 'Slot' is -1, it's not a local of the
+	//enclosing functions and is looked up from there. 'Frames' are the
+	//layouts of the function scopes on the way, innermost first.
+	Depth  int
+	Slot   int
+	Frames []*Locals
 }
 
 func (i *Identifier) Pos() token.Position { return i.Token.Pos }
@@ -442,8 +495,34 @@ type FunctionLiteral struct {
 	Token      token.Token // The 'fn' token
 	Name       string      // function's name
 	Parameters []*Identifier
+	ParamTypes []*Identifier //optional type annotations, nil if not annotated
+	ReturnType *Identifier   //optional return type annotation(fn f() -> type)
 	Variadic   bool
 	Body       *BlockStatement
+
+	IsGenerator bool //function body contains 'yield'
+	IsAsync     bool //declared with 'async', calling it returns a promise
+
+	Locals *Locals //the layout of the local variables, set by the resolver
+}
+
+// Locals is the layout of a function's local variables: the parameters
+// first, then the variables assigned in the function's body.
+type Locals struct {
+	Names []string
+	Index map[string]int //name -> slot
+
+	Captured bool //the call's scope could outlive the call, e.g. a closure is created in it
+}
+
+// Add adds the variable if it's not in the layout, and returns its slot.
+func (l *Locals) Add(name string) int {
+	if idx, ok := l.Index[name]; ok {
+		return idx
+	}
+	l.Index[name] = len(l.Names)
+	l.Names = append(l.Names, name)
+	return len(l.Names) - 1
 }
 
 func (fl *FunctionLiteral) Pos() token.Position {
@@ -451,6 +530,9 @@ func (fl *FunctionLiteral) Pos() token.Position {
 }
 
 func (fl *FunctionLiteral) End() token.Position {
+	if fl.Body == nil { //interface method without default implementation
+		return fl.Token.Pos
+	}
 	return fl.Body.End()
 }
 
@@ -460,10 +542,13 @@ func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
 	params := []string{}
-	for _, p := range fl.Parameters {
-		params = append(params, p.String())
+	for i, p := range fl.Parameters {
+		params = append(params, p.String()+typeString(fl.ParamTypes, i))
 	}
 
+	if fl.IsAsync {
+		out.WriteString("async ")
+	}
 	out.WriteString(fl.TokenLiteral())
 	if fl.Name != "" {
 		out.WriteString(" ")
@@ -474,13 +559,89 @@ func (fl *FunctionLiteral) String() string {
 	if fl.Variadic {
 		out.WriteString("...")
 	}
-	out.WriteString(") {")
+	out.WriteString(")")
+	if fl.ReturnType != nil {
+		out.WriteString(" -> " + fl.ReturnType.String())
+	}
+	if fl.Body == nil { //interface method without default implementation
+		return out.String()
+	}
+	out.WriteString(" {")
 	out.WriteString(fl.Body.String())
 	out.WriteString("}")
 
 	return out.String()
 }
 
+//macro(x, y) { quote(...) }, or macro name(x, y) { quote(...) }
+type MacroLiteral struct {
+	Token      token.Token // The 'macro' token
+	Name       string      // macro's name
+	Parameters []*Identifier
+	Body       *BlockStatement
+}
+
+func (ml *MacroLiteral) Pos() token.Position {
+	return ml.Token.Pos
+}
+
+func (ml *MacroLiteral) End() token.Position {
+	return ml.Body.End()
+}
+
+func (ml *MacroLiteral) expressionNode()      {}
+func (ml *MacroLiteral) TokenLiteral() string { return ml.Token.Literal }
+func (ml *MacroLiteral) String() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for _, p := range ml.Parameters {
+		params = append(params, p.String())
+	}
+
+	out.WriteString(ml.TokenLiteral())
+	if ml.Name != "" {
+		out.WriteString(" ")
+		out.WriteString(ml.Name)
+	}
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") {")
+	out.WriteString(ml.Body.String())
+	out.WriteString("}")
+
+	return out.String()
+}
+
+// a block passed to a macro, e.g. 'measure { ... }' or 'retry(3) { ... }'.
+// Evaluating it runs the block in the current scope.
+type BlockLiteral struct {
+	Token token.Token // the '{' token
+	Block *BlockStatement
+}
+
+func (bl *BlockLiteral) Pos() token.Position {
+	return bl.Token.Pos
+}
+
+func (bl *BlockLiteral) End() token.Position {
+	return bl.Block.End()
+}
+
+func (bl *BlockLiteral) expressionNode()      {}
+func (bl *BlockLiteral) TokenLiteral() string { return bl.Token.Literal }
+func (bl *BlockLiteral) String() string {
+	return "{ " + bl.Block.String() + " }"
+}
+
+// the type annotation's string representation(": type"), or "" if not annotated.
+func typeString(types []*Identifier, idx int) string {
+	if idx >= len(types) || types[idx] == nil {
+		return ""
+	}
+	return ": " + types[idx].String()
+}
+
 type ArrayLiteral struct {
 	Token   token.Token
 	Members []Expression
@@ -617,6 +778,128 @@ func (h *HashLiteral) String() string {
 	return out.String()
 }
 
+///////////////////////////////////////////////////////////
+//                    COMPREHENSIONS                     //
+///////////////////////////////////////////////////////////
+// 'for x in xs if cond' part of the comprehensions
+type ComprehensionClause struct {
+	Token    token.Token // the 'for' token
+	Names    []*Identifier
+	Iterable Expression
+	Conds    []Expression // the 'if' conditions
+}
+
+func (cc *ComprehensionClause) Pos() token.Position {
+	return cc.Token.Pos
+}
+
+func (cc *ComprehensionClause) End() token.Position {
+	if len(cc.Conds) > 0 {
+		return cc.Conds[len(cc.Conds)-1].End()
+	}
+	return cc.Iterable.End()
+}
+
+func (cc *ComprehensionClause) TokenLiteral() string { return cc.Token.Literal }
+func (cc *ComprehensionClause) String() string {
+	var out bytes.Buffer
+
+	names := []string{}
+	for _, name := range cc.Names {
+		names = append(names, name.String())
+	}
+
+	out.WriteString(" for ")
+	out.WriteString(strings.Join(names, ", "))
+	out.WriteString(" in ")
+	out.WriteString(cc.Iterable.String())
+	for _, cond := range cc.Conds {
+		out.WriteString(" if ")
+		out.WriteString(cond.String())
+	}
+
+	return out.String()
+}
+
+func clausesString(clauses []*ComprehensionClause) string {
+	var out bytes.Buffer
+	for _, clause := range clauses {
+		out.WriteString(clause.String())
+	}
+	return out.String()
+}
+
+func closingTokenEnd(tok token.Token) token.Position {
+	return token.Position{Filename: tok.Pos.Filename, Line: tok.Pos.Line, Col: tok.Pos.Col + 1}
+}
+
+//[x * 2 for x in xs if x > 0]
+type ArrayComprehension struct {
+	Token    token.Token // the '[' token
+	Expr     Expression
+	Clauses  []*ComprehensionClause
+	EndToken token.Token // the ']' token
+}
+
+func (ac *ArrayComprehension) Pos() token.Position {
+	return ac.Token.Pos
+}
+
+func (ac *ArrayComprehension) End() token.Position {
+	return closingTokenEnd(ac.EndToken)
+}
+
+func (ac *ArrayComprehension) expressionNode()      {}
+func (ac *ArrayComprehension) TokenLiteral() string { return ac.Token.Literal }
+func (ac *ArrayComprehension) String() string {
+	return "[" + ac.Expr.String() + clausesString(ac.Clauses) + "]"
+}
+
+//(x * 2 for x in xs if x > 0)
+type TupleComprehension struct {
+	Token    token.Token // the '(' token
+	Expr     Expression
+	Clauses  []*ComprehensionClause
+	EndToken token.Token // the ')' token
+}
+
+func (tc *TupleComprehension) Pos() token.Position {
+	return tc.Token.Pos
+}
+
+func (tc *TupleComprehension) End() token.Position {
+	return closingTokenEnd(tc.EndToken)
+}
+
+func (tc *TupleComprehension) expressionNode()      {}
+func (tc *TupleComprehension) TokenLiteral() string { return tc.Token.Literal }
+func (tc *TupleComprehension) String() string {
+	return "(" + tc.Expr.String() + clausesString(tc.Clauses) + ")"
+}
+
+//{k: v for k, v in h if v > 0}
+type HashComprehension struct {
+	Token    token.Token // the '{' token
+	Key      Expression
+	Value    Expression
+	Clauses  []*ComprehensionClause
+	EndToken token.Token // the '}' token
+}
+
+func (hc *HashComprehension) Pos() token.Position {
+	return hc.Token.Pos
+}
+
+func (hc *HashComprehension) End() token.Position {
+	return closingTokenEnd(hc.EndToken)
+}
+
+func (hc *HashComprehension) expressionNode()      {}
+func (hc *HashComprehension) TokenLiteral() string { return hc.Token.Literal }
+func (hc *HashComprehension) String() string {
+	return "{" + hc.Key.String() + ": " + hc.Value.String() + clausesString(hc.Clauses) + "}"
+}
+
 type CallExpression struct {
 	Token     token.Token // The '(' token
 	Function  Expression  // Identifier or FunctionLiteral
@@ -828,6 +1111,7 @@ func (ae *AssignExpression) String() string {
 
 type BreakExpression struct {
 	Token token.Token
+	Label string //break label
 }
 
 func (be *BreakExpression) Pos() token.Position {
@@ -843,13 +1127,19 @@ func (be *BreakExpression) End() token.Position {
 func (be *BreakExpression) expressionNode()      {}
 func (be *BreakExpression) TokenLiteral() string { return be.Token.Literal }
 
-func (be *BreakExpression) String() string { return be.Token.Literal }
+func (be *BreakExpression) String() string {
+	if be.Label != "" {
+		return be.Token.Literal + " " + be.Label
+	}
+	return be.Token.Literal
+}
 
 ///////////////////////////////////////////////////////////
 //                         CONTINUE                      //
 ///////////////////////////////////////////////////////////
 type ContinueExpression struct {
 	Token token.Token
+	Label string //continue label
 }
 
 func (ce *ContinueExpression) Pos() token.Position {
@@ -865,7 +1155,80 @@ func (ce *ContinueExpression) End() token.Position {
 func (ce *ContinueExpression) expressionNode()      {}
 func (ce *ContinueExpression) TokenLiteral() string { return ce.Token.Literal }
 
-func (ce *ContinueExpression) String() string { return ce.Token.Literal }
+func (ce *ContinueExpression) String() string {
+	if ce.Label != "" {
+		return ce.Token.Literal + " " + ce.Label
+	}
+	return ce.Token.Literal
+}
+
+///////////////////////////////////////////////////////////
+//                         YIELD                         //
+///////////////////////////////////////////////////////////
+type YieldExpression struct {
+	Token token.Token
+	Value Expression //nil if no value
+}
+
+func (ye *YieldExpression) Pos() token.Position {
+	return ye.Token.Pos
+}
+
+func (ye *YieldExpression) End() token.Position {
+	if ye.Value != nil {
+		return ye.Value.End()
+	}
+	length := utf8.RuneCountInString(ye.Token.Literal)
+	pos := ye.Token.Pos
+	return token.Position{Filename: pos.Filename, Line: pos.Line, Col: pos.Col + length}
+}
+
+func (ye *YieldExpression) expressionNode()      {}
+func (ye *YieldExpression) TokenLiteral() string { return ye.Token.Literal }
+
+func (ye *YieldExpression) String() string {
+	if ye.Value == nil {
+		return ye.Token.Literal
+	}
+	return ye.Token.Literal + " " + ye.Value.String()
+}
+
+///////////////////////////////////////////////////////////
+//                         AWAIT                         //
+///////////////////////////////////////////////////////////
+type AwaitExpression struct {
+	Token token.Token
+	Value Expression
+}
+
+func (ae *AwaitExpression) Pos() token.Position {
+	return ae.Token.Pos
+}
+
+func (ae *AwaitExpression) End() token.Position {
+	return ae.Value.End()
+}
+
+func (ae *AwaitExpression) expressionNode()      {}
+func (ae *AwaitExpression) TokenLiteral() string { return ae.Token.Literal }
+
+func (ae *AwaitExpression) String() string {
+	return ae.Token.Literal + " " + ae.Value.String()
+}
+
+func labelString(label string) string {
+	if label == "" {
+		return ""
+	}
+	return label + ": "
+}
+
+func elseString(block *BlockStatement) string {
+	if block == nil {
+		return ""
+	}
+	return " else { " + block.String() + " }"
+}
 
 //c language like for loop
 type CForLoop struct {
@@ -874,6 +1237,8 @@ type CForLoop struct {
 	Cond   Expression
 	Update Expression
 	Block  *BlockStatement
+	Label  string          //loop label, e.g. 'outer: for (...) {}'
+	Else   *BlockStatement //runs when the loop finishes without 'break'
 }
 
 func (fl *CForLoop) Pos() token.Position {
@@ -881,6 +1246,9 @@ func (fl *CForLoop) Pos() token.Position {
 }
 
 func (fl *CForLoop) End() token.Position {
+	if fl.Else != nil {
+		return fl.Else.End()
+	}
 	return fl.Block.End()
 }
 
@@ -890,6 +1258,7 @@ func (fl *CForLoop) TokenLiteral() string { return fl.Token.Literal }
 func (fl *CForLoop) String() string {
 	var out bytes.Buffer
 
+	out.WriteString(labelString(fl.Label))
 	out.WriteString("for")
 	out.WriteString(" ( ")
 
@@ -910,6 +1279,7 @@ func (fl *CForLoop) String() string {
 	out.WriteString(" { ")
 	out.WriteString(fl.Block.String())
 	out.WriteString(" }")
+	out.WriteString(elseString(fl.Else))
 
 	return out.String()
 }
@@ -920,6 +1290,8 @@ type ForEachArrayLoop struct {
 	Var   string
 	Value Expression //value to range over
 	Block *BlockStatement
+	Label string
+	Else  *BlockStatement
 }
 
 func (fal *ForEachArrayLoop) Pos() token.Position {
@@ -927,6 +1299,9 @@ func (fal *ForEachArrayLoop) Pos() token.Position {
 }
 
 func (fal *ForEachArrayLoop) End() token.Position {
+	if fal.Else != nil {
+		return fal.Else.End()
+	}
 	return fal.Block.End()
 }
 
@@ -936,6 +1311,7 @@ func (fal *ForEachArrayLoop) TokenLiteral() string { return fal.Token.Literal }
 func (fal *ForEachArrayLoop) String() string {
 	var out bytes.Buffer
 
+	out.WriteString(labelString(fal.Label))
 	out.WriteString("for ")
 	out.WriteString(fal.Var)
 	out.WriteString(" in ")
@@ -943,6 +1319,7 @@ func (fal *ForEachArrayLoop) String() string {
 	out.WriteString(" { ")
 	out.WriteString(fal.Block.String())
 	out.WriteString(" }")
+	out.WriteString(elseString(fal.Else))
 
 	return out.String()
 }
@@ -954,6 +1331,8 @@ type ForEachMapLoop struct {
 	Value string
 	X     Expression //value to range over
 	Block *BlockStatement
+	Label string
+	Else  *BlockStatement
 }
 
 func (fml *ForEachMapLoop) Pos() token.Position {
@@ -961,6 +1340,9 @@ func (fml *ForEachMapLoop) Pos() token.Position {
 }
 
 func (fml *ForEachMapLoop) End() token.Position {
+	if fml.Else != nil {
+		return fml.Else.End()
+	}
 	return fml.Block.End()
 }
 
@@ -970,6 +1352,7 @@ func (fml *ForEachMapLoop) TokenLiteral() string { return fml.Token.Literal }
 func (fml *ForEachMapLoop) String() string {
 	var out bytes.Buffer
 
+	out.WriteString(labelString(fml.Label))
 	out.WriteString("for ")
 	out.WriteString(fml.Key + ", " + fml.Value)
 	out.WriteString(" in ")
@@ -977,6 +1360,7 @@ func (fml *ForEachMapLoop) String() string {
 	out.WriteString(" { ")
 	out.WriteString(fml.Block.String())
 	out.WriteString(" }")
+	out.WriteString(elseString(fml.Else))
 
 	return out.String()
 }
@@ -985,6 +1369,7 @@ func (fml *ForEachMapLoop) String() string {
 type ForEverLoop struct {
 	Token token.Token
 	Block *BlockStatement
+	Label string
 }
 
 func (fel *ForEverLoop) Pos() token.Position {
@@ -1001,6 +1386,7 @@ func (fel *ForEverLoop) TokenLiteral() string { return fel.Token.Literal }
 func (fel *ForEverLoop) String() string {
 	var out bytes.Buffer
 
+	out.WriteString(labelString(fel.Label))
 	out.WriteString("for ")
 	out.WriteString(" { ")
 	out.WriteString(fel.Block.String())
@@ -1014,6 +1400,8 @@ type WhileLoop struct {
 	Token     token.Token
 	Condition Expression
 	Block     *BlockStatement
+	Label     string
+	Else      *BlockStatement
 }
 
 func (wl *WhileLoop) Pos() token.Position {
@@ -1021,6 +1409,9 @@ func (wl *WhileLoop) Pos() token.Position {
 }
 
 func (wl *WhileLoop) End() token.Position {
+	if wl.Else != nil {
+		return wl.Else.End()
+	}
 	return wl.Block.End()
 }
 
@@ -1030,11 +1421,13 @@ func (wl *WhileLoop) TokenLiteral() string { return wl.Token.Literal }
 func (wl *WhileLoop) String() string {
 	var out bytes.Buffer
 
+	out.WriteString(labelString(wl.Label))
 	out.WriteString("while")
 	out.WriteString(wl.Condition.String())
 	out.WriteString("{")
 	out.WriteString(wl.Block.String())
 	out.WriteString("}")
+	out.WriteString(elseString(wl.Else))
 
 	return out.String()
 }
@@ -1043,6 +1436,8 @@ func (wl *WhileLoop) String() string {
 type DoLoop struct {
 	Token token.Token
 	Block *BlockStatement
+	Label string
+	Else  *BlockStatement
 }
 
 func (dl *DoLoop) Pos() token.Position {
@@ -1050,6 +1445,9 @@ func (dl *DoLoop) Pos() token.Position {
 }
 
 func (dl *DoLoop) End() token.Position {
+	if dl.Else != nil {
+		return dl.Else.End()
+	}
 	return dl.Block.End()
 }
 
@@ -1059,16 +1457,19 @@ func (dl *DoLoop) TokenLiteral() string { return dl.Token.Literal }
 func (dl *DoLoop) String() string {
 	var out bytes.Buffer
 
+	out.WriteString(labelString(dl.Label))
 	out.WriteString("do")
 	out.WriteString(" { ")
 	out.WriteString(dl.Block.String())
 	out.WriteString(" }")
+	out.WriteString(elseString(dl.Else))
 	return out.String()
 }
 
 type RegExLiteral struct {
-	Token token.Token
-	Value string // value of the regular expression
+	Token  token.Token
+	Value  string         // value of the regular expression
+	Regexp *regexp.Regexp // compiled by the optimizer, nil if it's compiled at each evaluation
 }
 
 func (rel *RegExLiteral) Pos() token.Position {
@@ -1096,8 +1497,9 @@ func (rel *RegExLiteral) String() string {
 }
 
 type StructStatement struct {
-	Token token.Token
-	Name  string //struct's name
+	Token      token.Token
+	Name       string        //struct's name
+	Implements []*Identifier //interfaces the struct declares to implement
 
 	Block       *BlockStatement //used in the String() method
 	RBraceToken token.Token     //used in End() method
@@ -1112,6 +1514,7 @@ func (s *StructStatement) End() token.Position {
 }
 
 func (s *StructStatement) statementNode()       {}
+func (s *StructStatement) expressionNode()      {} //a decorated struct is the decorator's operand
 func (s *StructStatement) TokenLiteral() string { return s.Token.Literal }
 func (s *StructStatement) String() string {
 	var out bytes.Buffer
@@ -1119,6 +1522,15 @@ func (s *StructStatement) String() string {
 	out.WriteString(s.Token.Literal + " ")
 	out.WriteString(s.Name)
 
+	if len(s.Implements) > 0 {
+		names := []string{}
+		for _, name := range s.Implements {
+			names = append(names, name.String())
+		}
+		out.WriteString(" implements ")
+		out.WriteString(strings.Join(names, ", "))
+	}
+
 	out.WriteString("{ ")
 	out.WriteString(s.Block.String())
 	out.WriteString(" }")
@@ -1126,6 +1538,45 @@ func (s *StructStatement) String() string {
 	return out.String()
 }
 
+/*
+   interface Name {
+       fn Method1(x)               //must be implemented by the struct
+       fn Method2(x, y) { block }  //default implementation
+   }
+*/
+type InterfaceStatement struct {
+	Token       token.Token
+	Name        string             //interface's name
+	Methods     []*FunctionLiteral //method's Body is nil if it has no default implementation
+	RBraceToken token.Token        //used in End() method
+}
+
+func (i *InterfaceStatement) Pos() token.Position {
+	return i.Token.Pos
+}
+
+func (i *InterfaceStatement) End() token.Position {
+	return i.RBraceToken.Pos
+}
+
+func (i *InterfaceStatement) statementNode()       {}
+func (i *InterfaceStatement) TokenLiteral() string { return i.Token.Literal }
+func (i *InterfaceStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(i.Token.Literal + " ")
+	out.WriteString(i.Name)
+
+	out.WriteString("{ ")
+	for _, m := range i.Methods {
+		out.WriteString(m.String())
+		out.WriteString("; ")
+	}
+	out.WriteString(" }")
+
+	return out.String()
+}
+
 /*
     switch Expr {
     case expr1, expr2, ... { block1 }
@@ -1231,6 +1682,7 @@ func (t *FallthroughExpression) String() string { return t.Token.Literal }
 //TryStmt provide "try/catch/finally" statement.
 /*
    try {block }
+   catch (e: IOError) { block }
    catch e { block }
    finally {block }
 */
@@ -1239,8 +1691,7 @@ func (t *FallthroughExpression) String() string { return t.Token.Literal }
 type TryStmt struct {
 	Token   token.Token
 	Try     *BlockStatement
-	Var     string
-	Catch   *BlockStatement
+	Catches []*CatchClause //tried in order, the first matched one handles the thrown value
 	Finally *BlockStatement
 }
 
@@ -1253,8 +1704,8 @@ func (t *TryStmt) End() token.Position {
 		return t.Finally.End()
 	}
 
-	if t.Catch != nil {
-		return t.Catch.End()
+	if n := len(t.Catches); n > 0 {
+		return t.Catches[n-1].Block.End()
 	}
 
 	return t.Try.End()
@@ -1270,14 +1721,8 @@ func (t *TryStmt) String() string {
 	out.WriteString(t.Try.String())
 	out.WriteString(" }")
 
-	if t.Catch != nil {
-		if t.Var != "" {
-			out.WriteString(" catch " + t.Var + " { ")
-		} else {
-			out.WriteString(" catch { ")
-		}
-		out.WriteString(t.Catch.String())
-		out.WriteString(" }")
+	for _, c := range t.Catches {
+		out.WriteString(" " + c.String())
 	}
 
 	if t.Finally != nil {
@@ -1289,7 +1734,157 @@ func (t *TryStmt) String() string {
 	return out.String()
 }
 
+//CatchClause is a 'catch' of the try statement, both the variable and the type are optional:
+/*
+   catch { block }
+   catch e { block }
+   catch (e) { block }
+   catch (e: IOError) { block }
+*/
+type CatchClause struct {
+	Token token.Token
+	Var   string
+	Type  string //the builtin error type or kind, the struct name, or the value's type
+	Block *BlockStatement
+}
+
+func (c *CatchClause) Pos() token.Position { return c.Token.Pos }
+func (c *CatchClause) End() token.Position { return c.Block.End() }
+
+func (c *CatchClause) TokenLiteral() string { return c.Token.Literal }
+
+func (c *CatchClause) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("catch ")
+	switch {
+	case c.Type != "":
+		out.WriteString("(" + c.Var + ": " + c.Type + ") ")
+	case c.Var != "":
+		out.WriteString(c.Var + " ")
+	}
+	out.WriteString("{ ")
+	out.WriteString(c.Block.String())
+	out.WriteString(" }")
+
+	return out.String()
+}
+
 //throw <expression>
+//defer expr
+type DeferStmt struct {
+	Token token.Token
+	Expr  Expression
+}
+
+func (ds *DeferStmt) Pos() token.Position {
+	return ds.Token.Pos
+}
+
+func (ds *DeferStmt) End() token.Position {
+	return ds.Expr.End()
+}
+
+func (ds *DeferStmt) statementNode()       {}
+func (ds *DeferStmt) TokenLiteral() string { return ds.Token.Literal }
+
+func (ds *DeferStmt) String() string {
+	return "defer " + ds.Expr.String() + ";"
+}
+
+//spawn f(args), spawn obj.method(args)
+type SpawnExpression struct {
+	Token token.Token
+	Call  Expression //CallExpression or MethodCallExpression
+}
+
+func (se *SpawnExpression) Pos() token.Position {
+	return se.Token.Pos
+}
+
+func (se *SpawnExpression) End() token.Position {
+	return se.Call.End()
+}
+
+func (se *SpawnExpression) expressionNode()      {}
+func (se *SpawnExpression) TokenLiteral() string { return se.Token.Literal }
+
+func (se *SpawnExpression) String() string {
+	return "spawn " + se.Call.String()
+}
+
+//select { case v = <-ch { block } case ch <- x { block } default { block } }
+type SelectStatement struct {
+	Token       token.Token
+	Cases       []*SelectCase
+	RBraceToken token.Token //used in End() method
+}
+
+func (ss *SelectStatement) Pos() token.Position {
+	return ss.Token.Pos
+}
+
+func (ss *SelectStatement) End() token.Position {
+	return ss.RBraceToken.Pos
+}
+
+func (ss *SelectStatement) statementNode()       {}
+func (ss *SelectStatement) TokenLiteral() string { return ss.Token.Literal }
+
+func (ss *SelectStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("select { ")
+	for _, c := range ss.Cases {
+		out.WriteString(c.String())
+	}
+	out.WriteString(" }")
+
+	return out.String()
+}
+
+/*
+   case <-ch          { block }
+   case v, ok = <-ch  { block }
+   case ch <- value   { block }
+   default            { block }
+*/
+type SelectCase struct {
+	Token       token.Token
+	Default     bool
+	Names       []Expression //the assigned values of a receive: 'v' or 'v, ok'
+	AssignToken token.Token  //the '=' of the names
+	Comm        Expression   //'<-ch'(PrefixExpression) or 'ch <- value'(InfixExpression)
+	Block       *BlockStatement
+}
+
+func (sc *SelectCase) Pos() token.Position { return sc.Token.Pos }
+func (sc *SelectCase) End() token.Position { return sc.Block.End() }
+
+func (sc *SelectCase) TokenLiteral() string { return sc.Token.Literal }
+
+func (sc *SelectCase) String() string {
+	var out bytes.Buffer
+
+	if sc.Default {
+		out.WriteString("default ")
+	} else {
+		out.WriteString("case ")
+		if len(sc.Names) > 0 {
+			names := []string{}
+			for _, name := range sc.Names {
+				names = append(names, name.String())
+			}
+			out.WriteString(strings.Join(names, ", ") + " = ")
+		}
+		out.WriteString(sc.Comm.String() + " ")
+	}
+	out.WriteString("{ ")
+	out.WriteString(sc.Block.String())
+	out.WriteString(" }")
+
+	return out.String()
+}
+
 type ThrowStmt struct {
 	Token token.Token
 	Expr  Expression
@@ -1300,6 +1895,9 @@ func (ts *ThrowStmt) Pos() token.Position {
 }
 
 func (ts *ThrowStmt) End() token.Position {
+	if ts.Expr == nil { //rethrow
+		return token.Position{Filename: ts.Token.Pos.Filename, Line: ts.Token.Pos.Line, Col: ts.Token.Pos.Col + len(ts.Token.Literal)}
+	}
 	return ts.Expr.End()
 }
 
@@ -1309,8 +1907,10 @@ func (ts *ThrowStmt) TokenLiteral() string { return ts.Token.Literal }
 func (ts *ThrowStmt) String() string {
 	var out bytes.Buffer
 
-	out.WriteString("throw ")
-	out.WriteString(ts.Expr.String())
+	out.WriteString("throw")
+	if ts.Expr != nil {
+		out.WriteString(" " + ts.Expr.String())
+	}
 	out.WriteString(";")
 
 	return out.String()
@@ -1321,7 +1921,7 @@ func (ts *ThrowStmt) String() string {
 type DecoratorExpr struct {
 	Token     token.Token // '@'
 	Decorator Expression  //Decorator function
-	Decorated Expression  //Decorated function or another Decorator
+	Decorated Expression  //Decorated function, struct or another Decorator
 }
 
 func (dc *DecoratorExpr) Pos() token.Position {
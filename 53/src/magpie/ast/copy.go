@@ -0,0 +1,76 @@
+package ast
+
+import (
+	"reflect"
+)
+
+// Copy returns a deep copy of the node. Nodes shared in the original tree
+// (e.g. the keys of a hash literal's 'Pairs' and 'Order') are also shared in the copy.
+func Copy(node Node) Node {
+	if node == nil {
+		return nil
+	}
+	c := &copier{seen: make(map[copyKey]reflect.Value)}
+	return c.copy(reflect.ValueOf(node)).Interface().(Node)
+}
+
+type copyKey struct {
+	typ reflect.Type
+	ptr uintptr
+}
+
+type copier struct {
+	seen map[copyKey]reflect.Value
+}
+
+func (c *copier) copy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		key := copyKey{v.Type(), v.Pointer()}
+		if cp, ok := c.seen[key]; ok {
+			return cp
+		}
+		cp := reflect.New(v.Elem().Type())
+		c.seen[key] = cp
+		cp.Elem().Set(c.copy(v.Elem()))
+		return cp
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.New(v.Type()).Elem()
+		cp.Set(c.copy(v.Elem()))
+		return cp
+	case reflect.Struct:
+		cp := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if cp.Field(i).CanSet() {
+				cp.Field(i).Set(c.copy(v.Field(i)))
+			}
+		}
+		return cp
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			cp.Index(i).Set(c.copy(v.Index(i)))
+		}
+		return cp
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		cp := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			cp.SetMapIndex(c.copy(iter.Key()), c.copy(iter.Value()))
+		}
+		return cp
+	}
+	return v
+}
@@ -0,0 +1,196 @@
+package ast
+
+// ModifierFunc is called with each node after its children are modified,
+// the returned node replaces the original one.
+type ModifierFunc func(Node) Node
+
+// Modify traverses the AST in depth-first order, and replaces each node with
+// the result of the modifier. If the result could not be used in the position
+// of the original node(e.g. an expression replaces a block), the original node
+// is kept. Imported programs are not traversed.
+func Modify(node Node, modifier ModifierFunc) Node {
+	if isNilNode(node) {
+		return node
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		n.Statements = modifyStatements(n.Statements, modifier)
+	case *LetStatement:
+		n.Values = modifyExpressions(n.Values, modifier)
+	case *ReturnStatement:
+		n.ReturnValues = modifyExpressions(n.ReturnValues, modifier)
+		if len(n.ReturnValues) > 0 {
+			n.ReturnValue = n.ReturnValues[0]
+		}
+	case *TailCallStatement:
+		n.Call = modifyExpression(n.Call, modifier)
+	case *BlockStatement:
+		n.Statements = modifyStatements(n.Statements, modifier)
+	case *ExpressionStatement:
+		n.Expression = modifyExpression(n.Expression, modifier)
+	case *InfixExpression:
+		n.Left = modifyExpression(n.Left, modifier)
+		n.Right = modifyExpression(n.Right, modifier)
+		n.Next = modifyExpression(n.Next, modifier)
+	case *PrefixExpression:
+		n.Right = modifyExpression(n.Right, modifier)
+	case *PostfixExpression:
+		n.Left = modifyExpression(n.Left, modifier)
+	case *FunctionLiteral:
+		n.Body = modifyBlock(n.Body, modifier)
+	case *MacroLiteral:
+		n.Body = modifyBlock(n.Body, modifier)
+	case *BlockLiteral:
+		n.Block = modifyBlock(n.Block, modifier)
+	case *ArrayLiteral:
+		n.Members = modifyExpressions(n.Members, modifier)
+	case *TupleLiteral:
+		n.Members = modifyExpressions(n.Members, modifier)
+	case *IndexExpression:
+		n.Left = modifyExpression(n.Left, modifier)
+		n.Index = modifyExpression(n.Index, modifier)
+	case *HashLiteral:
+		pairs := make(map[Expression]Expression)
+		for i, key := range n.Order {
+			value := modifyExpression(n.Pairs[key], modifier)
+			key = modifyExpression(key, modifier)
+			n.Order[i] = key
+			pairs[key] = value
+		}
+		n.Pairs = pairs
+	case *ArrayComprehension:
+		modifyClauses(n.Clauses, modifier)
+		n.Expr = modifyExpression(n.Expr, modifier)
+	case *TupleComprehension:
+		modifyClauses(n.Clauses, modifier)
+		n.Expr = modifyExpression(n.Expr, modifier)
+	case *HashComprehension:
+		modifyClauses(n.Clauses, modifier)
+		n.Key = modifyExpression(n.Key, modifier)
+		n.Value = modifyExpression(n.Value, modifier)
+	case *CallExpression:
+		n.Function = modifyExpression(n.Function, modifier)
+		n.Arguments = modifyExpressions(n.Arguments, modifier)
+	case *MethodCallExpression:
+		n.Object = modifyExpression(n.Object, modifier)
+		n.Call = modifyExpression(n.Call, modifier)
+	case *IfExpression:
+		for _, c := range n.Conditions {
+			c.Cond = modifyExpression(c.Cond, modifier)
+			c.Body = modifyBlock(c.Body, modifier)
+		}
+		n.Alternative = modifyBlock(n.Alternative, modifier)
+	case *MultiAssignStatement:
+		n.Names = modifyExpressions(n.Names, modifier)
+		n.Values = modifyExpressions(n.Values, modifier)
+	case *AssignExpression:
+		n.Name = modifyExpression(n.Name, modifier)
+		n.Value = modifyExpression(n.Value, modifier)
+	case *YieldExpression:
+		n.Value = modifyExpression(n.Value, modifier)
+	case *AwaitExpression:
+		n.Value = modifyExpression(n.Value, modifier)
+	case *CForLoop:
+		n.Init = modifyExpression(n.Init, modifier)
+		n.Cond = modifyExpression(n.Cond, modifier)
+		n.Update = modifyExpression(n.Update, modifier)
+		n.Block = modifyBlock(n.Block, modifier)
+		n.Else = modifyBlock(n.Else, modifier)
+	case *ForEachArrayLoop:
+		n.Value = modifyExpression(n.Value, modifier)
+		n.Block = modifyBlock(n.Block, modifier)
+		n.Else = modifyBlock(n.Else, modifier)
+	case *ForEachMapLoop:
+		n.X = modifyExpression(n.X, modifier)
+		n.Block = modifyBlock(n.Block, modifier)
+		n.Else = modifyBlock(n.Else, modifier)
+	case *ForEverLoop:
+		n.Block = modifyBlock(n.Block, modifier)
+	case *WhileLoop:
+		n.Condition = modifyExpression(n.Condition, modifier)
+		n.Block = modifyBlock(n.Block, modifier)
+		n.Else = modifyBlock(n.Else, modifier)
+	case *DoLoop:
+		n.Block = modifyBlock(n.Block, modifier)
+		n.Else = modifyBlock(n.Else, modifier)
+	case *StructStatement:
+		n.Block = modifyBlock(n.Block, modifier)
+	case *InterfaceStatement:
+		for _, m := range n.Methods {
+			m.Body = modifyBlock(m.Body, modifier)
+		}
+	case *SwitchExpression:
+		n.Expr = modifyExpression(n.Expr, modifier)
+		for _, c := range n.Cases {
+			c.Exprs = modifyExpressions(c.Exprs, modifier)
+			c.Block = modifyBlock(c.Block, modifier)
+		}
+	case *TryStmt:
+		n.Try = modifyBlock(n.Try, modifier)
+		for _, c := range n.Catches {
+			c.Block = modifyBlock(c.Block, modifier)
+		}
+		n.Finally = modifyBlock(n.Finally, modifier)
+	case *DeferStmt:
+		n.Expr = modifyExpression(n.Expr, modifier)
+	case *SpawnExpression:
+		n.Call = modifyExpression(n.Call, modifier)
+	case *SelectStatement:
+		for _, c := range n.Cases {
+			c.Names = modifyExpressions(c.Names, modifier)
+			c.Comm = modifyExpression(c.Comm, modifier)
+			c.Block = modifyBlock(c.Block, modifier)
+		}
+	case *ThrowStmt:
+		n.Expr = modifyExpression(n.Expr, modifier)
+	case *DecoratorExpr:
+		n.Decorator = modifyExpression(n.Decorator, modifier)
+		n.Decorated = modifyExpression(n.Decorated, modifier)
+	}
+
+	return modifier(node)
+}
+
+func modifyExpression(expr Expression, modifier ModifierFunc) Expression {
+	if expr == nil {
+		return nil
+	}
+	if e, ok := Modify(expr, modifier).(Expression); ok {
+		return e
+	}
+	return expr
+}
+
+func modifyBlock(block *BlockStatement, modifier ModifierFunc) *BlockStatement {
+	if block == nil {
+		return nil
+	}
+	if b, ok := Modify(block, modifier).(*BlockStatement); ok {
+		return b
+	}
+	return block
+}
+
+func modifyExpressions(exprs []Expression, modifier ModifierFunc) []Expression {
+	for i, expr := range exprs {
+		exprs[i] = modifyExpression(expr, modifier)
+	}
+	return exprs
+}
+
+func modifyStatements(stmts []Statement, modifier ModifierFunc) []Statement {
+	for i, stmt := range stmts {
+		if s, ok := Modify(stmt, modifier).(Statement); ok {
+			stmts[i] = s
+		}
+	}
+	return stmts
+}
+
+func modifyClauses(clauses []*ComprehensionClause, modifier ModifierFunc) {
+	for _, clause := range clauses {
+		clause.Iterable = modifyExpression(clause.Iterable, modifier)
+		clause.Conds = modifyExpressions(clause.Conds, modifier)
+	}
+}
@@ -0,0 +1,198 @@
+package ast
+
+// Inspect traverses the AST in depth-first order: it calls f(node), if f returns
+// true, Inspect invokes f recursively for each of the non-nil children of node.
+// Imported programs are not traversed.
+func Inspect(node Node, f func(Node) bool) {
+	if isNilNode(node) || !f(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		inspectStatements(n.Statements, f)
+	case *LetStatement:
+		for _, name := range n.Names {
+			Inspect(name, f)
+		}
+		inspectExpressions(n.Values, f)
+	case *ReturnStatement:
+		inspectExpressions(n.ReturnValues, f)
+	case *TailCallStatement:
+		Inspect(n.Call, f)
+	case *BlockStatement:
+		inspectStatements(n.Statements, f)
+	case *ExpressionStatement:
+		Inspect(n.Expression, f)
+	case *InfixExpression:
+		Inspect(n.Left, f)
+		Inspect(n.Right, f)
+		Inspect(n.Next, f)
+	case *PrefixExpression:
+		Inspect(n.Right, f)
+	case *PostfixExpression:
+		Inspect(n.Left, f)
+	case *FunctionLiteral:
+		for _, param := range n.Parameters {
+			Inspect(param, f)
+		}
+		Inspect(n.Body, f)
+	case *MacroLiteral:
+		for _, param := range n.Parameters {
+			Inspect(param, f)
+		}
+		Inspect(n.Body, f)
+	case *BlockLiteral:
+		Inspect(n.Block, f)
+	case *ArrayLiteral:
+		inspectExpressions(n.Members, f)
+	case *TupleLiteral:
+		inspectExpressions(n.Members, f)
+	case *IndexExpression:
+		Inspect(n.Left, f)
+		Inspect(n.Index, f)
+	case *HashLiteral:
+		for _, key := range n.Order {
+			Inspect(key, f)
+			Inspect(n.Pairs[key], f)
+		}
+	case *ComprehensionClause:
+		for _, name := range n.Names {
+			Inspect(name, f)
+		}
+		Inspect(n.Iterable, f)
+		inspectExpressions(n.Conds, f)
+	case *ArrayComprehension:
+		inspectClauses(n.Clauses, f)
+		Inspect(n.Expr, f)
+	case *TupleComprehension:
+		inspectClauses(n.Clauses, f)
+		Inspect(n.Expr, f)
+	case *HashComprehension:
+		inspectClauses(n.Clauses, f)
+		Inspect(n.Key, f)
+		Inspect(n.Value, f)
+	case *CallExpression:
+		Inspect(n.Function, f)
+		inspectExpressions(n.Arguments, f)
+	case *MethodCallExpression:
+		Inspect(n.Object, f)
+		Inspect(n.Call, f)
+	case *IfExpression:
+		for _, c := range n.Conditions {
+			Inspect(c, f)
+		}
+		Inspect(n.Alternative, f)
+	case *IfConditionExpr:
+		Inspect(n.Cond, f)
+		Inspect(n.Body, f)
+	case *MultiAssignStatement:
+		inspectExpressions(n.Names, f)
+		inspectExpressions(n.Values, f)
+	case *AssignExpression:
+		Inspect(n.Name, f)
+		Inspect(n.Value, f)
+	case *YieldExpression:
+		Inspect(n.Value, f)
+	case *AwaitExpression:
+		Inspect(n.Value, f)
+	case *CForLoop:
+		Inspect(n.Init, f)
+		Inspect(n.Cond, f)
+		Inspect(n.Update, f)
+		Inspect(n.Block, f)
+		Inspect(n.Else, f)
+	case *ForEachArrayLoop:
+		Inspect(n.Value, f)
+		Inspect(n.Block, f)
+		Inspect(n.Else, f)
+	case *ForEachMapLoop:
+		Inspect(n.X, f)
+		Inspect(n.Block, f)
+		Inspect(n.Else, f)
+	case *ForEverLoop:
+		Inspect(n.Block, f)
+	case *WhileLoop:
+		Inspect(n.Condition, f)
+		Inspect(n.Block, f)
+		Inspect(n.Else, f)
+	case *DoLoop:
+		Inspect(n.Block, f)
+		Inspect(n.Else, f)
+	case *StructStatement:
+		Inspect(n.Block, f)
+	case *InterfaceStatement:
+		for _, m := range n.Methods {
+			Inspect(m, f)
+		}
+	case *SwitchExpression:
+		Inspect(n.Expr, f)
+		for _, c := range n.Cases {
+			Inspect(c, f)
+		}
+	case *CaseExpression:
+		inspectExpressions(n.Exprs, f)
+		Inspect(n.Block, f)
+	case *TryStmt:
+		Inspect(n.Try, f)
+		for _, c := range n.Catches {
+			Inspect(c.Block, f)
+		}
+		Inspect(n.Finally, f)
+	case *DeferStmt:
+		Inspect(n.Expr, f)
+	case *SpawnExpression:
+		Inspect(n.Call, f)
+	case *SelectStatement:
+		for _, c := range n.Cases {
+			inspectExpressions(c.Names, f)
+			Inspect(c.Comm, f)
+			Inspect(c.Block, f)
+		}
+	case *ThrowStmt:
+		Inspect(n.Expr, f)
+	case *DecoratorExpr:
+		Inspect(n.Decorator, f)
+		Inspect(n.Decorated, f)
+	}
+}
+
+func inspectStatements(stmts []Statement, f func(Node) bool) {
+	for _, stmt := range stmts {
+		Inspect(stmt, f)
+	}
+}
+
+func inspectExpressions(exprs []Expression, f func(Node) bool) {
+	for _, expr := range exprs {
+		Inspect(expr, f)
+	}
+}
+
+func inspectClauses(clauses []*ComprehensionClause, f func(Node) bool) {
+	for _, clause := range clauses {
+		Inspect(clause, f)
+	}
+}
+
+// a nil pointer stored in the Node interface is also nil
+func isNilNode(node Node) bool {
+	if node == nil {
+		return true
+	}
+	switch n := node.(type) {
+	case *BlockStatement:
+		return n == nil
+	case *IfConditionExpr:
+		return n == nil
+	case *CaseExpression:
+		return n == nil
+	case *ComprehensionClause:
+		return n == nil
+	case *FunctionLiteral:
+		return n == nil
+	case *Identifier:
+		return n == nil
+	}
+	return false
+}
@@ -0,0 +1,956 @@
+// Package checker implements a gradual type checker for magpie programs.
+//
+// Type annotations are optional: 'let x: number', 'fn add(x: number) -> number'
+// and struct fields('let name: string' in the struct's body). The types of the
+// names which are not annotated are inferred from their values where possible,
+// and values of unknown types('any') are never reported.
+package checker
+
+import (
+	"fmt"
+	"magpie/ast"
+	"magpie/token"
+)
+
+const tAny = "any"
+
+// type names which could be used in type annotations, same as
+// the results of the 'type()' builtin. Others are struct or interface names.
+var builtinTypes = map[string]bool{
+	"any":       true,
+	"number":    true,
+	"string":    true,
+	"bool":      true,
+	"nil":       true,
+	"array":     true,
+	"tuple":     true,
+	"hash":      true,
+	"regex":     true,
+	"file":      true,
+	"generator": true,
+	"function":  true,
+	"module":    true,
+	"task":      true,
+	"channel":   true,
+	"mutex":     true,
+	"waitgroup": true,
+	"promise":   true,
+}
+
+// types which do not support operator overloading
+var primitiveTypes = map[string]bool{
+	"number":   true,
+	"string":   true,
+	"bool":     true,
+	"nil":      true,
+	"array":    true,
+	"tuple":    true,
+	"hash":     true,
+	"regex":    true,
+	"function": true,
+}
+
+// return types of the builtin functions
+var builtinFuncs = map[string]string{
+	"print":       "nil",
+	"println":     "nil",
+	"printf":      "nil",
+	"say":         "nil",
+	"len":         "number",
+	"type":        "string",
+	"flushStdout": "nil",
+	"chan":        "channel",
+	"close":       "nil",
+	"Mutex":       "mutex",
+	"WaitGroup":   "waitgroup",
+	"setTimeout":  "number",
+	"setInterval": "number",
+	"clearTimer":  "bool",
+	"openAsync":   "promise",
+	"execAsync":   "promise",
+	"memoize":     "function",
+	"trace":       "function",
+	"timeit":      "function",
+	"deprecated":  "function",
+}
+
+type symbol struct {
+	typ        string
+	declared   bool                 //the type is annotated
+	fn         *ast.FunctionLiteral //named function, used to check the calls
+	structName string               //struct name, calling it creates a struct object
+	owner      *env
+}
+
+type env struct {
+	vars   map[string]*symbol
+	parent *env
+}
+
+func newEnv(parent *env) *env {
+	return &env{vars: make(map[string]*symbol), parent: parent}
+}
+
+func (e *env) lookup(name string) *symbol {
+	for ; e != nil; e = e.parent {
+		if sym, ok := e.vars[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+func (e *env) define(name string, sym *symbol) {
+	sym.owner = e
+	e.vars[name] = sym
+}
+
+type structInfo struct {
+	stmt    *ast.StructStatement
+	fields  map[string]*ast.Identifier      //field's type annotation, nil if not annotated
+	methods map[string]*ast.FunctionLiteral //nil if the method is decorated
+}
+
+type Checker struct {
+	errors     []string
+	structs    map[string]*structInfo
+	interfaces map[string]*ast.InterfaceStatement
+	funcs      []*ast.FunctionLiteral //enclosing functions
+	selfTypes  []string               //enclosing structs, the type of 'self'
+	modules    map[*ast.Program]*env  //top level names of the imported modules
+}
+
+// Check checks the program, and returns the type errors.
+func Check(program *ast.Program) []string {
+	c := &Checker{
+		structs:    make(map[string]*structInfo),
+		interfaces: make(map[string]*ast.InterfaceStatement),
+		modules:    make(map[*ast.Program]*env),
+	}
+	e := newEnv(nil)
+	c.hoistImports(program, e)
+	c.checkStatements(program.Statements, e)
+	return c.errors
+}
+
+// declare the names of the imported modules, or the names imported
+// using 'from a.b.c import Name1, Name2'
+func (c *Checker) hoistImports(program *ast.Program, e *env) {
+	for _, is := range program.Imports {
+		if is.Program == nil {
+			continue
+		}
+		if len(is.Names) == 0 {
+			e.define(is.Name(), &symbol{typ: "module"})
+			continue
+		}
+
+		menv := c.moduleEnv(is.Program)
+		for _, name := range is.Names {
+			if sym, ok := menv.vars[name.Value]; ok {
+				copied := *sym
+				e.define(name.Value, &copied)
+			} else {
+				e.define(name.Value, &symbol{typ: tAny})
+			}
+		}
+	}
+}
+
+// the top level names of the imported module
+func (c *Checker) moduleEnv(program *ast.Program) *env {
+	if menv, ok := c.modules[program]; ok {
+		return menv
+	}
+	menv := newEnv(nil)
+	c.modules[program] = menv
+	c.hoistImports(program, menv)
+	c.hoist(program.Statements, menv)
+	return menv
+}
+
+func (c *Checker) errorf(pos token.Position, format string, args ...interface{}) {
+	msg := fmt.Sprintf("Type Error:%v- %s", pos, fmt.Sprintf(format, args...))
+	c.errors = append(c.errors, msg)
+}
+
+func (c *Checker) mismatch(pos token.Position, what, want, got string) {
+	c.errorf(pos, "type mismatch: %s expected '%s', got '%s'", what, want, got)
+}
+
+// declare the functions, structs and interfaces of a block first,
+// so they could be referenced before their declarations.
+func (c *Checker) hoist(stmts []ast.Statement, e *env) {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.ExpressionStatement:
+			switch fn := s.Expression.(type) {
+			case *ast.FunctionLiteral:
+				if fn.Name != "" {
+					e.define(fn.Name, &symbol{typ: "function", fn: fn})
+				}
+			case *ast.DecoratorExpr: //the decorator's result is unknown
+				if st := decoratedStruct(fn); st != nil {
+					c.structs[st.Name] = collectStruct(st)
+					e.define(st.Name, &symbol{typ: tAny})
+				} else if name := decoratedName(fn); name != "" {
+					e.define(name, &symbol{typ: tAny})
+				}
+			}
+		case *ast.StructStatement:
+			c.structs[s.Name] = collectStruct(s)
+			e.define(s.Name, &symbol{typ: "function", structName: s.Name})
+		case *ast.InterfaceStatement:
+			c.interfaces[s.Name] = s
+			e.define(s.Name, &symbol{typ: tAny})
+		}
+	}
+}
+
+func decoratedName(d *ast.DecoratorExpr) string {
+	switch fn := d.Decorated.(type) {
+	case *ast.FunctionLiteral:
+		return fn.Name
+	case *ast.DecoratorExpr:
+		return decoratedName(fn)
+	}
+	return ""
+}
+
+func decoratedStruct(d *ast.DecoratorExpr) *ast.StructStatement {
+	switch st := d.Decorated.(type) {
+	case *ast.StructStatement:
+		return st
+	case *ast.DecoratorExpr:
+		return decoratedStruct(st)
+	}
+	return nil
+}
+
+// collect the struct's fields and methods. fields are declared using 'let'
+// in the struct's body, or assigned using 'self.field = value' in its methods.
+func collectStruct(st *ast.StructStatement) *structInfo {
+	info := &structInfo{
+		stmt:    st,
+		fields:  make(map[string]*ast.Identifier),
+		methods: make(map[string]*ast.FunctionLiteral),
+	}
+
+	for _, stmt := range st.Block.Statements {
+		switch s := stmt.(type) {
+		case *ast.LetStatement:
+			for i, name := range s.Names {
+				var typ *ast.Identifier
+				if i < len(s.Types) {
+					typ = s.Types[i]
+				}
+				info.fields[name.Value] = typ
+			}
+		case *ast.ExpressionStatement:
+			switch fn := s.Expression.(type) {
+			case *ast.FunctionLiteral:
+				if fn.Name != "" {
+					info.methods[fn.Name] = fn
+				}
+			case *ast.DecoratorExpr:
+				if name := decoratedName(fn); name != "" {
+					info.methods[name] = nil
+				}
+			}
+		}
+	}
+
+	ast.Inspect(st.Block, func(n ast.Node) bool {
+		if assign, ok := n.(*ast.AssignExpression); ok {
+			if name := selfField(assign.Name); name != "" {
+				if _, ok := info.fields[name]; !ok {
+					info.fields[name] = nil
+				}
+			}
+		}
+		return true
+	})
+	return info
+}
+
+// returns the field's name if the expression is 'self.field'
+func selfField(expr ast.Expression) string {
+	mc, ok := expr.(*ast.MethodCallExpression)
+	if !ok {
+		return ""
+	}
+	obj, ok := mc.Object.(*ast.Identifier)
+	if !ok || obj.Value != "self" {
+		return ""
+	}
+	if field, ok := mc.Call.(*ast.Identifier); ok {
+		return field.Value
+	}
+	return ""
+}
+
+// find the struct's method, including the default methods of the interfaces it implements.
+func (c *Checker) findMethod(info *structInfo, name string) (*ast.FunctionLiteral, bool) {
+	if fn, ok := info.methods[name]; ok {
+		return fn, true
+	}
+	for _, i := range info.stmt.Implements {
+		if iface, ok := c.interfaces[i.Value]; ok {
+			for _, m := range iface.Methods {
+				if m.Name == name && m.Body != nil {
+					return m, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+func (c *Checker) implements(info *structInfo, iface *ast.InterfaceStatement) bool {
+	for _, i := range info.stmt.Implements {
+		if i.Value == iface.Name {
+			return true
+		}
+	}
+	for _, m := range iface.Methods {
+		if _, ok := info.methods[m.Name]; !ok && m.Body == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// check if a value of type 'got' could be used as type 'want'
+func (c *Checker) assignable(want, got string) bool {
+	if want == tAny || got == tAny || want == got {
+		return true
+	}
+	if iface, ok := c.interfaces[want]; ok {
+		info, ok := c.structs[got]
+		return ok && c.implements(info, iface)
+	}
+	if _, ok := c.structs[want]; ok || builtinTypes[want] {
+		return false
+	}
+	return true //unknown type, already reported
+}
+
+func (c *Checker) checkTypeName(typ *ast.Identifier) {
+	if typ == nil || builtinTypes[typ.Value] {
+		return
+	}
+	if _, ok := c.structs[typ.Value]; ok {
+		return
+	}
+	if _, ok := c.interfaces[typ.Value]; ok {
+		return
+	}
+	c.errorf(typ.Pos(), "unknown type '%s'", typ.Value)
+}
+
+func (c *Checker) checkStatements(stmts []ast.Statement, e *env) {
+	c.hoist(stmts, e)
+	for _, stmt := range stmts {
+		c.checkStatement(stmt, e)
+	}
+}
+
+func (c *Checker) checkBlock(block *ast.BlockStatement, e *env) {
+	if block != nil {
+		c.checkStatements(block.Statements, newEnv(e))
+	}
+}
+
+func (c *Checker) checkStatement(stmt ast.Statement, e *env) {
+	switch s := stmt.(type) {
+	case *ast.LetStatement:
+		c.checkLet(s, e)
+	case *ast.ReturnStatement:
+		c.checkReturn(s, e)
+	case *ast.ExpressionStatement:
+		c.typeOf(s.Expression, e)
+	case *ast.BlockStatement:
+		c.checkBlock(s, e)
+	case *ast.StructStatement:
+		c.checkStruct(s, e)
+	case *ast.InterfaceStatement:
+		for _, m := range s.Methods {
+			c.checkFunction(m, e)
+		}
+	case *ast.TailCallStatement:
+		c.typeOf(s.Call, e)
+	case *ast.ThrowStmt:
+		if s.Expr != nil { //a bare 'throw' rethrows
+			c.typeOf(s.Expr, e)
+		}
+	case *ast.DeferStmt:
+		c.typeOf(s.Expr, e)
+	case *ast.SelectStatement:
+		for _, sc := range s.Cases {
+			c.typeOf(sc.Comm, e)
+			for _, name := range sc.Names {
+				c.assign(sc.AssignToken, name, tAny, sc.Comm.Pos(), e)
+			}
+			c.checkBlock(sc.Block, e)
+		}
+	case *ast.TryStmt:
+		c.checkBlock(s.Try, e)
+		for _, clause := range s.Catches {
+			ce := newEnv(e)
+			if clause.Var != "" {
+				ce.define(clause.Var, &symbol{typ: tAny})
+			}
+			c.checkStatements(clause.Block.Statements, ce)
+		}
+		c.checkBlock(s.Finally, e)
+	case *ast.MultiAssignStatement:
+		types := make([]string, len(s.Names))
+		for i, v := range s.Values {
+			t := c.typeOf(v, e)
+			if len(s.Values) == len(s.Names) {
+				types[i] = t
+			}
+		}
+		for i, name := range s.Names {
+			if types[i] == "" {
+				types[i] = tAny
+			}
+			c.assign(s.Token, name, types[i], s.Values[0].Pos(), e)
+		}
+	}
+}
+
+func (c *Checker) checkLet(s *ast.LetStatement, e *env) {
+	types := make([]string, len(s.Names))
+	for i, v := range s.Values {
+		t := c.typeOf(v, e)
+		if len(s.Values) == len(s.Names) {
+			types[i] = t
+		}
+	}
+
+	for i, name := range s.Names {
+		if name.Value == "_" {
+			continue
+		}
+		var typ *ast.Identifier
+		if i < len(s.Types) {
+			typ = s.Types[i]
+		}
+		if typ == nil {
+			t := types[i]
+			if t == "" {
+				t = tAny
+			}
+			e.define(name.Value, &symbol{typ: t})
+			continue
+		}
+
+		c.checkTypeName(typ)
+		if types[i] != "" && !c.assignable(typ.Value, types[i]) {
+			c.mismatch(s.Values[i].Pos(), fmt.Sprintf("variable '%s'", name.Value), typ.Value, types[i])
+		}
+		e.define(name.Value, &symbol{typ: typ.Value, declared: true})
+	}
+}
+
+func (c *Checker) checkReturn(s *ast.ReturnStatement, e *env) {
+	types := []string{}
+	for _, v := range s.ReturnValues {
+		types = append(types, c.typeOf(v, e))
+	}
+	if len(c.funcs) == 0 {
+		return
+	}
+	fn := c.funcs[len(c.funcs)-1]
+	if fn.ReturnType == nil || fn.IsGenerator {
+		return
+	}
+
+	t := "nil"
+	if len(types) == 1 {
+		t = types[0]
+	} else if len(types) > 1 {
+		t = "tuple"
+	}
+	if !c.assignable(fn.ReturnType.Value, t) {
+		what := fmt.Sprintf("return value of function '%s'", funcName(fn))
+		c.mismatch(s.Pos(), what, fn.ReturnType.Value, t)
+	}
+}
+
+func (c *Checker) checkStruct(st *ast.StructStatement, e *env) {
+	for _, i := range st.Implements {
+		if _, ok := c.interfaces[i.Value]; !ok {
+			c.errorf(i.Pos(), "unknown interface '%s'", i.Value)
+		}
+	}
+
+	c.selfTypes = append(c.selfTypes, st.Name)
+	c.checkBlock(st.Block, e)
+	c.selfTypes = c.selfTypes[:len(c.selfTypes)-1]
+}
+
+func (c *Checker) checkFunction(fn *ast.FunctionLiteral, e *env) {
+	for _, typ := range fn.ParamTypes {
+		c.checkTypeName(typ)
+	}
+	c.checkTypeName(fn.ReturnType)
+	if fn.Body == nil { //interface method without default implementation
+		return
+	}
+
+	fe := newEnv(e)
+	for i, param := range fn.Parameters {
+		sym := &symbol{typ: tAny}
+		if fn.Variadic && i == len(fn.Parameters)-1 {
+			sym.typ = "array"
+		} else if i < len(fn.ParamTypes) && fn.ParamTypes[i] != nil {
+			sym.typ, sym.declared = fn.ParamTypes[i].Value, true
+		}
+		fe.define(param.Value, sym)
+	}
+
+	c.funcs = append(c.funcs, fn)
+	c.checkStatements(fn.Body.Statements, fe)
+	c.funcs = c.funcs[:len(c.funcs)-1]
+}
+
+// the type of an expression, 'any' if it could not be inferred.
+func (c *Checker) typeOf(expr ast.Expression, e *env) string {
+	switch n := expr.(type) {
+	case *ast.NumberLiteral:
+		return "number"
+	case *ast.StringLiteral:
+		return "string"
+	case *ast.BooleanLiteral:
+		return "bool"
+	case *ast.NilLiteral:
+		return "nil"
+	case *ast.RegExLiteral:
+		return "regex"
+	case *ast.ArrayLiteral:
+		c.typeOfAll(n.Members, e)
+		return "array"
+	case *ast.TupleLiteral:
+		c.typeOfAll(n.Members, e)
+		return "tuple"
+	case *ast.HashLiteral:
+		for _, key := range n.Order {
+			c.typeOf(key, e)
+			c.typeOf(n.Pairs[key], e)
+		}
+		return "hash"
+	case *ast.ArrayComprehension:
+		c.typeOf(n.Expr, c.checkClauses(n.Clauses, e))
+		return "array"
+	case *ast.TupleComprehension:
+		c.typeOf(n.Expr, c.checkClauses(n.Clauses, e))
+		return "tuple"
+	case *ast.HashComprehension:
+		ce := c.checkClauses(n.Clauses, e)
+		c.typeOf(n.Key, ce)
+		c.typeOf(n.Value, ce)
+		return "hash"
+	case *ast.Identifier:
+		return c.typeOfIdentifier(n, e)
+	case *ast.PrefixExpression:
+		return c.typeOfPrefix(n, e)
+	case *ast.PostfixExpression:
+		t := c.typeOf(n.Left, e)
+		if primitiveTypes[t] && t != "number" {
+			c.errorf(n.Pos(), "invalid operation: operator '%s' on '%s'", n.Operator, t)
+		}
+		return t
+	case *ast.InfixExpression:
+		if n.Operator == "|>" {
+			return c.typeOfPipe(n, e)
+		}
+		lt, rt := c.typeOf(n.Left, e), c.typeOf(n.Right, e)
+		if n.HasNext {
+			c.typeOf(n.Next, e)
+		}
+		return c.binaryType(n.Pos(), n.Operator, lt, rt)
+	case *ast.FunctionLiteral:
+		c.checkFunction(n, e)
+		return "function"
+	case *ast.CallExpression:
+		return c.typeOfCall(n, e)
+	case *ast.MethodCallExpression:
+		return c.typeOfMethodCall(n, e)
+	case *ast.IndexExpression:
+		c.typeOf(n.Left, e)
+		c.typeOf(n.Index, e)
+	case *ast.AssignExpression:
+		t := c.typeOf(n.Value, e)
+		if n.Token.Literal != "=" { //compound assignment, e.g. 'x += 1'
+			op := n.Token.Literal[:len(n.Token.Literal)-1]
+			t = c.binaryType(n.Pos(), op, c.typeOf(n.Name, e), t)
+		}
+		c.assign(n.Token, n.Name, t, n.Value.Pos(), e)
+		return t
+	case *ast.IfExpression:
+		for _, cond := range n.Conditions {
+			c.typeOf(cond.Cond, e)
+			c.checkBlock(cond.Body, e)
+		}
+		c.checkBlock(n.Alternative, e)
+	case *ast.SwitchExpression:
+		c.typeOf(n.Expr, e)
+		for _, cs := range n.Cases {
+			c.typeOfAll(cs.Exprs, e)
+			c.checkBlock(cs.Block, e)
+		}
+	case *ast.CForLoop:
+		le := newEnv(e)
+		c.typeOf(n.Init, le)
+		c.typeOf(n.Cond, le)
+		c.typeOf(n.Update, le)
+		c.checkBlock(n.Block, le)
+		c.checkBlock(n.Else, e)
+	case *ast.ForEachArrayLoop:
+		c.typeOf(n.Value, e)
+		le := newEnv(e)
+		le.define(n.Var, &symbol{typ: tAny})
+		c.checkBlock(n.Block, le)
+		c.checkBlock(n.Else, e)
+	case *ast.ForEachMapLoop:
+		c.typeOf(n.X, e)
+		le := newEnv(e)
+		le.define(n.Key, &symbol{typ: tAny})
+		le.define(n.Value, &symbol{typ: tAny})
+		c.checkBlock(n.Block, le)
+		c.checkBlock(n.Else, e)
+	case *ast.ForEverLoop:
+		c.checkBlock(n.Block, e)
+	case *ast.WhileLoop:
+		c.typeOf(n.Condition, e)
+		c.checkBlock(n.Block, e)
+		c.checkBlock(n.Else, e)
+	case *ast.DoLoop:
+		c.checkBlock(n.Block, e)
+		c.checkBlock(n.Else, e)
+	case *ast.YieldExpression:
+		c.typeOf(n.Value, e)
+	case *ast.SpawnExpression:
+		c.typeOf(n.Call, e)
+		return "task"
+	case *ast.AwaitExpression:
+		c.typeOf(n.Value, e)
+	case *ast.DecoratorExpr:
+		c.typeOf(n.Decorator, e)
+		if st, ok := n.Decorated.(*ast.StructStatement); ok {
+			c.checkStruct(st, e)
+		} else {
+			c.typeOf(n.Decorated, e)
+		}
+	}
+	return tAny
+}
+
+func (c *Checker) typeOfAll(exprs []ast.Expression, e *env) []string {
+	types := []string{}
+	for _, expr := range exprs {
+		types = append(types, c.typeOf(expr, e))
+	}
+	return types
+}
+
+// check the comprehension's clauses, returns the scope of the loop variables.
+func (c *Checker) checkClauses(clauses []*ast.ComprehensionClause, e *env) *env {
+	ce := newEnv(e)
+	for _, clause := range clauses {
+		c.typeOf(clause.Iterable, ce)
+		for _, name := range clause.Names {
+			ce.define(name.Value, &symbol{typ: tAny})
+		}
+		c.typeOfAll(clause.Conds, ce)
+	}
+	return ce
+}
+
+func (c *Checker) typeOfIdentifier(ident *ast.Identifier, e *env) string {
+	if ident.Value == "self" && len(c.selfTypes) > 0 {
+		return c.selfTypes[len(c.selfTypes)-1]
+	}
+	if sym := e.lookup(ident.Value); sym != nil {
+		return sym.typ
+	}
+	if _, ok := builtinFuncs[ident.Value]; ok {
+		return "function"
+	}
+	return tAny
+}
+
+func (c *Checker) typeOfPrefix(pe *ast.PrefixExpression, e *env) string {
+	t := c.typeOf(pe.Right, e)
+	switch pe.Operator {
+	case "!":
+		return "bool"
+	case "-", "+":
+		if primitiveTypes[t] && t != "number" {
+			c.errorf(pe.Pos(), "invalid operation: operator '%s' on '%s'", pe.Operator, t)
+		}
+		if t == "number" {
+			return t
+		}
+	case "<-":
+		if primitiveTypes[t] {
+			c.errorf(pe.Pos(), "invalid operation: receive from '%s', channel expected", t)
+		}
+	}
+	return tAny
+}
+
+// the result type of a binary operation, reports the invalid operations.
+// structs may overload the operators, so only the primitive types are checked.
+func (c *Checker) binaryType(pos token.Position, op, lt, rt string) string {
+	checked := primitiveTypes[lt] && primitiveTypes[rt]
+	invalid := func() string {
+		c.errorf(pos, "invalid operation: '%s' %s '%s'", lt, op, rt)
+		return tAny
+	}
+
+	switch op {
+	case "==", "!=", "&&", "||", "in", "is":
+		return "bool"
+	case "=~", "!~":
+		if primitiveTypes[rt] && rt != "regex" {
+			c.errorf(pos, "invalid operation: '%s' %s '%s', regular expression expected", lt, op, rt)
+		}
+		return "bool"
+	case "..":
+		return "array"
+	case "<-":
+		if primitiveTypes[lt] {
+			c.errorf(pos, "invalid operation: send to '%s', channel expected", lt)
+		}
+		return "nil"
+	case "<", "<=", ">", ">=":
+		if checked && !(lt == rt && (lt == "number" || lt == "string" || lt == "array" || lt == "tuple")) { //the collections lexicographically
+			invalid()
+		}
+		return "bool"
+	case "+":
+		if lt == rt && (lt == "number" || lt == "string") {
+			return lt
+		}
+		if checked {
+			return invalid()
+		}
+	case "-", "*", "/", "%", "**":
+		if lt == "number" && rt == "number" {
+			return lt
+		}
+		if checked {
+			return invalid()
+		}
+	}
+	if lt == "number" && rt == "number" {
+		return lt
+	}
+	return tAny
+}
+
+// assign a value of type 't' to the expression(a variable, or a struct field)
+func (c *Checker) assign(tok token.Token, name ast.Expression, t string, pos token.Position, e *env) {
+	switch n := name.(type) {
+	case *ast.Identifier:
+		if n.Value == "_" {
+			return
+		}
+		sym := e.lookup(n.Value)
+		switch {
+		case sym == nil:
+			e.define(n.Value, &symbol{typ: t})
+		case sym.declared:
+			if !c.assignable(sym.typ, t) {
+				c.mismatch(pos, fmt.Sprintf("variable '%s'", n.Value), sym.typ, t)
+			}
+		case sym.owner == e:
+			sym.typ, sym.fn, sym.structName = t, nil, ""
+		case sym.typ != t: //assigned in a nested block, the type is unknown after the block
+			sym.typ, sym.fn, sym.structName = tAny, nil, ""
+		}
+	case *ast.MethodCallExpression:
+		ot := c.typeOf(n.Object, e)
+		field, ok := n.Call.(*ast.Identifier)
+		if !ok {
+			return
+		}
+		if info, ok := c.structs[ot]; ok {
+			if ft := info.fields[field.Value]; ft != nil && !c.assignable(ft.Value, t) {
+				what := fmt.Sprintf("field '%s' of struct '%s'", field.Value, ot)
+				c.mismatch(pos, what, ft.Value, t)
+			}
+		}
+	default:
+		c.typeOf(name, e)
+	}
+}
+
+func (c *Checker) typeOfCall(call *ast.CallExpression, e *env) string {
+	args := c.typeOfAll(call.Arguments, e)
+
+	switch f := call.Function.(type) {
+	case *ast.Identifier:
+		sym := e.lookup(f.Value)
+		switch {
+		case sym == nil:
+			if t, ok := builtinFuncs[f.Value]; ok {
+				return t
+			}
+		case sym.fn != nil:
+			c.checkArgs(call, sym.fn, args, fmt.Sprintf("function '%s'", f.Value))
+			return returnType(sym.fn)
+		case sym.structName != "":
+			info := c.structs[sym.structName]
+			if init, ok := c.findMethod(info, "init"); ok {
+				if init != nil {
+					c.checkArgs(call, init, args, fmt.Sprintf("struct '%s' constructor", f.Value))
+				}
+			} else if len(args) > 0 {
+				c.errorf(call.Pos(), "struct '%s' has no 'init' constructor, but got %d argument(s)", f.Value, len(args))
+			}
+			return sym.structName
+		}
+	case *ast.FunctionLiteral: //fn(x) { ... }(10)
+		c.checkFunction(f, e)
+		c.checkArgs(call, f, args, fmt.Sprintf("function '%s'", funcName(f)))
+		return returnType(f)
+	default:
+		c.typeOf(call.Function, e)
+	}
+	return tAny
+}
+
+func (c *Checker) typeOfMethodCall(mc *ast.MethodCallExpression, e *env) string {
+	ot := c.typeOf(mc.Object, e)
+	info, isStruct := c.structs[ot]
+	iface, isInterface := c.interfaces[ot]
+
+	switch call := mc.Call.(type) {
+	case *ast.Identifier: //field access, or a bound method
+		if isStruct {
+			if ft := info.fields[call.Value]; ft != nil {
+				return ft.Value
+			}
+			if _, found := c.findMethod(info, call.Value); found {
+				return "function"
+			}
+		}
+	case *ast.CallExpression:
+		name, ok := call.Function.(*ast.Identifier)
+		if !ok {
+			c.typeOf(call, e)
+			return tAny
+		}
+		args := c.typeOfAll(call.Arguments, e)
+
+		var method *ast.FunctionLiteral
+		switch {
+		case isStruct:
+			var found bool
+			if method, found = c.findMethod(info, name.Value); !found {
+				if _, isField := info.fields[name.Value]; !isField && e.lookup(name.Value) == nil {
+					c.errorf(name.Pos(), "struct '%s' has no method '%s'", ot, name.Value)
+				}
+			}
+		case isInterface:
+			for _, m := range iface.Methods {
+				if m.Name == name.Value {
+					method = m
+				}
+			}
+			if method == nil {
+				c.errorf(name.Pos(), "interface '%s' has no method '%s'", ot, name.Value)
+			}
+		}
+		if method != nil {
+			c.checkArgs(call, method, args, fmt.Sprintf("method '%s.%s'", ot, name.Value))
+			return returnType(method)
+		}
+	default:
+		c.typeOf(mc.Call, e)
+	}
+	return tAny
+}
+
+// 'x |> f(args)' is the same as 'f(x, args)'
+func (c *Checker) typeOfPipe(ie *ast.InfixExpression, e *env) string {
+	switch right := ie.Right.(type) {
+	case *ast.CallExpression:
+		return c.typeOf(pipeCall(ie.Left, right), e)
+	case *ast.Identifier:
+		return c.typeOf(pipeCall(ie.Left, &ast.CallExpression{Token: ie.Token, Function: right}), e)
+	case *ast.MethodCallExpression:
+		call, ok := right.Call.(*ast.CallExpression)
+		if !ok {
+			call = &ast.CallExpression{Token: ie.Token, Function: right.Call}
+		}
+		mc := &ast.MethodCallExpression{Token: right.Token, Object: right.Object, Call: pipeCall(ie.Left, call)}
+		return c.typeOf(mc, e)
+	}
+	c.typeOf(ie.Left, e)
+	c.typeOf(ie.Right, e)
+	return tAny
+}
+
+func pipeCall(arg ast.Expression, call *ast.CallExpression) *ast.CallExpression {
+	args := append([]ast.Expression{arg}, call.Arguments...)
+	return &ast.CallExpression{Token: call.Token, Function: call.Function, Arguments: args, Variadic: call.Variadic}
+}
+
+// check the number of arguments and the annotated parameter types.
+func (c *Checker) checkArgs(call *ast.CallExpression, fn *ast.FunctionLiteral, args []string, what string) {
+	if call.Variadic { //the number of the unboxed arguments is unknown
+		return
+	}
+
+	required := len(fn.Parameters)
+	if fn.Variadic {
+		required--
+	}
+	if len(args) < required {
+		c.errorf(call.Pos(), "not enough arguments in call to %s, expected %d, got %d", what, required, len(args))
+		return
+	}
+
+	if fn.ParamTypes == nil {
+		return
+	}
+	for i, t := range args {
+		idx := i
+		if idx >= len(fn.Parameters) {
+			if !fn.Variadic {
+				break
+			}
+			idx = len(fn.Parameters) - 1
+		}
+		pt := fn.ParamTypes[idx]
+		if pt != nil && !c.assignable(pt.Value, t) {
+			desc := fmt.Sprintf("argument '%s' of %s", fn.Parameters[idx].Value, what)
+			c.mismatch(call.Arguments[i].Pos(), desc, pt.Value, t)
+		}
+	}
+}
+
+func returnType(fn *ast.FunctionLiteral) string {
+	if fn.IsGenerator {
+		return "generator"
+	}
+	if fn.IsAsync {
+		return "promise"
+	}
+	if fn.ReturnType != nil {
+		return fn.ReturnType.Value
+	}
+	return tAny
+}
+
+func funcName(fn *ast.FunctionLiteral) string {
+	if fn.Name == "" {
+		return "<anonymous>"
+	}
+	return fn.Name
+}
@@ -0,0 +1,625 @@
+package eval
+
+import (
+	"container/heap"
+	"magpie/ast"
+	"magpie/token"
+	"sync"
+	"time"
+)
+
+// The event loop runs the timers' callbacks, the continuations of the async
+// functions and the completions of the async I/O, one at a time in the
+// goroutine which runs the program. It's run by the top level 'await' until
+// the awaited promise settles, and it's drained when the program ends.
+type eventLoop struct {
+	mu       sync.Mutex
+	jobs     []job          //ready to run, before the due timers
+	timers   timerQueue     //ordered by the deadline
+	active   map[int]*timer //the timers which are not fired or cleared
+	lastID   int
+	pending  int           //the async operations which are not completed
+	rejected []*Promise    //checked for the unhandled rejections when the loop is drained
+	wake     chan struct{} //a job or a timer is added
+}
+
+// a job returns an error if it's not handled, which stops the loop
+type job func() Object
+
+var loop = &eventLoop{active: make(map[int]*timer), wake: make(chan struct{}, 1)}
+
+func (l *eventLoop) post(j job) {
+	l.mu.Lock()
+	l.jobs = append(l.jobs, j)
+	l.mu.Unlock()
+	l.notify()
+}
+
+func (l *eventLoop) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next job to run. If none is ready, it returns how long
+// to wait for the next timer(-1 if there's no timer), and whether the loop
+// has work left at all.
+func (l *eventLoop) next() (j job, wait time.Duration, alive bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.jobs) > 0 {
+		j = l.jobs[0]
+		l.jobs[0] = nil
+		l.jobs = l.jobs[1:]
+		return j, 0, true
+	}
+	if len(l.timers) > 0 {
+		t := l.timers[0]
+		if d := time.Until(t.when); d > 0 {
+			return nil, d, true
+		}
+		heap.Pop(&l.timers)
+		if t.repeat {
+			t.when = time.Now().Add(t.delay)
+			heap.Push(&l.timers, t)
+		} else {
+			delete(l.active, t.id)
+		}
+		return t.fire, 0, true
+	}
+	return nil, -1, l.pending > 0
+}
+
+// run runs the jobs until the loop has no work left, or until 'until' is
+// closed(the awaited promise settles).
+func (l *eventLoop) run(line string, scope *Scope, until <-chan struct{}) Object {
+	for {
+		select {
+		case <-until:
+			return nil
+		default:
+		}
+
+		j, wait, alive := l.next()
+		if j != nil {
+			if r := j(); r != nil {
+				return r
+			}
+			continue
+		}
+		if !alive {
+			if until == nil {
+				return nil
+			}
+			if !threaded.Load() { //no task could settle it
+				return newError(line, ERR_NEVERSETTLED)
+			}
+		}
+
+		var t *time.Timer
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			t = time.NewTimer(wait)
+			timeout = t.C
+		}
+		select {
+		case <-l.wake:
+		case <-timeout:
+		case <-until:
+		case <-scope.canceled():
+			return scope.sandbox.checkContext(line)
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// drain runs the loop after the program, the first rejection which is not
+// handled is reported as the program's error.
+func (l *eventLoop) drain(line string, result Object, scope *Scope) Object {
+	if result.Type() == ERROR_OBJ {
+		return result
+	}
+	if r := l.run(line, scope, nil); r != nil {
+		return r
+	}
+
+	l.mu.Lock()
+	rejected := l.rejected
+	l.rejected = nil
+	l.mu.Unlock()
+	for _, p := range rejected {
+		if reason, handled := p.unhandled(); !handled {
+			return uncaught(reason)
+		}
+	}
+	return result
+}
+
+// the error of a result which is not handled, nil if it's not an error
+func uncaught(r Object) Object {
+	switch r := r.(type) {
+	case *Error:
+		return r
+	case *Throw:
+		return r.unhandled()
+	}
+	return nil
+}
+
+// runAsync runs the blocking operation in its own goroutine, the returned
+// promise is settled by the loop. The operation must not use the
+// interpreter's state.
+func runAsync(op func() Object) *Promise {
+	p := newPromise()
+	loop.mu.Lock()
+	loop.pending++
+	loop.mu.Unlock()
+
+	go func() {
+		result := op()
+		loop.mu.Lock()
+		loop.pending--
+		loop.jobs = append(loop.jobs, func() Object {
+			p.settle(result)
+			return nil
+		})
+		loop.mu.Unlock()
+		loop.notify()
+	}()
+	return p
+}
+
+// timer is created by 'setTimeout' and 'setInterval'
+type timer struct {
+	id     int
+	when   time.Time
+	delay  time.Duration
+	repeat bool
+	index  int //in the queue
+
+	fn    Object
+	args  []Object
+	scope *Scope
+	line  string
+}
+
+// the callback's error or throw which is not caught stops the loop
+func (t *timer) fire() Object {
+	return uncaught(applyFunction(t.line, t.scope, t.fn, t.args))
+}
+
+func (l *eventLoop) addTimer(t *timer) int {
+	l.mu.Lock()
+	l.lastID++
+	t.id = l.lastID
+	t.when = time.Now().Add(t.delay)
+	heap.Push(&l.timers, t)
+	l.active[t.id] = t
+	l.mu.Unlock()
+	l.notify()
+	return t.id
+}
+
+func (l *eventLoop) clearTimer(id int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.active[id]
+	if !ok {
+		return false
+	}
+	delete(l.active, id)
+	heap.Remove(&l.timers, t.index)
+	return true
+}
+
+// timerQueue implements heap.Interface, the timers of the same deadline
+// fire in the order they're added.
+type timerQueue []*timer
+
+func (q timerQueue) Len() int { return len(q) }
+func (q timerQueue) Less(i, j int) bool {
+	if q[i].when.Equal(q[j].when) {
+		return q[i].id < q[j].id
+	}
+	return q[i].when.Before(q[j].when)
+}
+func (q timerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *timerQueue) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+func (q *timerQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return t
+}
+
+type promiseState int
+
+const (
+	pending promiseState = iota
+	fulfilled
+	rejected
+)
+
+// Promise is the result of an async function's call, or of an async
+// operation. A rejected promise's value is the error or the throw, which
+// 'await' raises in the awaiting function.
+type Promise struct {
+	mu        sync.Mutex
+	state     promiseState
+	value     Object
+	handled   bool     //awaited, or passed to 'then' or the combinators
+	callbacks []func() //called when it's settled
+	done      chan struct{}
+}
+
+func newPromise() *Promise {
+	return &Promise{done: make(chan struct{})}
+}
+
+// settle fulfills the promise with the result, or rejects it if the result
+// is an error or a throw. A promise result is adopted. Settling a settled
+// promise does nothing.
+func (p *Promise) settle(result Object) {
+	if other, ok := result.(*Promise); ok && other != p {
+		other.onSettled(func() {
+			value, _ := other.result()
+			p.settle(value)
+		})
+		return
+	}
+
+	p.mu.Lock()
+	if p.state != pending {
+		p.mu.Unlock()
+		return
+	}
+	p.state = fulfilled
+	if result == nil {
+		result = NIL
+	} else if isError(result) || result.Type() == THROW_OBJ {
+		p.state = rejected
+	}
+	p.value = result
+	callbacks := p.callbacks
+	p.callbacks = nil
+	close(p.done)
+	state := p.state
+	p.mu.Unlock()
+
+	if state == rejected {
+		loop.mu.Lock()
+		loop.rejected = append(loop.rejected, p)
+		loop.mu.Unlock()
+	}
+	for _, cb := range callbacks {
+		cb()
+	}
+}
+
+// onSettled calls 'cb' when the promise is settled, at once if it's settled
+// already. The callbacks should post the jobs which run the script's code.
+func (p *Promise) onSettled(cb func()) {
+	p.mu.Lock()
+	p.handled = true
+	if p.state == pending {
+		p.callbacks = append(p.callbacks, cb)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	cb()
+}
+
+// the value or the rejection of the settled promise
+func (p *Promise) result() (Object, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handled = true
+	return p.value, p.state == rejected
+}
+
+func (p *Promise) unhandled() (Object, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.value, p.handled
+}
+
+func (p *Promise) Inspect() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.state {
+	case fulfilled:
+		return "<promise fulfilled: " + p.value.Inspect() + ">"
+	case rejected:
+		return "<promise rejected: " + p.value.Inspect() + ">"
+	}
+	return "<promise pending>"
+}
+
+func (p *Promise) Type() ObjectType { return PROMISE_OBJ }
+func (p *Promise) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	switch method {
+	case "then": //then(onFulfilled, onRejected=nil)
+		if len(args) < 1 || len(args) > 2 {
+			return newError(line, ERR_ARGUMENT, 2, len(args))
+		}
+		var onRejected Object = NIL
+		if len(args) == 2 {
+			onRejected = args[1]
+		}
+		return p.then(line, scope, args[0], onRejected)
+	case "catch": //catch(onRejected)
+		if len(args) != 1 {
+			return newError(line, ERR_ARGUMENT, 1, len(args))
+		}
+		return p.then(line, scope, NIL, args[0])
+	}
+	return newError(line, ERR_NOMETHOD, method, p.Type())
+}
+
+// then returns a promise of the handler's result, the handler is called
+// with the value, or with the caught value if it's rejected. A nil handler
+// passes the result on.
+func (p *Promise) then(line string, scope *Scope, onFulfilled, onRejected Object) *Promise {
+	next := newPromise()
+	callScope := scope.detached()
+	p.onSettled(func() {
+		loop.post(func() Object {
+			value, isRejected := p.result()
+			handler, arg := onFulfilled, value
+			if isRejected {
+				handler, arg = onRejected, caughtValue(value)
+			}
+			if handler == NIL {
+				next.settle(value)
+				return nil
+			}
+			next.settle(applyFunction(line, callScope, handler, []Object{arg}))
+			return nil
+		})
+	})
+	return next
+}
+
+// the value which 'catch' gets for a rejection
+func caughtValue(reason Object) Object {
+	switch r := reason.(type) {
+	case *Error:
+		return newRuntimeError(r)
+	case *Throw:
+		return r.value
+	}
+	return reason
+}
+
+// the rejection of 'reject(value)', like the value is thrown at the line
+func rejection(line string, scope *Scope, value Object) Object {
+	if re, ok := value.(*RuntimeError); ok {
+		return re.err
+	}
+	pos := parseSline(line)
+	stmt := &ast.ThrowStmt{Token: token.Token{Pos: pos, Type: token.TOKEN_THROW, Literal: "throw"}}
+	return &Throw{stmt: stmt, value: value, stack: scope.traceback(pos)}
+}
+
+// Promises is the global 'Promise' object, which creates and combines the
+// promises.
+type Promises struct{}
+
+func (ps *Promises) Inspect() string  { return "<Promise>" }
+func (ps *Promises) Type() ObjectType { return PROMISES_OBJ }
+func (ps *Promises) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	if len(args) != 1 {
+		return newError(line, ERR_ARGUMENT, 1, len(args))
+	}
+	switch method {
+	case "new": //Promise.new(fn(resolve, reject) { ... })
+		return newPromiseWith(line, scope, args[0])
+	case "resolve":
+		p := newPromise()
+		p.settle(args[0])
+		return p
+	case "reject":
+		p := newPromise()
+		p.settle(rejection(line, scope, args[0]))
+		return p
+	case "all", "race":
+		var items []Object
+		switch a := args[0].(type) {
+		case *Array:
+			items = a.Members
+		case *Tuple:
+			items = a.Members
+		default:
+			return newError(line, ERR_PARAMTYPE, "first", method, "*Array", args[0].Type())
+		}
+		if method == "all" {
+			return promiseAll(items)
+		}
+		return promiseRace(items)
+	}
+	return newError(line, ERR_NOMETHOD, method, ps.Type())
+}
+
+// the executor is called at once with the 'resolve' and 'reject' functions
+func newPromiseWith(line string, scope *Scope, executor Object) Object {
+	p := newPromise()
+	resolve := &Builtin{Fn: func(line string, scope *Scope, args ...Object) Object {
+		if len(args) > 1 {
+			return newError(line, ERR_ARGUMENT, 1, len(args))
+		}
+		var v Object = NIL
+		if len(args) == 1 {
+			v = args[0]
+		}
+		p.settle(v)
+		return NIL
+	}}
+	reject := &Builtin{Fn: func(line string, scope *Scope, args ...Object) Object {
+		if len(args) != 1 {
+			return newError(line, ERR_ARGUMENT, 1, len(args))
+		}
+		p.settle(rejection(line, scope, args[0]))
+		return NIL
+	}}
+
+	if r := applyFunction(line, scope, executor, []Object{resolve, reject}); uncaught(r) != nil {
+		p.settle(r) //the executor failed
+	}
+	return p
+}
+
+// a promise of the values, the promises' values in order, or the first rejection
+func promiseAll(items []Object) *Promise {
+	all := newPromise()
+	values := make([]Object, len(items))
+	remaining := len(items)
+	if remaining == 0 {
+		all.settle(&Array{Members: values})
+	}
+
+	var mu sync.Mutex
+	for i, item := range items {
+		p := toPromise(item)
+		p.onSettled(func() {
+			value, isRejected := p.result()
+			if isRejected {
+				all.settle(value)
+				return
+			}
+			mu.Lock()
+			values[i] = value
+			remaining--
+			last := remaining == 0
+			mu.Unlock()
+			if last {
+				all.settle(&Array{Members: values})
+			}
+		})
+	}
+	return all
+}
+
+// a promise which settles as the first of the promises settles
+func promiseRace(items []Object) *Promise {
+	first := newPromise()
+	for _, item := range items {
+		p := toPromise(item)
+		p.onSettled(func() {
+			value, _ := p.result()
+			first.settle(value)
+		})
+	}
+	return first
+}
+
+func toPromise(obj Object) *Promise {
+	if p, ok := obj.(*Promise); ok {
+		return p
+	}
+	p := newPromise()
+	p.settle(obj)
+	return p
+}
+
+// asyncContext is used for passing the control between an async function's
+// body(running in its own goroutine) and the loop. Only one of them runs at
+// a time.
+type asyncContext struct {
+	resume chan Object   //the awaited promise's value or rejection
+	yield  chan struct{} //the body is suspended at an 'await' or it returned
+}
+
+// callAsync starts the async function, its body runs until the first
+// 'await' before the call returns the promise of its result.
+func callAsync(line string, scope *Scope, fn *Function, extendedScope *Scope) Object {
+	if errObj := enterCall(line, scope, fn, extendedScope); errObj != nil {
+		return errObj
+	}
+	ctx := &asyncContext{resume: make(chan Object), yield: make(chan struct{})}
+	extendedScope.async = ctx
+
+	p := newPromise()
+	go func() {
+		var result Object
+		defer func() {
+			if r := recover(); r != nil {
+				result = panicToError(r, fn.Literal)
+			}
+			p.settle(result)
+			ctx.yield <- struct{}{}
+		}()
+		result = extendedScope.defers.run(callBody(line, fn, extendedScope))
+	}()
+	<-ctx.yield
+	return p
+}
+
+// suspend the body until the promise settles, the loop resumes it
+func (ctx *asyncContext) await(p *Promise) Object {
+	p.onSettled(func() {
+		loop.post(func() Object {
+			value, _ := p.result()
+			ctx.resume <- value
+			<-ctx.yield
+			return nil
+		})
+	})
+	ctx.yield <- struct{}{}
+	return <-ctx.resume
+}
+
+// get the context of the async function which the scope belongs to, and
+// whether the scope is in a function at all.
+func (s *Scope) getAsync() (*asyncContext, bool) {
+	for scope := s; scope != nil; scope = scope.parentScope {
+		if scope.defers != nil {
+			return scope.async, true
+		}
+	}
+	return nil, false
+}
+
+// 'await promise' gives the promise's value, a rejection is raised as the
+// error or the throw. Awaiting other values gives the value itself. The top
+// level 'await' runs the loop until the promise settles.
+func evalAwaitExpression(ae *ast.AwaitExpression, scope *Scope) Object {
+	v := Eval(ae.Value, scope)
+	if isError(v) {
+		return v
+	}
+	return awaitValue(ae, v, scope)
+}
+
+// await the evaluated value
+func awaitValue(ae *ast.AwaitExpression, v Object, scope *Scope) Object {
+	p, ok := v.(*Promise)
+	if !ok {
+		return v
+	}
+
+	line := ae.Pos().Sline()
+	ctx, inFunction := scope.getAsync()
+	if ctx != nil {
+		return ctx.await(p)
+	}
+	if inFunction {
+		return newError(line, ERR_AWAIT)
+	}
+	if r := loop.run(line, scope, p.done); r != nil {
+		return r
+	}
+	value, _ := p.result()
+	return value
+}
@@ -3,6 +3,8 @@ package eval
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -24,7 +26,8 @@ var fileModeTable = map[string]int{
 type BuiltinFunc func(line string, scope *Scope, args ...Object) Object
 
 type Builtin struct {
-	Fn BuiltinFunc
+	Fn   BuiltinFunc
+	name string //the decorated function's name, if it's a decorator's wrapper
 }
 
 func (b *Builtin) Inspect() string  { return "<builtin function>" }
@@ -104,11 +107,18 @@ func lenBuiltin() *Builtin {
 				n := utf8.RuneCountInString(arg.String)
 				return NewNumber(float64(n))
 			case *Array:
-				return NewNumber(float64(len(arg.Members)))
+				return NewNumber(float64(arg.count()))
 			case *Tuple:
 				return NewNumber(float64(len(arg.Members)))
 			case *Hash:
-				return NewNumber(float64(len(arg.Pairs)))
+				return NewNumber(float64(arg.count()))
+			case *Channel: //the buffered values
+				return NewNumber(float64(len(arg.ch)))
+			case *Struct:
+				if r, ok := callProtocol(line, scope, arg, PROTO_LEN); ok {
+					return r
+				}
+				return newError(line, "argument to `len` not supported, got %s", args[0].Type())
 			default:
 				return newError(line, "argument to `len` not supported, got %s", args[0].Type())
 			}
@@ -119,59 +129,67 @@ func lenBuiltin() *Builtin {
 func openBuiltin() *Builtin {
 	return &Builtin{
 		Fn: func(line string, scope *Scope, args ...Object) Object {
-			var fname *String
-			var flag int = os.O_RDONLY
-			var ok bool
-			var perm os.FileMode = os.FileMode(0666)
-
-			tup := NewTuple(true)
-
-			argLen := len(args)
-			if argLen < 1 {
-				tup.Members[1] = newError(line, ERR_ARGUMENT, "at least one", argLen)
-				return tup
+			if errObj := scope.denied(line, CapFile); errObj != nil {
+				return errObj
 			}
+			return openFile(line, args...)
+		},
+	}
+}
 
-			fname, ok = args[0].(*String)
-			if !ok {
-				tup.Members[1] = newError(line, ERR_PARAMTYPE, "first", "open", "*String", args[0].Type())
-				return tup
-			}
+// open(name, mode="r", perm=0666), returns a (file, error) tuple
+func openFile(line string, args ...Object) Object {
+	var fname *String
+	var flag int = os.O_RDONLY
+	var ok bool
+	var perm os.FileMode = os.FileMode(0666)
 
-			if argLen == 2 {
-				m, ok := args[1].(*String)
-				if !ok {
-					tup.Members[1] = newError(line, ERR_PARAMTYPE, "second", "open", "*String", args[1].Type())
-					return tup
-				}
+	tup := NewTuple(true)
 
-				flag, ok = fileModeTable[m.String]
-				if !ok {
-					tup.Members[1] = newError(line, "unknown file mode supplied")
-					return tup
-				}
-			}
+	argLen := len(args)
+	if argLen < 1 {
+		tup.Members[1] = newError(line, ERR_ARGUMENT, "at least one", argLen)
+		return tup
+	}
 
-			if len(args) == 3 {
-				p, ok := args[2].(*Number)
-				if !ok {
-					tup.Members[1] = newError(line, ERR_PARAMTYPE, "third", "open", "*Integer", args[2].Type())
-					return tup
-				}
+	fname, ok = args[0].(*String)
+	if !ok {
+		tup.Members[1] = newError(line, ERR_PARAMTYPE, "first", "open", "*String", args[0].Type())
+		return tup
+	}
 
-				perm = os.FileMode(int(p.Value))
-			}
+	if argLen == 2 {
+		m, ok := args[1].(*String)
+		if !ok {
+			tup.Members[1] = newError(line, ERR_PARAMTYPE, "second", "open", "*String", args[1].Type())
+			return tup
+		}
 
-			f, err := os.OpenFile(fname.String, flag, perm)
-			if err != nil {
-				tup.Members[1] = newError(line, "'open' failed with error: %s", err.Error())
-				return tup
-			}
+		flag, ok = fileModeTable[m.String]
+		if !ok {
+			tup.Members[1] = newError(line, "unknown file mode supplied")
+			return tup
+		}
+	}
 
-			tup.Members[0] = &FileObject{File: f, Name: "<file object: " + fname.String + ">"}
+	if len(args) == 3 {
+		p, ok := args[2].(*Number)
+		if !ok {
+			tup.Members[1] = newError(line, ERR_PARAMTYPE, "third", "open", "*Integer", args[2].Type())
 			return tup
-		},
+		}
+
+		perm = os.FileMode(int(p.Value))
 	}
+
+	f, err := os.OpenFile(fname.String, flag, perm)
+	if err != nil {
+		tup.Members[1] = newError(line, ERR_IO, "open", err.Error())
+		return tup
+	}
+
+	tup.Members[0] = &FileObject{File: f, Name: "<file object: " + fname.String + ">"}
+	return tup
 }
 
 func init() {
@@ -184,6 +202,20 @@ func init() {
 		"open":        openBuiltin(),
 		"type":        typeBuiltin(),
 		"flushStdout": flushStdoutBuiltin(),
+		"NewError":    newErrorBuiltin(),
+		"chan":        chanBuiltin(),
+		"close":       closeBuiltin(),
+		"Mutex":       mutexBuiltin(),
+		"WaitGroup":   waitGroupBuiltin(),
+		"setTimeout":  timerBuiltin("setTimeout", false),
+		"setInterval": timerBuiltin("setInterval", true),
+		"clearTimer":  clearTimerBuiltin(),
+		"openAsync":   openAsyncBuiltin(),
+		"execAsync":   execAsyncBuiltin(),
+		"memoize":     memoizeBuiltin(),
+		"trace":       traceBuiltin(),
+		"timeit":      timeitBuiltin(),
+		"deprecated":  deprecatedBuiltin(),
 	}
 }
 
@@ -194,54 +226,82 @@ func typeBuiltin() *Builtin {
 				return newError(line, ERR_ARGUMENT, 1, len(args))
 			}
 
-			switch args[0].(type) {
-			case *Number:
-				return NewString("number")
-			case *Nil:
-				return NewString("nil")
-			case *Boolean:
-				return NewString("bool")
-			case *Error:
-				return NewString("error")
-			case *Break:
-				return NewString("break")
-			case *Continue:
-				return NewString("continue")
-			case *ReturnValue:
-				return NewString("return")
-			case *Function:
-				return NewString("function")
-			case *Builtin:
-				return NewString("builtin")
-			case *RegEx:
-				return NewString("regex")
-			case *GoObject:
-				return NewString("go")
-			case *GoFuncObject:
-				return NewString("gofunction")
-			case *FileObject:
-				return NewString("file")
-			case *Os:
-				return NewString("os")
-			case *Struct:
-				return NewString("struct")
-			case *Throw:
-				return NewString("throw")
-			case *String:
-				return NewString("string")
-			case *Array:
-				return NewString("array")
-			case *Tuple:
-				return NewString("tuple")
-			case *Hash:
-				return NewString("hash")
-			default:
+			name := typeName(args[0])
+			if name == "" {
 				return newError(line, "argument to `type` not supported, got=%s", args[0].Type())
 			}
+			return NewString(name)
 		},
 	}
 }
 
+// the type's name of the object which 'type()' returns, empty if it's not supported
+func typeName(obj Object) string {
+	switch obj.(type) {
+	case *Number:
+		return "number"
+	case *Nil:
+		return "nil"
+	case *Boolean:
+		return "bool"
+	case *Error, *RuntimeError:
+		return "error"
+	case *Break:
+		return "break"
+	case *Continue:
+		return "continue"
+	case *ReturnValue:
+		return "return"
+	case *Function:
+		return "function"
+	case *Builtin:
+		return "builtin"
+	case *RegEx:
+		return "regex"
+	case *GoObject:
+		return "go"
+	case *GoFuncObject:
+		return "gofunction"
+	case *BoundMethod:
+		return "method"
+	case *FileObject:
+		return "file"
+	case *Os:
+		return "os"
+	case *Struct:
+		return "struct"
+	case *Interface:
+		return "interface"
+	case *Generator:
+		return "generator"
+	case *Task:
+		return "task"
+	case *Channel:
+		return "channel"
+	case *Mutex:
+		return "mutex"
+	case *WaitGroup:
+		return "waitgroup"
+	case *Promise:
+		return "promise"
+	case *Quote:
+		return "quote"
+	case *Module:
+		return "module"
+	case *Throw:
+		return "throw"
+	case *String:
+		return "string"
+	case *Array:
+		return "array"
+	case *Tuple:
+		return "tuple"
+	case *Hash:
+		return "hash"
+	}
+	return ""
+}
+
 func flushStdoutBuiltin() *Builtin {
 	return &Builtin{
 		Fn: func(line string, scope *Scope, args ...Object) Object {
@@ -254,3 +314,174 @@ func flushStdoutBuiltin() *Builtin {
 		},
 	}
 }
+
+// NewError(message, kind: "ERR_CONFIG", cause: e) creates an error value for
+// 'throw', the keyword arguments are optional. If it's not caught, the report
+// shows the cause too.
+func newErrorBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if len(args) == 0 || len(args) > 2 {
+				return newError(line, ERR_ARGUMENT, 1, len(args))
+			}
+			msg, ok := args[0].(*String)
+			if !ok {
+				return newError(line, ERR_PARAMTYPE, "first", "NewError", "*String", args[0].Type())
+			}
+
+			errObj := newError(line, "%s", msg.String)
+			errObj.pos = parseSline(line)
+			errObj.stack = scope.traceback(errObj.pos)
+			if len(args) == 2 {
+				opts, ok := args[1].(*Hash)
+				if !ok {
+					return newError(line, ERR_PARAMTYPE, "second", "NewError", "*Hash", args[1].Type())
+				}
+				if kind, ok, _ := opts.lookup(line, scope, NewString("kind")); ok {
+					errObj.kind = kind.Value.Inspect()
+				}
+				if cause, ok, _ := opts.lookup(line, scope, NewString("cause")); ok && cause.Value != NIL {
+					errObj.cause = cause.Value
+					errObj.Message += "Caused by: "
+					if re, ok := cause.Value.(*RuntimeError); ok {
+						errObj.Message += re.err.Traceback() + re.err.Message
+					} else {
+						errObj.Message += cause.Value.Inspect() + "\n"
+					}
+				}
+			}
+			return newRuntimeError(errObj)
+		},
+	}
+}
+
+// chan(n) creates a channel with a buffer of 'n' values, unbuffered by default.
+func chanBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if len(args) > 1 {
+				return newError(line, ERR_ARGUMENT, 1, len(args))
+			}
+			size := 0
+			if len(args) == 1 {
+				n, ok := args[0].(*Number)
+				if !ok || n.Value < 0 {
+					return newError(line, ERR_PARAMTYPE, "first", "chan", "*Number", args[0].Type())
+				}
+				size = int(n.Value)
+			}
+			return &Channel{ch: make(chan Object, size)}
+		},
+	}
+}
+
+func closeBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if len(args) != 1 {
+				return newError(line, ERR_ARGUMENT, 1, len(args))
+			}
+			c, ok := args[0].(*Channel)
+			if !ok {
+				return newError(line, ERR_NOTCHANNEL, "close", args[0].Type())
+			}
+			return c.close(line)
+		},
+	}
+}
+
+func mutexBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if len(args) != 0 {
+				return newError(line, ERR_ARGUMENT, 0, len(args))
+			}
+			return &Mutex{sem: make(chan struct{}, 1)}
+		},
+	}
+}
+
+func waitGroupBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if len(args) != 0 {
+				return newError(line, ERR_ARGUMENT, 0, len(args))
+			}
+			return &WaitGroup{}
+		},
+	}
+}
+
+// setTimeout(fn, ms, args...) calls the function once after 'ms' milliseconds,
+// setInterval(fn, ms, args...) calls it every 'ms' milliseconds until it's
+// cleared. Both return the timer's id for 'clearTimer'.
+func timerBuiltin(name string, repeat bool) *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if len(args) < 2 {
+				return newError(line, ERR_ARGUMENT, 2, len(args))
+			}
+			switch args[0].(type) {
+			case *Function, *Builtin, *GoFuncObject, *BoundMethod, *Struct:
+			default:
+				return newError(line, ERR_PARAMTYPE, "first", name, "*Function", args[0].Type())
+			}
+			ms, ok := args[1].(*Number)
+			if !ok {
+				return newError(line, ERR_PARAMTYPE, "second", name, "*Number", args[1].Type())
+			}
+
+			t := &timer{fn: args[0], args: args[2:], scope: scope.detached(), line: line, repeat: repeat}
+			t.delay = time.Duration(ms.Value * float64(time.Millisecond))
+			return NewNumber(float64(loop.addTimer(t)))
+		},
+	}
+}
+
+// clearTimer(id) returns false if the timer has fired or is cleared already
+func clearTimerBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if len(args) != 1 {
+				return newError(line, ERR_ARGUMENT, 1, len(args))
+			}
+			id, ok := args[0].(*Number)
+			if !ok {
+				return newError(line, ERR_PARAMTYPE, "first", "clearTimer", "*Number", args[0].Type())
+			}
+			return nativeBoolToBooleanObject(loop.clearTimer(int(id.Value)))
+		},
+	}
+}
+
+// openAsync(name, mode="r", perm=0666) returns a promise of open's (file, error) tuple
+func openAsyncBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if errObj := scope.denied(line, CapFile); errObj != nil {
+				return errObj
+			}
+			return runAsync(func() Object { return openFile(line, args...) })
+		},
+	}
+}
+
+// execAsync(cmd) returns a promise of the command's result, like `cmd`
+func execAsyncBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if errObj := scope.denied(line, CapCommand); errObj != nil {
+				return errObj
+			}
+			if len(args) != 1 {
+				return newError(line, ERR_ARGUMENT, 1, len(args))
+			}
+			cmd, ok := args[0].(*String)
+			if !ok {
+				return newError(line, ERR_PARAMTYPE, "first", "execAsync", "*String", args[0].Type())
+			}
+			ctx := scope.context()
+			return runAsync(func() Object { return runCommand(ctx, strings.TrimSpace(cmd.String)) })
+		},
+	}
+}
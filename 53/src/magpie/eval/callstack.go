@@ -0,0 +1,131 @@
+package eval
+
+import (
+	"fmt"
+	"magpie/token"
+	"strings"
+)
+
+// MaxDepth is the maximum number of nested function calls, 0 means no limit.
+// The tail calls('tailcall f(x)' and 'return f(x)') do not nest.
+var MaxDepth = 10000
+
+const maxChainNames = 10 //a longer call chain is elided in the middle
+
+// a function invocation, linked to its caller's
+type callFrame struct {
+	fn     *Function //the running function, changed by the tail calls
+	caller *callFrame
+	depth  int
+	line   string //the call site, which is parsed only for a traceback
+	tails  int    //the number of the tail calls which reused the frame
+}
+
+// get the call frame of the nearest function invocation, nil at the top level
+func (s *Scope) getCallFrame() *callFrame {
+	for scope := s; scope != nil; scope = scope.parentScope {
+		if scope.defers != nil {
+			return scope.call
+		}
+	}
+	return nil
+}
+
+// enterCall links the function call's scope to its caller's frame, it
+// returns an error if the calls are nested deeper than 'MaxDepth'.
+func enterCall(line string, scope *Scope, fn *Function, extendedScope *Scope) *Error {
+	frame := &callFrame{fn: fn, depth: 1, line: line}
+	if caller := scope.getCallFrame(); caller != nil {
+		frame.caller, frame.depth = caller, caller.depth+1
+	}
+	extendedScope.call = frame
+
+	if MaxDepth > 0 && frame.depth > MaxDepth { //the chain of the pushed frames
+		return newError(line, ERR_MAXDEPTH, MaxDepth, frame.caller.chain())
+	}
+	return nil
+}
+
+// the names of the functions from the outermost call to this one, the
+// consecutive calls of the same function are shown once with a count,
+// e.g. 'main -> fact (repeated 9999 times)'
+func (f *callFrame) chain() string {
+	var names []string
+	var counts []int
+	for ; f != nil; f = f.caller {
+		name := funcName(f.fn.Literal)
+		if n := len(names); n > 0 && names[n-1] == name {
+			counts[n-1]++
+			continue
+		}
+		names = append(names, name)
+		counts = append(counts, 1)
+	}
+
+	var parts []string
+	for i := len(names) - 1; i >= 0; i-- {
+		if counts[i] > 1 {
+			parts = append(parts, fmt.Sprintf("%s (repeated %d times)", names[i], counts[i]))
+		} else {
+			parts = append(parts, names[i])
+		}
+	}
+	if len(parts) > maxChainNames {
+		half := maxChainNames / 2
+		elided := fmt.Sprintf("... (%d more) ...", len(parts)-2*half)
+		parts = append(append(parts[:half:half], elided), parts[len(parts)-half:]...)
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// traceback returns the calls which led to the position, the outermost
+// first, e.g.
+//
+//	examples/a.mp:20 in <main>
+//	examples/a.mp:12 in outer
+//	examples/a.mp:5 in inner (3 tail calls elided)
+//	[previous frame repeated 99 more times]
+//
+// The consecutive frames of the same function at the same line are shown once.
+func (s *Scope) traceback(pos token.Position) []string {
+	type entry struct {
+		name  string
+		pos   token.Position
+		tails int
+	}
+	var entries []entry
+	for f := s.getCallFrame(); f != nil; f = f.caller {
+		entries = append(entries, entry{funcName(f.fn.Literal), pos, f.tails})
+		pos = parseSline(f.line)
+	}
+	entries = append(entries, entry{"<main>", pos, 0})
+
+	var lines []string
+	repeated := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if i < len(entries)-1 {
+			prev := entries[i+1]
+			if prev.name == e.name && prev.pos.Filename == e.pos.Filename && prev.pos.Line == e.pos.Line && prev.tails == e.tails {
+				repeated++
+				continue
+			}
+		}
+		if repeated > 0 {
+			lines = append(lines, fmt.Sprintf("[previous frame repeated %d more times]", repeated))
+			repeated = 0
+		}
+		line := fmt.Sprintf("line %d in %s", e.pos.Line, e.name)
+		if e.pos.Filename != "" {
+			line = fmt.Sprintf("%s:%d in %s", e.pos.Filename, e.pos.Line, e.name)
+		}
+		if e.tails > 0 {
+			line += fmt.Sprintf(" (%d tail calls elided)", e.tails)
+		}
+		lines = append(lines, line)
+	}
+	if repeated > 0 {
+		lines = append(lines, fmt.Sprintf("[previous frame repeated %d more times]", repeated))
+	}
+	return lines
+}
@@ -0,0 +1,890 @@
+package eval
+
+import (
+	"encoding/binary"
+	"errors"
+	"magpie/ast"
+	"math"
+	"strings"
+)
+
+// Code is the compiled bytecode of a program, a function's body, or another
+// node which runs apart from the code around it(e.g. a struct's block).
+//
+// Every construct of the language is compiled to the instructions, which
+// call the tree-walker's helpers for the objects' semantics, so both give the
+// same results. The local variables which the resolver has laid out are read
+// and written in the call scope's slots, the other variables are looked up
+// by name. The loops, the comprehensions and the catch clauses keep their
+// states on the stack, which are left(e.g. the loop variables are deleted,
+// the iterators are closed) when the code leaves them, also by an error.
+type Code struct {
+	Instructions []byte
+	Nodes        []ast.Node //the nodes which the instructions refer to
+	lines        []string   //the nodes' lines, for the error messages
+	root         ast.Node
+	handlers     []handler
+	maxStack     int
+}
+
+// An error raised by the instructions in [start, end) leaves the stack at
+// 'depth', is pushed as the result, and the execution goes on at 'target'.
+// Without a handler, the error is the code's result.
+type handler struct {
+	start, end int
+	target     int
+	depth      int
+}
+
+var errCodeTooLarge = errors.New("code too large")
+
+type compiler struct {
+	code    *Code
+	nodeIdx map[ast.Node]int
+	depth   int
+}
+
+// an operand of an instruction, which is a jump target to be patched
+type jump struct {
+	pos     int
+	operand int
+}
+
+// Compile compiles the node to bytecode.
+func Compile(node ast.Node) (code *Code, err error) {
+	c := &compiler{code: &Code{root: node}, nodeIdx: make(map[ast.Node]int)}
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errCodeTooLarge {
+				panic(r)
+			}
+			code, err = nil, errCodeTooLarge
+		}
+	}()
+
+	switch node := node.(type) {
+	case *ast.Program:
+		c.compileProgram(node)
+	default:
+		c.compile(node)
+	}
+	return c.code, nil
+}
+
+func (c *compiler) compileProgram(program *ast.Program) {
+	if len(program.Statements) == 0 {
+		c.emit(opNil)
+		return
+	}
+	for i, stmt := range program.Statements {
+		c.compile(stmt)
+		if i == len(program.Statements)-1 {
+			c.emit(opProgStmtEnd, 1)
+		} else {
+			c.emit(opProgStmtEnd, 0)
+		}
+	}
+}
+
+// a block's result is its last statement's result, or the first control
+// object(return, break, error, ...) returned by a statement.
+func (c *compiler) compileBlock(block *ast.BlockStatement) {
+	if len(block.Statements) == 0 {
+		c.emit(opNull)
+		return
+	}
+
+	var ends []int
+	for i, stmt := range block.Statements {
+		c.compile(stmt)
+		if i < len(block.Statements)-1 {
+			ends = append(ends, c.emit(opStmtEnd, 0))
+		}
+	}
+	for _, pos := range ends {
+		c.patchJump(pos)
+	}
+}
+
+// each node leaves exactly one result on the stack
+func (c *compiler) compile(node ast.Node) {
+	switch node := node.(type) {
+	case nil:
+		c.emit(opNull)
+	case *ast.ExpressionStatement:
+		c.compile(node.Expression)
+	case *ast.BlockStatement:
+		c.compileBlock(node)
+	case *ast.NumberLiteral:
+		c.emit(opNumber, c.node(node))
+	case *ast.StringLiteral:
+		if strings.Contains(node.Value, "$") {
+			c.emit(opInterpolate, c.node(node))
+		} else {
+			c.emit(opString, c.node(node))
+		}
+	case *ast.BooleanLiteral:
+		if node.Value {
+			c.emit(opTrue)
+		} else {
+			c.emit(opFalse)
+		}
+	case *ast.NilLiteral:
+		c.emit(opNil)
+	case *ast.Identifier:
+		if _, ok := GetGlobalObj(node.Value); !ok && isSlotLocal(node) {
+			c.emit(opGetLocal, c.node(node))
+		} else {
+			c.emit(opIdent, c.node(node))
+		}
+	case *ast.FunctionLiteral:
+		c.emit(opFunction, c.node(node))
+	case *ast.RegExLiteral:
+		c.emit(opRegex, c.node(node))
+	case *ast.CmdExpression:
+		c.emit(opCmd, c.node(node))
+	case *ast.StructStatement:
+		c.emit(opStruct, c.node(node))
+	case *ast.InterfaceStatement:
+		c.emit(opInterface, c.node(node))
+	case *ast.ImportStatement:
+		c.emit(opImport, c.node(node))
+	case *ast.MacroLiteral:
+		c.emit(opMacro, c.node(node))
+	case *ast.BlockLiteral:
+		c.compileBlock(node.Block)
+		c.emit(opOrNil)
+	case *ast.PrefixExpression:
+		c.compile(node.Right)
+		c.emit(opPrefix, c.node(node))
+	case *ast.InfixExpression:
+		c.compileInfix(node)
+	case *ast.PostfixExpression:
+		c.compile(node.Left)
+		c.emit(opPostfix, c.node(node))
+	case *ast.IndexExpression:
+		c.compile(node.Left)
+		c.compile(node.Index)
+		c.emit(opIndex, c.node(node))
+	case *ast.ArrayLiteral:
+		for _, m := range node.Members {
+			c.compile(m)
+		}
+		c.emit(opArray, c.node(node), len(node.Members))
+	case *ast.TupleLiteral:
+		for _, m := range node.Members {
+			c.compile(m)
+		}
+		c.emit(opTuple, c.node(node), len(node.Members))
+	case *ast.HashLiteral:
+		c.compileHash(node)
+	case *ast.ArrayComprehension:
+		c.compileComprehension(node, node.Clauses, func(slot int, leaves *[]jump) {
+			c.compile(node.Expr)
+			*leaves = append(*leaves, jump{c.emit(opCompPush, c.node(node), slot, 0), 2})
+		})
+	case *ast.TupleComprehension:
+		c.compileComprehension(node, node.Clauses, func(slot int, leaves *[]jump) {
+			c.compile(node.Expr)
+			*leaves = append(*leaves, jump{c.emit(opCompPush, c.node(node), slot, 0), 2})
+		})
+	case *ast.HashComprehension:
+		c.compileComprehension(node, node.Clauses, func(slot int, leaves *[]jump) {
+			c.compile(node.Key)
+			*leaves = append(*leaves, jump{c.emit(opCompKey, c.node(node), 0), 1})
+			c.compile(node.Value)
+			*leaves = append(*leaves, jump{c.emit(opCompPair, c.node(node), slot, 0), 2})
+		})
+	case *ast.CallExpression:
+		c.compileCall(node)
+	case *ast.MethodCallExpression:
+		c.compileMethodCall(node)
+	case *ast.LetStatement:
+		if len(node.Names) == 1 && len(node.Values) == 1 && node.Names[0].Token.Literal != "_" && isSlotLocal(node.Names[0]) {
+			c.compileValue(node.Values[0])
+			c.emit(opLetLocal, c.node(node))
+			return
+		}
+		for _, value := range node.Values {
+			c.compileValue(value)
+		}
+		c.emit(opLet, c.node(node), len(node.Values))
+	case *ast.ReturnStatement:
+		if node.ReturnValue == nil {
+			c.emit(opReturn, c.node(node), 0)
+			return
+		}
+		if node.IsTailCall {
+			c.compileTailCall(node.ReturnValue.(*ast.CallExpression))
+			return
+		}
+		for _, value := range node.ReturnValues {
+			c.compileValue(value)
+		}
+		c.emit(opReturn, c.node(node), len(node.ReturnValues))
+	case *ast.TailCallStatement:
+		c.compileTailCall(node.Call.(*ast.CallExpression))
+	case *ast.AssignExpression:
+		c.compile(node.Value)
+		c.compileAssign(node)
+	case *ast.MultiAssignStatement:
+		c.compileMultiAssign(node)
+	case *ast.ThrowStmt:
+		if node.Expr == nil {
+			c.emit(opRethrow, c.node(node))
+			return
+		}
+		c.compile(node.Expr)
+		c.emit(opThrow, c.node(node))
+	case *ast.IfExpression:
+		c.compileIf(node)
+	case *ast.BreakExpression:
+		c.emit(opBreak, c.node(node))
+	case *ast.ContinueExpression:
+		c.emit(opContinue, c.node(node))
+	case *ast.FallthroughExpression:
+		c.emit(opFallthrough)
+	case *ast.CForLoop, *ast.ForEverLoop, *ast.ForEachArrayLoop, *ast.ForEachMapLoop, *ast.DoLoop, *ast.WhileLoop:
+		c.compileLoop(node)
+	case *ast.TryStmt:
+		c.compileTry(node)
+	case *ast.SwitchExpression:
+		c.compileSwitch(node)
+	case *ast.SelectStatement:
+		c.compileSelect(node)
+	case *ast.DecoratorExpr:
+		base := c.depth
+		var leaves []jump
+		c.compileDecorators(node, &leaves)
+		c.emit(opDecorate, c.node(node))
+		c.patchAll(leaves)
+		c.emit(opLeave, base)
+	case *ast.DeferStmt:
+		c.emit(opCheck, c.node(node))
+		n := c.compileCallee(node.Expr)
+		c.emit(opDefer, c.node(node), n)
+	case *ast.SpawnExpression:
+		n := c.compileCallee(node.Call)
+		c.emit(opSpawn, c.node(node), n)
+	case *ast.AwaitExpression:
+		c.compile(node.Value)
+		c.emit(opAwait, c.node(node))
+	case *ast.YieldExpression:
+		c.emit(opCheck, c.node(node))
+		if node.Value != nil {
+			c.compile(node.Value)
+		} else {
+			c.emit(opNil)
+		}
+		c.emit(opYield, c.node(node))
+	default: //like the tree-walker, an unknown node has no result
+		c.emit(opNull)
+	}
+}
+
+// the identifier is a local variable of the function whose scope runs the
+// code, which is read and written in the scope's slot
+func isSlotLocal(ident *ast.Identifier) bool {
+	return ident.Frames != nil && ident.Depth == 0 && ident.Slot >= 0
+}
+
+// the let/return statements keep the values' errors as values
+func (c *compiler) compileValue(value ast.Expression) {
+	start, depth := len(c.code.Instructions), c.depth
+	c.compile(value)
+	end := len(c.code.Instructions)
+	c.code.handlers = append(c.code.handlers, handler{start: start, end: end, target: end, depth: depth})
+}
+
+func (c *compiler) compileIf(ie *ast.IfExpression) {
+	var ends []int
+	for _, cond := range ie.Conditions {
+		c.compile(cond.Cond)
+		next := c.emit(opJumpIfFalse, c.node(ie), 0)
+		c.compileBlock(cond.Body)
+		ends = append(ends, c.emit(opJump, 0))
+		c.depth-- //the next branch starts without the result
+		c.patchJump(next)
+	}
+
+	if ie.Alternative != nil {
+		c.compileBlock(ie.Alternative)
+	} else {
+		c.emit(opNil)
+	}
+	for _, pos := range ends {
+		c.patchJump(pos)
+	}
+}
+
+// the pipes and 'is' evaluate their operands themselves, the chained
+// comparisons('a < b < c') evaluate 'Next' lazily in the instruction.
+func (c *compiler) compileInfix(node *ast.InfixExpression) {
+	switch node.Operator {
+	case "|>":
+		c.compilePipe(node)
+		c.emit(opCharge, c.node(node))
+	case "is":
+		c.compile(node.Left)
+		end := c.emit(opIsStruct, c.node(node), 0)
+		c.compile(node.Right)
+		c.emit(opIs, c.node(node))
+		c.patchJump(end)
+		c.emit(opCharge, c.node(node))
+	default:
+		c.compile(node.Left)
+		c.compile(node.Right)
+		c.emit(opInfix, c.node(node))
+	}
+}
+
+// 'x |> f(y)' is compiled as 'f(x, y)', 'x |> f' calls the function which
+// 'f' is.
+func (c *compiler) compilePipe(node *ast.InfixExpression) {
+	switch right := node.Right.(type) {
+	case *ast.MethodCallExpression, *ast.CallExpression:
+		if call := pipedCall(node); call != nil {
+			c.compile(call)
+			return
+		}
+		c.emit(opNil)
+		c.emit(opPipeCheck, c.node(node))
+	case *ast.Identifier:
+		c.compile(right)
+		c.emit(opPipeCheck, c.node(node))
+		if node.Left.TokenLiteral() == ALL_ARGS { //the call's arguments are piped
+			c.emit(opNull)
+		} else {
+			c.compile(node.Left)
+		}
+		c.emit(opPipeCall, c.node(node))
+	default:
+		c.emit(opNil)
+	}
+}
+
+func (c *compiler) compileHash(node *ast.HashLiteral) {
+	c.emit(opHash, c.node(node))
+	var ends []jump
+	for _, key := range node.Order {
+		c.compile(key)
+		c.emit(opHashKey, c.node(node))
+		c.compile(node.Pairs[key])
+		ends = append(ends, jump{c.emit(opHashPair, c.node(node), 0), 1})
+	}
+	c.patchAll(ends)
+	c.emit(opCharge, c.node(node))
+}
+
+// the arguments are evaluated first, then a struct's name creates the
+// struct object, or the function is evaluated and called.
+func (c *compiler) compileCall(call *ast.CallExpression) {
+	if isQuoteCall(call) {
+		c.compileQuote(call)
+		return
+	}
+
+	n := 0
+	if !isAllArgsCall(call) { //'f($_)' passes the call's arguments
+		for _, arg := range call.Arguments {
+			c.compile(arg)
+		}
+		n = len(call.Arguments)
+	}
+	if call.Variadic {
+		c.emit(opUnbox, c.node(call), n)
+		n = 1
+	}
+	skip := c.emit(opNewStruct, c.node(call), n, 0)
+	c.compile(call.Function)
+	c.emit(opCall, c.node(call), n)
+	c.patchJump(skip)
+}
+
+// the unquote calls' arguments are evaluated, then replaced with their
+// results' nodes in the quoted expression
+func (c *compiler) compileQuote(call *ast.CallExpression) {
+	if len(call.Arguments) != 1 {
+		c.emit(opQuote, c.node(call), 0)
+		return
+	}
+	unquotes := unquoteCalls(call.Arguments[0])
+	for _, unquote := range unquotes {
+		c.compile(unquote.Arguments[0])
+		c.emit(opUnquote, c.node(unquote))
+	}
+	c.emit(opQuote, c.node(call), len(unquotes))
+}
+
+func (c *compiler) compileMethodCall(call *ast.MethodCallExpression) {
+	switch goMemberOf(call) {
+	case goVar:
+		c.emit(opGoMember, c.node(call))
+		return
+	case goMethod:
+		args := call.Call.(*ast.CallExpression).Arguments
+		for _, arg := range args {
+			c.compile(arg)
+		}
+		c.emit(opGoCall, c.node(call), len(args))
+		return
+	}
+
+	c.compile(call.Object)
+	o, ok := call.Call.(*ast.CallExpression)
+	if !ok {
+		c.emit(opMember, c.node(call))
+		return
+	}
+	c.emit(opMethodCheck, c.node(call))
+	if isAllArgsCall(o) { //a hash's function is passed the call's arguments instead
+		c.compileValue(o.Arguments[0])
+	} else {
+		for _, arg := range o.Arguments {
+			c.compile(arg)
+		}
+	}
+	c.emit(opMethodCall, c.node(call), len(o.Arguments))
+}
+
+// the caller runs the tail call with the evaluated arguments and function,
+// the function is an error if it's a struct's name
+func (c *compiler) compileTailCall(call *ast.CallExpression) {
+	for _, arg := range call.Arguments {
+		c.compile(arg)
+	}
+	c.compileValue(call.Function)
+	c.emit(opTailCall, c.node(call), len(call.Arguments))
+}
+
+// the function(or the method's receiver) and the arguments of the call
+// which 'defer' or 'spawn' runs later, returns the number of the arguments
+func (c *compiler) compileCallee(expr ast.Expression) int {
+	callee, _, call := calleeOf(expr)
+	if call == nil {
+		c.emit(opNull)
+		return 0
+	}
+	c.compile(callee)
+	for _, arg := range call.Arguments {
+		c.compile(arg)
+	}
+	return len(call.Arguments)
+}
+
+// assign the value on the stack
+func (c *compiler) compileAssign(a *ast.AssignExpression) {
+	switch name := a.Name.(type) {
+	case *ast.Identifier:
+		if a.Token.Literal == "=" && isSlotLocal(name) {
+			c.emit(opSetLocal, c.node(a))
+			return
+		}
+	case *ast.MethodCallExpression: //obj.x = val
+		c.compile(name.Object)
+		c.emit(opAssignMember, c.node(a))
+		return
+	case *ast.IndexExpression:
+		if a.Token.Literal != "=" {
+			break
+		}
+		if _, ok := name.Left.(*ast.Identifier); !ok { //getObj()[idx] = val
+			c.compile(name.Left)
+			c.compile(name.Index)
+			c.emit(opSetIndex, c.node(a))
+			return
+		}
+		c.compileValue(name.Index) //arr[idx] = val
+		c.emit(opAssignIndex, c.node(a))
+		return
+	}
+	c.emit(opAssign, c.node(a))
+}
+
+// the names are assigned one by one, their errors are ignored
+func (c *compiler) compileMultiAssign(ma *ast.MultiAssignStatement) {
+	for _, value := range ma.Values {
+		c.compile(value)
+	}
+	values := c.depth - len(ma.Values)
+	c.emit(opMultiValues, c.node(ma), len(ma.Values))
+	for i, name := range ma.Names {
+		if name.TokenLiteral() == "_" {
+			continue
+		}
+		c.emit(opListItem, values, i)
+		start := len(c.code.Instructions)
+		c.compileAssign(&ast.AssignExpression{Token: ma.Token, Name: name})
+		end := len(c.code.Instructions)
+		c.code.handlers = append(c.code.handlers, handler{start: start, end: end, target: end, depth: values + 1})
+		c.emit(opPop)
+	}
+	c.emit(opPop)
+	c.emit(opNil)
+}
+
+// the loop's state is at the stack's 'base', the body's result is passed to
+// LOOP_BODY. At the end the loop's result is pushed, and 'else' runs unless
+// the loop is broken.
+func (c *compiler) compileLoop(node ast.Node) {
+	base := c.depth
+	var exits, breaks, leaves []jump
+	var elseBlock *ast.BlockStatement
+	body := func(block *ast.BlockStatement) {
+		c.compileBlock(block)
+		pos := c.emit(opLoopBody, c.node(node), 0, 0)
+		breaks = append(breaks, jump{pos, 1})
+		leaves = append(leaves, jump{pos, 2})
+	}
+	next := func() {
+		c.compileIter(node)
+		pos := c.emit(opNext, c.node(node), 0, 0)
+		c.reserve(1) //the iterator's error
+		exits = append(exits, jump{pos, 1})
+		leaves = append(leaves, jump{pos, 2})
+	}
+
+	var top int
+	switch n := node.(type) {
+	case *ast.CForLoop:
+		if n.Init != nil {
+			c.compile(n.Init)
+			c.emit(opPop)
+		}
+		c.emit(opLoop, c.node(n))
+		top = len(c.code.Instructions)
+		if n.Cond != nil {
+			c.compile(n.Cond)
+			exits = append(exits, jump{c.emit(opJumpIfFalse, c.node(n), 0), 1})
+		}
+		body(n.Block)
+		if n.Update != nil {
+			c.compile(n.Update)
+			c.emit(opPop)
+		}
+		elseBlock = n.Else
+	case *ast.WhileLoop:
+		c.emit(opLoop, c.node(n))
+		top = len(c.code.Instructions)
+		c.compile(n.Condition)
+		exits = append(exits, jump{c.emit(opJumpIfFalse, c.node(n), 0), 1})
+		body(n.Block)
+		elseBlock = n.Else
+	case *ast.DoLoop: //it's left by 'break' only, so 'else' never runs
+		c.emit(opLoop, c.node(n))
+		top = len(c.code.Instructions)
+		body(n.Block)
+	case *ast.ForEverLoop:
+		c.emit(opLoop, c.node(n))
+		top = len(c.code.Instructions)
+		body(n.Block)
+	case *ast.ForEachArrayLoop:
+		next()
+		top = exits[0].pos
+		body(n.Block)
+		elseBlock = n.Else
+	case *ast.ForEachMapLoop:
+		next()
+		top = exits[0].pos
+		body(n.Block)
+		elseBlock = n.Else
+	}
+	c.emit(opJump, top)
+
+	c.depth = base + 1
+	c.patchAll(exits)
+	if elseBlock != nil {
+		c.emit(opLoopResult, c.node(node))
+		c.compileBlock(elseBlock)
+		c.emit(opLoopElse, c.node(node))
+		end := c.emit(opJump, 0)
+		c.depth = base + 1
+		c.patchAll(breaks)
+		c.emit(opLoopResult, c.node(node))
+		c.patchJump(end)
+	} else {
+		c.patchAll(breaks)
+		c.emit(opLoopResult, c.node(node))
+	}
+	c.patchAll(leaves)
+	c.emit(opLeave, base)
+}
+
+// push the state of the for-each loop(or the comprehension's clause) which
+// iterates the value, a range 'start..end' is iterated without the array.
+func (c *compiler) compileIter(node ast.Node) {
+	expr := iterableOf(node)
+	if ie, ok := rangeOf(expr); ok {
+		c.compile(ie.Left)
+		c.compile(ie.Right)
+		c.emit(opRangeIter, c.node(node))
+		return
+	}
+	c.compile(expr)
+	c.emit(opIter, c.node(node))
+}
+
+// the comprehension's clauses are the nested loops in its own scope, 'emit'
+// adds the values of the innermost loop to the collection in the stack's
+// slot. The failures(a throw) jump to the leaves.
+func (c *compiler) compileComprehension(node ast.Node, clauses []*ast.ComprehensionClause, emit func(slot int, leaves *[]jump)) {
+	base := c.depth
+	c.emit(opNewScope)
+	c.emit(opComp, c.node(node))
+	var leaves []jump
+	c.compileClauses(clauses, func() { emit(base+1, &leaves) }, &leaves)
+	c.patchAll(leaves)
+	c.emit(opLeave, base)
+	c.emit(opCharge, c.node(node))
+}
+
+func (c *compiler) compileClauses(clauses []*ast.ComprehensionClause, emit func(), leaves *[]jump) {
+	clause := clauses[0]
+	c.compileIter(clause)
+	top := c.emit(opNext, c.node(clause), 0, 0)
+	c.reserve(1) //the iterator's error
+	*leaves = append(*leaves, jump{top, 2})
+	for _, cond := range clause.Conds {
+		c.compile(cond)
+		*leaves = append(*leaves, jump{c.emit(opCompCond, c.node(clause), top, 0), 2})
+	}
+	if len(clauses) > 1 {
+		c.compileClauses(clauses[1:], emit, leaves)
+	} else {
+		emit()
+	}
+	c.emit(opJump, top)
+	c.patchOperand(top, 1)
+	c.emit(opDrop)
+}
+
+// the try block's error(or throw) is caught by the first catch clause which
+// catches it. Without a clause, or if the clause fails, 'finally' runs with
+// the failure, which is the statement's result then.
+func (c *compiler) compileTry(ts *ast.TryStmt) {
+	base := c.depth
+	start := len(c.code.Instructions)
+	c.compileBlock(ts.Try)
+	end := len(c.code.Instructions)
+	c.code.handlers = append(c.code.handlers, handler{start: start, end: end, target: end, depth: base})
+
+	c.emit(opCatch, c.node(ts))
+	table := len(c.code.Instructions)
+	for i := 0; i <= len(ts.Catches); i++ { //the jumps to the clauses, the first one is no clause's
+		c.emit(opJump, 0)
+	}
+	var ends []int
+	start = len(c.code.Instructions)
+	for i, clause := range ts.Catches {
+		c.depth = base + 1 //the clause's state
+		c.patchJump(table + 3*(i+1))
+		c.compileBlock(clause.Block)
+		c.emit(opCatchEnd)
+		ends = append(ends, c.emit(opJump, 0))
+	}
+	end = len(c.code.Instructions)
+	if len(ts.Catches) > 0 {
+		c.code.handlers = append(c.code.handlers, handler{start: start, end: end, target: end, depth: base})
+	}
+	c.patchJump(table)
+	for _, pos := range ends {
+		c.patchJump(pos)
+	}
+
+	c.depth = base + 1
+	if ts.Finally == nil {
+		c.emit(opTryEnd, c.node(ts))
+		return
+	}
+	c.emit(opFinally, c.node(ts))
+	c.compileBlock(ts.Finally)
+	c.emit(opFinallyEnd, c.node(ts))
+}
+
+// the cases' values are evaluated until one matches, the default block runs
+// if none does. 'fallthrough' runs the next case's block.
+func (c *compiler) compileSwitch(se *ast.SwitchExpression) {
+	base := c.depth
+	c.compile(se.Expr)
+	ends := []jump{{c.emit(opSwitch, c.node(se), 0), 1}}
+	bodies := make([][]jump, len(se.Cases))
+	var defaultBlock *ast.BlockStatement
+	for i, choice := range se.Cases {
+		if choice.Default {
+			defaultBlock = choice.Block
+			continue
+		}
+		for _, expr := range choice.Exprs {
+			c.compile(expr)
+			pos := c.emit(opCase, c.node(se), 0, 0)
+			bodies[i] = append(bodies[i], jump{pos, 1})
+			ends = append(ends, jump{pos, 2})
+		}
+	}
+	c.emit(opPop) //no case matches
+	if defaultBlock != nil {
+		c.compileBlock(defaultBlock)
+	} else {
+		c.emit(opNil)
+	}
+	ends = append(ends, jump{c.emit(opJump, 0), 0})
+
+	var through []jump
+	for i, choice := range se.Cases {
+		if choice.Default {
+			continue
+		}
+		c.depth = base
+		c.patchAll(through)
+		c.patchAll(bodies[i])
+		c.compileBlock(choice.Block)
+		pos := c.emit(opCaseEnd, c.node(se), 0, 0)
+		through = []jump{{pos, 1}}
+		ends = append(ends, jump{pos, 2})
+	}
+	c.depth = base
+	c.patchAll(through)
+	c.emit(opNil)
+	c.patchAll(ends)
+}
+
+// the cases' channels(and the values to send) are evaluated in order, then
+// the chosen case's received values are assigned, and its block runs.
+func (c *compiler) compileSelect(ss *ast.SelectStatement) {
+	n := 0
+	for _, sc := range ss.Cases {
+		switch comm := sc.Comm.(type) {
+		case *ast.PrefixExpression: //<-ch
+			c.compile(comm.Right)
+			c.emit(opSelectChan, c.node(comm.Right))
+			n++
+		case *ast.InfixExpression: //ch <- value
+			c.compile(comm.Left)
+			c.emit(opSelectChan, c.node(comm.Left))
+			c.compile(comm.Right)
+			n += 2
+		}
+	}
+	values := c.depth - n
+	ends := []jump{{c.emit(opSelect, c.node(ss), n, 0), 2}}
+	table := len(c.code.Instructions)
+	for range ss.Cases {
+		c.emit(opJump, 0)
+	}
+	for i, sc := range ss.Cases {
+		c.depth = values + 1
+		c.patchJump(table + 3*i)
+		for j, name := range sc.Names { //v, ok = <-ch
+			if name.TokenLiteral() == "_" {
+				continue
+			}
+			c.emit(opListItem, values, j)
+			c.compileAssign(&ast.AssignExpression{Token: sc.AssignToken, Name: name})
+			c.emit(opPop)
+		}
+		c.emit(opPop)
+		c.compileBlock(sc.Block)
+		ends = append(ends, jump{c.emit(opJump, 0), 0})
+	}
+	c.depth = values + 1
+	c.patchAll(ends)
+}
+
+// the decorators are applied from the innermost one, a throw jumps to the
+// leaves
+func (c *compiler) compileDecorators(node *ast.DecoratorExpr, leaves *[]jump) {
+	c.compile(node.Decorator)
+	c.emit(opDecorator, c.node(node))
+	if d, ok := node.Decorated.(*ast.DecoratorExpr); ok {
+		c.compileDecorators(d, leaves)
+	} else {
+		c.emit(opDecorated, c.node(node))
+	}
+	*leaves = append(*leaves, jump{c.emit(opApplyDecorator, c.node(node), 0), 1})
+}
+
+func (c *compiler) node(node ast.Node) int {
+	if idx, ok := c.nodeIdx[node]; ok {
+		return idx
+	}
+	c.code.Nodes = append(c.code.Nodes, node)
+	c.code.lines = append(c.code.lines, node.Pos().Sline())
+	c.nodeIdx[node] = len(c.code.Nodes) - 1
+	return len(c.code.Nodes) - 1
+}
+
+// emit the instruction, returns its position
+func (c *compiler) emit(op Opcode, operands ...int) int {
+	pos := len(c.code.Instructions)
+	c.code.Instructions = append(c.code.Instructions, byte(op))
+	for _, operand := range operands {
+		if operand > math.MaxUint16 {
+			panic(errCodeTooLarge)
+		}
+		c.code.Instructions = append(c.code.Instructions, 0, 0)
+		binary.BigEndian.PutUint16(c.code.Instructions[len(c.code.Instructions)-2:], uint16(operand))
+	}
+
+	if op == opLeave { //the states are popped, the result is kept
+		c.depth = operands[0] + 1
+	} else {
+		c.depth += stackEffect(op, operands)
+	}
+	if c.depth > c.code.maxStack {
+		c.code.maxStack = c.depth
+	}
+	return pos
+}
+
+// set the jump target of the instruction at pos to the current position
+func (c *compiler) patchJump(pos int) {
+	c.patchOperand(pos, opDefs[c.code.Instructions[pos]].operands-1)
+}
+
+// set the instruction's operand, which is a jump target, to the current position
+func (c *compiler) patchOperand(pos, operand int) {
+	target := len(c.code.Instructions)
+	if target > math.MaxUint16 {
+		panic(errCodeTooLarge)
+	}
+	binary.BigEndian.PutUint16(c.code.Instructions[pos+1+2*operand:], uint16(target))
+}
+
+func (c *compiler) patchAll(jumps []jump) {
+	for _, j := range jumps {
+		c.patchOperand(j.pos, j.operand)
+	}
+}
+
+// the instruction pushes n more objects when it jumps
+func (c *compiler) reserve(n int) {
+	if c.depth+n > c.code.maxStack {
+		c.code.maxStack = c.depth + n
+	}
+}
+
+// the stack's depth after the instruction, when it doesn't jump
+func stackEffect(op Opcode, operands []int) int {
+	switch op {
+	case opNull, opNil, opTrue, opFalse, opNumber, opString, opInterpolate, opIdent, opGetLocal,
+		opFunction, opRegex, opCmd, opStruct, opInterface, opImport, opMacro, opHash, opGoMember,
+		opRethrow, opBreak, opContinue, opFallthrough, opLoop, opNewScope, opComp, opListItem,
+		opMethodCheck, opDecorated, opLoopResult:
+		return 1
+	case opInfix, opIndex, opPop, opJumpIfFalse, opStmtEnd, opAssignIndex, opAssignMember,
+		opPipeCall, opIs, opRangeIter, opDrop, opLoopBody, opLoopElse, opCompCond, opCompPush,
+		opCatchEnd, opFinallyEnd, opCase, opApplyDecorator:
+		return -1
+	case opSetIndex, opHashPair, opCompPair:
+		return -2
+	case opProgStmtEnd:
+		return -1 + operands[0]
+	case opArray, opTuple, opUnbox, opGoCall, opLet, opReturn, opMultiValues, opSelect, opQuote:
+		return 1 - operands[1]
+	case opCall, opTailCall, opDefer, opSpawn:
+		return -operands[1]
+	case opMethodCall:
+		return -1 - operands[1]
+	}
+	return 0
+}
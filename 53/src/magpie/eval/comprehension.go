@@ -0,0 +1,119 @@
+package eval
+
+import (
+	"magpie/ast"
+)
+
+//[x * 2 for x in xs if x > 0]
+func evalArrayComprehension(ac *ast.ArrayComprehension, scope *Scope) Object {
+	arr := &Array{Members: []Object{}}
+	errObj := evalComprehensionClauses(ac.Clauses, NewScope(scope, nil), func(s *Scope) Object {
+		value := Eval(ac.Expr, s)
+		if isIterError(value) {
+			return value
+		}
+		arr.Members = append(arr.Members, value)
+		return nil
+	})
+	if errObj != nil {
+		return errObj
+	}
+	return arr
+}
+
+//(x * 2 for x in xs if x > 0)
+func evalTupleComprehension(tc *ast.TupleComprehension, scope *Scope) Object {
+	tuple := &Tuple{Members: []Object{}}
+	errObj := evalComprehensionClauses(tc.Clauses, NewScope(scope, nil), func(s *Scope) Object {
+		value := Eval(tc.Expr, s)
+		if isIterError(value) {
+			return value
+		}
+		tuple.Members = append(tuple.Members, value)
+		return nil
+	})
+	if errObj != nil {
+		return errObj
+	}
+	return tuple
+}
+
+//{k: v for k, v in h if v > 0}
+func evalHashComprehension(hc *ast.HashComprehension, scope *Scope) Object {
+	hash := NewHash()
+	errObj := evalComprehensionClauses(hc.Clauses, NewScope(scope, nil), func(s *Scope) Object {
+		key := Eval(hc.Key, s)
+		if isIterError(key) {
+			return key
+		}
+		value := Eval(hc.Value, s)
+		if isIterError(value) {
+			return value
+		}
+		if r := hash.push(hc.Key.Pos().Sline(), s, key, value); failed(r) {
+			return r
+		}
+		return nil
+	})
+	if errObj != nil {
+		return errObj
+	}
+	return hash
+}
+
+// evaluate the comprehension's 'for' clauses recursively, calls 'emit' for each
+// combination of the loop variables which satisfies all the 'if' conditions.
+// 'scope' is the comprehension's own scope, so the loop variables do not leak.
+// returns nil if no errors.
+func evalComprehensionClauses(clauses []*ast.ComprehensionClause, scope *Scope, emit func(*Scope) Object) Object {
+	clause := clauses[0]
+	it, errObj := evalIterator(clause.Iterable, scope)
+	if errObj != nil {
+		return errObj
+	}
+	defer closeIterator(it)
+
+outer:
+	for idx := 0; ; idx++ {
+		item, ok := it.Next()
+		if !ok {
+			break
+		}
+		if isIterError(item) {
+			return item
+		}
+
+		if len(clause.Names) == 1 {
+			scope.Set(clause.Names[0].Value, item)
+		} else { //for k, v in hash, or for index, value in others
+			key, value := keyValueOf(it, idx, item, clause.Iterable.Pos().Sline(), scope)
+			if failed(value) {
+				return value
+			}
+			scope.Set(clause.Names[0].Value, key)
+			scope.Set(clause.Names[1].Value, value)
+		}
+
+		for _, cond := range clause.Conds {
+			c := Eval(cond, scope)
+			if isIterError(c) {
+				return c
+			}
+			if !IsTrue(c) {
+				continue outer
+			}
+		}
+
+		var r Object
+		if len(clauses) > 1 {
+			r = evalComprehensionClauses(clauses[1:], scope, emit)
+		} else {
+			r = emit(scope)
+		}
+		if r != nil {
+			return r
+		}
+	}
+
+	return nil
+}
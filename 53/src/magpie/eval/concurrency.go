@@ -0,0 +1,437 @@
+package eval
+
+import (
+	"fmt"
+	"magpie/ast"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Task is returned by 'spawn f(x)', the call runs in its own goroutine.
+type Task struct {
+	name   string
+	done   chan struct{} //closed when the call returns
+	result Object
+}
+
+// The function value(or the method's receiver) and the arguments are
+// evaluated by the spawner, the call has its own call stack.
+func evalSpawnExpression(se *ast.SpawnExpression, scope *Scope) Object {
+	fn, method, args, errObj := evalCallee(se.Call, scope)
+	if errObj != nil {
+		return errObj
+	}
+	return spawnCall(se, fn, method, args, scope)
+}
+
+// run the evaluated call in a new task
+func spawnCall(se *ast.SpawnExpression, fn Object, method string, args []Object, scope *Scope) Object {
+	threaded.Store(true)
+	line := se.Pos().Sline()
+	callScope := scope.detached()
+
+	t := &Task{name: method, done: make(chan struct{})}
+	if f, ok := fn.(*Function); ok && method == "" {
+		t.name = f.Literal.Name
+	}
+	go func() {
+		defer close(t.done)
+		defer func() {
+			if r := recover(); r != nil {
+				t.result = panicToError(r, se)
+			}
+		}()
+		if method != "" {
+			t.result = fn.CallMethod(line, callScope, method, args...)
+		} else {
+			t.result = applyFunction(line, callScope, fn, args)
+		}
+	}()
+	return t
+}
+
+func (t *Task) Inspect() string {
+	if t.name == "" {
+		return "<task>"
+	}
+	return "<task " + t.name + ">"
+}
+
+func (t *Task) Type() ObjectType { return TASK_OBJ }
+func (t *Task) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	switch method {
+	case "wait": //the call's result, its error or throw is raised in the waiter
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		if errObj := scope.block(line, t.done); errObj != nil {
+			return errObj
+		}
+		return t.result
+	case "done":
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		select {
+		case <-t.done:
+			return TRUE
+		default:
+			return FALSE
+		}
+	}
+	return newError(line, ERR_NOMETHOD, method, t.Type())
+}
+
+// Channel is created by 'chan(n)', it's unbuffered if 'n' is 0.
+type Channel struct {
+	ch     chan Object
+	closed atomic.Bool
+}
+
+func (c *Channel) iter() bool { return true }
+
+func (c *Channel) Inspect() string  { return fmt.Sprintf("<channel %d/%d>", len(c.ch), cap(c.ch)) }
+func (c *Channel) Type() ObjectType { return CHANNEL_OBJ }
+func (c *Channel) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	switch method {
+	case "send":
+		if len(args) != 1 {
+			return newError(line, ERR_ARGUMENT, 1, len(args))
+		}
+		return c.send(line, scope, args[0])
+	case "recv": //returns (value, ok), 'ok' is false if the channel is closed and drained
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		v, ok, errObj := c.recv(line, scope)
+		if errObj != nil {
+			return errObj
+		}
+		return &Tuple{Members: []Object{v, nativeBoolToBooleanObject(ok)}, IsMulti: true}
+	case "close":
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		return c.close(line)
+	case "len":
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		return NewNumber(float64(len(c.ch)))
+	case "cap":
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		return NewNumber(float64(cap(c.ch)))
+	}
+	return newError(line, ERR_NOMETHOD, method, c.Type())
+}
+
+func (c *Channel) send(line string, scope *Scope, v Object) (result Object) {
+	if c.closed.Load() {
+		return newError(line, ERR_CHANCLOSED, "send")
+	}
+	defer func() { //closed while the sender is blocked
+		if r := recover(); r != nil {
+			result = newError(line, ERR_CHANCLOSED, "send")
+		}
+	}()
+
+	select {
+	case c.ch <- v:
+		return NIL
+	case <-scope.canceled():
+		return scope.sandbox.checkContext(line)
+	}
+}
+
+// 'ok' is false if the channel is closed and drained, the value is nil then.
+func (c *Channel) recv(line string, scope *Scope) (Object, bool, *Error) {
+	select {
+	case v, ok := <-c.ch:
+		if !ok {
+			return NIL, false, nil
+		}
+		return v, true, nil
+	case <-scope.canceled():
+		return nil, false, scope.sandbox.checkContext(line)
+	}
+}
+
+func (c *Channel) close(line string) Object {
+	if !c.closed.CompareAndSwap(false, true) {
+		return newError(line, ERR_CHANCLOSED, "close")
+	}
+	close(c.ch)
+	return NIL
+}
+
+// ch <- value
+func evalSendExpression(node *ast.InfixExpression, left, right Object, scope *Scope) Object {
+	c, ok := left.(*Channel)
+	if !ok {
+		return newError(node.Pos().Sline(), ERR_NOTCHANNEL, node.Operator, left.Type())
+	}
+	return c.send(node.Pos().Sline(), scope, right)
+}
+
+// <-ch, the value is nil if the channel is closed
+func evalRecvExpression(node *ast.PrefixExpression, right Object, scope *Scope) Object {
+	c, ok := right.(*Channel)
+	if !ok {
+		return newError(node.Pos().Sline(), ERR_NOTCHANNEL, node.Operator, right.Type())
+	}
+	v, _, errObj := c.recv(node.Pos().Sline(), scope)
+	if errObj != nil {
+		return errObj
+	}
+	return v
+}
+
+// The channels and the sent values of all the cases are evaluated in order,
+// then one of the ready cases is chosen randomly, or the default case if
+// none is ready. The case of a nil channel is never ready. The block's
+// result(e.g. 'break' or 'return') is the statement's result.
+func evalSelectStatement(ss *ast.SelectStatement, scope *Scope) Object {
+	var operands []Object //the channels, and the values to send
+	for _, sc := range ss.Cases {
+		switch comm := sc.Comm.(type) {
+		case *ast.PrefixExpression: //<-ch
+			ch := Eval(comm.Right, scope)
+			if _, errObj := selectChannel(comm.Right, ch); errObj != nil {
+				return errObj
+			}
+			operands = append(operands, ch)
+		case *ast.InfixExpression: //ch <- value
+			ch := Eval(comm.Left, scope)
+			if _, errObj := selectChannel(comm.Left, ch); errObj != nil {
+				return errObj
+			}
+			v := Eval(comm.Right, scope)
+			if isError(v) {
+				return v
+			}
+			operands = append(operands, ch, v)
+		}
+	}
+
+	chosen, values, errObj := selectOn(ss, operands, scope)
+	if errObj != nil {
+		return errObj
+	}
+	if chosen == len(ss.Cases) {
+		return selectCanceled(ss, scope)
+	}
+
+	sc := ss.Cases[chosen]
+	for i, name := range sc.Names { //v, ok = <-ch
+		if name.TokenLiteral() == "_" {
+			continue
+		}
+		a := &ast.AssignExpression{Token: sc.AssignToken, Name: name}
+		if r := _evalAssignExpression(a, values[i], scope); isError(r) {
+			return r
+		}
+	}
+	return Eval(sc.Block, scope)
+}
+
+// wait until one of the cases could proceed, 'operands' are the evaluated
+// channels of the cases(and the values to send). 'chosen' is the chosen
+// case's index, or len(ss.Cases) if the execution is canceled, 'values' are
+// the received value and whether it's received before the channel is closed.
+func selectOn(ss *ast.SelectStatement, operands []Object, scope *Scope) (chosen int, values []Object, errObj Object) {
+	line := ss.Pos().Sline()
+	cases := make([]reflect.SelectCase, 0, len(ss.Cases)+1)
+	for _, sc := range ss.Cases {
+		if sc.Default {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+			continue
+		}
+
+		switch comm := sc.Comm.(type) {
+		case *ast.PrefixExpression:
+			ch, _ := selectChannel(comm.Right, operands[0])
+			operands = operands[1:]
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: ch})
+		case *ast.InfixExpression:
+			ch, _ := selectChannel(comm.Left, operands[0])
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: ch, Send: reflect.ValueOf(operands[1])})
+			operands = operands[2:]
+		}
+	}
+	if done := scope.canceled(); done != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+	}
+
+	chosen, value, ok, errObj := selectCases(line, cases)
+	if errObj != nil || chosen == len(ss.Cases) {
+		return chosen, nil, errObj
+	}
+	var v Object = NIL
+	if ok {
+		v = value.Interface().(Object)
+	}
+	return chosen, []Object{v, nativeBoolToBooleanObject(ok)}, nil
+}
+
+// the result of the select statement which is canceled
+func selectCanceled(ss *ast.SelectStatement, scope *Scope) Object {
+	if errObj := scope.sandbox.checkContext(ss.Pos().Sline()); errObj != nil {
+		return errObj
+	}
+	return NIL
+}
+
+func selectCases(line string, cases []reflect.SelectCase) (chosen int, value reflect.Value, ok bool, errObj Object) {
+	defer func() { //a channel of the sending case is closed
+		if r := recover(); r != nil {
+			errObj = newError(line, ERR_CHANCLOSED, "send")
+		}
+	}()
+	chosen, value, ok = reflect.Select(cases)
+	return chosen, value, ok, nil
+}
+
+// the channel of a select case, the zero value for nil
+func selectChannel(expr ast.Expression, obj Object) (reflect.Value, Object) {
+	switch o := obj.(type) {
+	case *Channel:
+		return reflect.ValueOf(o.ch), nil
+	case *Nil:
+		return reflect.Value{}, nil
+	case *Error:
+		return reflect.Value{}, o
+	}
+	return reflect.Value{}, newError(expr.Pos().Sline(), ERR_NOTCHANNEL, "select", obj.Type())
+}
+
+// Mutex is created by 'Mutex()'. Unlike go's, unlocking an unlocked mutex is
+// an error which could be caught.
+type Mutex struct {
+	sem chan struct{} //holds a value while it's locked
+}
+
+func (m *Mutex) Inspect() string  { return "<mutex>" }
+func (m *Mutex) Type() ObjectType { return MUTEX_OBJ }
+func (m *Mutex) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	if len(args) != 0 {
+		return newError(line, ERR_ARGUMENT, 0, len(args))
+	}
+	switch method {
+	case "lock":
+		select {
+		case m.sem <- struct{}{}:
+			return NIL
+		case <-scope.canceled():
+			return scope.sandbox.checkContext(line)
+		}
+	case "tryLock":
+		select {
+		case m.sem <- struct{}{}:
+			return TRUE
+		default:
+			return FALSE
+		}
+	case "unlock":
+		select {
+		case <-m.sem:
+			return NIL
+		default:
+			return newError(line, ERR_UNLOCK)
+		}
+	}
+	return newError(line, ERR_NOMETHOD, method, m.Type())
+}
+
+// WaitGroup is created by 'WaitGroup()', it waits for a number of tasks.
+type WaitGroup struct {
+	mu    sync.Mutex
+	count int
+	zero  chan struct{} //closed when the counter drops to zero
+}
+
+func (wg *WaitGroup) Inspect() string  { return "<waitgroup>" }
+func (wg *WaitGroup) Type() ObjectType { return WAITGROUP_OBJ }
+func (wg *WaitGroup) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	switch method {
+	case "add": //add(n=1)
+		if len(args) > 1 {
+			return newError(line, ERR_ARGUMENT, 1, len(args))
+		}
+		n := 1
+		if len(args) == 1 {
+			num, ok := args[0].(*Number)
+			if !ok {
+				return newError(line, ERR_PARAMTYPE, "first", "add", "*Number", args[0].Type())
+			}
+			n = int(num.Value)
+		}
+		return wg.add(line, n)
+	case "done":
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		return wg.add(line, -1)
+	case "wait":
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		wg.mu.Lock()
+		zero := wg.zero
+		wg.mu.Unlock()
+		if zero == nil {
+			return NIL
+		}
+		if errObj := scope.block(line, zero); errObj != nil {
+			return errObj
+		}
+		return NIL
+	}
+	return newError(line, ERR_NOMETHOD, method, wg.Type())
+}
+
+func (wg *WaitGroup) add(line string, n int) Object {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	if wg.count+n < 0 {
+		return newError(line, ERR_WAITGROUP)
+	}
+	if wg.count == 0 && n > 0 {
+		wg.zero = make(chan struct{})
+	}
+	wg.count += n
+	if wg.count == 0 && wg.zero != nil {
+		close(wg.zero)
+		wg.zero = nil
+	}
+	return NIL
+}
+
+// detached returns a new top level scope of the same execution, for the
+// calls which do not run in their caller's call stack.
+func (s *Scope) detached() *Scope {
+	scope := NewScope(nil, s.Writer)
+	scope.sandbox = s.sandbox
+	return scope
+}
+
+// canceled returns the channel which is closed when the execution is
+// canceled or timed out, nil if it has no context.
+func (s *Scope) canceled() <-chan struct{} {
+	if s == nil || s.sandbox == nil || s.sandbox.opts.Context == nil {
+		return nil
+	}
+	return s.sandbox.opts.Context.Done()
+}
+
+// block until the channel is closed, or the execution is canceled
+func (s *Scope) block(line string, ch <-chan struct{}) *Error {
+	select {
+	case <-ch:
+		return nil
+	case <-s.canceled():
+		return s.sandbox.checkContext(line)
+	}
+}
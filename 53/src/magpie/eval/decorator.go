@@ -0,0 +1,232 @@
+package eval
+
+import (
+	"fmt"
+	"magpie/ast"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the constructors of the decorated structs, 'StructName(args)' calls the
+// decorators' result instead of creating the struct object directly.
+var structConstructors = map[*ast.StructStatement]Object{}
+var constructorsMu sync.RWMutex //guards structConstructors
+
+func setStructConstructor(structStmt *ast.StructStatement, ctor Object) {
+	constructorsMu.Lock()
+	defer constructorsMu.Unlock()
+	structConstructors[structStmt] = ctor
+}
+
+func getStructConstructor(structStmt *ast.StructStatement) (Object, bool) {
+	constructorsMu.RLock()
+	defer constructorsMu.RUnlock()
+	ctor, ok := structConstructors[structStmt]
+	return ctor, ok
+}
+
+// the struct's constructor which is passed to the struct's decorators, the
+// struct objects are created in the scope of the struct's declaration.
+func structConstructor(structStmt *ast.StructStatement, scope *Scope) *Builtin {
+	return &Builtin{
+		name: structStmt.Name,
+		Fn: func(line string, _ *Scope, args ...Object) Object {
+			return newStructObj(line, structStmt, scope, args)
+		},
+	}
+}
+
+// get the decorated struct, e.g. '@dec1 @dec2 struct Name {}'
+func decoratedStruct(node *ast.DecoratorExpr) (*ast.StructStatement, bool) {
+	switch d := node.Decorated.(type) {
+	case *ast.StructStatement:
+		return d, true
+	case *ast.DecoratorExpr:
+		return decoratedStruct(d)
+	}
+	return nil, false
+}
+
+// the name of the function used in the builtin decorators' messages
+func callableName(fn Object) string {
+	switch fn := fn.(type) {
+	case *Function:
+		return funcName(fn.Literal)
+	case *GoFuncObject:
+		return fn.name
+	case *Builtin:
+		if fn.name != "" {
+			return fn.name
+		}
+	case *Struct:
+		return fn.Stmt.Name
+	}
+	return fn.Inspect()
+}
+
+// the function which the builtin decorator is applied to
+func decoratedArg(line string, name string, args []Object) (Object, Object) {
+	if len(args) != 1 {
+		return nil, newError(line, ERR_ARGUMENT, 1, len(args))
+	}
+	switch args[0].(type) {
+	case *Function, *Builtin, *GoFuncObject, *BoundMethod, *Struct:
+		return args[0], nil
+	}
+	return nil, newError(line, ERR_PARAMTYPE, "first", name, "*Function", args[0].Type())
+}
+
+// the call's failure, an error or a thrown value
+func failed(r Object) bool {
+	return isError(r) || r.Type() == THROW_OBJ
+}
+
+// @memoize caches the results by the arguments, the calls with unhashable
+// arguments and the failed calls are not cached.
+func memoizeBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			fn, errObj := decoratedArg(line, "memoize", args)
+			if errObj != nil {
+				return errObj
+			}
+
+			var mu sync.Mutex
+			cache := NewHash() //key: the arguments' tuple
+			return &Builtin{
+				name: callableName(fn),
+				Fn: func(line string, scope *Scope, args ...Object) Object {
+					key := &Tuple{Members: args}
+					if _, ok := hashable(key); !ok {
+						return applyFunction(line, scope, fn, args)
+					}
+					mu.Lock()
+					pair, ok, errObj := cache.lookup(line, scope, key)
+					mu.Unlock()
+					if errObj != nil {
+						return errObj
+					}
+					if ok {
+						return pair.Value
+					}
+
+					r := applyFunction(line, scope, fn, args)
+					if !failed(r) {
+						mu.Lock()
+						cache.push(line, scope, key, r)
+						mu.Unlock()
+					}
+					return r
+				},
+			}
+		},
+	}
+}
+
+// @trace prints the calls' arguments and results
+func traceBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			fn, errObj := decoratedArg(line, "trace", args)
+			if errObj != nil {
+				return errObj
+			}
+
+			name := callableName(fn)
+			return &Builtin{
+				name: name,
+				Fn: func(line string, scope *Scope, args ...Object) Object {
+					members := []string{}
+					for _, arg := range args {
+						if arg.Type() == STRING_OBJ {
+							members = append(members, "\""+arg.Inspect()+"\"")
+						} else {
+							members = append(members, arg.Inspect())
+						}
+					}
+					call := name + "(" + strings.Join(members, ", ") + ")"
+
+					r := applyFunction(line, scope, fn, args)
+					switch {
+					case isError(r):
+						fmt.Fprintf(scope.Writer, "trace: %s failed: %s\n", call, r.(*Error).text)
+					case r.Type() == THROW_OBJ:
+						fmt.Fprintf(scope.Writer, "trace: %s threw %s\n", call, r.Inspect())
+					default:
+						fmt.Fprintf(scope.Writer, "trace: %s => %s\n", call, r.Inspect())
+					}
+					return r
+				},
+			}
+		},
+	}
+}
+
+// @timeit prints the time which every call takes
+func timeitBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			fn, errObj := decoratedArg(line, "timeit", args)
+			if errObj != nil {
+				return errObj
+			}
+
+			name := callableName(fn)
+			return &Builtin{
+				name: name,
+				Fn: func(line string, scope *Scope, args ...Object) Object {
+					start := time.Now()
+					r := applyFunction(line, scope, fn, args)
+					fmt.Fprintf(scope.Writer, "timeit: %s took %v\n", name, time.Since(start))
+					return r
+				},
+			}
+		},
+	}
+}
+
+// @deprecated, or @deprecated(msg), warns at the first call of the function
+func deprecatedBuiltin() *Builtin {
+	return &Builtin{
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			if len(args) == 1 {
+				if msg, ok := args[0].(*String); ok { //a decorator factory
+					return &Builtin{
+						Fn: func(line string, scope *Scope, args ...Object) Object {
+							fn, errObj := decoratedArg(line, "deprecated", args)
+							if errObj != nil {
+								return errObj
+							}
+							return deprecate(fn, msg.String)
+						},
+					}
+				}
+			}
+
+			fn, errObj := decoratedArg(line, "deprecated", args)
+			if errObj != nil {
+				return errObj
+			}
+			return deprecate(fn, "")
+		},
+	}
+}
+
+func deprecate(fn Object, msg string) *Builtin {
+	name := callableName(fn)
+	var once sync.Once
+	return &Builtin{
+		name: name,
+		Fn: func(line string, scope *Scope, args ...Object) Object {
+			once.Do(func() {
+				warning := fmt.Sprintf("Warning at %s: '%s' is deprecated", strings.TrimSpace(line), name)
+				if msg != "" {
+					warning += ": " + msg
+				}
+				fmt.Fprintln(scope.Writer, warning)
+			})
+			return applyFunction(line, scope, fn, args)
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package eval
+
+import (
+	"magpie/ast"
+)
+
+// a deferred call. Same as go, the function value(or the method's receiver)
+// and the arguments are evaluated when the 'defer' statement executes.
+// Other kinds of expressions are evaluated when the function returns.
+type deferredCall struct {
+	stmt   *ast.DeferStmt
+	scope  *Scope
+	fn     Object //function, or the method's receiver
+	method string //method name if it's a method call
+	args   []Object
+}
+
+// deferred calls of one function invocation.
+type deferFrame struct {
+	calls []*deferredCall
+}
+
+// get the defer frame of the nearest function invocation.
+func (s *Scope) getDeferFrame() *deferFrame {
+	for scope := s; scope != nil; scope = scope.parentScope {
+		if scope.defers != nil {
+			return scope.defers
+		}
+	}
+	return nil
+}
+
+func evalDeferStatement(ds *ast.DeferStmt, scope *Scope) Object {
+	if errObj := checkDefer(ds, scope); errObj != nil {
+		return errObj
+	}
+
+	fn, method, args, errObj := evalCallee(ds.Expr, scope)
+	if errObj != nil {
+		return errObj
+	}
+	return deferCall(ds, fn, method, args, scope)
+}
+
+// check that 'defer' is in a function, before the call is evaluated
+func checkDefer(ds *ast.DeferStmt, scope *Scope) Object {
+	if scope.getDeferFrame() == nil {
+		return newError(ds.Pos().Sline(), ERR_DEFER)
+	}
+	return nil
+}
+
+// add the evaluated call to the function invocation's deferred calls
+func deferCall(ds *ast.DeferStmt, fn Object, method string, args []Object, scope *Scope) Object {
+	frame := scope.getDeferFrame()
+	frame.calls = append(frame.calls, &deferredCall{stmt: ds, scope: scope, fn: fn, method: method, args: args})
+	return NIL
+}
+
+// the call of 'defer' and 'spawn': 'callee' is the function(or the method's
+// receiver) which is evaluated before the arguments, 'call' is nil if the
+// expression is not a call.
+func calleeOf(expr ast.Expression) (callee ast.Expression, method string, call *ast.CallExpression) {
+	switch e := expr.(type) {
+	case *ast.CallExpression: //f(args)
+		return e.Function, "", e
+	case *ast.MethodCallExpression: //obj.method(args)
+		if c, ok := e.Call.(*ast.CallExpression); ok {
+			if name, ok := c.Function.(*ast.Identifier); ok {
+				return e.Object, name.Value, c
+			}
+		}
+	}
+	return nil, "", nil
+}
+
+// evaluate the function value(or the method's receiver) and the arguments
+// of a call which runs later('defer' and 'spawn'). 'fn' is nil if the
+// expression is not a call.
+func evalCallee(expr ast.Expression, scope *Scope) (fn Object, method string, args []Object, errObj Object) {
+	callee, method, call := calleeOf(expr)
+	if call == nil {
+		return nil, "", nil, nil
+	}
+
+	fn = Eval(callee, scope)
+	if isError(fn) {
+		return nil, "", nil, fn
+	}
+	args = evalExpressions(call.Arguments, scope)
+	if len(args) == 1 && isError(args[0]) {
+		return nil, "", nil, args[0]
+	}
+	if call.Variadic {
+		args = getVariadicArgs(call, args, scope) //unboxing
+		if len(args) == 1 && isError(args[0]) {
+			return nil, "", nil, args[0]
+		}
+	}
+	return fn, method, args, nil
+}
+
+func (d *deferredCall) call() Object {
+	line := d.stmt.Pos().Sline()
+	switch {
+	case d.fn == nil:
+		return evalBody(d.stmt.Expr, d.scope)
+	case d.method != "":
+		return d.fn.CallMethod(line, d.scope, d.method, d.args...)
+	default:
+		return applyFunction(line, d.scope, d.fn, d.args)
+	}
+}
+
+// run the deferred calls in LIFO order. If the function's result is not an error,
+// then the first error of the deferred calls becomes the result.
+func (frame *deferFrame) run(result Object) Object {
+	for len(frame.calls) > 0 {
+		d := frame.calls[len(frame.calls)-1]
+		frame.calls = frame.calls[:len(frame.calls)-1]
+
+		r := d.call()
+		if (isError(r) || r.Type() == THROW_OBJ) && !(isError(result) || result.Type() == THROW_OBJ) {
+			result = r
+		}
+	}
+	return result
+}
@@ -0,0 +1,300 @@
+package eval
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// objectsEqual reports whether the values are equal. The arrays and the
+// tuples are equal if their members are, the hashes if they have the same
+// pairs(in the same order if both are ordered), and the structs if they are
+// of the same struct and their fields are equal, unless they define '__eq__'.
+// The other objects are equal only to themselves.
+func objectsEqual(line string, scope *Scope, a, b Object) bool {
+	c := &comparer{line: line, scope: scope}
+	return c.equal(a, b)
+}
+
+// compareObjects returns -1, 0 or 1 if 'a' is less than, equal to or greater
+// than 'b'. The numbers and the strings are compared by their values, the
+// arrays and the tuples lexicographically. 'ok' is false if they could not
+// be ordered.
+func compareObjects(line string, scope *Scope, a, b Object) (cmp int, ok bool) {
+	c := &comparer{line: line, scope: scope}
+	return c.compare(a, b)
+}
+
+type comparer struct {
+	line  string
+	scope *Scope
+	seen  map[[2]Object]bool //the collections being compared, a cyclic one is not compared again
+}
+
+func (c *comparer) equal(a, b Object) bool {
+	if a == b {
+		return true
+	}
+	if r, ok := c.protocolEqual(a, b); ok {
+		return r
+	}
+
+	switch l := a.(type) {
+	case *Number:
+		r, ok := b.(*Number)
+		return ok && l.Value == r.Value
+	case *String:
+		r, ok := b.(*String)
+		return ok && l.String == r.String
+	case *Boolean:
+		r, ok := b.(*Boolean)
+		return ok && l.Bool == r.Bool
+	case *Nil:
+		_, ok := b.(*Nil)
+		return ok
+	case *Array:
+		r, ok := b.(*Array)
+		return ok && (c.visited(a, b) || c.members(l.Members, r.Members))
+	case *Tuple:
+		r, ok := b.(*Tuple)
+		return ok && (c.visited(a, b) || c.members(l.Members, r.Members))
+	case *Hash:
+		r, ok := b.(*Hash)
+		return ok && (c.visited(a, b) || c.hashes(l, r))
+	case *Struct:
+		r, ok := b.(*Struct)
+		return ok && (c.visited(a, b) || c.structs(l, r))
+	case *BoundMethod: //the same method of the same receiver
+		r, ok := b.(*BoundMethod)
+		return ok && l.Receiver == r.Receiver && l.Name == r.Name
+	}
+	return false
+}
+
+// the '__eq__' of the struct objects
+func (c *comparer) protocolEqual(a, b Object) (equal bool, ok bool) {
+	if a.Type() != STRUCT_OBJ && b.Type() != STRUCT_OBJ {
+		return false, false
+	}
+	r, ok := callProtocol(c.line, c.scope, a, PROTO_EQ, b)
+	if !ok {
+		r, ok = callProtocol(c.line, c.scope, b, PROTO_EQ, a)
+	}
+	if !ok {
+		return false, false
+	}
+	return !isError(r) && IsTrue(r), true
+}
+
+// visited reports whether the pair of the collections is already being
+// compared(e.g. 'a = [1]; a.push(a); b = [1]; b.push(b); a == b'), which
+// is taken as equal, otherwise it marks the pair.
+func (c *comparer) visited(a, b Object) bool {
+	key := [2]Object{a, b}
+	if c.seen[key] {
+		return true
+	}
+	if c.seen == nil {
+		c.seen = make(map[[2]Object]bool)
+	}
+	c.seen[key] = true
+	return false
+}
+
+func (c *comparer) members(a, b []Object) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !c.equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *comparer) hashes(a, b *Hash) bool {
+	pairs, others := a.pairs(true), b.pairs(true)
+	if len(pairs) != len(others) {
+		return false
+	}
+	if a.IsOrdered && b.IsOrdered {
+		for i, pair := range pairs {
+			if !c.equal(pair.Key, others[i].Key) {
+				return false
+			}
+		}
+	}
+	for _, pair := range pairs {
+		other, ok, errObj := b.lookup(c.line, c.scope, pair.Key)
+		if !ok || errObj != nil || !c.equal(pair.Value, other.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// the struct objects' fields, the methods are not compared
+func (c *comparer) structs(a, b *Struct) bool {
+	if a.Stmt != b.Stmt {
+		return false
+	}
+	keys := a.Scope.GetKeys()
+	if len(keys) != len(b.Scope.GetKeys()) {
+		return false
+	}
+	for _, k := range keys {
+		x, _ := a.Scope.Get(k)
+		y, ok := b.Scope.Get(k)
+		if !ok {
+			return false
+		}
+		switch x.(type) {
+		case *Function, *Builtin: //the methods, or the decorated methods
+			continue
+		}
+		if !c.equal(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *comparer) compare(a, b Object) (int, bool) {
+	switch l := a.(type) {
+	case *Number:
+		if r, ok := b.(*Number); ok {
+			return compareNative(l.Value < r.Value, l.Value > r.Value), true
+		}
+	case *String:
+		if r, ok := b.(*String); ok {
+			return compareNative(l.String < r.String, l.String > r.String), true
+		}
+	case *Array:
+		if r, ok := b.(*Array); ok {
+			return c.compareMembers(l.Members, r.Members)
+		}
+	case *Tuple:
+		if r, ok := b.(*Tuple); ok {
+			return c.compareMembers(l.Members, r.Members)
+		}
+	}
+	return 0, false
+}
+
+// the first unequal members decide, or the shorter one is less
+func (c *comparer) compareMembers(a, b []Object) (int, bool) {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c.equal(a[i], b[i]) {
+			continue
+		}
+		return c.compare(a[i], b[i])
+	}
+	return compareNative(len(a) < len(b), len(a) > len(b)), true
+}
+
+func compareNative(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// hashable returns the object as a hash key. A tuple is hashable if all its
+// members are, the other collections are not.
+func hashable(obj Object) (Hashable, bool) {
+	if t, ok := obj.(*Tuple); ok {
+		for _, m := range t.Members {
+			if _, ok := hashable(m); !ok {
+				return nil, false
+			}
+		}
+	}
+	h, ok := obj.(Hashable)
+	return h, ok
+}
+
+// the failure(an error or a thrown value) of a struct's '__hash__'
+type hashFailure struct{ obj Object }
+
+// hashKeyOf returns the object's hash key, or the error if it's not hashable
+// or a struct's '__hash__' fails.
+func hashKeyOf(line string, scope *Scope, obj Object) (hk HashKey, errObj Object) {
+	h, ok := hashable(obj)
+	if !ok {
+		return hk, newError(line, ERR_KEY, obj.Type())
+	}
+
+	defer func() { //the struct members of a tuple
+		if r := recover(); r != nil {
+			f, ok := r.(hashFailure)
+			if !ok {
+				panic(r)
+			}
+			errObj = f.obj
+		}
+	}()
+	if s, ok := obj.(*Struct); ok {
+		return s.hashKey(line, scope)
+	}
+	return h.HashKey(), nil
+}
+
+// the hash of a float, the zeros are the same key
+func hashFloat(f float64) uint64 {
+	if f == 0 {
+		f = 0 //-0
+	}
+	return math.Float64bits(f)
+}
+
+// the hash of the members' types and hashes
+func hashMembers(members []Object) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, m := range members {
+		hashable, ok := m.(Hashable)
+		if !ok { //the callers check it with 'hashable()'
+			panic(newError("", ERR_KEY, m.Type()))
+		}
+		hk := hashable.HashKey()
+		h.Write([]byte(hk.Type))
+		binary.LittleEndian.PutUint64(buf[:], hk.Value)
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+// the hash of the struct's name and its fields, the equal struct objects
+// have the same hash. Only the scalar fields are hashed by their values, the
+// others by their types. A struct defining '__eq__' is hashed by its name.
+func hashFields(s *Struct) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s.Stmt.Name))
+	if s.hasProtocol(PROTO_EQ) {
+		return h.Sum64()
+	}
+
+	keys := s.Scope.GetKeys()
+	sort.Strings(keys)
+	var buf [8]byte
+	for _, k := range keys {
+		v, _ := s.Scope.getOwn(k)
+		switch v.(type) {
+		case *Function, *Builtin: //the methods are not compared
+			continue
+		}
+		h.Write([]byte(k))
+		h.Write([]byte(v.Type()))
+		switch v := v.(type) {
+		case *Number, *String, *Boolean:
+			binary.LittleEndian.PutUint64(buf[:], v.(Hashable).HashKey().Value)
+			h.Write(buf[:])
+		}
+	}
+	return h.Sum64()
+}
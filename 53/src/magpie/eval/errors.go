@@ -2,6 +2,9 @@ package eval
 
 import (
 	"fmt"
+	"magpie/ast"
+	"magpie/token"
+	"strconv"
 	"strings"
 )
 
@@ -19,8 +22,9 @@ var (
 	ERR_NOTFUNCTION     = "expect a function, got %s"
 	ERR_PARAMTYPE       = "%s argument for '%s' should be type %s. got=%s"
 	ERR_NOTITERABLE     = "foreach's operating type must be iterable"
-	ERR_IMPORT          = "import error: %s"
+	ERR_IMPORT          = "in module '%s' imported at %s"
 	ERR_NAMENOTEXPORTED = "cannot refer to unexported name %s.%s"
+	ERR_NOMODULEMEMBER  = "module '%s' has no exported name '%s'"
 	ERR_INVALIDARG      = "invalid argument supplied"
 	ERR_NOINDEXABLE     = "index error: type %s is not indexable"
 	ERR_NOTREGEXP       = "right type is not a regexp object, got %s"
@@ -30,17 +34,132 @@ var (
 	ERR_MULTIASSIGN     = "the number of names and values are not equal"
 	ERR_DECORATOR       = "decorator '%s' is not a function"
 	ERR_DECORATED_NAME  = "can not find the name of the decorated function"
-	ERR_DECORATOR_FN    = "a decorator must decorate a named function or another decorator"
+	ERR_DECORATOR_FN    = "a decorator must decorate a named function, a struct or another decorator"
 	ERR_PIPE            = "pipe operator's right hand side is not a function"
+	ERR_NOTINTERFACE    = "'%s' is not an interface, got %s"
+	ERR_NOTIMPLEMENTED  = "struct '%s' does not implement interface '%s', missing method(s): %s"
+	ERR_METHODSIGNATURE = "struct '%s' has wrong signature for method '%s' of interface '%s', expected '%s'"
+	ERR_YIELD           = "'yield' outside of generator function"
+	ERR_GENCLOSED       = "generator is closed"
+	ERR_ITERNEXT        = "iterator's '%s' method should return (value, ok), got %s"
+	ERR_DEFER           = "'defer' outside of function"
+	ERR_TYPEMISMATCH    = "type mismatch: %s expected '%s', got '%s'"
+	ERR_UNKNOWNTYPE     = "unknown type '%s'"
+	ERR_MACRODEF        = "macro definitions are only allowed at the top level"
+	ERR_MACROARGS       = "macro '%s' expects %d argument(s), got %d"
+	ERR_MACRORESULT     = "macro '%s' should return a quoted node, got %s"
+	ERR_MACRODEPTH      = "macro expansion is too deep, maybe macro '%s' expands to itself"
+	ERR_MACRODUP        = "macro '%s' is already defined"
+	ERR_QUOTE           = "'quote' expects one argument, got %d"
+	ERR_UNQUOTE         = "could not unquote %s to an AST node"
+	ERR_MAXDEPTH        = "maximum recursion depth exceeded(%d), call chain: %s"
+	ERR_STEPLIMIT       = "step limit exceeded(%d steps)"
+	ERR_ALLOCLIMIT      = "allocation limit exceeded(%d bytes)"
+	ERR_TIMEOUT         = "execution timed out"
+	ERR_CANCELED        = "execution canceled"
+	ERR_DENIED          = "%s is not allowed"
+	ERR_IO              = "'%s' failed. reason: %s"
+	ERR_RETHROW         = "'throw' without a value outside of 'catch'"
+	ERR_NOTCHANNEL      = "'%s' expects a channel, got %s"
+	ERR_CHANCLOSED      = "'%s' on a closed channel"
+	ERR_UNLOCK          = "unlock of an unlocked mutex"
+	ERR_WAITGROUP       = "negative WaitGroup counter"
+	ERR_AWAIT           = "'await' outside of async function"
+	ERR_NEVERSETTLED    = "the awaited promise could never be settled"
 )
 
+// the errors' kinds by their formats, the kind of an error created with
+// another format is 'ERR_RUNTIME'
+var errKinds = map[string]string{
+	ERR_ARGUMENT:        "ERR_ARGUMENT",
+	ERR_NOMETHOD:        "ERR_NOMETHOD",
+	ERR_NOMETHODEX:      "ERR_NOMETHODEX",
+	ERR_INDEX:           "ERR_INDEX",
+	ERR_KEY:             "ERR_KEY",
+	ERR_PREFIXOP:        "ERR_PREFIXOP",
+	ERR_INFIXOP:         "ERR_INFIXOP",
+	ERR_POSTFIXOP:       "ERR_POSTFIXOP",
+	ERR_UNKNOWNIDENT:    "ERR_UNKNOWNIDENT",
+	ERR_DIVIDEBYZERO:    "ERR_DIVIDEBYZERO",
+	ERR_NOTFUNCTION:     "ERR_NOTFUNCTION",
+	ERR_PARAMTYPE:       "ERR_PARAMTYPE",
+	ERR_NOTITERABLE:     "ERR_NOTITERABLE",
+	ERR_IMPORT:          "ERR_IMPORT",
+	ERR_NAMENOTEXPORTED: "ERR_NAMENOTEXPORTED",
+	ERR_NOMODULEMEMBER:  "ERR_NOMODULEMEMBER",
+	ERR_INVALIDARG:      "ERR_INVALIDARG",
+	ERR_NOINDEXABLE:     "ERR_NOINDEXABLE",
+	ERR_NOTREGEXP:       "ERR_NOTREGEXP",
+	ERR_NOCONSTRUCTOR:   "ERR_NOCONSTRUCTOR",
+	ERR_THROWNOTHANDLED: "ERR_THROWNOTHANDLED",
+	ERR_RANGETYPE:       "ERR_RANGETYPE",
+	ERR_MULTIASSIGN:     "ERR_MULTIASSIGN",
+	ERR_DECORATOR:       "ERR_DECORATOR",
+	ERR_DECORATED_NAME:  "ERR_DECORATED_NAME",
+	ERR_DECORATOR_FN:    "ERR_DECORATOR_FN",
+	ERR_PIPE:            "ERR_PIPE",
+	ERR_NOTINTERFACE:    "ERR_NOTINTERFACE",
+	ERR_NOTIMPLEMENTED:  "ERR_NOTIMPLEMENTED",
+	ERR_METHODSIGNATURE: "ERR_METHODSIGNATURE",
+	ERR_YIELD:           "ERR_YIELD",
+	ERR_GENCLOSED:       "ERR_GENCLOSED",
+	ERR_ITERNEXT:        "ERR_ITERNEXT",
+	ERR_DEFER:           "ERR_DEFER",
+	ERR_TYPEMISMATCH:    "ERR_TYPEMISMATCH",
+	ERR_UNKNOWNTYPE:     "ERR_UNKNOWNTYPE",
+	ERR_MACRODEF:        "ERR_MACRODEF",
+	ERR_MACROARGS:       "ERR_MACROARGS",
+	ERR_MACRORESULT:     "ERR_MACRORESULT",
+	ERR_MACRODEPTH:      "ERR_MACRODEPTH",
+	ERR_MACRODUP:        "ERR_MACRODUP",
+	ERR_QUOTE:           "ERR_QUOTE",
+	ERR_UNQUOTE:         "ERR_UNQUOTE",
+	ERR_MAXDEPTH:        "ERR_MAXDEPTH",
+	ERR_STEPLIMIT:       "ERR_STEPLIMIT",
+	ERR_ALLOCLIMIT:      "ERR_ALLOCLIMIT",
+	ERR_TIMEOUT:         "ERR_TIMEOUT",
+	ERR_CANCELED:        "ERR_CANCELED",
+	ERR_DENIED:          "ERR_DENIED",
+	ERR_IO:              "ERR_IO",
+	ERR_RETHROW:         "ERR_RETHROW",
+	ERR_NOTCHANNEL:      "ERR_NOTCHANNEL",
+	ERR_CHANCLOSED:      "ERR_CHANCLOSED",
+	ERR_UNLOCK:          "ERR_UNLOCK",
+	ERR_WAITGROUP:       "ERR_WAITGROUP",
+	ERR_AWAIT:           "ERR_AWAIT",
+	ERR_NEVERSETTLED:    "ERR_NEVERSETTLED",
+}
+
 func newError(line string, format string, args ...interface{}) *Error {
-	msg := "Runtime Error at " + strings.TrimLeft(line, " \t") + "\n\t" + fmt.Sprintf(format, args...) + "\n"
-	return &Error{Message: msg}
+	text := fmt.Sprintf(format, args...)
+	msg := "Runtime Error at " + strings.TrimLeft(line, " \t") + "\n\t" + text + "\n"
+	return &Error{Message: msg, kind: errKinds[format], text: text, line: line}
 }
 
+// Error is a runtime error. It could be caught by 'try/catch', except the
+// violated execution limits, as a RuntimeError.
 type Error struct {
 	Message string
+
+	kind  string         //e.g. 'ERR_INDEX', empty if it's not created with an ERR_XXX format
+	text  string         //the message without the location
+	line  string         //the location which the error is created with
+	pos   token.Position //the location, the column is set by the node which raised it
+	limit error          //the violated execution limit, see 'Options'
+	stack []string       //the traceback, see 'Scope.traceback'
+	cause Object         //the error which caused it, see 'NewError'
+}
+
+func (e *Error) Error() string { return e.Message }
+func (e *Error) Unwrap() error { return e.limit }
+
+// Traceback returns the function calls which led to the error, or an empty
+// string if it's raised at the top level.
+func (e *Error) Traceback() string {
+	if len(e.stack) < 2 {
+		return ""
+	}
+	return "Traceback (most recent call last):\n\t" + strings.Join(e.stack, "\n\t") + "\n"
 }
 
 func (e *Error) Inspect() string  { return e.Message }
@@ -56,3 +175,130 @@ func isError(obj Object) bool {
 func (e *Error) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
 	return newError(line, "%s", e.Message)
 }
+
+// set the error's location from the node which raised it, if it's on the
+// line which the error is created with
+func (e *Error) at(node ast.Node) {
+	if e.pos.Col != 0 || e.line == "" {
+		return
+	}
+	if e.pos.Line == 0 {
+		e.pos = parseSline(e.line)
+	}
+	pos := node.Pos()
+	if pos.Line == e.pos.Line && pos.Filename == e.pos.Filename {
+		e.pos.Col = pos.Col
+	}
+}
+
+// parse the position's 'Sline()': ' <file:line> ', or 'line' without a file
+func parseSline(sline string) token.Position {
+	var pos token.Position
+	s := strings.TrimSpace(sline)
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") {
+		s = s[1 : len(s)-1]
+		if idx := strings.LastIndex(s, ":"); idx >= 0 {
+			pos.Filename, s = s[:idx], s[idx+1:]
+		}
+	}
+	pos.Line, _ = strconv.Atoi(s)
+	return pos
+}
+
+// RuntimeError is the value which 'catch' gets for a runtime error, or
+// which 'NewError' creates. Its members are 'kind', 'message', 'file',
+// 'line', 'col', 'stack' and 'cause'.
+type RuntimeError struct {
+	err *Error
+}
+
+func (re *RuntimeError) Inspect() string  { return re.err.text }
+func (re *RuntimeError) Type() ObjectType { return RUNERROR_OBJ }
+func (re *RuntimeError) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	return newError(line, ERR_NOMETHOD, method, re.Type())
+}
+
+func newRuntimeError(errObj *Error) *RuntimeError {
+	if errObj.pos.Line == 0 {
+		errObj.pos = parseSline(errObj.line)
+	}
+	return &RuntimeError{err: errObj}
+}
+
+func (re *RuntimeError) kind() string {
+	if re.err.kind == "" {
+		return "ERR_RUNTIME"
+	}
+	return re.err.kind
+}
+
+// e.kind, e.message, ...
+func (re *RuntimeError) get(line string, name string) Object {
+	e := re.err
+	switch name {
+	case "kind":
+		return NewString(re.kind())
+	case "message":
+		return NewString(e.text)
+	case "file":
+		return NewString(e.pos.Filename)
+	case "line":
+		return NewNumber(float64(e.pos.Line))
+	case "col":
+		return NewNumber(float64(e.pos.Col))
+	case "stack":
+		members := make([]Object, len(e.stack))
+		for i, s := range e.stack {
+			members[i] = NewString(s)
+		}
+		return &Array{Members: members}
+	case "cause":
+		if e.cause == nil {
+			return NIL
+		}
+		return e.cause
+	}
+	return newError(line, ERR_NOMETHOD, name, re.Type())
+}
+
+// the builtin error types which 'catch (e: Type)' matches, besides
+// 'Error'(any runtime error) and the kinds themselves(e.g. 'ERR_INDEX')
+var errTypes = map[string][]string{
+	"IOError":         {"ERR_IO"},
+	"IndexError":      {"ERR_INDEX", "ERR_NOINDEXABLE"},
+	"KeyError":        {"ERR_KEY"},
+	"ArithmeticError": {"ERR_DIVIDEBYZERO"},
+	"NameError":       {"ERR_UNKNOWNIDENT", "ERR_NAMENOTEXPORTED", "ERR_NOMODULEMEMBER"},
+	"AttributeError":  {"ERR_NOMETHOD", "ERR_NOMETHODEX"},
+	"TypeError": {"ERR_PARAMTYPE", "ERR_TYPEMISMATCH", "ERR_PREFIXOP", "ERR_INFIXOP", "ERR_POSTFIXOP",
+		"ERR_NOTFUNCTION", "ERR_NOTITERABLE", "ERR_RANGETYPE", "ERR_ARGUMENT", "ERR_INVALIDARG", "ERR_NOTCHANNEL"},
+	"ImportError":     {"ERR_IMPORT"},
+	"RecursionError":  {"ERR_MAXDEPTH"},
+	"PermissionError": {"ERR_DENIED"},
+}
+
+// catches reports whether the catch clause of the type handles the thrown
+// value: a runtime error of the builtin error type or kind, a struct object
+// of the struct, or a value of the type('string', 'hash', ...).
+func catches(typ string, value Object) bool {
+	if typ == "" {
+		return true
+	}
+	switch v := value.(type) {
+	case *RuntimeError:
+		kind := v.kind()
+		if typ == "Error" || typ == kind {
+			return true
+		}
+		for _, k := range errTypes[typ] {
+			if k == kind {
+				return true
+			}
+		}
+	case *Struct:
+		if v.Stmt.Name == typ {
+			return true
+		}
+	}
+	return typeName(value) == typ
+}
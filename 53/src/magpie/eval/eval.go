@@ -2,22 +2,30 @@ package eval
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"magpie/ast"
+	"magpie/resolver"
 	"math"
 	"os"
 	"os/exec"
-	"reflect"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 )
 
-var importMap map[string]*Scope = map[string]*Scope{}
+var importMap map[string]*Module = map[string]*Module{} //key: the module's resolved path
+var importMu sync.Mutex                                 //guards importMap
 var ALL_ARGS = "$_"
 
+// the name of the value which a bare 'throw' rethrows, it's a keyword so it
+// could not be a variable's name
+const RETHROW = "throw"
+
 func panicToError(p interface{}, node ast.Node) *Error {
 	errLine := node.Pos().Sline()
 	switch e := p.(type) {
@@ -35,11 +43,26 @@ func Eval(node ast.Node, scope *Scope) (val Object) {
 		if r := recover(); r != nil {
 			val = panicToError(r, node)
 		}
+		if e, ok := val.(*Error); ok {
+			e.at(node) //the innermost node on the error's line gives the column
+			if e.stack == nil {
+				e.stack = scope.traceback(e.pos)
+			}
+		}
 	}()
+	if scope != nil && scope.sandbox != nil {
+		sb := scope.sandbox
+		if errObj := sb.step(node); errObj != nil {
+			return errObj
+		}
+		if allocates(node) {
+			defer func() { val = sb.charge(node, val, sizeOf(val)) }()
+		}
+	}
 	//fmt.Printf("node.Type=%T, node=<%s>, start=%d, end=%d\n", node, node.String(), node.Pos().Line, node.End().Line) //debugging
 	switch node := node.(type) {
 	case *ast.Program:
-		return evalProgram(node, scope)
+		return loop.drain(node.End().Sline(), evalProgram(node, scope), scope)
 	case *ast.ImportStatement:
 		return evalImportStatement(node, scope)
 	case *ast.BlockStatement:
@@ -52,15 +75,30 @@ func Eval(node ast.Node, scope *Scope) (val Object) {
 		return evalStringLiteral(node, scope)
 	case *ast.FunctionLiteral:
 		return evalFunctionLiteral(node, scope)
+	case *ast.MacroLiteral:
+		return evalMacroLiteral(node, scope)
+	case *ast.BlockLiteral:
+		return evalBlockLiteral(node, scope)
 	case *ast.StructStatement:
 		return evalStructStatement(node, scope)
+	case *ast.InterfaceStatement:
+		return evalInterfaceStatement(node, scope)
 	case *ast.SwitchExpression:
 		return evalSwitchExpression(node, scope)
 	case *ast.TryStmt:
 		return evalTryStatement(node, scope)
 	case *ast.ThrowStmt:
 		return evalThrowStatement(node, scope)
+	case *ast.SpawnExpression:
+		return evalSpawnExpression(node, scope)
+	case *ast.SelectStatement:
+		return evalSelectStatement(node, scope)
+	case *ast.DeferStmt:
+		return evalDeferStatement(node, scope)
 	case *ast.CallExpression:
+		if isQuoteCall(node) {
+			return evalQuote(node, scope)
+		}
 		return evalCallExpression(node, nil, scope)
 	case *ast.MethodCallExpression:
 		return evalMethodCallExpression(node, scope)
@@ -74,6 +112,9 @@ func Eval(node ast.Node, scope *Scope) (val Object) {
 		if node.Operator == "|>" {
 			return evalPipeInfix(node, scope)
 		}
+		if node.Operator == "is" {
+			return evalIsExpression(node, scope)
+		}
 
 		left := Eval(node.Left, scope)
 		if isError(left) {
@@ -112,9 +153,15 @@ func Eval(node ast.Node, scope *Scope) (val Object) {
 			return index
 		}
 
-		return evalIndexExpression(node, left, index)
+		return evalIndexExpression(node, left, index, scope)
 	case *ast.HashLiteral:
 		return evalHashLiteral(node, scope)
+	case *ast.ArrayComprehension:
+		return evalArrayComprehension(node, scope)
+	case *ast.TupleComprehension:
+		return evalTupleComprehension(node, scope)
+	case *ast.HashComprehension:
+		return evalHashComprehension(node, scope)
 	case *ast.TupleLiteral:
 		members := evalExpressions(node.Members, scope)
 		if len(members) == 1 && isError(members[0]) {
@@ -135,8 +182,18 @@ func Eval(node ast.Node, scope *Scope) (val Object) {
 	case *ast.AssignExpression:
 		return evalAssignExpression(node, scope)
 	case *ast.BreakExpression:
+		if node.Label != "" {
+			return &Break{Label: node.Label}
+		}
 		return BREAK
+	case *ast.YieldExpression:
+		return evalYieldExpression(node, scope)
+	case *ast.AwaitExpression:
+		return evalAwaitExpression(node, scope)
 	case *ast.ContinueExpression:
+		if node.Label != "" {
+			return &Continue{Label: node.Label}
+		}
 		return CONTINUE
 	case *ast.FallthroughExpression:
 		return FALLTHROUGH
@@ -156,7 +213,7 @@ func Eval(node ast.Node, scope *Scope) (val Object) {
 	case *ast.RegExLiteral:
 		return evalRegExLiteral(node, scope)
 	case *ast.TailCallStatement:
-		return &TailCall{tail: node}
+		return evalTailCall(node.Call.(*ast.CallExpression), scope)
 	case *ast.DecoratorExpr:
 		return evalDecorator(node, scope)
 	case *ast.CmdExpression:
@@ -167,6 +224,7 @@ func Eval(node ast.Node, scope *Scope) (val Object) {
 }
 
 func evalProgram(program *ast.Program, scope *Scope) (results Object) {
+	resolver.Resolve(program)
 	if len(program.Imports) > 0 {
 		results = loadImports(program.Imports, scope)
 		if results.Type() == ERROR_OBJ {
@@ -174,6 +232,11 @@ func evalProgram(program *ast.Program, scope *Scope) (results Object) {
 		}
 	}
 
+	if UseVM {
+		if code := compiled(program); code != nil {
+			return code.run(scope)
+		}
+	}
 	for _, stmt := range program.Statements {
 		results = Eval(stmt, scope)
 		if returnValue, ok := results.(*ReturnValue); ok {
@@ -184,7 +247,7 @@ func evalProgram(program *ast.Program, scope *Scope) (results Object) {
 		}
 		if throwObj, ok := results.(*Throw); ok {
 			//convert ThrowValue to Errors
-			return newError(throwObj.stmt.Pos().Sline(), ERR_THROWNOTHANDLED, throwObj.value.Inspect())
+			return throwObj.unhandled()
 		}
 	}
 
@@ -194,31 +257,58 @@ func evalProgram(program *ast.Program, scope *Scope) (results Object) {
 	return results
 }
 
-func loadImports(imports map[string]*ast.ImportStatement, scope *Scope) Object {
+func loadImports(imports []*ast.ImportStatement, scope *Scope) Object {
 	for _, p := range imports {
 		v := evalImportStatement(p, scope)
 		if v.Type() == ERROR_OBJ {
-			return newError(p.Pos().Sline(), ERR_IMPORT, p.ImportPath)
+			return v
 		}
 	}
 	return NIL
 }
 
 func evalImportStatement(i *ast.ImportStatement, scope *Scope) Object {
-	if importedScope, ok := importMap[i.ImportPath]; ok {
-		importedScope.GetAllExported(scope)
-		return NIL
+	importMu.Lock()
+	module, ok := importMap[i.Path]
+	if !ok { //the tasks importing it at the same time wait for the same run
+		module = &Module{Name: filepath.Base(i.ImportPath), Path: i.Path}
+		importMap[i.Path] = module
+	}
+	importMu.Unlock()
+
+	module.once.Do(func() {
+		newScope := NewScope(nil, scope.Writer)
+		newScope.sandbox = scope.sandbox
+		if errObj, ok := evalProgram(i.Program, newScope).(*Error); ok {
+			module.err = errObj
+			importMu.Lock()
+			delete(importMap, i.Path) //the later imports run it again
+			importMu.Unlock()
+			return
+		}
+		module.Scope = newScope
+	})
+	if module.err != nil { //keep the module's error, and add the import trace
+		trace := fmt.Sprintf(ERR_IMPORT, i.ImportPath, strings.TrimSpace(i.Pos().Sline()))
+		e := *module.err
+		e.Message += "\t" + trace + "\n"
+		return &e
 	}
 
-	newScope := NewScope(nil, scope.Writer)
-	v := evalProgram(i.Program, newScope)
-	if v.Type() == ERROR_OBJ {
-		return newError(i.Pos().Sline(), ERR_IMPORT, i.ImportPath)
+	if len(i.Names) == 0 {
+		scope.Set(i.Name(), module)
+		return NIL
 	}
 
-	importMap[i.ImportPath] = newScope
-	newScope.GetAllExported(scope)
-
+	//from a.b.c import Name1, Name2
+	for _, name := range i.Names {
+		if i.Macros[name.Value] { //expanded already
+			continue
+		}
+		if errObj := module.importName(name.Pos().Sline(), name.Value, scope); errObj != nil {
+			return errObj
+		}
+	}
 	return NIL
 }
 
@@ -285,6 +375,11 @@ func InterpolateString(str string, scope *Scope) string {
 	return str
 }
 
+// macro definitions are removed by the macro expansion
+func evalMacroLiteral(ml *ast.MacroLiteral, scope *Scope) Object {
+	return newError(ml.Pos().Sline(), ERR_MACRODEF)
+}
+
 func evalFunctionLiteral(fl *ast.FunctionLiteral, scope *Scope) Object {
 	fn := &Function{Literal: fl, Scope: scope}
 	if fl.Name != "" {
@@ -294,12 +389,20 @@ func evalFunctionLiteral(fl *ast.FunctionLiteral, scope *Scope) Object {
 }
 
 func evalStructStatement(structStmt *ast.StructStatement, scope *Scope) Object {
+	//check interface conformance at declaration time
+	if r := checkStructConformance(structStmt, scope); isError(r) {
+		return r
+	}
+
 	scope.SetStruct(structStmt) //save to scope
 	return NIL
 }
 
 func evalSwitchExpression(switchExpr *ast.SwitchExpression, scope *Scope) Object {
 	obj := Eval(switchExpr.Expr, scope)
+	if isError(obj) || obj.Type() == THROW_OBJ {
+		return obj
+	}
 
 	var defaultBlock *ast.BlockStatement
 	match := false
@@ -316,104 +419,200 @@ loopCases:
 		if !through {
 			for _, expr := range choice.Exprs {
 				out := Eval(expr, scope)
+				if isError(out) || out.Type() == THROW_OBJ {
+					return out
+				}
 
-				// literal match?
-				if obj.Type() == out.Type() && (obj.Inspect() == out.Inspect()) {
+				if caseMatches(obj, out) {
 					match = true
 					break
 				}
-
-				// regexp-match?
-				if out.Type() == REGEX_OBJ {
-					matched := out.(*RegEx).RegExp.MatchString(obj.Inspect())
-					if matched {
-						match = true
-						break
-					}
-				}
 			}
 		}
 
 		if match || through {
 			through = false
-			result := evalBlockStatement(choice.Block, scope)
+			result := Eval(choice.Block, scope)
 			if _, ok := result.(*Fallthrough); ok {
 				through = true
 				continue loopCases
 			}
+			if isOuterControl(result) { //control flow goes to the outer code
+				return result
+			}
 			return NIL
 		}
 	}
 
 	// handle default
 	if !match && defaultBlock != nil {
-		return evalBlockStatement(defaultBlock, scope)
+		return Eval(defaultBlock, scope)
 	}
 
 	return NIL
 }
 
+// check if the case's value matches the switch's value, literally or by
+// the regexp
+func caseMatches(obj, out Object) bool {
+	// literal match?
+	if obj.Type() == out.Type() && (obj.Inspect() == out.Inspect()) {
+		return true
+	}
+
+	// regexp-match?
+	return out.Type() == REGEX_OBJ && out.(*RegEx).RegExp.MatchString(obj.Inspect())
+}
+
 func evalThrowStatement(t *ast.ThrowStmt, scope *Scope) Object {
+	if t.Expr == nil {
+		return rethrow(t, scope)
+	}
 	throwObj := Eval(t.Expr, scope)
 	if throwObj.Type() == ERROR_OBJ {
 		return throwObj
 	}
 
-	return &Throw{stmt: t, value: throwObj}
+	return &Throw{stmt: t, value: throwObj, stack: scope.traceback(t.Pos())}
+}
+
+// a bare 'throw' in a catch clause rethrows the caught value, the thrown
+// value keeps its position
+func rethrow(t *ast.ThrowStmt, scope *Scope) Object {
+	if caught, ok := scope.Get(RETHROW); ok {
+		return caught
+	}
+	return newError(t.Pos().Sline(), ERR_RETHROW)
 }
 
 func evalTryStatement(tryStmt *ast.TryStmt, scope *Scope) Object {
 	rv := Eval(tryStmt.Try, scope)
-	if rv.Type() == ERROR_OBJ {
+	if isLimitError(rv) { //the violated limits could not be caught
 		return rv
 	}
-
-	defer func() {
-		if tryStmt.Catch != nil {
-			if tryStmt.Var != "" {
-				scope.Del(tryStmt.Var)
+	if caught := caughtOf(rv); caught != nil {
+		for _, clause := range tryStmt.Catches {
+			if catches(clause.Type, caught.value) {
+				rv = evalCatchClause(clause, caught, scope)
+				break
 			}
 		}
-	}()
+	}
 
-	throwNotHandled := false
-	var throwObj Object = NIL
-	if rv.Type() == THROW_OBJ {
-		throwObj = rv.(*Throw)
-		if tryStmt.Catch != nil {
-			if tryStmt.Var != "" {
-				scope.Set(tryStmt.Var, rv.(*Throw).value)
-			}
-			rv = evalBlockStatement(tryStmt.Catch, scope) //catch Block
-			if rv.Type() == ERROR_OBJ {
-				return rv
-			}
-		} else {
-			throwNotHandled = true
-		}
+	if tryStmt.Finally == nil {
+		return rv //the error or the throw object if it's not handled
+	}
+	//finally will always run, even after 'return' or an error
+	if isLimitError(rv) {
+		return rv
 	}
+	return finallyResult(rv, Eval(tryStmt.Finally, scope))
+}
+
+func isLimitError(obj Object) bool {
+	e, ok := obj.(*Error)
+	return ok && e.limit != nil
+}
 
-	if tryStmt.Finally != nil { //finally will always run(if has)
-		return evalBlockStatement(tryStmt.Finally, scope)
+// the thrown value, or the runtime error which the try block's result is,
+// nil if it's neither
+func caughtOf(rv Object) *Throw {
+	switch r := rv.(type) {
+	case *Error:
+		return &Throw{value: newRuntimeError(r), stack: r.stack}
+	case *Throw:
+		return r
 	}
+	return nil
+}
 
-	if throwNotHandled {
-		return throwObj
+// the result of the try statement with the 'finally' block, the finally
+// block's control object(e.g. 'return') wins over the try's.
+func finallyResult(rv, frv Object) Object {
+	if isControl(frv) {
+		return frv
+	}
+	if isControl(rv) {
+		return rv
+	}
+	return frv
+}
+
+// run the catch clause which handles the thrown value, a bare 'throw' in it
+// rethrows the value
+func evalCatchClause(clause *ast.CatchClause, caught *Throw, scope *Scope) Object {
+	vars := enterCatch(clause, caught, scope)
+	defer vars.leave()
+	return Eval(clause.Block, scope)
+}
+
+// the variables which a catch clause sets: the caught value and the value
+// which a bare 'throw' rethrows
+type catchVars struct {
+	clause *ast.CatchClause
+	scope  *Scope
+	outer  Object //the rethrown value of an outer catch clause
+	nested bool
+}
+
+func enterCatch(clause *ast.CatchClause, caught *Throw, scope *Scope) *catchVars {
+	if clause.Var != "" {
+		scope.Set(clause.Var, caught.value)
+	}
+
+	vars := &catchVars{clause: clause, scope: scope}
+	vars.outer, vars.nested = scope.Get(RETHROW) //in an outer catch clause
+	scope.Set(RETHROW, caught)
+	return vars
+}
+
+// restore the variables when the catch clause is left
+func (v *catchVars) leave() {
+	if v.nested {
+		v.scope.Set(RETHROW, v.outer)
+	} else {
+		v.scope.Del(RETHROW)
+	}
+	if v.clause.Var != "" {
+		v.scope.Del(v.clause.Var)
 	}
-	return rv
 }
 
 func createStructObj(structStmt *ast.StructStatement, scope *Scope) *Struct {
+	//'self' is kept in a scope of its own, so the decorated methods(which are
+	//called without the struct object) could also refer to it.
+	selfScope := NewScope(scope, nil)
 	structObj := &Struct{
-		Scope: NewScope(scope, nil),
+		Scope: NewScope(selfScope, nil),
+		Stmt:  structStmt,
 	}
+	selfScope.Set("self", structObj)
 
-	Eval(structStmt.Block, structObj.Scope)
+	evalBody(structStmt.Block, structObj.Scope)
+	addDefaultMethods(structStmt, structObj)
 	scope.Set(structStmt.Name, structObj)
 
 	return structObj
 }
 
+// create the struct object, and call its 'init' constructor with the arguments
+func newStructObj(line string, structStmt *ast.StructStatement, scope *Scope, args []Object) Object {
+	structObj := createStructObj(structStmt, scope)
+	//check if the struct has 'init' function
+	if _, ok := structObj.Scope.Get("init"); !ok {
+		if len(args) > 0 { //No "init" constructor,but has arguments passed.
+			return newError(line, ERR_NOCONSTRUCTOR, len(args))
+		}
+		return structObj
+	}
+	//call `init` constructor, then return the struct object
+	r := structObj.CallMethod(line, scope, "init", args...)
+	if r.Type() == ERROR_OBJ {
+		return r //return error object
+	}
+	return structObj
+}
+
 func evalPrefixExpression(node *ast.PrefixExpression, right Object, scope *Scope) Object {
 	switch node.Operator {
 	case "+":
@@ -422,6 +621,8 @@ func evalPrefixExpression(node *ast.PrefixExpression, right Object, scope *Scope
 		return evalMinusPrefixOperatorExpression(node, right, scope)
 	case "!":
 		return evalBangOperatorExpression(node, right, scope)
+	case "<-":
+		return evalRecvExpression(node, right, scope)
 	default:
 		return newError(node.Pos().Sline(), ERR_PREFIXOP, node.Operator, right.Type())
 	}
@@ -435,6 +636,9 @@ func evalPlusPrefixOperatorExpression(node *ast.PrefixExpression, right Object,
 }
 
 func evalMinusPrefixOperatorExpression(node *ast.PrefixExpression, right Object, scope *Scope) Object {
+	if r, ok := callProtocol(node.Pos().Sline(), scope, right, PROTO_NEG); ok {
+		return r
+	}
 	if right.Type() != NUMBER_OBJ {
 		return newError(node.Pos().Sline(), ERR_PREFIXOP, node.Operator, right.Type())
 	}
@@ -447,6 +651,9 @@ func evalBangOperatorExpression(node *ast.PrefixExpression, right Object, scope
 }
 
 func evalInfixExpression(node *ast.InfixExpression, left, right Object, scope *Scope) Object {
+	if node.Operator == "<-" {
+		return evalSendExpression(node, left, right, scope)
+	}
 	if left.Type() == GO_OBJ {
 		left = goValueToObject(left.(*GoObject).obj)
 	}
@@ -454,7 +661,19 @@ func evalInfixExpression(node *ast.InfixExpression, left, right Object, scope *S
 		right = goValueToObject(right.(*GoObject).obj)
 	}
 
+	//operator overloading
+	if left.Type() == STRUCT_OBJ || right.Type() == STRUCT_OBJ {
+		if r, ok := evalStructInfixExpression(node, left, right, scope); ok {
+			return r
+		}
+	}
+
 	operator := node.Operator
+	if scope != nil && scope.sandbox != nil { //e.g. 'str * 1e10' should fail before it runs out of memory
+		if errObj := scope.sandbox.reserve(node, infixSize(operator, left, right)); errObj != nil {
+			return errObj
+		}
+	}
 	switch {
 	case operator == "in":
 		return evalInExpression(node, left, right, scope)
@@ -498,15 +717,47 @@ func evalInfixExpression(node *ast.InfixExpression, left, right Object, scope *S
 		return evalNumberInfixExpression(node, left, right, scope)
 	case left.Type() == STRING_OBJ && right.Type() == STRING_OBJ:
 		return evalStringInfixExpression(node, left, right, scope)
-	case operator == "==":
-		return nativeBoolToBooleanObject(left == right)
-	case operator == "!=":
-		return nativeBoolToBooleanObject(left != right)
+	case operator == "==", operator == "!=":
+		equal := objectsEqual(node.Pos().Sline(), scope, left, right)
+		return evalNextInfix(node, nativeBoolToBooleanObject(equal == (operator == "==")), right, scope)
+	case operator == "<", operator == "<=", operator == ">", operator == ">=":
+		cmp, ok := compareObjects(node.Pos().Sline(), scope, left, right)
+		if !ok {
+			return newError(node.Pos().Sline(), ERR_INFIXOP, left.Type(), node.Operator, right.Type())
+		}
+		var result bool
+		switch operator {
+		case "<":
+			result = cmp < 0
+		case "<=":
+			result = cmp <= 0
+		case ">":
+			result = cmp > 0
+		case ">=":
+			result = cmp >= 0
+		}
+		return evalNextInfix(node, nativeBoolToBooleanObject(result), right, scope)
 	default:
 		return newError(node.Pos().Sline(), ERR_INFIXOP, left.Type(), node.Operator, right.Type())
 	}
 }
 
+// the chained comparison of the collections, e.g. 'a == b == c'
+func evalNextInfix(node *ast.InfixExpression, result *Boolean, right Object, scope *Scope) Object {
+	if !node.HasNext {
+		return result
+	}
+	if result == TRUE {
+		infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
+		r := evalNext(node, scope)
+		if isError(r) {
+			return r
+		}
+		return evalInfixExpression(infixExpr, right, r, scope)
+	}
+	return FALSE
+}
+
 func evalRangeExpression(node *ast.InfixExpression, left, right Object, scope *Scope) Object {
 	arr := &Array{}
 	switch l := left.(type) {
@@ -549,7 +800,7 @@ func evalInExpression(node *ast.InfixExpression, left, right Object, scope *Scop
 		return TRUE
 	case *Array:
 		for _, v := range r.Members {
-			r := reflect.DeepEqual(left, v)
+			r := objectsEqual(node.Pos().Sline(), scope, left, v)
 			if r {
 				return TRUE
 			}
@@ -557,22 +808,40 @@ func evalInExpression(node *ast.InfixExpression, left, right Object, scope *Scop
 		return FALSE
 	case *Tuple:
 		for _, v := range r.Members {
-			r := reflect.DeepEqual(left, v)
+			r := objectsEqual(node.Pos().Sline(), scope, left, v)
 			if r {
 				return TRUE
 			}
 		}
 		return FALSE
 	case *Hash:
-		hashable, ok := left.(Hashable)
-		if !ok {
-			return newError(node.Pos().Sline(), ERR_KEY, left.Type())
+		_, ok, errObj := r.lookup(node.Pos().Sline(), scope, left)
+		if errObj != nil {
+			return errObj
 		}
 
-		if _, ok = r.Pairs[hashable.HashKey()]; ok {
+		if ok {
 			return TRUE
 		}
 		return FALSE
+	case *Generator, *Struct, *FileObject, *GoObject: //consume the iterator until found
+		it, errObj := newIterator(node.Pos().Sline(), scope, right)
+		if errObj != nil {
+			return newError(node.Pos().Sline(), ERR_INFIXOP, left.Type(), "in", right.Type())
+		}
+		defer closeIterator(it)
+		for {
+			v, ok := it.Next()
+			if !ok {
+				return FALSE
+			}
+			if isIterError(v) {
+				return v
+			}
+			if objectsEqual(node.Pos().Sline(), scope, left, v) {
+				return TRUE
+			}
+		}
 	default:
 		return newError(node.Pos().Sline(), ERR_INFIXOP, left.Type(), "in", right.Type())
 	}
@@ -589,7 +858,7 @@ func evalStringInfixExpression(node *ast.InfixExpression, left, right Object, sc
 		s := NewString(leftVal + rightVal)
 		if node.HasNext {
 			infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-			r := Eval(node.Next, scope)
+			r := evalNext(node, scope)
 			return evalStringInfixExpression(infixExpr, s, r, scope)
 		}
 		return s
@@ -622,7 +891,7 @@ func evalNextStringInfix(node *ast.InfixExpression, result *Boolean, right Objec
 	}
 	if result == TRUE {
 		infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-		r := Eval(node.Next, scope)
+		r := evalNext(node, scope)
 		return evalStringInfixExpression(infixExpr, right, r, scope)
 	}
 	return FALSE
@@ -637,7 +906,7 @@ func evalNumberInfixExpression(node *ast.InfixExpression, left, right Object, sc
 		n := &Number{Value: leftVal + rightVal}
 		if node.HasNext {
 			infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-			r := Eval(node.Next, scope)
+			r := evalNext(node, scope)
 			return evalNumberInfixExpression(infixExpr, n, r, scope)
 		}
 		return n
@@ -645,7 +914,7 @@ func evalNumberInfixExpression(node *ast.InfixExpression, left, right Object, sc
 		n := &Number{Value: leftVal - rightVal}
 		if node.HasNext {
 			infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-			r := Eval(node.Next, scope)
+			r := evalNext(node, scope)
 			return evalNumberInfixExpression(infixExpr, n, r, scope)
 		}
 		return n
@@ -653,7 +922,7 @@ func evalNumberInfixExpression(node *ast.InfixExpression, left, right Object, sc
 		n := &Number{Value: leftVal * rightVal}
 		if node.HasNext {
 			infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-			r := Eval(node.Next, scope)
+			r := evalNext(node, scope)
 			return evalNumberInfixExpression(infixExpr, n, r, scope)
 		}
 		return n
@@ -664,7 +933,7 @@ func evalNumberInfixExpression(node *ast.InfixExpression, left, right Object, sc
 		n := &Number{Value: leftVal / rightVal}
 		if node.HasNext {
 			infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-			r := Eval(node.Next, scope)
+			r := evalNext(node, scope)
 			return evalNumberInfixExpression(infixExpr, n, r, scope)
 		}
 		return n
@@ -673,7 +942,7 @@ func evalNumberInfixExpression(node *ast.InfixExpression, left, right Object, sc
 		n := &Number{Value: v}
 		if node.HasNext {
 			infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-			r := Eval(node.Next, scope)
+			r := evalNext(node, scope)
 			return evalNumberInfixExpression(infixExpr, n, r, scope)
 		}
 		return n
@@ -681,7 +950,7 @@ func evalNumberInfixExpression(node *ast.InfixExpression, left, right Object, sc
 		n := &Number{Value: math.Pow(leftVal, rightVal)}
 		if node.HasNext {
 			infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-			r := Eval(node.Next, scope)
+			r := evalNext(node, scope)
 			return evalNumberInfixExpression(infixExpr, n, r, scope)
 		}
 		return n
@@ -714,43 +983,78 @@ func evalNextNumberInfix(node *ast.InfixExpression, result *Boolean, right Objec
 	}
 	if result == TRUE {
 		infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
-		r := Eval(node.Next, scope)
+		r := evalNext(node, scope)
 		return evalNumberInfixExpression(infixExpr, right, r, scope)
 	}
 	return FALSE
 }
 
 func evalPipeInfix(node *ast.InfixExpression, scope *Scope) Object {
+	var call ast.Expression
+	switch rightFunc := node.Right.(type) {
+	case *ast.MethodCallExpression, *ast.CallExpression:
+		call = pipedCall(node)
+	case *ast.Identifier:
+		right := Eval(node.Right, scope)
+		if isError(right) {
+			return right
+		}
+		if c := pipedFuncCall(node, rightFunc, right); c != nil {
+			return evalCallExpression(c, right, scope)
+		}
+	default:
+		return NIL
+	}
+	if call == nil {
+		return pipeError(node)
+	}
+	return Eval(call, scope)
+}
+
+func pipeError(node *ast.InfixExpression) Object {
+	return newError(node.Pos().Sline(), ERR_PIPE)
+}
+
+// the call of 'x |> f(y)' or 'x |> obj.f(y)', which passes the piped value as
+// the first argument: 'f(x, y)', nil if the right hand side is not a call.
+// The pipe's own nodes are not changed.
+func pipedCall(node *ast.InfixExpression) ast.Expression {
 	switch rightFunc := node.Right.(type) {
 	case *ast.MethodCallExpression:
-		switch rightFunc.Call.(type) {
+		var call *ast.CallExpression
+		switch c := rightFunc.Call.(type) {
 		case *ast.Identifier:
 			//e.g.
 			//x = "hello, world" |> xxx.upper    : rightFunc.Call.(type) == *ast.Identifier
 			//x = "hello, world" |> xxx.upper()  : rightFunc.Call.(type) == *ast.CallExpression
 			//so here we convert *ast.Identifier to * ast.CallExpression
-			rightFunc.Call = &ast.CallExpression{Token: node.Token, Function: rightFunc.Call}
+			call = &ast.CallExpression{Token: node.Token, Function: c}
+		case *ast.CallExpression:
+			copied := *c
+			call = &copied
+		default:
+			return nil
 		}
-		rightFunc.Call.(*ast.CallExpression).Arguments = append([]ast.Expression{node.Left}, rightFunc.Call.(*ast.CallExpression).Arguments...)
-		return Eval(rightFunc, scope)
+		call.Arguments = append([]ast.Expression{node.Left}, call.Arguments...)
+		return &ast.MethodCallExpression{Token: rightFunc.Token, Object: rightFunc.Object, Call: call}
 	case *ast.CallExpression:
-		rightFunc.Arguments = append([]ast.Expression{node.Left}, rightFunc.Arguments...)
-		return Eval(rightFunc, scope)
-	case *ast.Identifier:
-		right := Eval(node.Right, scope)
-		if isError(right) {
-			return right
-		}
-		if right.Type() == FUNCTION_OBJ {
-			call := &ast.CallExpression{Token: node.Token, Function: rightFunc, Variadic: right.(*Function).Literal.Variadic}
-			call.Arguments = append([]ast.Expression{node.Left}, call.Arguments...)
-			return evalCallExpression(call, right, scope)
-		} else {
-			return newError(node.Pos().Sline(), ERR_PIPE)
-		}
+		call := *rightFunc
+		call.Arguments = append([]ast.Expression{node.Left}, rightFunc.Arguments...)
+		return &call
 	}
+	return nil
+}
 
-	return NIL
+// the call of 'x |> f', where 'fn' is the value of 'f', nil if it's not a
+// function. A variadic function unboxes the piped value.
+func pipedFuncCall(node *ast.InfixExpression, rightFunc *ast.Identifier, fn Object) *ast.CallExpression {
+	switch f := fn.(type) {
+	case *Function:
+		return &ast.CallExpression{Token: node.Token, Function: rightFunc, Arguments: []ast.Expression{node.Left}, Variadic: f.Literal.Variadic}
+	case *Builtin, *GoFuncObject, *BoundMethod: //e.g. 'x |> f' where 'f = obj.method'
+		return &ast.CallExpression{Token: node.Token, Function: rightFunc, Arguments: []ast.Expression{node.Left}}
+	}
+	return nil
 }
 
 func evalPostfixExpression(node *ast.PostfixExpression, left Object, scope *Scope) Object {
@@ -788,11 +1092,26 @@ func evalDecrementPostfixExpression(node *ast.PostfixExpression, left Object, sc
 	}
 }
 
-func evalLetStatement(l *ast.LetStatement, scope *Scope) (val Object) {
+func evalLetStatement(l *ast.LetStatement, scope *Scope) Object {
+	vals := make([]Object, len(l.Values))
+	for i, value := range l.Values {
+		vals[i] = Eval(value, scope)
+	}
+	return bindLetValues(l, vals, scope)
+}
+
+// bind the evaluated values of the let statement to its names
+func bindLetValues(l *ast.LetStatement, vals []Object, scope *Scope) (val Object) {
 	values := []Object{}
 	valuesLen := 0
-	for _, value := range l.Values {
-		val := Eval(value, scope)
+	for _, val := range vals {
+		if len(l.Values) == 1 && len(l.Names) > 1 && isLazyIterable(val) { //let a, b = generator()
+			members, errObj := iterateAll(l.Pos().Sline(), scope, val)
+			if errObj != nil {
+				return errObj
+			}
+			val = &Tuple{Members: members, IsMulti: true}
+		}
 		if val.Type() == TUPLE_OBJ {
 			tupleObj := val.(*Tuple)
 			if tupleObj.IsMulti {
@@ -834,18 +1153,37 @@ func evalLetStatement(l *ast.LetStatement, scope *Scope) (val Object) {
 
 func evalReturnStatement(r *ast.ReturnStatement, scope *Scope) Object {
 	if r.ReturnValue == nil { //no return value, we default return `NIL` object
-		return &ReturnValue{Value: NIL, Values: []Object{NIL}}
+		return newReturnValue(nil)
+	}
+	if r.IsTailCall {
+		return evalTailCall(r.ReturnValue.(*ast.CallExpression), scope)
 	}
 
-	ret := &ReturnValue{}
+	var values []Object
 	for _, value := range r.ReturnValues {
-		ret.Values = append(ret.Values, Eval(value, scope))
+		values = append(values, Eval(value, scope))
+	}
+	return newReturnValue(values)
+}
+
+// the tail call of 'tailcall f(x)' or 'return f(x)'. The arguments and the
+// function are evaluated here, so the variables of the loops and the catch
+// clauses which the call leaves are still set, the caller runs the call.
+func evalTailCall(call *ast.CallExpression, scope *Scope) Object {
+	args := evalExpressions(call.Arguments, scope)
+	if len(args) == 1 && isError(args[0]) {
+		return args[0]
 	}
+	return &TailCall{call: call, args: args, fn: Eval(call.Function, scope)}
+}
 
-	// for old campatibility
-	ret.Value = ret.Values[0]
+func newReturnValue(values []Object) *ReturnValue {
+	if len(values) == 0 {
+		return &ReturnValue{Value: NIL, Values: []Object{NIL}}
+	}
 
-	return ret
+	// for old campatibility
+	return &ReturnValue{Value: values[0], Values: values}
 }
 
 func evalIdentifier(node *ast.Identifier, scope *Scope) Object {
@@ -854,7 +1192,11 @@ func evalIdentifier(node *ast.Identifier, scope *Scope) Object {
 		return obj
 	}
 
-	if val, ok := scope.Get(node.Value); ok {
+	val, ok, resolved := scope.lookup(node)
+	if !resolved {
+		val, ok = scope.Get(node.Value)
+	}
+	if ok {
 		return val
 	}
 
@@ -900,14 +1242,19 @@ func evalExpressions(exps []ast.Expression, scope *Scope) []Object {
 	return result
 }
 
-func evalIndexExpression(node *ast.IndexExpression, left, index Object) Object {
+func evalIndexExpression(node *ast.IndexExpression, left, index Object, scope *Scope) Object {
 	switch {
+	case left.Type() == STRUCT_OBJ:
+		if r, ok := callProtocol(node.Pos().Sline(), scope, left, PROTO_INDEX, index); ok {
+			return r
+		}
+		return newError(node.Pos().Sline(), ERR_NOINDEXABLE, left.Type())
 	case left.Type() == STRING_OBJ:
 		return evalStringIndex(node.Pos().Sline(), left, index)
 	case left.Type() == ARRAY_OBJ:
 		return evalArrayIndexExpression(node.Pos().Sline(), left, index)
 	case left.Type() == HASH_OBJ:
-		return evalHashIndexExpression(node.Pos().Sline(), left, index)
+		return evalHashIndexExpression(node.Pos().Sline(), scope, left, index)
 	case left.Type() == TUPLE_OBJ:
 		return evalTupleIndexExpression(node.Pos().Sline(), left, index)
 	default:
@@ -929,6 +1276,10 @@ func evalStringIndex(line string, left, index Object) Object {
 
 func evalArrayIndexExpression(line string, array, index Object) Object {
 	arrayObject := array.(*Array)
+	if threaded.Load() {
+		arrayObject.mu.Lock()
+		defer arrayObject.mu.Unlock()
+	}
 	idx := int64(index.(*Number).Value)
 	max := int64(len(arrayObject.Members) - 1)
 	if idx < 0 || idx > max {
@@ -950,14 +1301,12 @@ func evalTupleIndexExpression(line string, tuple, index Object) Object {
 	return tupleObject.Members[idx]
 }
 
-func evalHashIndexExpression(line string, hash, index Object) Object {
+func evalHashIndexExpression(line string, scope *Scope, hash, index Object) Object {
 	hashObject := hash.(*Hash)
-	key, ok := index.(Hashable)
-	if !ok {
-		return newError(line, ERR_KEY, index.Type())
+	pair, ok, errObj := hashObject.lookup(line, scope, index)
+	if errObj != nil {
+		return errObj
 	}
-
-	pair, ok := hashObject.Pairs[key.HashKey()]
 	if !ok {
 		return NIL
 	}
@@ -975,7 +1324,7 @@ func evalHashLiteral(node *ast.HashLiteral, scope *Scope) Object {
 			return k
 		}
 
-		if _, ok := k.(Hashable); !ok {
+		if _, ok := hashable(k); !ok {
 			return newError(node.Pos().Sline(), ERR_KEY, k.Type())
 		}
 
@@ -984,7 +1333,9 @@ func evalHashLiteral(node *ast.HashLiteral, scope *Scope) Object {
 		if v.Type() == ERROR_OBJ {
 			return v
 		}
-		hash.push(node.Pos().Sline(), k, v)
+		if r := hash.push(node.Pos().Sline(), scope, k, v); failed(r) {
+			return r
+		}
 	}
 	return hash
 }
@@ -1018,137 +1369,196 @@ func evalHashLiteral(node *ast.HashLiteral, scope *Scope) Object {
 
 func evalMethodCallExpression(call *ast.MethodCallExpression, scope *Scope) Object {
 	//First check if is a stanard library object
+	switch goMemberOf(call) {
+	case goVar:
+		return goMember(call, scope)
+	case goMethod:
+		args := evalExpressions(call.Call.(*ast.CallExpression).Arguments, scope)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+		return goMethodCall(call, args, scope)
+	}
+
+	obj := Eval(call.Object, scope)
+	if obj.Type() == ERROR_OBJ {
+		return obj
+	}
+
+	o, ok := call.Call.(*ast.CallExpression)
+	if !ok {
+		return evalMember(call, obj, scope)
+	}
+	if m, ok := obj.(*Hash); ok {
+		funcObj := m.get(call.Call.Pos().Sline(), scope, NewString(o.Function.String()))
+		if isError(funcObj) {
+			return funcObj
+		}
+		return evalCallExpression(o, funcObj, scope)
+	}
+	if errObj := checkMethodCall(call, obj); errObj != nil {
+		return errObj
+	}
+	args := evalExpressions(o.Arguments, scope)
+	if len(args) == 1 && isError(args[0]) {
+		return args[0]
+	}
+	return applyMethodCall(call, obj, args, scope)
+}
+
+// what a member of a Go object is: 'os.Args' or 'fmt.Printf(x)'
+type goMemberKind int
+
+const (
+	notGoMember goMemberKind = iota
+	goVar                    //a Go variable, or a variable registered by 'RegisterGoVars'
+	goMethod                 //a Go function
+)
+
+func goMemberOf(call *ast.MethodCallExpression) goMemberKind {
 	str := call.Object.String()
-	if obj, ok := GetGlobalObj(str); ok {
+	if _, ok := GetGlobalObj(str); ok {
 		switch o := call.Call.(type) {
 		case *ast.Identifier: //e.g. os.xxx
-			if i, ok := GetGlobalObj(str + "." + o.String()); ok {
-				return i
+			if _, ok := GetGlobalObj(str + "." + o.String()); ok {
+				return goVar
 			}
 		case *ast.CallExpression: //e.g. method call like 'fmt.Printf()'
-			if method, ok := call.Call.(*ast.CallExpression); ok {
-				args := evalExpressions(method.Arguments, scope)
-				if len(args) == 1 && isError(args[0]) {
-					return args[0]
-				}
+			return goMethod
+		}
+	} else if _, ok := GetGlobalObj(str + "." + call.Call.String()); ok { //process variable registed using 'RegisterGoVars' method
+		return goVar
+	}
+	return notGoMember
+}
 
-				if method.Variadic {
-					args = getVariadicArgs(method, args)
-					if len(args) == 1 && isError(args[0]) {
-						return args[0]
-					}
-				}
+func goMember(call *ast.MethodCallExpression, scope *Scope) Object {
+	obj, _ := GetGlobalObj(call.Object.String() + "." + call.Call.String())
+	return goGlobal(call.Call.Pos().Sline(), scope, obj)
+}
 
-				if obj.Type() == HASH_OBJ { // It's a GoFuncObject
-					foundMethod := false
-					hash := obj.(*Hash)
-					for _, pair := range hash.Pairs {
-						funcName := pair.Key.(*String).String
-						if funcName == o.Function.String() {
-							foundMethod = true
-							goFuncObj := pair.Value.(*GoFuncObject)
-							return goFuncObj.CallMethod(call.Call.Pos().Sline(), scope, o.Function.String(), args...)
-						}
-					}
-					if !foundMethod {
-						return newError(call.Call.Pos().Sline(), ERR_NOMETHODEX, str, o.Function.String(), str, strings.Title(o.Function.String()))
-					}
-				} else {
-					return obj.CallMethod(call.Call.Pos().Sline(), scope, o.Function.String(), args...)
-				}
+// call the Go function with the evaluated arguments
+func goMethodCall(call *ast.MethodCallExpression, args []Object, scope *Scope) Object {
+	str := call.Object.String()
+	obj, _ := GetGlobalObj(str)
+	method := call.Call.(*ast.CallExpression)
+	if method.Variadic {
+		args = getVariadicArgs(method, args, scope)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
+	}
+
+	if obj.Type() == HASH_OBJ { // It's a GoFuncObject
+		hash := obj.(*Hash)
+		for _, pair := range hash.pairs(false) {
+			funcName := pair.Key.(*String).String
+			if funcName == method.Function.String() {
+				goFuncObj := pair.Value.(*GoFuncObject)
+				return goFuncObj.CallMethod(call.Call.Pos().Sline(), scope, method.Function.String(), args...)
 			}
 		}
-	} else {
-		//process variable registed using 'RegisterGoVars' method
-		if obj, ok := GetGlobalObj(str + "." + call.Call.String()); ok {
-			return obj
+		return newError(call.Call.Pos().Sline(), ERR_NOMETHODEX, str, method.Function.String(), str, strings.Title(method.Function.String()))
+	}
+	return obj.CallMethod(call.Call.Pos().Sline(), scope, method.Function.String(), args...)
+}
+
+// check if the object's method could be called, before the arguments are
+// evaluated. The hashes' functions are called like the other functions.
+func checkMethodCall(call *ast.MethodCallExpression, obj Object) Object {
+	switch obj.(type) {
+	case *RuntimeError:
+		return newError(call.Call.Pos().Sline(), ERR_NOMETHOD, call.String(), obj.Type())
+	case *Struct:
+		funcName := call.Call.(*ast.CallExpression).Function.String()
+		if !unicode.IsUpper(rune(funcName[0])) && call.Object.String() != "self" {
+			return newError(call.Call.Pos().Sline(), ERR_NAMENOTEXPORTED, call.Object.String(), funcName)
 		}
 	}
+	return nil
+}
 
-	obj := Eval(call.Object, scope)
-	if obj.Type() == ERROR_OBJ {
-		return obj
+// call the object's method with the evaluated arguments
+func applyMethodCall(call *ast.MethodCallExpression, obj Object, args []Object, scope *Scope) Object {
+	o := call.Call.(*ast.CallExpression)
+	if o.Variadic {
+		args = getVariadicArgs(o, args, scope)
+		if len(args) == 1 && isError(args[0]) {
+			return args[0]
+		}
 	}
 
+	switch obj.(type) {
+	case *Struct, *Module:
+		return obj.CallMethod(call.Call.Pos().Sline(), scope, o.Function.String(), args...)
+	}
+	size := sizeOf(obj)
+	r := obj.CallMethod(call.Call.Pos().Sline(), scope, o.Function.String(), args...)
+	return scope.chargeMethod(call, obj, size, r)
+}
+
+// get the object's member which is not a method call: 'obj.name' or 'arr.1'
+func evalMember(call *ast.MethodCallExpression, obj Object, scope *Scope) Object {
 	switch m := obj.(type) {
+	case *RuntimeError:
+		if o, ok := call.Call.(*ast.Identifier); ok { //e.g. 'e.kind'
+			return m.get(call.Call.Pos().Sline(), o.Value)
+		}
 	case *Struct:
 		switch o := call.Call.(type) {
 		case *ast.Identifier:
 			if i, ok := m.Scope.Get(call.Call.String()); ok {
-				return i
-			}
-		case *ast.CallExpression:
-			funcName := o.Function.String()
-			if !unicode.IsUpper(rune(funcName[0])) && str != "self" {
-				return newError(call.Call.Pos().Sline(), ERR_NAMENOTEXPORTED, call.Object.String(), funcName)
-			}
-			args := evalExpressions(o.Arguments, scope)
-			if len(args) == 1 && isError(args[0]) {
-				return args[0]
-			}
-
-			if o.Variadic {
-				args = getVariadicArgs(o, args)
-				if len(args) == 1 && isError(args[0]) {
-					return args[0]
+				switch i.(type) {
+				case *Function, *Builtin:
+					if !m.isMethod(o.Value) {
+						return i
+					}
+					if !unicode.IsUpper(rune(o.Value[0])) && call.Object.String() != "self" {
+						return newError(call.Call.Pos().Sline(), ERR_NAMENOTEXPORTED, call.Object.String(), o.Value)
+					}
+					return &BoundMethod{Receiver: m, Name: o.Value, node: call}
 				}
+				return i
 			}
-
-			r := obj.CallMethod(call.Call.Pos().Sline(), scope, funcName, args...)
-			return r
 		case *ast.IndexExpression: //e.g. math.xxx[i] (assume 'math' is a struct)
 			//left := Eval(o.Left, m.Scope)
 			//index := Eval(o.Index, m.Scope)
 			//return evalIndexExpression(o, left, index)
-			return Eval(o, m.Scope)
+			return evalBody(o, m.Scope)
+		}
+	case *Module:
+		if o, ok := call.Call.(*ast.Identifier); ok {
+			return m.get(call.Call.Pos().Sline(), o.Value)
 		}
 	case *Hash:
-		switch o := call.Call.(type) {
-		case *ast.Identifier:
+		if _, ok := call.Call.(*ast.Identifier); ok {
 			index := NewString(call.Call.String())
-			return evalHashIndexExpression(call.Call.Pos().Sline(), m, index)
-		case *ast.CallExpression:
-			funcObj := m.get(call.Call.Pos().Sline(), NewString(o.Function.String()))
-			if isError(funcObj) {
-				return funcObj
-			}
-			return evalCallExpression(o, funcObj, scope)
+			return evalHashIndexExpression(call.Call.Pos().Sline(), scope, m, index)
 		}
 	default:
 		if obj.Type() == ARRAY_OBJ {
-			switch call.Call.(type) {
+			switch o := call.Call.(type) {
 			case *ast.NumberLiteral:
-				index := Eval(call.Call, scope)
+				index := evalNumber(o, scope)
 				return evalArrayIndexExpression(call.Call.Pos().Sline(), obj, index)
 			}
 		} else if obj.Type() == TUPLE_OBJ {
-			switch call.Call.(type) {
+			switch o := call.Call.(type) {
 			case *ast.NumberLiteral:
-				index := Eval(call.Call, scope)
+				index := evalNumber(o, scope)
 				return evalTupleIndexExpression(call.Call.Pos().Sline(), m, index)
 			}
 		} else if obj.Type() == STRING_OBJ {
-			switch call.Call.(type) {
+			switch o := call.Call.(type) {
 			case *ast.NumberLiteral:
-				index := Eval(call.Call, scope)
+				index := evalNumber(o, scope)
 				return evalStringIndex(call.Call.Pos().Sline(), m, index)
 			}
 		}
 
-		if method, ok := call.Call.(*ast.CallExpression); ok {
-			args := evalExpressions(method.Arguments, scope)
-			if len(args) == 1 && isError(args[0]) {
-				return args[0]
-			}
-
-			if method.Variadic {
-				args = getVariadicArgs(method, args)
-				if len(args) == 1 && isError(args[0]) {
-					return args[0]
-				}
-			}
-
-			return obj.CallMethod(call.Call.Pos().Sline(), scope, method.Function.String(), args...)
+		//e.g. 'arr.push', the method is looked up when it's called
+		if o, ok := call.Call.(*ast.Identifier); ok && obj.Type() != NIL_OBJ {
+			return &BoundMethod{Receiver: obj, Name: o.Value, node: call}
 		}
 	}
 
@@ -1156,44 +1566,59 @@ func evalMethodCallExpression(call *ast.MethodCallExpression, scope *Scope) Obje
 }
 
 func evalMultiAssignStatement(ma *ast.MultiAssignStatement, scope *Scope) Object {
-	values := []Object{}
-	valuesLen := 0
-
-	for _, value := range ma.Values {
-		val := Eval(value, scope)
-		if val.Type() == ERROR_OBJ {
-			return val
+	vals := make([]Object, len(ma.Values))
+	for i, value := range ma.Values {
+		vals[i] = Eval(value, scope)
+		if vals[i].Type() == ERROR_OBJ {
+			return vals[i]
 		}
+	}
+	values, errObj := multiAssignValues(ma, vals, scope)
+	if errObj != nil {
+		return errObj
+	}
 
-		if val.Type() == TUPLE_OBJ {
+	for idx, name := range ma.Names {
+		if name.TokenLiteral() == "_" { // _: placeholder
+			continue
+		}
+
+		a := &ast.AssignExpression{Token: ma.Token, Name: name}
+		_evalAssignExpression(a, values[idx], scope)
+	}
+
+	return NIL
+}
+
+// the values of the names of the multiple assignment, a function's multiple
+// results are assigned to the names one by one.
+func multiAssignValues(ma *ast.MultiAssignStatement, vals []Object, scope *Scope) ([]Object, Object) {
+	values := []Object{}
+	for _, val := range vals {
+		if len(ma.Values) == 1 && len(ma.Names) > 1 && isLazyIterable(val) { //a, b = generator()
+			members, errObj := iterateAll(ma.Pos().Sline(), scope, val)
+			if errObj != nil {
+				return nil, errObj
+			}
+			val = &Tuple{Members: members, IsMulti: true}
+		}
+
+		if val.Type() == TUPLE_OBJ {
 			tupleObj := val.(*Tuple)
 			if tupleObj.IsMulti { //it's a function which returns multiple results
-				valuesLen += len(tupleObj.Members)
 				values = append(values, tupleObj.Members...)
 			} else { //it's a real tuple
-				valuesLen += 1
 				values = append(values, tupleObj)
 			}
 		} else {
-			valuesLen += 1
 			values = append(values, val)
 		}
 	}
 
 	if len(values) != len(ma.Names) {
-		return newError(ma.Pos().Sline(), ERR_MULTIASSIGN)
-	}
-
-	for idx, name := range ma.Names {
-		if name.TokenLiteral() == "_" { // _: placeholder
-			continue
-		}
-
-		a := &ast.AssignExpression{Token: ma.Token, Name: name}
-		_evalAssignExpression(a, values[idx], scope)
+		return nil, newError(ma.Pos().Sline(), ERR_MULTIASSIGN)
 	}
-
-	return NIL
+	return values, nil
 }
 
 func evalAssignExpression(a *ast.AssignExpression, scope *Scope) Object {
@@ -1206,63 +1631,125 @@ func evalAssignExpression(a *ast.AssignExpression, scope *Scope) Object {
 }
 
 func _evalAssignExpression(a *ast.AssignExpression, val Object, scope *Scope) Object {
-	if strings.Contains(a.Name.String(), ".") {
-		switch o := a.Name.(type) {
-		case *ast.MethodCallExpression: //structObj.x = 10
-			obj := Eval(o.Object, scope)
-			if obj.Type() == ERROR_OBJ {
-				return obj
+	if o, ok := a.Name.(*ast.MethodCallExpression); ok { //structObj.x = 10
+		obj := Eval(o.Object, scope)
+		if obj.Type() == ERROR_OBJ {
+			return obj
+		}
+		return assignMember(a, obj, val, scope)
+	}
+
+	//e.g. self.items[idx] = xxx, getObj()[idx] = xxx
+	if idxExpr, ok := a.Name.(*ast.IndexExpression); ok && a.Token.Literal == "=" {
+		if _, ok := idxExpr.Left.(*ast.Identifier); !ok {
+			left := Eval(idxExpr.Left, scope)
+			if isError(left) {
+				return left
 			}
-			switch m := obj.(type) {
-			case *Struct:
-				switch c := o.Call.(type) {
-				case *ast.Identifier:
-					m.Scope.Set(c.Value, val)
-					return val
-				case *ast.IndexExpression: //structObj.xxx[idx]
-					var left Object
-					var ok bool
-
-					name := c.Left.(*ast.Identifier).Value
-					if left, ok = m.Scope.Get(name); !ok {
-						return newError(a.Pos().Sline(), ERR_UNKNOWNIDENT, name)
-					}
-					b := &ast.AssignExpression{Token: a.Token, Name: c}
-					switch left.Type() {
-					case STRING_OBJ:
-						return evalStrAssignExpression(b, name, left, m.Scope, val)
-					case ARRAY_OBJ:
-						return evalArrayAssignExpression(b, name, left, m.Scope, val)
-					case TUPLE_OBJ:
-						return evalTupleAssignExpression(b, name, left, m.Scope, val)
-					case HASH_OBJ:
-						return evalHashAssignExpression(b, name, left, m.Scope, val)
-					}
-				default:
-					//error
-				}
-			case *Hash: //h.key = xxx
-				key := NewString(o.Call.String()) //we treat 'key' as string
-				m.push(a.Pos().Sline(), key, val)
-				return NIL
-			case *Array: //a.1 = xxx
-				switch o.Call.(type) {
-				case *ast.NumberLiteral:
-					index := Eval(o.Call, scope)
-					m.set(o.Call.Pos().Sline(), index, val)
-				}
-				return NIL
-			case *String: //s.1 = xxx
-				switch o.Call.(type) {
-				case *ast.NumberLiteral:
-					index := Eval(o.Call, scope)
-					m.set(o.Call.Pos().Sline(), index, val)
-				}
-				return NIL
+			index := Eval(idxExpr.Index, scope)
+			if isError(index) {
+				return index
+			}
+			return setIndex(a, left, index, val, scope)
+		}
+	}
+
+	return assignVar(a, nil, val, scope)
+}
+
+// assign the value to the member of the evaluated object: 'obj.x = val'
+func assignMember(a *ast.AssignExpression, obj, val Object, scope *Scope) Object {
+	o := a.Name.(*ast.MethodCallExpression)
+	switch m := obj.(type) {
+	case *Struct:
+		switch c := o.Call.(type) {
+		case *ast.Identifier:
+			if a.Token.Literal != "=" { //structObj.x += 10
+				b := &ast.AssignExpression{Token: a.Token, Name: c}
+				return _evalAssignExpression(b, val, m.Scope)
+			}
+			m.Scope.Set(c.Value, val)
+			return val
+		case *ast.IndexExpression: //structObj.xxx[idx]
+			var left Object
+			var ok bool
+
+			name := c.Left.(*ast.Identifier).Value
+			if left, ok = m.Scope.Get(name); !ok {
+				return newError(a.Pos().Sline(), ERR_UNKNOWNIDENT, name)
+			}
+			b := &ast.AssignExpression{Token: a.Token, Name: c}
+			switch left.Type() {
+			case STRING_OBJ:
+				return evalStrAssignExpression(b, name, left, m.Scope, val, nil)
+			case ARRAY_OBJ:
+				return evalArrayAssignExpression(b, name, left, m.Scope, val, nil)
+			case TUPLE_OBJ:
+				return evalTupleAssignExpression(b, name, left, m.Scope, val)
+			case HASH_OBJ:
+				return evalHashAssignExpression(b, name, left, m.Scope, val, nil)
+			}
+		default:
+			//error
+		}
+	case *Hash: //h.key = xxx
+		key := NewString(o.Call.String()) //we treat 'key' as string
+		if r := m.push(a.Pos().Sline(), scope, key, val); isError(r) {
+			return r
+		}
+		return NIL
+	case *Array: //a.1 = xxx
+		switch c := o.Call.(type) {
+		case *ast.NumberLiteral:
+			index := evalNumber(c, scope)
+			m.set(o.Call.Pos().Sline(), index, val)
+		}
+		return NIL
+	case *String: //s.1 = xxx
+		switch c := o.Call.(type) {
+		case *ast.NumberLiteral:
+			index := evalNumber(c, scope)
+			m.set(o.Call.Pos().Sline(), index, val)
+		}
+		return NIL
+	}
+
+	return assignVar(a, nil, val, scope)
+}
+
+//<expression>[idx] = val, with the evaluated expression and index
+func setIndex(a *ast.AssignExpression, left, index, val Object, scope *Scope) Object {
+	line := a.Pos().Sline()
+	switch m := left.(type) {
+	case *Array:
+		if _, ok := index.(*Number); !ok {
+			return newError(line, ERR_PARAMTYPE, "first", "set", "*Number", index.Type())
+		}
+		if r := m.set(line, index, val); isError(r) {
+			return r
+		}
+		return val
+	case *Hash:
+		if r := m.push(line, scope, index, val); failed(r) {
+			return r
+		}
+		return val
+	case *Struct:
+		if r, ok := callProtocol(line, scope, m, PROTO_SETINDEX, index, val); ok {
+			if isError(r) {
+				return r
 			}
+			return val
 		}
 	}
 
+	return newError(line, ERR_INFIXOP, left.Type(), a.Token.Literal, val.Type())
+}
+
+// assign the value to the variable, or to its element: 'x = val', 'x += val',
+// 'arr[idx] = val'. 'index' is the evaluated index of 'arr[idx] = val', or
+// nil if it's evaluated when it's used.
+func assignVar(a *ast.AssignExpression, index, val Object, scope *Scope) Object {
 	var name string
 	switch nodeType := a.Name.(type) {
 	//a = 10
@@ -1298,18 +1785,62 @@ func _evalAssignExpression(a *ast.AssignExpression, val Object, scope *Scope) Ob
 	case NUMBER_OBJ:
 		return evalNumAssignExpression(a, name, left, scope, val)
 	case STRING_OBJ:
-		return evalStrAssignExpression(a, name, left, scope, val)
+		return evalStrAssignExpression(a, name, left, scope, val, index)
 	case ARRAY_OBJ:
-		return evalArrayAssignExpression(a, name, left, scope, val)
+		return evalArrayAssignExpression(a, name, left, scope, val, index)
 	case TUPLE_OBJ:
 		return evalTupleAssignExpression(a, name, left, scope, val)
 	case HASH_OBJ:
-		return evalHashAssignExpression(a, name, left, scope, val)
+		return evalHashAssignExpression(a, name, left, scope, val, index)
+	case STRUCT_OBJ:
+		return evalStructAssignExpression(a, name, left, scope, val, index)
 	}
 
 	return newError(a.Pos().Sline(), ERR_INFIXOP, left.Type(), a.Token.Literal, val.Type())
 }
 
+// the index of 'x[idx] = val', unless it's evaluated already
+func assignIndex(node *ast.IndexExpression, index Object, scope *Scope) Object {
+	if index != nil {
+		return index
+	}
+	return evalBody(node.Index, scope)
+}
+
+//structObj[idx] = item   (calls '__setindex__')
+//structObj += item       (calls '__add__', same for other compound assignment operators)
+func evalStructAssignExpression(a *ast.AssignExpression, name string, left Object, scope *Scope, val, index Object) Object {
+	line := a.Pos().Sline()
+	if a.Token.Literal == "=" {
+		if nodeType, ok := a.Name.(*ast.IndexExpression); ok {
+			index = assignIndex(nodeType, index, scope)
+			if isError(index) {
+				return index
+			}
+			if r, ok := callProtocol(line, scope, left, PROTO_SETINDEX, index, val); ok {
+				if isError(r) {
+					return r
+				}
+				return val
+			}
+		}
+		return newError(line, ERR_INFIXOP, left.Type(), a.Token.Literal, val.Type())
+	}
+
+	if _, ok := a.Name.(*ast.Identifier); ok {
+		operator := strings.TrimSuffix(a.Token.Literal, "=") // '+=' => '+'
+		if r, ok := callProtocol(line, scope, left, binaryProtocols[operator], val); ok {
+			if isError(r) {
+				return r
+			}
+			scope.Set(name, r)
+			return r
+		}
+	}
+
+	return newError(line, ERR_INFIXOP, left.Type(), a.Token.Literal, val.Type())
+}
+
 // num += num
 // num -= num
 // etc...
@@ -1341,14 +1872,14 @@ func evalNumAssignExpression(a *ast.AssignExpression, name string, left Object,
 
 //str[idx] = item
 //str += item
-func evalStrAssignExpression(a *ast.AssignExpression, name string, left Object, scope *Scope, val Object) (ret Object) {
+func evalStrAssignExpression(a *ast.AssignExpression, name string, left Object, scope *Scope, val, index Object) (ret Object) {
 	leftVal := left.(*String).String
 
 	switch a.Token.Literal {
 	case "=":
 		switch nodeType := a.Name.(type) {
 		case *ast.IndexExpression: //str[idx] = xxx
-			index := Eval(nodeType.Index, scope)
+			index = assignIndex(nodeType, index, scope)
 			if index == NIL {
 				ret = NIL
 				return
@@ -1380,8 +1911,8 @@ func evalStrAssignExpression(a *ast.AssignExpression, name string, left Object,
 //array[idx] = item
 //array += item (push item to end of array)
 //array[idx] += item
-func evalArrayAssignExpression(a *ast.AssignExpression, name string, left Object, scope *Scope, val Object) (ret Object) {
-	leftVals := left.(*Array).Members
+func evalArrayAssignExpression(a *ast.AssignExpression, name string, left Object, scope *Scope, val, index Object) (ret Object) {
+	leftVals := left.(*Array).members()
 	switch a.Token.Literal {
 	case "+=":
 		switch nodeType := a.Name.(type) {
@@ -1395,7 +1926,7 @@ func evalArrayAssignExpression(a *ast.AssignExpression, name string, left Object
 	case "=":
 		switch nodeType := a.Name.(type) {
 		case *ast.IndexExpression: //arr[idx] = xxx
-			index := Eval(nodeType.Index, scope)
+			index = assignIndex(nodeType, index, scope)
 			if index == NIL {
 				ret = NIL
 				return
@@ -1406,6 +1937,12 @@ func evalArrayAssignExpression(a *ast.AssignExpression, name string, left Object
 				return newError(a.Pos().Sline(), ERR_INDEX, idx)
 			}
 
+			if threaded.Load() {
+				arr := left.(*Array)
+				arr.mu.Lock()
+				defer arr.mu.Unlock()
+				leftVals = arr.Members
+			}
 			if idx < int64(len(leftVals)) { //index is in range
 				if a.Token.Literal == "=" {
 					leftVals[idx] = val
@@ -1450,19 +1987,26 @@ func evalTupleAssignExpression(a *ast.AssignExpression, name string, left Object
 }
 
 //hash[key] = value
-func evalHashAssignExpression(a *ast.AssignExpression, name string, left Object, scope *Scope, val Object) (ret Object) {
+func evalHashAssignExpression(a *ast.AssignExpression, name string, left Object, scope *Scope, val, index Object) (ret Object) {
 	leftHash := left.(*Hash)
 	switch a.Token.Literal {
 	case "=":
 		switch nodeType := a.Name.(type) {
 		case *ast.IndexExpression: //hashObj[key] = val
-			key := Eval(nodeType.Index, scope)
-			leftHash.push(a.Pos().Sline(), key, val)
+			key := assignIndex(nodeType, index, scope)
+			if isError(key) {
+				return key
+			}
+			if r := leftHash.push(a.Pos().Sline(), scope, key, val); failed(r) {
+				return r
+			}
 			return leftHash
 		case *ast.Identifier: //hashObj.key = val
 			key := strings.Split(a.Name.String(), ".")[1]
 			keyObj := NewString(key)
-			leftHash.push(a.Pos().Sline(), keyObj, val)
+			if r := leftHash.push(a.Pos().Sline(), scope, keyObj, val); isError(r) {
+				return r
+			}
 			return leftHash
 		}
 		return newError(a.Pos().Sline(), ERR_INFIXOP, left.Type(), a.Token.Literal, val.Type())
@@ -1482,6 +2026,7 @@ func evalCForLoopExpression(fl *ast.CForLoop, scope *Scope) Object { //fl:For Lo
 	}
 
 	var result Object = NIL
+	broken := false
 	for {
 		//condition
 		var condition Object = NIL
@@ -1497,27 +2042,16 @@ func evalCForLoopExpression(fl *ast.CForLoop, scope *Scope) Object { //fl:For Lo
 
 		//body
 		result = Eval(fl.Block, scope)
-		if result.Type() == ERROR_OBJ {
+		action := getLoopAction(fl.Label, result)
+		if action == loopReturn {
 			return result
 		}
-
-		if _, ok := result.(*Break); ok {
+		if action == loopBreak {
+			broken = true
 			break
 		}
-		if _, ok := result.(*Continue); ok {
-			if fl.Update != nil {
-				newVal := Eval(fl.Update, scope) //Before continue, we need to call 'Update'
-				if newVal.Type() == ERROR_OBJ {
-					return newVal
-				}
-			}
-
-			continue
-		}
-		if v, ok := result.(*ReturnValue); ok {
-			return v
-		}
 
+		//Before continue, we need to call 'Update'
 		if fl.Update != nil {
 			newVal := Eval(fl.Update, scope)
 			if newVal.Type() == ERROR_OBJ {
@@ -1527,10 +2061,61 @@ func evalCForLoopExpression(fl *ast.CForLoop, scope *Scope) Object { //fl:For Lo
 	}
 
 	if result == nil || result.Type() == BREAK_OBJ || result.Type() == CONTINUE_OBJ {
-		return NIL
+		result = NIL
 	}
 
-	return result
+	return evalLoopElse(fl.Else, broken, result, scope)
+}
+
+// how a loop goes on after evaluating its body
+type loopAction int
+
+const (
+	loopNext   loopAction = iota //next iteration(normal or 'continue')
+	loopBreak                    //'break' the loop
+	loopReturn                   //leave the loop with the body's result(return/error/throw/tailcall, or break/continue of an outer loop)
+)
+
+func getLoopAction(label string, result Object) loopAction {
+	switch r := result.(type) {
+	case *Break:
+		if r.Label == "" || r.Label == label {
+			return loopBreak
+		}
+		return loopReturn
+	case *Continue:
+		if r.Label == "" || r.Label == label {
+			return loopNext
+		}
+		return loopReturn
+	case *ReturnValue, *Error, *Throw, *TailCall:
+		return loopReturn
+	}
+	return loopNext
+}
+
+// evaluate the loop's 'else' block if the loop finished without 'break'.
+// 'value' is the loop's own result.
+func evalLoopElse(block *ast.BlockStatement, broken bool, value Object, scope *Scope) Object {
+	if block == nil || broken {
+		return value
+	}
+
+	r := Eval(block, scope)
+	if isOuterControl(r) { //control flow goes to the outer code
+		return r
+	}
+	return value
+}
+
+// the control objects which leave a loop's 'else' block or a switch's case
+// to the outer code, all but 'fallthrough'
+func isOuterControl(obj Object) bool {
+	switch obj.(type) {
+	case *Break, *Continue, *ReturnValue, *Error, *Throw, *TailCall:
+		return true
+	}
+	return false
 }
 
 // for { block }
@@ -1539,19 +2124,13 @@ func evalForEverLoopExpression(fel *ast.ForEverLoop, scope *Scope) Object {
 	var e Object = NIL
 	for {
 		e = Eval(fel.Block, scope)
-		if e.Type() == ERROR_OBJ {
+		action := getLoopAction(fel.Label, e)
+		if action == loopReturn {
 			return e
 		}
-
-		if _, ok := e.(*Break); ok {
+		if action == loopBreak {
 			break
 		}
-		if _, ok := e.(*Continue); ok {
-			continue
-		}
-		if v, ok := e.(*ReturnValue); ok {
-			return v
-		}
 	}
 
 	if e == nil || e.Type() == BREAK_OBJ || e.Type() == CONTINUE_OBJ {
@@ -1564,106 +2143,61 @@ func evalForEverLoopExpression(fel *ast.ForEverLoop, scope *Scope) Object {
 //for item in array
 //for item in string
 //for item in tuple
+//for item in hash(keys)
 //for item in goObj
+//for item in generator/iterable struct/file object
 //returns an Array-object or a Return-object
 func evalForEachArrayExpression(fal *ast.ForEachArrayLoop, scope *Scope) Object { //fal:For Array Loop
-	aValue := Eval(fal.Value, scope)
-	if aValue.Type() == ERROR_OBJ {
-		return &Array{Members: []Object{aValue}}
-	}
-
-	//first check if it's a Nil object
-	if aValue.Type() == NIL_OBJ {
-		return &Array{Members: []Object{}} //return empty array
-	}
-
-	iterObj, ok := aValue.(Iterable)
-	if !ok {
-		errObj := newError(fal.Pos().Sline(), ERR_NOTITERABLE)
-		return &Array{Members: []Object{errObj}}
-	}
-	if !iterObj.iter() {
-		errObj := newError(fal.Pos().Sline(), ERR_NOTITERABLE)
-		return &Array{Members: []Object{errObj}}
-	}
-
-	var members []Object
-	if aValue.Type() == STRING_OBJ {
-		aStr, _ := aValue.(*String)
-		runes := []rune(aStr.String)
-		for _, rune := range runes {
-			members = append(members, NewString(string(rune)))
-		}
-	} else if aValue.Type() == ARRAY_OBJ {
-		arr, _ := aValue.(*Array)
-		members = arr.Members
-	} else if aValue.Type() == TUPLE_OBJ {
-		tuple, _ := aValue.(*Tuple)
-		members = tuple.Members
-	} else if aValue.Type() == GO_OBJ { //go object
-		goObj := aValue.(*GoObject)
-		arr := goValueToObject(goObj.obj).(*Array)
-		members = arr.Members
-	}
-
-	if len(members) == 0 {
-		return &Array{Members: []Object{}} //return empty array
+	it, errObj := evalIterator(fal.Value, scope)
+	if errObj != nil {
+		return errObj
 	}
+	defer closeIterator(it)
 
 	arr := &Array{}
+	broken := false
 	defer func() {
 		scope.Del(fal.Var)
 	}()
-	for _, value := range members {
+	for {
+		value, ok := it.Next()
+		if !ok {
+			break
+		}
+		if isIterError(value) {
+			return value
+		}
 		scope.Set(fal.Var, value)
 
 		result := Eval(fal.Block, scope)
-		if result.Type() == ERROR_OBJ {
-			arr.Members = append(arr.Members, result)
-			return arr
+		action := getLoopAction(fal.Label, result)
+		if action == loopReturn {
+			return result
 		}
-
-		if _, ok := result.(*Break); ok {
+		if action == loopBreak {
+			broken = true
 			break
 		}
-		if _, ok := result.(*Continue); ok {
-			continue
-		}
-		if v, ok := result.(*ReturnValue); ok {
-			return v
-		} else {
+		if result.Type() != CONTINUE_OBJ {
 			arr.Members = append(arr.Members, result)
 		}
 	}
 
-	return arr
+	return evalLoopElse(fal.Else, broken, arr, scope)
 }
 
-//for index, value in string
-//for index, value in array
-//for index, value in tuple
+//for k, v in hash
+//for index, value in X(any iterable object except hash)
 //returns an Array-object or a Return-object
-func evalForEachArrayWithIndex(fml *ast.ForEachMapLoop, val Object, scope *Scope) Object {
-	var members []Object
-	if val.Type() == STRING_OBJ {
-		aStr, _ := val.(*String)
-		runes := []rune(aStr.String)
-		for _, rune := range runes {
-			members = append(members, NewString(string(rune)))
-		}
-	} else if val.Type() == ARRAY_OBJ {
-		arr, _ := val.(*Array)
-		members = arr.Members
-	} else if val.Type() == TUPLE_OBJ {
-		tuple, _ := val.(*Tuple)
-		members = tuple.Members
-	}
-
-	if len(members) == 0 {
-		return &Array{Members: []Object{}} //return empty error
+func evalForEachMapExpression(fml *ast.ForEachMapLoop, scope *Scope) Object { //fml:For Map Loop
+	it, errObj := evalIterator(fml.X, scope)
+	if errObj != nil {
+		return errObj
 	}
+	defer closeIterator(it)
 
 	arr := &Array{}
+	broken := false
 	defer func() {
 		if fml.Key != "_" {
 			scope.Del(fml.Key)
@@ -1672,140 +2206,66 @@ func evalForEachArrayWithIndex(fml *ast.ForEachMapLoop, val Object, scope *Scope
 			scope.Del(fml.Value)
 		}
 	}()
-	for idx, value := range members {
-		if fml.Key != "_" {
-			scope.Set(fml.Key, NewNumber(float64(idx)))
-		}
-		if fml.Value != "_" {
-			scope.Set(fml.Value, value)
-		}
 
-		result := Eval(fml.Block, scope)
-		if result.Type() == ERROR_OBJ {
-			arr.Members = append(arr.Members, result)
-			return arr
-		}
-
-		if _, ok := result.(*Break); ok {
+	for idx := 0; ; idx++ {
+		item, ok := it.Next()
+		if !ok {
 			break
 		}
-		if _, ok := result.(*Continue); ok {
-			continue
+		if isIterError(item) {
+			return item
 		}
-		if v, ok := result.(*ReturnValue); ok {
-			return v
-		} else {
-			arr.Members = append(arr.Members, result)
-		}
-	}
-
-	return arr
-}
-
-//for k, v in X { block }
-//returns an Array-object or a Return-object
-func evalForEachMapExpression(fml *ast.ForEachMapLoop, scope *Scope) Object { //fml:For Map Loop
-	aValue := Eval(fml.X, scope)
-	if aValue.Type() == ERROR_OBJ {
-		return &Array{Members: []Object{aValue}}
-	}
-
-	//first check if it's a Nil object
-	if aValue.Type() == NIL_OBJ {
-		//return an empty array object
-		return &Array{Members: []Object{}}
-	}
 
-	iterObj, ok := aValue.(Iterable)
-	if !ok {
-		errObj := newError(fml.Pos().Sline(), ERR_NOTITERABLE)
-		return &Array{Members: []Object{errObj}}
-	}
-	if !iterObj.iter() {
-		errObj := newError(fml.Pos().Sline(), ERR_NOTITERABLE)
-		return &Array{Members: []Object{errObj}}
-	}
-
-	//for index, value in arr
-	//for index, value in string
-	//for index, value in tuple
-	if aValue.Type() == STRING_OBJ || aValue.Type() == ARRAY_OBJ || aValue.Type() == TUPLE_OBJ {
-		return evalForEachArrayWithIndex(fml, aValue, scope)
-	}
-
-	hash, _ := aValue.(*Hash)
-	if len(hash.Pairs) == 0 { //hash is empty
-		return &Array{Members: []Object{}}
-	}
-
-	arr := &Array{}
-	defer func() {
-		if fml.Key != "_" {
-			scope.Del(fml.Key)
-		}
-		if fml.Value != "_" {
-			scope.Del(fml.Value)
+		key, value := keyValueOf(it, idx, item, fml.Pos().Sline(), scope)
+		if failed(value) {
+			return value
 		}
-	}()
-
-	//for _, pair := range hash.Pairs {
-	for _, hk := range hash.Order {
-		pair, _ := hash.Pairs[hk]
 		if fml.Key != "_" {
-			scope.Set(fml.Key, pair.Key)
+			scope.Set(fml.Key, key)
 		}
 		if fml.Value != "_" {
-			scope.Set(fml.Value, pair.Value)
+			scope.Set(fml.Value, value)
 		}
 
 		result := Eval(fml.Block, scope)
-		if result.Type() == ERROR_OBJ {
-			arr.Members = append(arr.Members, result)
-			return arr
+		action := getLoopAction(fml.Label, result)
+		if action == loopReturn {
+			return result
 		}
-
-		if _, ok := result.(*Break); ok {
+		if action == loopBreak {
+			broken = true
 			break
 		}
-		if _, ok := result.(*Continue); ok {
-			continue
-		}
-		if v, ok := result.(*ReturnValue); ok {
-			return v
-		} else {
+		if result.Type() != CONTINUE_OBJ {
 			arr.Members = append(arr.Members, result)
 		}
 	}
 
-	return arr
+	return evalLoopElse(fml.Else, broken, arr, scope)
 }
 
 //do { block }
 // returns the last expression value or NIL
 func evalDoLoopExpression(dl *ast.DoLoop, scope *Scope) Object {
 	var e Object = NIL
+	broken := false
 	for {
 		e = Eval(dl.Block, scope)
-		if e.Type() == ERROR_OBJ {
+		action := getLoopAction(dl.Label, e)
+		if action == loopReturn {
 			return e
 		}
-
-		if _, ok := e.(*Break); ok {
+		if action == loopBreak {
+			broken = true
 			break
 		}
-		if _, ok := e.(*Continue); ok {
-			continue
-		}
-		if v, ok := e.(*ReturnValue); ok {
-			return v
-		}
 	}
 
 	if e == nil || e.Type() == BREAK_OBJ || e.Type() == CONTINUE_OBJ {
-		return NIL
+		e = NIL
 	}
 
-	return e
+	return evalLoopElse(dl.Else, broken, e, scope)
 }
 
 //while condition { block }
@@ -1819,23 +2279,17 @@ func evalWhileLoopExpression(wl *ast.WhileLoop, scope *Scope) Object {
 		}
 
 		if !IsTrue(condition) {
-			return NIL
+			return evalLoopElse(wl.Else, false, NIL, scope)
 		}
 
 		result = Eval(wl.Block, scope)
-		if result.Type() == ERROR_OBJ {
+		action := getLoopAction(wl.Label, result)
+		if action == loopReturn {
 			return result
 		}
-
-		if _, ok := result.(*Break); ok {
+		if action == loopBreak {
 			break
 		}
-		if _, ok := result.(*Continue); ok {
-			continue
-		}
-		if v, ok := result.(*ReturnValue); ok {
-			return v
-		}
 	}
 
 	if result == nil || result.Type() == BREAK_OBJ || result.Type() == CONTINUE_OBJ {
@@ -1846,6 +2300,9 @@ func evalWhileLoopExpression(wl *ast.WhileLoop, scope *Scope) Object {
 }
 
 func evalRegExLiteral(node *ast.RegExLiteral, scope *Scope) Object {
+	if node.Regexp != nil { //precompiled
+		return &RegEx{RegExp: node.Regexp, Value: node.Value}
+	}
 	regExp, err := regexp.Compile(node.Value)
 	if err != nil {
 		return newError(node.Pos().Sline(), ERR_INVALIDARG)
@@ -1855,11 +2312,18 @@ func evalRegExLiteral(node *ast.RegExLiteral, scope *Scope) Object {
 }
 
 func evalCmdExpression(t *ast.CmdExpression, scope *Scope) Object {
+	if errObj := scope.denied(t.Pos().Sline(), CapCommand); errObj != nil {
+		return errObj
+	}
 	cmd := strings.Trim(t.Value, " ")
 
 	// interpolate any $vars in the cmd string
 	cmd = InterpolateString(cmd, scope)
+	return runCommand(scope.context(), cmd)
+}
 
+// run the command with the shell, the context kills it when it's canceled
+func runCommand(ctx context.Context, cmd string) Object {
 	var commands []string
 	var executor string
 	if runtime.GOOS == "windows" {
@@ -1873,7 +2337,7 @@ func evalCmdExpression(t *ast.CmdExpression, scope *Scope) Object {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
-	c := exec.Command(executor, commands...)
+	c := exec.CommandContext(ctx, executor, commands...)
 	c.Env = os.Environ()
 	c.Stdin = os.Stdin
 	c.Stdout = &stdout
@@ -1928,10 +2392,20 @@ func evalCmdExpression(t *ast.CmdExpression, scope *Scope) Object {
 */
 
 func evalDecorator(node *ast.DecoratorExpr, scope *Scope) Object {
-	name, fn, err := _evalDecorator(node, scope)
-	if isError(err) {
+	fn, err := _evalDecorator(node, scope)
+	if err != nil {
 		return err
 	}
+	return bindDecorated(node, fn, scope)
+}
+
+// bind the decorators' result to the decorated function's name
+func bindDecorated(node *ast.DecoratorExpr, fn Object, scope *Scope) Object {
+	//a decorated struct's calls 'StructName(args)' call the decorated constructor
+	if structStmt, ok := decoratedStruct(node); ok {
+		setStructConstructor(structStmt, fn)
+		return NIL
+	}
 
 	/* reassign the decorated function. e.g.
 	// @decorator1()
@@ -1940,50 +2414,77 @@ func evalDecorator(node *ast.DecoratorExpr, scope *Scope) Object {
 	// =>
 	   demo = decorator1(decorator2(demo))
 	*/
+	name, _ := getDecoratedFuncName(node.Decorated)
 	scope.Set(name, fn)
 	return NIL
 }
 
-//func _evalDecorator(node *ast.DecoratorExpr, scope *Scope) (name string, evaluated Object, err Object) {
-func _evalDecorator(node *ast.DecoratorExpr, scope *Scope) (string, Object, Object) {
+//func _evalDecorator(node *ast.DecoratorExpr, scope *Scope) (evaluated Object, err Object) {
+func _evalDecorator(node *ast.DecoratorExpr, scope *Scope) (Object, Object) {
 	decorator := Eval(node.Decorator, scope) //evaluate the 'decorator' iteself
 	if isError(decorator) {
-		return "", nil, decorator
+		return nil, decorator
+	}
+	if errObj := checkDecorator(node, decorator); errObj != nil {
+		return nil, errObj
 	}
 
-	if _, ok := decorator.(*Function); !ok { //if the decorator is not a function
-		return "", nil, newError(node.Pos().Sline(), ERR_DECORATOR, decorator.Inspect())
+	//evaluate the 'decorated' function(or struct, or another decorator)
+	var decorated Object
+	if d, ok := node.Decorated.(*ast.DecoratorExpr); ok {
+		// eval the last decorator first
+		var err Object
+		if decorated, err = _evalDecorator(d, scope); err != nil {
+			return nil, err
+		}
+	} else if decorated = decoratedValue(node, scope); isError(decorated) {
+		return nil, decorated
 	}
 
-	name, ok := getDecoratedFuncName(node.Decorated) //get decorated function's name
-	if !ok {
-		return "", nil, newError(node.Pos().Sline(), ERR_DECORATED_NAME)
+	result := applyFunction(node.Pos().Sline(), scope, decorator, []Object{decorated})
+	if failed(result) {
+		return nil, result
+	}
+	return result, nil
+}
+
+// check the evaluated decorator, and the decorated function's name
+func checkDecorator(node *ast.DecoratorExpr, decorator Object) Object {
+	//the decorator could be a function, a builtin, a go function or a callable struct object
+	switch decorator.(type) {
+	case *Function, *Builtin, *GoFuncObject, *BoundMethod, *Struct:
+	default:
+		return newError(node.Pos().Sline(), ERR_DECORATOR, decorator.Inspect())
+	}
+
+	if _, ok := getDecoratedFuncName(node.Decorated); !ok { //get decorated function's name
+		return newError(node.Pos().Sline(), ERR_DECORATED_NAME)
 	}
+	return nil
+}
 
-	decoratorFn := decorator.(*Function)
-	//evaluate the 'decorated' function(or another decorator)
-	switch decorated := node.Decorated.(type) {
+// the decorated function, or the decorated struct's constructor
+func decoratedValue(node *ast.DecoratorExpr, scope *Scope) Object {
+	switch d := node.Decorated.(type) {
 	case *ast.FunctionLiteral:
-		decoratedFn := &Function{Literal: decorated, Scope: scope}
-		return name, applyFunction(decorated.Pos().Sline(), scope, decoratorFn, []Object{decoratedFn}), nil
-	case *ast.DecoratorExpr:
-		// eval the last decorator first
-		name, decoratedFn, err := _evalDecorator(decorated, scope)
-		if isError(err) {
-			return "", nil, err
+		return &Function{Literal: d, Scope: scope}
+	case *ast.StructStatement:
+		if r := evalStructStatement(d, scope); isError(r) {
+			return r
 		}
-		return name, applyFunction(node.Pos().Sline(), scope, decoratorFn, append([]Object{decoratedFn})), nil
+		return structConstructor(d, scope)
 	}
-
 	//should never reach here
-	return "", nil, newError(node.Pos().Sline(), ERR_DECORATOR_FN)
+	return newError(node.Pos().Sline(), ERR_DECORATOR_FN)
 }
 
-// get the actual name of the decorated function.
+// get the actual name of the decorated function(or struct).
 func getDecoratedFuncName(decorated ast.Expression) (string, bool) {
 	switch d := decorated.(type) {
 	case *ast.FunctionLiteral:
 		return d.Name, true
+	case *ast.StructStatement:
+		return d.Name, true
 	case *ast.DecoratorExpr:
 		return getDecoratedFuncName(d.Decorated)
 	}
@@ -1992,37 +2493,13 @@ func getDecoratedFuncName(decorated ast.Expression) (string, bool) {
 }
 
 //Unboxing
-func getVariadicArgs(call *ast.CallExpression, args []Object) []Object {
+func getVariadicArgs(call *ast.CallExpression, args []Object, scope *Scope) []Object {
 	lastArg := args[len(args)-1]
-	iterObj, ok := lastArg.(Iterable)
-	if !ok {
-		errObj := newError(call.Pos().Sline(), ERR_NOTITERABLE)
-		return []Object{errObj}
-	}
-	if !iterObj.iter() {
-		errObj := newError(call.Pos().Sline(), ERR_NOTITERABLE)
+	members, errObj := iterateAll(call.Pos().Sline(), scope, lastArg)
+	if errObj != nil {
 		return []Object{errObj}
 	}
 
-	var members []Object
-	if lastArg.Type() == STRING_OBJ {
-		aStr, _ := lastArg.(*String)
-		runes := []rune(aStr.String)
-		for _, rune := range runes {
-			members = append(members, NewString(string(rune)))
-		}
-	} else if lastArg.Type() == ARRAY_OBJ {
-		arr, _ := lastArg.(*Array)
-		members = arr.Members
-	} else if lastArg.Type() == TUPLE_OBJ {
-		tuple, _ := lastArg.(*Tuple)
-		members = tuple.Members
-	} else if lastArg.Type() == GO_OBJ { //go object
-		goObj := lastArg.(*GoObject)
-		arr := goValueToObject(goObj.obj).(*Array)
-		members = arr.Members
-	}
-
 	args = args[:len(args)-1]
 	for _, m := range members {
 		args = append(args, m)
@@ -2033,12 +2510,8 @@ func getVariadicArgs(call *ast.CallExpression, args []Object) []Object {
 
 func evalCallExpression(node *ast.CallExpression, funcObj Object, scope *Scope) Object {
 	var args []Object
-	if len(node.Arguments) == 1 && node.Arguments[0].TokenLiteral() == ALL_ARGS {
-		if arr, ok := scope.Get(ALL_ARGS); ok {
-			for _, v := range arr.(*Array).Members {
-				args = append(args, v)
-			}
-		}
+	if isAllArgsCall(node) {
+		args = allArgs(scope)
 	} else {
 		args = evalExpressions(node.Arguments, scope)
 		if len(args) == 1 && isError(args[0]) {
@@ -2046,8 +2519,29 @@ func evalCallExpression(node *ast.CallExpression, funcObj Object, scope *Scope)
 		}
 	}
 
+	return applyCall(node.Pos().Sline(), node, funcObj, args, scope)
+}
+
+// f($_)
+func isAllArgsCall(node *ast.CallExpression) bool {
+	return len(node.Arguments) == 1 && node.Arguments[0].TokenLiteral() == ALL_ARGS
+}
+
+// the arguments of the current call, which 'f($_)' passes
+func allArgs(scope *Scope) []Object {
+	var args []Object
+	if arr, ok := scope.Get(ALL_ARGS); ok {
+		for _, v := range arr.(*Array).Members {
+			args = append(args, v)
+		}
+	}
+	return args
+}
+
+// call the function(or create the struct object) with the evaluated arguments
+func applyCall(line string, node *ast.CallExpression, funcObj Object, args []Object, scope *Scope) Object {
 	if node.Variadic {
-		args = getVariadicArgs(node, args)
+		args = getVariadicArgs(node, args, scope)
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
@@ -2055,20 +2549,7 @@ func evalCallExpression(node *ast.CallExpression, funcObj Object, scope *Scope)
 
 	//check if it is a struct call
 	if structStmt, ok := scope.GetStruct(node.Function.String()); ok {
-		structObj := createStructObj(structStmt, scope)
-		//check if the struct has 'init' function
-		if _, ok := structObj.Scope.Get("init"); !ok {
-			if len(args) > 0 { //No "init" constructor,but has arguments passed.
-				return newError(node.Pos().Sline(), ERR_NOCONSTRUCTOR, len(args))
-			}
-			return structObj
-		}
-		//call `init` constructor, then return the struct object
-		r := structObj.CallMethod(node.Pos().Sline(), scope, "init", args...)
-		if r.Type() == ERROR_OBJ {
-			return r //return error object
-		}
-		return structObj
+		return callStruct(line, structStmt, args, scope)
 	}
 
 	var function Object
@@ -2081,100 +2562,110 @@ func evalCallExpression(node *ast.CallExpression, funcObj Object, scope *Scope)
 		}
 	}
 
-	return applyFunction(node.Pos().Sline(), scope, function, args)
+	return applyFunction(line, scope, function, args)
+}
+
+// create the struct object of 'StructName(args)'
+func callStruct(line string, structStmt *ast.StructStatement, args []Object, scope *Scope) Object {
+	if ctor, ok := getStructConstructor(structStmt); ok { //a decorated struct
+		return applyFunction(line, scope, ctor, args)
+	}
+	importedMu.RLock()
+	m, ok := importedStructs[structStmt]
+	importedMu.RUnlock()
+	if ok {
+		return newStructObj(line, structStmt, m.Scope, args)
+	}
+	return newStructObj(line, structStmt, scope, args)
 }
 
-func applyFunction(line string, scope *Scope, fn Object, args []Object) Object {
+func applyFunction(line string, scope *Scope, fn Object, args []Object) (result Object) {
 	switch fn := fn.(type) {
 	case *Function:
+		if errObj := checkArgTypes(line, fn, args); errObj != nil {
+			return errObj
+		}
 		extendedScope := extendFunctionScope(fn, args)
-		evaluated := Eval(fn.Literal.Body, extendedScope)
-		if evaluated.Type() == TAIL_OBJ {
-			call := evaluated.(*TailCall).tail.Call.(*ast.CallExpression)
-
-			var o Object
-			needContinue := true
-			//expands out a recursive function into a flat for-loop control structure
-			for needContinue {
-				args2 := evalExpressions(call.Arguments, extendedScope)
-				if len(args2) == 1 && isError(args2[0]) {
-					return args2[0]
-				}
-
-				if call.Variadic {
-					args2 = getVariadicArgs(call, args2) //unboxing
-					if len(args2) == 1 && isError(args2[0]) {
-						return args2[0]
-					}
-				}
-
-				function := Eval(call.Function, extendedScope)
-				if isError(function) {
-					return function
-				}
-
-				fn2 := function.(*Function)
-				argObjTable := make(map[string]Object)
-				for i, identNode := range fn2.Literal.Parameters {
-					argObjTable[identNode.Value] = args2[i]
-				}
-
-				//This is the most important part. we reuse the scope
-				// and not making a new scope.
-				extendedScope.store = argObjTable
-				extendedScope.parentScope = fn2.Scope
-				extendedScope.Writer = scope.Writer
-
-				if fn2.Literal.Variadic { //boxing
-					ellipsisArgs := args2[len(fn2.Literal.Parameters)-1:]
-					newArgs := make([]Object, 0, len(fn2.Literal.Parameters)+1)
-					newArgs = append(newArgs, args2[:len(fn2.Literal.Parameters)-1]...)
-					args2 = append(newArgs, &Array{Members: ellipsisArgs})
-					for i, arg := range args2 {
-						extendedScope.Set(fn2.Literal.Parameters[i].String(), arg)
-					}
-				}
-
-				extendedScope.Set(ALL_ARGS, &Array{Members: args2})
-
-				o = Eval(fn2.Literal.Body, extendedScope)
-				if o.Type() == ERROR_OBJ {
-					return o
-				}
-				if tailcall, ok := o.(*TailCall); ok {
-					needContinue = true
-					call = tailcall.tail.Call.(*ast.CallExpression)
-				} else {
-					needContinue = false
-				}
-			}
-			return unwrapReturnValue(o)
-		} else {
-			return unwrapReturnValue(evaluated)
+		if fn.Literal.IsGenerator {
+			return newGenerator(fn, extendedScope)
 		}
+		if fn.Literal.IsAsync {
+			return callAsync(line, scope, fn, extendedScope)
+		}
+		if errObj := enterCall(line, scope, fn, extendedScope); errObj != nil {
+			return errObj
+		}
+		//run the deferred calls on every exit path
+		frame := extendedScope.defers
+		defer func() { result = frame.run(result) }()
+		return callBody(line, fn, extendedScope)
 	case *Builtin:
 		return fn.Fn(line, scope, args...)
+	case *GoFuncObject:
+		return fn.CallMethod(line, scope, fn.name, args...)
+	case *BoundMethod:
+		return fn.call(line, scope, args)
 	default:
+		if r, ok := callProtocol(line, scope, fn, PROTO_CALL, args...); ok { //callable struct object
+			return r
+		}
 		return newError(line, ERR_NOTFUNCTION, fn.Type())
 	}
 }
 
-func extendFunctionScope(fn *Function, args []Object) *Scope {
-	scope := NewScope(fn.Scope, nil)
-	if fn.Literal.Variadic { //boxing
-		ellipsisArgs := args[len(fn.Literal.Parameters)-1:]
-		newArgs := make([]Object, 0, len(fn.Literal.Parameters)+1)
-		newArgs = append(newArgs, args[:len(fn.Literal.Parameters)-1]...)
-		args = append(newArgs, &Array{Members: ellipsisArgs})
-		for i, arg := range args {
-			scope.Set(fn.Literal.Parameters[i].String(), arg)
+// run the function's body in the call's scope. The tail calls are run in
+// a loop instead of nesting the calls, which expands out a recursive
+// function(including the mutually recursive ones) into a flat loop.
+func callBody(line string, fn *Function, extendedScope *Scope) Object {
+	for {
+		evaluated := evalBody(fn.Literal.Body, extendedScope)
+		tail, ok := evaluated.(*TailCall)
+		if !ok {
+			return checkReturnType(line, fn, unwrapReturnValue(evaluated))
 		}
-	} else {
-		for paramIdx, param := range fn.Literal.Parameters {
-			scope.Set(param.Value, args[paramIdx])
+
+		//the structs, the builtins, the generators and the async functions are called as usual
+		call, args, function := tail.call, tail.args, tail.fn
+		fn2, ok := function.(*Function)
+		if !ok || fn2.Literal.IsGenerator || fn2.Literal.IsAsync {
+			if _, isStruct := extendedScope.GetStruct(call.Function.String()); isStruct {
+				function = nil
+			} else if isError(function) {
+				return function
+			}
+			return checkReturnType(line, fn, applyCall(call.Pos().Sline(), call, function, args, extendedScope))
 		}
+
+		if call.Variadic {
+			args = getVariadicArgs(call, args, extendedScope) //unboxing
+			if len(args) == 1 && isError(args[0]) {
+				return args[0]
+			}
+		}
+		if errObj := checkArgTypes(line, fn2, args); errObj != nil {
+			return errObj
+		}
+
+		//This is the most important part. we reuse the scope and not making
+		//a new scope, unless the deferred calls or the closures created in
+		//the scope still need it.
+		frame := extendedScope.defers
+		if len(frame.calls) > 0 || fn.Literal.Locals == nil || fn.Literal.Locals.Captured {
+			extendedScope = &Scope{Writer: extendedScope.Writer, structStore: extendedScope.structStore,
+				defers: frame, call: extendedScope.call, sandbox: extendedScope.sandbox}
+		}
+		extendedScope.parentScope = fn2.Scope
+		extendedScope.bindArgs(fn2.Literal, args)
+		extendedScope.call.fn = fn2
+		extendedScope.call.tails++
+		fn = fn2
 	}
-	scope.Set(ALL_ARGS, &Array{Members: args})
+}
+
+func extendFunctionScope(fn *Function, args []Object) *Scope {
+	scope := NewScope(fn.Scope, nil)
+	scope.bindArgs(fn.Literal, args)
+	scope.defers = &deferFrame{}
 	return scope
 }
 
@@ -2208,7 +2699,7 @@ func objectToNativeBoolean(o Object) bool {
 	case *String:
 		return obj.String != ""
 	case *Array:
-		if len(obj.Members) == 0 {
+		if obj.count() == 0 {
 			return false
 		}
 		return true
@@ -2218,7 +2709,7 @@ func objectToNativeBoolean(o Object) bool {
 		}
 		return true
 	case *Hash:
-		if len(obj.Pairs) == 0 {
+		if obj.count() == 0 {
 			return false
 		}
 		return true
@@ -2255,11 +2746,11 @@ func IsTrue(obj Object) bool {
 				return false
 			}
 		case ARRAY_OBJ:
-			if len(obj.(*Array).Members) == 0 {
+			if obj.(*Array).count() == 0 {
 				return false
 			}
 		case HASH_OBJ:
-			if len(obj.(*Hash).Pairs) == 0 {
+			if obj.(*Hash).count() == 0 {
 				return false
 			}
 		case TUPLE_OBJ:
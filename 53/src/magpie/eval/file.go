@@ -5,17 +5,45 @@ import (
 	_ "fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
 )
 
 type FileObject struct {
 	File    *os.File
 	Name    string
 	Scanner *bufio.Scanner
+
+	mu sync.Mutex //serializes the methods, the async ones run in their own goroutines
+}
+
+// the methods which have async variants, e.g. 'readLineAsync()' returns a
+// promise of 'readLine()'s result
+var asyncFileMethods = map[string]bool{
+	"read":        true,
+	"readLine":    true,
+	"write":       true,
+	"writeString": true,
+	"writeLine":   true,
+	"close":       true,
 }
 
 func (f *FileObject) Inspect() string  { return "<file object: " + f.Name + ">" }
 func (f *FileObject) Type() ObjectType { return FILE_OBJ }
 func (f *FileObject) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	if errObj := scope.denied(line, CapFile); errObj != nil {
+		return errObj
+	}
+	if name, ok := strings.CutSuffix(method, "Async"); ok && asyncFileMethods[name] {
+		return runAsync(func() Object { return f.call(line, name, args...) })
+	}
+	return f.call(line, method, args...)
+}
+
+func (f *FileObject) call(line string, method string, args ...Object) Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	switch method {
 	case "close":
 		return f.close(line, args...)
@@ -42,7 +70,7 @@ func (f *FileObject) close(line string, args ...Object) Object {
 	}
 	err := f.File.Close()
 	if err != nil {
-		return newError(line, "'close' failed. reason: %s", err.Error())
+		return newError(line, ERR_IO, "close", err.Error())
 	}
 	return TRUE
 }
@@ -64,7 +92,7 @@ func (f *FileObject) read(line string, args ...Object) Object {
 	buffer := make([]byte, int(readlen.Value))
 	n, err := f.File.Read(buffer)
 	if err != io.EOF && err != nil {
-		return newError(line, "'read' failed. reason: %s", err.Error())
+		return newError(line, ERR_IO, "read", err.Error())
 	}
 
 	if n == 0 && err == io.EOF {
@@ -83,7 +111,7 @@ func (f *FileObject) readLine(line string, args ...Object) Object {
 	}
 	aLine := f.Scanner.Scan()
 	if err := f.Scanner.Err(); err != nil {
-		return newError(line, "'readline' failed. reason: %s", err.Error())
+		return newError(line, ERR_IO, "readline", err.Error())
 	}
 	if !aLine {
 		return NIL
@@ -103,7 +131,7 @@ func (f *FileObject) write(line string, args ...Object) Object {
 
 	n, err := f.File.Write([]byte(content.String))
 	if err != nil {
-		return newError(line, "'write' failed. reason: %s", err.Error())
+		return newError(line, ERR_IO, "write", err.Error())
 	}
 
 	return NewNumber(float64(n))
@@ -121,7 +149,7 @@ func (f *FileObject) writeString(line string, args ...Object) Object {
 
 	ret, err := f.File.WriteString(content.String)
 	if err != nil {
-		return newError(line, "'writeString' failed. reason: %s", err.Error())
+		return newError(line, ERR_IO, "writeString", err.Error())
 	}
 
 	return NewNumber(float64(ret))
@@ -139,7 +167,7 @@ func (f *FileObject) writeLine(line string, args ...Object) Object {
 
 	ret, err := f.File.Write([]byte(content.String + "\n"))
 	if err != nil {
-		return newError(line, "'writeLine' failed. reason: %s", err.Error())
+		return newError(line, ERR_IO, "writeLine", err.Error())
 	}
 
 	return NewNumber(float64(ret))
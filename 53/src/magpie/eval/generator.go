@@ -0,0 +1,195 @@
+package eval
+
+import (
+	"magpie/ast"
+	"runtime"
+	"sync"
+)
+
+// genContext is used for the communication between the generator
+// function's body(running in its own goroutine) and the caller.
+type genContext struct {
+	values chan Object   //yielded values
+	resume chan Object   //values sent by the caller('next' sends NIL)
+	stop   chan struct{} //closed when the generator is closed
+}
+
+// Generator is returned when calling a function which contains 'yield'.
+// The function's body does not run until the first 'next' call, and it
+// suspends at each 'yield' until the next 'next' call.
+type Generator struct {
+	Name  string
+	Body  *ast.BlockStatement
+	Scope *Scope
+
+	ctx       *genContext
+	started   bool
+	done      bool
+	closeOnce sync.Once
+}
+
+func newGenerator(fn *Function, scope *Scope) *Generator {
+	g := &Generator{Name: fn.Literal.Name, Body: fn.Literal.Body, Scope: scope}
+	g.ctx = &genContext{
+		values: make(chan Object),
+		resume: make(chan Object),
+		stop:   make(chan struct{}),
+	}
+	scope.generator = g.ctx
+
+	//a generator which is not exhausted, and is no longer referenced,
+	//should not leave its goroutine blocked forever.
+	runtime.SetFinalizer(g, func(g *Generator) { g.stop() })
+	return g
+}
+
+func (g *Generator) iter() bool { return true }
+
+func (g *Generator) Inspect() string {
+	if g.Name == "" {
+		return "<generator>"
+	}
+	return "<generator " + g.Name + ">"
+}
+
+func (g *Generator) Type() ObjectType { return GENERATOR_OBJ }
+func (g *Generator) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	switch method {
+	case "next":
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		return g.next(NIL)
+	case "send":
+		if len(args) != 1 {
+			return newError(line, ERR_ARGUMENT, 1, len(args))
+		}
+		return g.next(args[0])
+	case "close":
+		if len(args) != 0 {
+			return newError(line, ERR_ARGUMENT, 0, len(args))
+		}
+		g.close()
+		return NIL
+	}
+	return newError(line, ERR_NOMETHOD, method, g.Type())
+}
+
+// resume the generator, returns a (value, ok) tuple.
+// 'sent' becomes the value of the 'yield' expression which the generator suspended at.
+func (g *Generator) next(sent Object) Object {
+	value, ok := g.Next(sent)
+	if isError(value) || value.Type() == THROW_OBJ {
+		return value
+	}
+	return &Tuple{Members: []Object{value, nativeBoolToBooleanObject(ok)}, IsMulti: true}
+}
+
+// Next resumes the generator and returns the next yielded value.
+// The second return value is false if the generator is exhausted.
+func (g *Generator) Next(sent Object) (Object, bool) {
+	if g.done {
+		return NIL, false
+	}
+	if !g.started {
+		g.started = true
+		go runGenerator(g.ctx, g.Body, g.Scope) //not referencing 'g', so the finalizer could run
+	}
+
+	g.ctx.resume <- sent
+	value, ok := <-g.ctx.values
+	if !ok {
+		g.done = true
+		return NIL, false
+	}
+	if isError(value) || value.Type() == THROW_OBJ {
+		g.done = true
+	}
+	return value, true
+}
+
+func runGenerator(ctx *genContext, body *ast.BlockStatement, scope *Scope) {
+	defer close(ctx.values)
+
+	select {
+	case <-ctx.resume:
+	case <-ctx.stop:
+		return
+	}
+
+	result := scope.defers.run(evalBody(body, scope))
+	if isError(result) || result.Type() == THROW_OBJ {
+		select {
+		case ctx.values <- result:
+		case <-ctx.stop:
+		}
+	}
+}
+
+// stop the generator, and wait for its body to return: the suspended 'yield'
+// fails, so the body's 'finally' blocks and defers have run when it returns.
+func (g *Generator) close() {
+	g.stop()
+	if g.started {
+		for range g.ctx.values { //the body may still yield before it sees the stop
+		}
+	}
+}
+
+// stop the generator without waiting, e.g. in the finalizer
+func (g *Generator) stop() {
+	g.closeOnce.Do(func() {
+		g.done = true
+		close(g.ctx.stop)
+	})
+}
+
+// get the generator context of the nearest generator function.
+func (s *Scope) getGenerator() *genContext {
+	for scope := s; scope != nil; scope = scope.parentScope {
+		if scope.generator != nil {
+			return scope.generator
+		}
+	}
+	return nil
+}
+
+func evalYieldExpression(ye *ast.YieldExpression, scope *Scope) Object {
+	if errObj := checkYield(ye, scope); errObj != nil {
+		return errObj
+	}
+
+	var value Object = NIL
+	if ye.Value != nil {
+		value = Eval(ye.Value, scope)
+		if isError(value) {
+			return value
+		}
+	}
+	return yieldValue(ye, value, scope)
+}
+
+// check that 'yield' is in a generator function, before its value is evaluated
+func checkYield(ye *ast.YieldExpression, scope *Scope) Object {
+	if scope.getGenerator() == nil {
+		return newError(ye.Pos().Sline(), ERR_YIELD)
+	}
+	return nil
+}
+
+// pass the evaluated value to the generator's caller, and wait until it's resumed
+func yieldValue(ye *ast.YieldExpression, value Object, scope *Scope) Object {
+	ctx := scope.getGenerator()
+	select {
+	case ctx.values <- value:
+	case <-ctx.stop:
+		return newError(ye.Pos().Sline(), ERR_GENCLOSED)
+	}
+
+	select {
+	case sent := <-ctx.resume:
+		return sent
+	case <-ctx.stop:
+		return newError(ye.Pos().Sline(), ERR_GENCLOSED)
+	}
+}
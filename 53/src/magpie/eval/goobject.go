@@ -22,8 +22,10 @@ func (gobj *GoObject) iter() bool {
 	kind := gobj.value.Kind()
 
 	switch kind {
-	case reflect.Slice, reflect.Array:
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
 		return true
+	case reflect.Func:
+		return isGoSeq(gobj.value.Type())
 	default:
 		return false
 	}
@@ -33,12 +35,15 @@ func (gobj *GoObject) Inspect() string  { return fmt.Sprint(gobj.obj) }
 func (gobj *GoObject) Type() ObjectType { return GO_OBJ }
 
 func (gobj *GoObject) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	if errObj := scope.denied(line, CapGo); errObj != nil {
+		return errObj
+	}
 	methodValue := gobj.value.MethodByName(method)
 	if !methodValue.IsValid() {
 		return newError(line, ERR_NOMETHOD, method, gobj.Type())
 	}
 
-	return callGoMethod(line, methodValue, args...)
+	return callGoMethod(line, scope, methodValue, args...)
 }
 
 func NewGoObject(obj interface{}) *GoObject {
@@ -56,7 +61,10 @@ func (gfn *GoFuncObject) Inspect() string  { return gfn.name }
 func (gfn *GoFuncObject) Type() ObjectType { return GFO_OBJ }
 
 func (gfn *GoFuncObject) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
-	return callGoMethod(line, reflect.ValueOf(gfn.fn), args...)
+	if errObj := scope.denied(line, CapGo); errObj != nil {
+		return errObj
+	}
+	return callGoMethod(line, scope, reflect.ValueOf(gfn.fn), args...)
 }
 
 func NewGoFuncObject(fname string, fn interface{}) *GoFuncObject {
@@ -139,7 +147,7 @@ func goValueToObject(v interface{}) Object {
 	}
 }
 
-func callGoMethod(line string, methodVal reflect.Value, args ...Object) (ret Object) {
+func callGoMethod(line string, scope *Scope, methodVal reflect.Value, args ...Object) (ret Object) {
 	defer func() {
 		if r := recover(); r != nil {
 			ret = newError(line, "error calling go method. %s", r)
@@ -151,6 +159,13 @@ func callGoMethod(line string, methodVal reflect.Value, args ...Object) (ret Obj
 	callArgs := []reflect.Value{}
 	for i := 0; i < len(args); i++ {
 		reqTyp := methodType.In(i)
+		switch args[i].(type) {
+		case *Function, *Builtin, *BoundMethod:
+			if reqTyp.Kind() == reflect.Func { //a callback
+				callArgs = append(callArgs, goFunc(line, scope, args[i], reqTyp))
+				continue
+			}
+		}
 		callArgs = append(callArgs, ObjectToGoValue(args[i], reqTyp))
 	}
 
@@ -172,6 +187,10 @@ func callGoMethod(line string, methodVal reflect.Value, args ...Object) (ret Obj
 		case reflect.Float64, reflect.Float32:
 			results = append(results, NewNumber(retVal.Float()))
 		default:
+			if obj, ok := retVal.Interface().(Object); ok { //e.g. the wrapper returned by a decorator
+				results = append(results, obj)
+				break
+			}
 			results = append(results, NewGoObject(retVal.Interface()))
 		}
 	}
@@ -187,6 +206,16 @@ func callGoMethod(line string, methodVal reflect.Value, args ...Object) (ret Obj
 	return
 }
 
+// the value of a global object, the registered Go values are denied by CapGo
+func goGlobal(line string, scope *Scope, obj Object) Object {
+	if _, ok := obj.(*GoObject); ok {
+		if errObj := scope.denied(line, CapGo); errObj != nil {
+			return errObj
+		}
+	}
+	return obj
+}
+
 func RegisterGoVars(name string, vars map[string]interface{}) error {
 	for k, v := range vars {
 		if strings.Contains(k, ".") {
@@ -211,7 +240,7 @@ func RegisterGoFunctions(name string, vars map[string]interface{}) error {
 		}
 
 		key := NewString(k)
-		hash.push("", key, NewGoFuncObject(k, v))
+		hash.push("", nil, key, NewGoFuncObject(k, v))
 	}
 
 	//Replace all '/' to '_'.
@@ -220,3 +249,11 @@ func RegisterGoFunctions(name string, vars map[string]interface{}) error {
 
 	return nil
 }
+
+// Apply calls a magpie function(or a builtin, or a callable struct object)
+// with the arguments. The Go functions registered with RegisterGoFunctions
+// could use it to call the functions they received, e.g. a decorator written
+// in Go calls the decorated function in the wrapper it returns.
+func Apply(line string, scope *Scope, fn Object, args ...Object) Object {
+	return applyFunction(line, scope, fn, args)
+}
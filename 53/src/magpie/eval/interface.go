@@ -0,0 +1,188 @@
+package eval
+
+import (
+	"magpie/ast"
+	"strings"
+	"sync"
+)
+
+// interfaces which a struct declared to implement(using 'implements'),
+// resolved when the struct statement is evaluated.
+var structInterfaces = map[*ast.StructStatement][]*Interface{}
+var interfacesMu sync.RWMutex //guards structInterfaces
+
+// the interfaces which the struct declares to implement
+func implementedInterfaces(structStmt *ast.StructStatement) []*Interface {
+	interfacesMu.RLock()
+	defer interfacesMu.RUnlock()
+	return structInterfaces[structStmt]
+}
+
+type Interface struct {
+	Name    string
+	Methods []*ast.FunctionLiteral
+	Scope   *Scope //scope used by the default implementations
+}
+
+func (i *Interface) Inspect() string  { return "<interface " + i.Name + ">" }
+func (i *Interface) Type() ObjectType { return INTERFACE_OBJ }
+func (i *Interface) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	return newError(line, ERR_NOMETHOD, method, i.Type())
+}
+
+func evalInterfaceStatement(is *ast.InterfaceStatement, scope *Scope) Object {
+	iface := &Interface{Name: is.Name, Methods: is.Methods, Scope: scope}
+	scope.Set(is.Name, iface)
+	return NIL
+}
+
+// get all the methods declared in the struct's body
+func getStructMethods(structStmt *ast.StructStatement) map[string]*ast.FunctionLiteral {
+	methods := make(map[string]*ast.FunctionLiteral)
+	for _, stmt := range structStmt.Block.Statements {
+		exprStmt, ok := stmt.(*ast.ExpressionStatement)
+		if !ok {
+			continue
+		}
+
+		switch e := exprStmt.Expression.(type) {
+		case *ast.FunctionLiteral:
+			if e.Name != "" {
+				methods[e.Name] = e
+			}
+		case *ast.DecoratorExpr:
+			if name, ok := getDecoratedFuncName(e); ok {
+				methods[name] = nil //decorated, we do not know the final parameters
+			}
+		}
+	}
+	return methods
+}
+
+// check if the struct satisfies all the interfaces it declared,
+// report all the missing methods if not.
+func checkStructConformance(structStmt *ast.StructStatement, scope *Scope) Object {
+	if len(structStmt.Implements) == 0 {
+		return NIL
+	}
+
+	methods := getStructMethods(structStmt)
+
+	var interfaces []*Interface
+	for _, ident := range structStmt.Implements {
+		obj, ok := scope.Get(ident.Value)
+		if !ok {
+			return newError(ident.Pos().Sline(), ERR_UNKNOWNIDENT, ident.Value)
+		}
+		iface, ok := obj.(*Interface)
+		if !ok {
+			return newError(ident.Pos().Sline(), ERR_NOTINTERFACE, ident.Value, obj.Type())
+		}
+
+		missing := []string{}
+		for _, m := range iface.Methods {
+			fn, ok := methods[m.Name]
+			if !ok {
+				if m.Body == nil { //no default implementation
+					missing = append(missing, m.Name)
+				}
+				continue
+			}
+
+			if fn != nil && (len(fn.Parameters) != len(m.Parameters) || fn.Variadic != m.Variadic) {
+				return newError(structStmt.Pos().Sline(), ERR_METHODSIGNATURE, structStmt.Name, m.Name, iface.Name, m.String())
+			}
+		}
+
+		if len(missing) > 0 {
+			return newError(structStmt.Pos().Sline(), ERR_NOTIMPLEMENTED, structStmt.Name, iface.Name, strings.Join(missing, ", "))
+		}
+		interfaces = append(interfaces, iface)
+	}
+
+	interfacesMu.Lock()
+	structInterfaces[structStmt] = interfaces
+	interfacesMu.Unlock()
+	return NIL
+}
+
+// add the interfaces' default methods which are not implemented by the struct.
+func addDefaultMethods(structStmt *ast.StructStatement, structObj *Struct) {
+	for _, iface := range implementedInterfaces(structStmt) {
+		for _, m := range iface.Methods {
+			if m.Body == nil {
+				continue
+			}
+			if _, ok := structObj.Scope.getOwn(m.Name); ok { //the struct has its own implementation
+				continue
+			}
+			structObj.Scope.Set(m.Name, &Function{Literal: m, Scope: structObj.Scope})
+		}
+	}
+}
+
+// 'obj is InterfaceName' or 'obj is StructName'
+func evalIsExpression(node *ast.InfixExpression, scope *Scope) Object {
+	left := Eval(node.Left, scope)
+	if isError(left) {
+		return left
+	}
+	if r, ok := isStruct(node, left, scope); ok {
+		return r
+	}
+
+	right := Eval(node.Right, scope)
+	if isError(right) {
+		return right
+	}
+	return isInterface(node, left, right)
+}
+
+// 'obj is StructName', 'ok' is false if the right hand side is not a struct's
+// name, which is evaluated then.
+func isStruct(node *ast.InfixExpression, left Object, scope *Scope) (r Object, ok bool) {
+	if ident, ok := node.Right.(*ast.Identifier); ok {
+		if structStmt, ok := scope.GetStruct(ident.Value); ok {
+			if s, ok := left.(*Struct); ok {
+				return nativeBoolToBooleanObject(s.Stmt == structStmt), true
+			}
+			return FALSE, true
+		}
+	}
+	return nil, false
+}
+
+// 'obj is InterfaceName' with the evaluated interface
+func isInterface(node *ast.InfixExpression, left, right Object) Object {
+	iface, ok := right.(*Interface)
+	if !ok {
+		return newError(node.Pos().Sline(), ERR_NOTINTERFACE, node.Right.String(), right.Type())
+	}
+
+	s, ok := left.(*Struct)
+	if !ok {
+		return FALSE
+	}
+	return nativeBoolToBooleanObject(structImplements(s, iface))
+}
+
+// check if the struct implements the interface, either declared using
+// 'implements', or has all the required methods.
+func structImplements(s *Struct, iface *Interface) bool {
+	for _, i := range implementedInterfaces(s.Stmt) {
+		if i == iface {
+			return true
+		}
+	}
+
+	for _, m := range iface.Methods {
+		if m.Body != nil {
+			continue
+		}
+		fn, ok := s.Scope.getOwn(m.Name)
+		if !ok || fn.Type() != FUNCTION_OBJ {
+			return false
+		}
+	}
+	return true
+}
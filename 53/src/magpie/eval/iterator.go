@@ -0,0 +1,389 @@
+package eval
+
+import (
+	"magpie/ast"
+	"reflect"
+)
+
+// Iterator protocol methods which a struct could define to be iterable.
+// '__iter__' returns the iterator object(maybe the struct itself),
+// '__next__'(or 'next') returns a (value, ok) tuple.
+const (
+	PROTO_ITER = "__iter__"
+	PROTO_NEXT = "__next__"
+)
+
+// Iterator is used by for loops, variadic unboxing, destructuring and 'in'
+// to iterate an object lazily.
+type Iterator interface {
+	// Next returns the next value, or false if there are no more values.
+	// If an error occurred, the returned value is an Error(or Throw) object.
+	Next() (Object, bool)
+}
+
+// iterators which hold resources(e.g. goroutines) should be closed
+// when the iteration is stopped before exhausted.
+type iteratorCloser interface {
+	close()
+}
+
+func closeIterator(it Iterator) {
+	if c, ok := it.(iteratorCloser); ok {
+		c.close()
+	}
+}
+
+type iteratorFunc func() (Object, bool)
+
+func (f iteratorFunc) Next() (Object, bool) { return f() }
+
+type sliceIterator struct {
+	members []Object
+	idx     int
+}
+
+func (si *sliceIterator) Next() (Object, bool) {
+	if si.idx >= len(si.members) {
+		return NIL, false
+	}
+	si.idx++
+	return si.members[si.idx-1], true
+}
+
+// generator's iterator, which closes the generator when the loop is left
+// early, e.g. by 'break' or 'return'
+type generatorIterator struct {
+	gen *Generator
+}
+
+func (gi *generatorIterator) Next() (Object, bool) { return gi.gen.Next(NIL) }
+func (gi *generatorIterator) close()               { gi.gen.close() }
+
+// hash's keys iterator, 'for k, v in hash' uses 'hash' to get the values.
+type hashIterator struct {
+	sliceIterator
+	hash *Hash
+}
+
+// the key's value in the hash, or the failure of the key's '__hash__'
+func (hi *hashIterator) value(line string, scope *Scope, key Object) Object {
+	pair, ok, errObj := hi.hash.lookup(line, scope, key)
+	if errObj != nil {
+		return errObj
+	}
+	if !ok { //removed in the loop
+		return NIL
+	}
+	return pair.Value
+}
+
+// iterator for 'start..end', so the range is not materialised into an array.
+type rangeIterator struct {
+	cur  int64
+	end  int64
+	step int64
+}
+
+func (ri *rangeIterator) Next() (Object, bool) {
+	if (ri.step > 0 && ri.cur > ri.end) || (ri.step < 0 && ri.cur < ri.end) {
+		return NIL, false
+	}
+	ri.cur += ri.step
+	return NewNumber(float64(ri.cur - ri.step)), true
+}
+
+// check if the iterator's result is an error.
+func isIterError(obj Object) bool {
+	return isError(obj) || obj.Type() == THROW_OBJ
+}
+
+// get the iterator of an expression. if the expression is a range expression,
+// then it will not be materialised.
+func evalIterator(expr ast.Expression, scope *Scope) (Iterator, Object) {
+	if ie, ok := rangeOf(expr); ok {
+		left := Eval(ie.Left, scope)
+		if isError(left) {
+			return nil, left
+		}
+		right := Eval(ie.Right, scope)
+		if isError(right) {
+			return nil, right
+		}
+		return newRangeIterator(ie, left, right)
+	}
+
+	obj := Eval(expr, scope)
+	if isError(obj) {
+		return nil, obj
+	}
+	return iteratorOf(expr, obj, scope)
+}
+
+// the range expression 'start..end' which is iterated without the array
+func rangeOf(expr ast.Expression) (*ast.InfixExpression, bool) {
+	ie, ok := expr.(*ast.InfixExpression)
+	return ie, ok && ie.Operator == ".." && !ie.HasNext
+}
+
+// get the iterator of the expression's value
+func iteratorOf(expr ast.Expression, obj Object, scope *Scope) (Iterator, Object) {
+	if obj.Type() == NIL_OBJ { //iterating a nil object is the same as iterating an empty array
+		return &sliceIterator{}, nil
+	}
+	return newIterator(expr.Pos().Sline(), scope, obj)
+}
+
+// the key and the value of 'for k, v in x': the hash's key and its value, or
+// the index and the item. The value is an error(or a throw) if the key's
+// '__hash__' fails.
+func keyValueOf(it Iterator, idx int, item Object, line string, scope *Scope) (Object, Object) {
+	if hi, ok := it.(*hashIterator); ok {
+		return item, hi.value(line, scope, item)
+	}
+	return NewNumber(float64(idx)), item
+}
+
+func newRangeIterator(node *ast.InfixExpression, left, right Object) (Iterator, Object) {
+	l, ok := left.(*Number)
+	if !ok {
+		return nil, newError(node.Pos().Sline(), ERR_RANGETYPE, NUMBER_OBJ, left.Type())
+	}
+	r, ok := right.(*Number)
+	if !ok {
+		return nil, newError(node.Pos().Sline(), ERR_RANGETYPE, NUMBER_OBJ, right.Type())
+	}
+
+	it := &rangeIterator{cur: int64(l.Value), end: int64(r.Value), step: 1}
+	if it.cur >= it.end {
+		it.step = -1
+	}
+	return it, nil
+}
+
+// get the iterator of an object. the second return value is an error object if
+// the object is not iterable.
+func newIterator(line string, scope *Scope, obj Object) (Iterator, Object) {
+	switch o := obj.(type) {
+	case *String:
+		members := []Object{}
+		for _, r := range o.String {
+			members = append(members, NewString(string(r)))
+		}
+		return &sliceIterator{members: members}, nil
+	case *Array:
+		return &sliceIterator{members: o.members()}, nil
+	case *Tuple:
+		return &sliceIterator{members: o.Members}, nil
+	case *Hash: //iterating the keys
+		keys := []Object{}
+		for _, pair := range o.pairs(true) {
+			keys = append(keys, pair.Key)
+		}
+		return &hashIterator{sliceIterator: sliceIterator{members: keys}, hash: o}, nil
+	case *Generator:
+		return &generatorIterator{gen: o}, nil
+	case *Channel: //receiving until it's closed
+		return iteratorFunc(func() (Object, bool) {
+			v, ok, errObj := o.recv(line, scope)
+			if errObj != nil {
+				return errObj, true
+			}
+			return v, ok
+		}), nil
+	case *FileObject: //iterating the lines
+		return iteratorFunc(func() (Object, bool) {
+			r := o.readLine(line)
+			if r.Type() == NIL_OBJ {
+				return NIL, false
+			}
+			return r, true
+		}), nil
+	case *Struct:
+		return newStructIterator(line, scope, o)
+	case *GoObject:
+		return newGoIterator(line, o)
+	}
+	return nil, newError(line, ERR_NOTITERABLE)
+}
+
+// struct's iterator protocol: '__iter__', '__next__' or 'next'
+func newStructIterator(line string, scope *Scope, s *Struct) (Iterator, Object) {
+	if s.hasProtocol(PROTO_ITER) {
+		r := s.CallMethod(line, scope, PROTO_ITER)
+		if isIterError(r) {
+			return nil, r
+		}
+		it, ok := r.(*Struct)
+		if !ok { //e.g. '__iter__' returns a generator or an array
+			return newIterator(line, scope, r)
+		}
+		s = it
+	}
+
+	method := PROTO_NEXT
+	if !s.hasProtocol(method) {
+		method = "next"
+		if !s.hasProtocol(method) {
+			return nil, newError(line, ERR_NOTITERABLE)
+		}
+	}
+
+	return iteratorFunc(func() (Object, bool) {
+		r := s.CallMethod(line, scope, method)
+		if isIterError(r) {
+			return r, true
+		}
+		t, ok := r.(*Tuple)
+		if !ok || len(t.Members) != 2 {
+			return newError(line, ERR_ITERNEXT, method, r.Inspect()), true
+		}
+		if !IsTrue(t.Members[1]) {
+			return NIL, false
+		}
+		return t.Members[0], true
+	}), nil
+}
+
+// go slices, arrays, maps(keys), channels and iterator functions
+// (iter.Seq and iter.Seq2, the latter yields (key, value) tuples).
+func newGoIterator(line string, gobj *GoObject) (Iterator, Object) {
+	v := gobj.value
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		idx := 0
+		return iteratorFunc(func() (Object, bool) {
+			if idx >= v.Len() {
+				return NIL, false
+			}
+			idx++
+			return goValueToObject(v.Index(idx - 1).Interface()), true
+		}), nil
+	case reflect.Map:
+		iter := v.MapRange()
+		return iteratorFunc(func() (Object, bool) {
+			if !iter.Next() {
+				return NIL, false
+			}
+			return goValueToObject(iter.Key().Interface()), true
+		}), nil
+	case reflect.Chan:
+		return iteratorFunc(func() (Object, bool) {
+			x, ok := v.Recv()
+			if !ok {
+				return NIL, false
+			}
+			return goValueToObject(x.Interface()), true
+		}), nil
+	case reflect.Func:
+		if isGoSeq(v.Type()) {
+			return &goSeqIterator{line: line, fn: v}, nil
+		}
+	}
+	return nil, newError(line, ERR_NOTITERABLE)
+}
+
+// check if the type is 'func(yield func(V) bool)' or 'func(yield func(K, V) bool)'
+func isGoSeq(t reflect.Type) bool {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 0 {
+		return false
+	}
+	yield := t.In(0)
+	if yield.Kind() != reflect.Func || yield.NumOut() != 1 || yield.Out(0).Kind() != reflect.Bool {
+		return false
+	}
+	return yield.NumIn() == 1 || yield.NumIn() == 2
+}
+
+// go iterator function's push style iteration is converted to pull style
+// by running it in its own goroutine.
+type goSeqIterator struct {
+	line    string
+	fn      reflect.Value
+	values  chan Object
+	resume  chan bool
+	started bool
+	done    bool
+}
+
+func (gi *goSeqIterator) Next() (Object, bool) {
+	if gi.done {
+		return NIL, false
+	}
+	if !gi.started {
+		gi.started = true
+		gi.values = make(chan Object)
+		gi.resume = make(chan bool)
+		go gi.run()
+	} else {
+		gi.resume <- true
+	}
+
+	value, ok := <-gi.values
+	if !ok {
+		gi.done = true
+		return NIL, false
+	}
+	return value, true
+}
+
+func (gi *goSeqIterator) run() {
+	defer close(gi.values)
+	defer func() {
+		if r := recover(); r != nil {
+			gi.values <- newError(gi.line, "error calling go iterator. %s", r)
+		}
+	}()
+
+	yield := reflect.MakeFunc(gi.fn.Type().In(0), func(args []reflect.Value) []reflect.Value {
+		var value Object
+		if len(args) == 1 {
+			value = goValueToObject(args[0].Interface())
+		} else {
+			value = &Tuple{Members: []Object{goValueToObject(args[0].Interface()), goValueToObject(args[1].Interface())}}
+		}
+		gi.values <- value
+		return []reflect.Value{reflect.ValueOf(<-gi.resume)}
+	})
+	gi.fn.Call([]reflect.Value{yield})
+}
+
+func (gi *goSeqIterator) close() {
+	if !gi.started || gi.done {
+		return
+	}
+	gi.done = true
+	gi.resume <- false
+	for range gi.values { //wait for the iterator function to return
+	}
+}
+
+// get all the values of an iterable object.
+func iterateAll(line string, scope *Scope, obj Object) ([]Object, Object) {
+	it, err := newIterator(line, scope, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []Object{}
+	for {
+		value, ok := it.Next()
+		if !ok {
+			return values, nil
+		}
+		if isIterError(value) {
+			return nil, value
+		}
+		values = append(values, value)
+	}
+}
+
+// objects which could only be iterated using the iterator protocol.
+func isLazyIterable(obj Object) bool {
+	switch o := obj.(type) {
+	case *Generator, *Channel:
+		return true
+	case *Struct:
+		return o.hasProtocol(PROTO_ITER) || o.hasProtocol(PROTO_NEXT)
+	}
+	return false
+}
@@ -0,0 +1,387 @@
+package eval
+
+import (
+	"magpie/ast"
+	"magpie/token"
+	"os"
+	"path/filepath"
+)
+
+// a macro could expand to another macro call, this limits the expansion depth.
+const maxMacroDepth = 100
+
+// Quote is the result of 'quote(expression)', it holds the unevaluated expression.
+type Quote struct {
+	Node ast.Node
+}
+
+func (q *Quote) Inspect() string  { return "quote(" + q.Node.String() + ")" }
+func (q *Quote) Type() ObjectType { return QUOTE_OBJ }
+func (q *Quote) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	return newError(line, ERR_NOMETHOD, method, q.Type())
+}
+
+func isQuoteCall(call *ast.CallExpression) bool {
+	ident, ok := call.Function.(*ast.Identifier)
+	return ok && ident.Value == "quote"
+}
+
+func isUnquoteCall(node ast.Node) (*ast.CallExpression, bool) {
+	call, ok := node.(*ast.CallExpression)
+	if !ok || len(call.Arguments) != 1 {
+		return nil, false
+	}
+	ident, ok := call.Function.(*ast.Identifier)
+	return call, ok && ident.Value == "unquote"
+}
+
+// quote(expression): the 'unquote(x)' calls in the expression are evaluated,
+// and replaced with the AST nodes of their results.
+func evalQuote(call *ast.CallExpression, scope *Scope) Object {
+	if len(call.Arguments) != 1 {
+		return newError(call.Pos().Sline(), ERR_QUOTE, len(call.Arguments))
+	}
+
+	var errObj Object
+	node := ast.Modify(ast.Copy(call.Arguments[0]), func(node ast.Node) ast.Node {
+		unquote, ok := isUnquoteCall(node)
+		if !ok || errObj != nil {
+			return node
+		}
+		obj := Eval(unquote.Arguments[0], scope)
+		if isError(obj) {
+			errObj = obj
+			return node
+		}
+		n, err := objectToNode(unquote.Pos(), obj)
+		if err != nil {
+			errObj = err
+			return node
+		}
+		return n
+	})
+	if errObj != nil {
+		return errObj
+	}
+	return &Quote{Node: node}
+}
+
+// the unquote calls of the quoted expression, in the order which evalQuote
+// evaluates them in. They are the calls of a copy of the expression.
+func unquoteCalls(expr ast.Expression) []*ast.CallExpression {
+	var calls []*ast.CallExpression
+	ast.Modify(ast.Copy(expr), func(node ast.Node) ast.Node {
+		if unquote, ok := isUnquoteCall(node); ok {
+			calls = append(calls, unquote)
+		}
+		return node
+	})
+	return calls
+}
+
+// quote(expression) whose unquote calls are replaced with the nodes of their
+// evaluated results, which are in the order of unquoteCalls.
+func quoteWith(call *ast.CallExpression, unquoted []*Quote) Object {
+	node := ast.Modify(ast.Copy(call.Arguments[0]), func(node ast.Node) ast.Node {
+		if _, ok := isUnquoteCall(node); !ok || len(unquoted) == 0 {
+			return node
+		}
+		n := unquoted[0].Node
+		unquoted = unquoted[1:]
+		return n
+	})
+	return &Quote{Node: node}
+}
+
+// convert the result of 'unquote(x)' to an AST node.
+func objectToNode(pos token.Position, obj Object) (ast.Expression, Object) {
+	switch o := obj.(type) {
+	case *Number:
+		return &ast.NumberLiteral{Token: token.Token{Pos: pos, Type: token.TOKEN_NUMBER, Literal: o.Inspect()}, Value: o.Value}, nil
+	case *String:
+		return &ast.StringLiteral{Token: token.Token{Pos: pos, Type: token.TOKEN_STRING, Literal: o.String}, Value: o.String}, nil
+	case *Boolean:
+		tok := token.Token{Pos: pos, Type: token.TOKEN_FALSE, Literal: "false"}
+		if o.Bool {
+			tok = token.Token{Pos: pos, Type: token.TOKEN_TRUE, Literal: "true"}
+		}
+		return &ast.BooleanLiteral{Token: tok, Value: o.Bool}, nil
+	case *Nil:
+		return &ast.NilLiteral{Token: token.Token{Pos: pos, Type: token.TOKEN_NIL, Literal: "nil"}}, nil
+	case *Array:
+		arr := &ast.ArrayLiteral{Token: token.Token{Pos: pos, Type: token.TOKEN_LBRACKET, Literal: "["}}
+		for _, m := range o.Members {
+			n, err := objectToNode(pos, m)
+			if err != nil {
+				return nil, err
+			}
+			arr.Members = append(arr.Members, n)
+		}
+		return arr, nil
+	case *Quote:
+		if expr, ok := ast.Copy(o.Node).(ast.Expression); ok {
+			return expr, nil
+		}
+	}
+	return nil, newError(pos.Sline(), ERR_UNQUOTE, obj.Type())
+}
+
+func evalBlockLiteral(bl *ast.BlockLiteral, scope *Scope) Object {
+	result := evalBlockStatement(bl.Block, scope)
+	if result == nil { //empty block
+		return NIL
+	}
+	return result
+}
+
+// ExpandMacros runs after parsing and before evaluation. It removes the top level
+// macro definitions('let name = macro(...) {...}' or 'macro name(...) {...}') from
+// the program and its imported modules, then replaces the macro calls with the
+// AST nodes quoted by the macros. A macro is only expanded in the module which
+// defines it, and in the modules which import it by name('from m import Name'),
+// but not where the module binds the same name itself, e.g. 'fn Name() {}'.
+// Returns an error object if the expansion fails.
+func ExpandMacros(program *ast.Program) Object {
+	return ExpandMacrosWithOptions(program, nil)
+}
+
+// ExpandMacrosWithOptions is like ExpandMacros, but the macros' bodies are
+// evaluated with the options' limits, which are counted separately from
+// the program's execution.
+func ExpandMacrosWithOptions(program *ast.Program, opts *Options) Object {
+	modules := make(map[*ast.Program]*moduleMacros)
+	if errObj := defineMacros(program, modules); errObj != nil {
+		return errObj
+	}
+	return expandProgram(program, modules, make(map[*ast.Program]bool), newSandbox(opts))
+}
+
+// the macros of a module
+type moduleMacros struct {
+	own     map[string]*macroDef //defined in the module
+	visible map[string]*macroDef //the own and the imported ones, which are expanded in the module
+}
+
+type macroDef struct {
+	literal *ast.MacroLiteral
+	module  *moduleMacros //the defining module, whose macros expand the macro's result
+}
+
+func defineMacros(program *ast.Program, modules map[*ast.Program]*moduleMacros) Object {
+	if _, ok := modules[program]; ok {
+		return nil
+	}
+	mm := &moduleMacros{own: make(map[string]*macroDef), visible: make(map[string]*macroDef)}
+	modules[program] = mm
+
+	for _, is := range program.Imports {
+		if is.Program != nil {
+			if errObj := defineMacros(is.Program, modules); errObj != nil {
+				return errObj
+			}
+		}
+	}
+
+	stmts := []ast.Statement{}
+	for _, stmt := range program.Statements {
+		if name, m := macroDefinition(stmt); m != nil {
+			if _, ok := mm.own[name]; ok {
+				return newError(m.Pos().Sline(), ERR_MACRODUP, name)
+			}
+			mm.own[name] = &macroDef{literal: m, module: mm}
+			mm.visible[name] = mm.own[name]
+			continue
+		}
+		stmts = append(stmts, stmt)
+	}
+	program.Statements = stmts
+
+	//from a.b.c import Name1, Name2
+	for _, is := range program.Imports {
+		if is.Program == nil {
+			continue
+		}
+		for _, name := range is.Names {
+			def, ok := modules[is.Program].own[name.Value]
+			if !ok {
+				continue
+			}
+			line := name.Pos().Sline()
+			if !isExported(name.Value) {
+				return newError(line, ERR_NAMENOTEXPORTED, filepath.Base(is.ImportPath), name.Value)
+			}
+			if _, ok := mm.visible[name.Value]; ok {
+				return newError(line, ERR_MACRODUP, name.Value)
+			}
+			mm.visible[name.Value] = def
+			if is.Macros == nil {
+				is.Macros = make(map[string]bool)
+			}
+			is.Macros[name.Value] = true
+		}
+	}
+
+	//the module's own names hide the macros
+	for name := range boundNames(program) {
+		delete(mm.visible, name)
+	}
+	return nil
+}
+
+// the names which the program binds: the variables, functions, parameters,
+// structs and imports
+func boundNames(program *ast.Program) map[string]bool {
+	names := make(map[string]bool)
+	for _, is := range program.Imports {
+		if len(is.Names) == 0 {
+			names[is.Name()] = true
+		}
+		for _, name := range is.Names {
+			if !is.Macros[name.Value] {
+				names[name.Value] = true
+			}
+		}
+	}
+
+	ast.Inspect(program, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.LetStatement:
+			for _, name := range n.Names {
+				names[name.Value] = true
+			}
+		case *ast.AssignExpression:
+			if ident, ok := n.Name.(*ast.Identifier); ok {
+				names[ident.Value] = true
+			}
+		case *ast.MultiAssignStatement:
+			for _, name := range n.Names {
+				if ident, ok := name.(*ast.Identifier); ok {
+					names[ident.Value] = true
+				}
+			}
+		case *ast.FunctionLiteral:
+			if n.Name != "" {
+				names[n.Name] = true
+			}
+			for _, param := range n.Parameters {
+				names[param.Value] = true
+			}
+		case *ast.StructStatement:
+			names[n.Name] = true
+		case *ast.ForEachArrayLoop:
+			names[n.Var] = true
+		case *ast.ForEachMapLoop:
+			names[n.Key] = true
+			names[n.Value] = true
+		case *ast.ComprehensionClause:
+			for _, name := range n.Names {
+				names[name.Value] = true
+			}
+		case *ast.TryStmt:
+			for _, c := range n.Catches {
+				names[c.Var] = true
+			}
+		}
+		return true
+	})
+	return names
+}
+
+func macroDefinition(stmt ast.Statement) (string, *ast.MacroLiteral) {
+	switch s := stmt.(type) {
+	case *ast.LetStatement:
+		if len(s.Names) == 1 && len(s.Values) == 1 {
+			if m, ok := s.Values[0].(*ast.MacroLiteral); ok {
+				return s.Names[0].Value, m
+			}
+		}
+	case *ast.ExpressionStatement:
+		if m, ok := s.Expression.(*ast.MacroLiteral); ok && m.Name != "" {
+			return m.Name, m
+		}
+	}
+	return "", nil
+}
+
+func expandProgram(program *ast.Program, modules map[*ast.Program]*moduleMacros, visited map[*ast.Program]bool, sb *sandbox) Object {
+	if visited[program] {
+		return nil
+	}
+	visited[program] = true
+
+	for _, is := range program.Imports {
+		if is.Program != nil {
+			if errObj := expandProgram(is.Program, modules, visited, sb); errObj != nil {
+				return errObj
+			}
+		}
+	}
+	macros := modules[program].visible
+	if len(macros) == 0 {
+		return nil
+	}
+	_, errObj := expandNode(program, macros, 0, sb)
+	return errObj
+}
+
+// expand all the macro calls in the node.
+func expandNode(node ast.Node, macros map[string]*macroDef, depth int, sb *sandbox) (ast.Node, Object) {
+	var errObj Object
+	node = ast.Modify(node, func(node ast.Node) ast.Node {
+		if errObj != nil {
+			return node
+		}
+		expanded, err := expandMacroCall(node, macros, depth, sb)
+		if err != nil {
+			errObj = err
+			return node
+		}
+		return expanded
+	})
+	return node, errObj
+}
+
+func expandMacroCall(node ast.Node, macros map[string]*macroDef, depth int, sb *sandbox) (ast.Node, Object) {
+	call, ok := node.(*ast.CallExpression)
+	if !ok {
+		return node, nil
+	}
+	ident, ok := call.Function.(*ast.Identifier)
+	if !ok {
+		return node, nil
+	}
+	def, ok := macros[ident.Value]
+	if !ok {
+		return node, nil
+	}
+	m := def.literal
+
+	line := call.Pos().Sline()
+	if depth >= maxMacroDepth {
+		return nil, newError(line, ERR_MACRODEPTH, ident.Value)
+	}
+	if len(call.Arguments) != len(m.Parameters) {
+		return nil, newError(line, ERR_MACROARGS, ident.Value, len(m.Parameters), len(call.Arguments))
+	}
+
+	//the arguments are passed to the macro unevaluated
+	scope := NewScope(nil, os.Stdout)
+	scope.sandbox = sb
+	for i, param := range m.Parameters {
+		scope.Set(param.Value, &Quote{Node: call.Arguments[i]})
+	}
+	result := unwrapReturnValue(Eval(m.Body, scope))
+	if result == nil { //empty body
+		result = NIL
+	}
+	if isError(result) {
+		return nil, result
+	}
+	quote, ok := result.(*Quote)
+	if !ok {
+		return nil, newError(line, ERR_MACRORESULT, ident.Value, result.Type())
+	}
+
+	//the expanded node may contain the defining module's macro calls too
+	return expandNode(quote.Node, def.module.visible, depth+1, sb)
+}
@@ -0,0 +1,91 @@
+package eval
+
+import (
+	"magpie/ast"
+	"reflect"
+)
+
+// BoundMethod is the result of 'obj.method' without calling it, it keeps the
+// receiver, so calling it later is the same as calling 'obj.method(args)'.
+type BoundMethod struct {
+	Receiver Object
+	Name     string
+
+	node ast.Node //the 'obj.method' expression, for the execution's limits
+}
+
+func (m *BoundMethod) Inspect() string {
+	return "<bound method " + typeNameOf(m.Receiver) + "." + m.Name + ">"
+}
+func (m *BoundMethod) Type() ObjectType { return BOUND_METHOD_OBJ }
+func (m *BoundMethod) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	return newError(line, ERR_NOMETHOD, method, m.Type())
+}
+
+func (m *BoundMethod) call(line string, scope *Scope, args []Object) Object {
+	if _, ok := m.Receiver.(*Struct); ok {
+		return m.Receiver.CallMethod(line, scope, m.Name, args...)
+	}
+
+	size := sizeOf(m.Receiver)
+	r := m.Receiver.CallMethod(line, scope, m.Name, args...)
+	return scope.chargeMethod(m.node, m.Receiver, size, r)
+}
+
+// check if the name is one of the struct's methods(including the default
+// methods of the interfaces it implements), not a field.
+func (s *Struct) isMethod(name string) bool {
+	if _, ok := getStructMethods(s.Stmt)[name]; ok {
+		return true
+	}
+	for _, iface := range implementedInterfaces(s.Stmt) {
+		for _, m := range iface.Methods {
+			if m.Name == name && m.Body != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the magpie function(or a bound method, etc.) as a Go function of the type,
+// so it could be passed to the Go functions which take a callback.
+func goFunc(line string, scope *Scope, fn Object, typ reflect.Type) reflect.Value {
+	return reflect.MakeFunc(typ, func(in []reflect.Value) []reflect.Value {
+		args := make([]Object, len(in))
+		for i, v := range in {
+			args[i] = goValueToObject(v.Interface())
+		}
+
+		r := applyFunction(line, scope, fn, args)
+		if errObj, ok := r.(*Error); ok {
+			panic(errObj.text) //recovered by callGoMethod
+		}
+		if r.Type() == THROW_OBJ {
+			panic(r.Inspect())
+		}
+
+		results := []Object{r}
+		if t, ok := r.(*Tuple); ok && t.IsMulti {
+			results = t.Members
+		}
+		out := make([]reflect.Value, typ.NumOut())
+		for i := range out {
+			t := typ.Out(i)
+			if i >= len(results) {
+				out[i] = reflect.Zero(t)
+				continue
+			}
+			v := ObjectToGoValue(results[i], t)
+			switch {
+			case !v.IsValid(): //nil
+				v = reflect.Zero(t)
+			case v.Type().AssignableTo(t):
+			case v.Type().ConvertibleTo(t):
+				v = v.Convert(t)
+			}
+			out[i] = v
+		}
+		return out
+	})
+}
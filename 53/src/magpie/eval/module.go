@@ -0,0 +1,83 @@
+package eval
+
+import (
+	"magpie/ast"
+	"sync"
+	"unicode"
+)
+
+// the modules of the structs imported by 'from a.b.c import StructName',
+// the struct objects are created in their modules' scopes.
+var importedStructs = map[*ast.StructStatement]*Module{}
+var importedMu sync.RWMutex //guards importedStructs
+
+// Module is the object which an 'import' statement binds to, only the
+// names which have their first letter 'Uppercased' could be referred.
+type Module struct {
+	Name  string //the module's name, e.g. 'util' for 'import a.b.util'
+	Path  string //the module's resolved path
+	Scope *Scope
+
+	once sync.Once //the module is run once
+	err  *Error    //the module's error, if running it fails
+}
+
+func (m *Module) Inspect() string  { return "<module '" + m.Name + "'>" }
+func (m *Module) Type() ObjectType { return MODULE_OBJ }
+
+// module.Func(args), or module.StructName(args)
+func (m *Module) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	if !isExported(method) {
+		return newError(line, ERR_NAMENOTEXPORTED, m.Name, method)
+	}
+
+	if structStmt, ok := m.Scope.GetStruct(method); ok {
+		return newStructObj(line, structStmt, m.Scope, args)
+	}
+
+	fn, ok := m.Scope.Get(method)
+	if !ok {
+		return newError(line, ERR_NOMODULEMEMBER, m.Name, method)
+	}
+	return applyFunction(line, scope, fn, args)
+}
+
+// module.Name
+func (m *Module) get(line string, name string) Object {
+	if !isExported(name) {
+		return newError(line, ERR_NAMENOTEXPORTED, m.Name, name)
+	}
+
+	v, ok := m.Scope.Get(name)
+	if !ok {
+		return newError(line, ERR_NOMODULEMEMBER, m.Name, name)
+	}
+	return v
+}
+
+// bind the exported name to the importer's scope, for 'from a.b.c import Name'
+func (m *Module) importName(line string, name string, scope *Scope) Object {
+	if !isExported(name) {
+		return newError(line, ERR_NAMENOTEXPORTED, m.Name, name)
+	}
+
+	if structStmt, ok := m.Scope.GetStruct(name); ok {
+		importedMu.Lock()
+		importedStructs[structStmt] = m
+		importedMu.Unlock()
+		scope.SetStruct(structStmt)
+		return nil
+	}
+
+	v, ok := m.Scope.Get(name)
+	if !ok {
+		return newError(line, ERR_NOMODULEMEMBER, m.Name, name)
+	}
+	scope.Set(name, v)
+	return nil
+}
+
+// identifiers and functions which have their first letter 'Uppercased' are exported
+func isExported(name string) bool {
+	return len(name) > 0 && unicode.IsUpper(rune(name[0]))
+}
@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 )
 
@@ -41,6 +42,19 @@ const (
 	THROW_OBJ        = "THROW"
 	TAIL_OBJ         = "TAIL_OBJ"
 	CMD_OBJ          = "CMD_OBJ"
+	INTERFACE_OBJ    = "INTERFACE"
+	GENERATOR_OBJ    = "GENERATOR"
+	QUOTE_OBJ        = "QUOTE"
+	MODULE_OBJ       = "MODULE"
+	RUNERROR_OBJ     = "RUNTIME_ERROR"
+	TASK_OBJ         = "TASK"
+	CHANNEL_OBJ      = "CHANNEL"
+	MUTEX_OBJ        = "MUTEX"
+	WAITGROUP_OBJ    = "WAITGROUP"
+	PROMISE_OBJ      = "PROMISE"
+	PROMISES_OBJ     = "PROMISES"
+	BOUND_METHOD_OBJ = "BOUND_METHOD"
+	VM_OBJ           = "VM_OBJ"
 )
 
 var (
@@ -65,6 +79,8 @@ type Hashable interface {
 type HashKey struct {
 	Type  ObjectType
 	Value uint64
+
+	probe int //the unequal keys with the same hash are at the next probes
 }
 
 type Number struct {
@@ -78,7 +94,7 @@ func (n *Number) Inspect() string {
 func (n *Number) Type() ObjectType { return NUMBER_OBJ }
 
 func (n *Number) HashKey() HashKey {
-	return HashKey{Type: n.Type(), Value: uint64(n.Value)}
+	return HashKey{Type: n.Type(), Value: hashFloat(n.Value)}
 }
 
 func (n *Number) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
@@ -368,6 +384,8 @@ func (f *Function) CallMethod(line string, scope *Scope, method string, args ...
 
 type Array struct {
 	Members []Object
+
+	mu sync.Mutex //guards the members once the program is threaded
 }
 
 func (a *Array) iter() bool       { return true }
@@ -375,7 +393,7 @@ func (a *Array) Type() ObjectType { return ARRAY_OBJ }
 func (a *Array) Inspect() string {
 	var out bytes.Buffer
 	members := []string{}
-	for _, e := range a.Members {
+	for _, e := range a.members() {
 		if e.Type() == STRING_OBJ {
 			members = append(members, "\""+e.Inspect()+"\"")
 		} else {
@@ -403,7 +421,31 @@ func (a *Array) CallMethod(line string, scope *Scope, method string, args ...Obj
 	return newError(line, ERR_NOMETHOD, method, a.Type())
 }
 
+// the members, or a copy of them once the program is threaded, so they could
+// be used without the lock.
+func (a *Array) members() []Object {
+	if !threaded.Load() {
+		return a.Members
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Object(nil), a.Members...)
+}
+
+// the number of the members
+func (a *Array) count() int {
+	if threaded.Load() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+	}
+	return len(a.Members)
+}
+
 func (a *Array) len(line string, args ...Object) Object {
+	if threaded.Load() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+	}
 	if len(args) != 0 {
 		return newError(line, ERR_ARGUMENT, "0", len(args))
 	}
@@ -411,6 +453,10 @@ func (a *Array) len(line string, args ...Object) Object {
 }
 
 func (a *Array) pop(line string, args ...Object) Object {
+	if threaded.Load() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+	}
 	last := len(a.Members) - 1
 	if len(args) == 0 {
 		if last < 0 {
@@ -433,6 +479,10 @@ func (a *Array) pop(line string, args ...Object) Object {
 }
 
 func (a *Array) push(line string, args ...Object) Object {
+	if threaded.Load() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+	}
 	l := len(args)
 	if l != 1 {
 		return newError(line, ERR_ARGUMENT, "1", l)
@@ -442,6 +492,10 @@ func (a *Array) push(line string, args ...Object) Object {
 }
 
 func (a *Array) set(line string, args ...Object) Object {
+	if threaded.Load() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+	}
 	if len(args) != 2 {
 		return newError(line, ERR_ARGUMENT, "2", len(args))
 	}
@@ -476,6 +530,8 @@ type Hash struct {
 	Pairs     map[HashKey]HashPair
 	IsOrdered bool
 	Order     []HashKey
+
+	mu sync.Mutex //guards the pairs once the program is threaded
 }
 
 func (h *Hash) iter() bool       { return true }
@@ -483,42 +539,21 @@ func (h *Hash) Type() ObjectType { return HASH_OBJ }
 func (h *Hash) Inspect() string {
 	var out bytes.Buffer
 	pairs := []string{}
-	if h.IsOrdered {
-		for _, hk := range h.Order { //hk:hash key
-			var key, val string
-
-			pair, _ := h.Pairs[hk]
-			if pair.Key.Type() == STRING_OBJ {
-				key = "\"" + pair.Key.Inspect() + "\""
-			} else {
-				key = pair.Key.Inspect()
-			}
-
-			if pair.Value.Type() == STRING_OBJ {
-				val = "\"" + pair.Value.Inspect() + "\""
-			} else {
-				val = pair.Value.Inspect()
-			}
-
-			pairs = append(pairs, fmt.Sprintf("%s:%s", key, val))
+	for _, pair := range h.pairs(h.IsOrdered) {
+		var key, val string
+		if pair.Key.Type() == STRING_OBJ {
+			key = "\"" + pair.Key.Inspect() + "\""
+		} else {
+			key = pair.Key.Inspect()
 		}
-	} else {
-		for _, pair := range h.Pairs {
-			var key, val string
-			if pair.Key.Type() == STRING_OBJ {
-				key = "\"" + pair.Key.Inspect() + "\""
-			} else {
-				key = pair.Key.Inspect()
-			}
-
-			if pair.Value.Type() == STRING_OBJ {
-				val = "\"" + pair.Value.Inspect() + "\""
-			} else {
-				val = pair.Value.Inspect()
-			}
 
-			pairs = append(pairs, fmt.Sprintf("%s:%s", key, val))
+		if pair.Value.Type() == STRING_OBJ {
+			val = "\"" + pair.Value.Inspect() + "\""
+		} else {
+			val = pair.Value.Inspect()
 		}
+
+		pairs = append(pairs, fmt.Sprintf("%s:%s", key, val))
 	}
 
 	out.WriteString("{")
@@ -534,11 +569,11 @@ func (h *Hash) CallMethod(line string, scope *Scope, method string, args ...Obje
 	case "values":
 		return h.values(line, args...)
 	case "pop", "delete", "remove":
-		return h.pop(line, args...)
+		return h.pop(line, scope, args...)
 	case "push", "set":
-		return h.push(line, args...)
+		return h.push(line, scope, args...)
 	case "get":
-		return h.get(line, args...)
+		return h.get(line, scope, args...)
 	}
 
 	return newError(line, ERR_NOMETHOD, method, h.Type())
@@ -546,15 +581,8 @@ func (h *Hash) CallMethod(line string, scope *Scope, method string, args ...Obje
 
 func (h *Hash) keys(line string, args ...Object) Object {
 	keys := &Array{}
-	if h.IsOrdered {
-		for _, hk := range h.Order { //hk:hash key
-			pair, _ := h.Pairs[hk]
-			keys.Members = append(keys.Members, pair.Key)
-		}
-	} else {
-		for _, pair := range h.Pairs {
-			keys.Members = append(keys.Members, pair.Key)
-		}
+	for _, pair := range h.pairs(h.IsOrdered) {
+		keys.Members = append(keys.Members, pair.Key)
 	}
 
 	return keys
@@ -562,78 +590,164 @@ func (h *Hash) keys(line string, args ...Object) Object {
 
 func (h *Hash) values(line string, args ...Object) Object {
 	values := &Array{}
-	if h.IsOrdered {
-		for _, hk := range h.Order { //hk:hash key
-			pair, _ := h.Pairs[hk]
-			values.Members = append(values.Members, pair.Value)
-		}
-	} else {
-		for _, pair := range h.Pairs {
-			values.Members = append(values.Members, pair.Value)
-		}
+	for _, pair := range h.pairs(h.IsOrdered) {
+		values.Members = append(values.Members, pair.Value)
 	}
 	return values
 }
 
-func (h *Hash) pop(line string, args ...Object) Object {
+func (h *Hash) pop(line string, scope *Scope, args ...Object) Object {
 	if len(args) != 1 {
 		return newError(line, ERR_ARGUMENT, "1", len(args))
 	}
-	hashable, ok := args[0].(Hashable)
-	if !ok {
-		return newError(line, ERR_KEY, args[0].Type())
+	hk, errObj := hashKeyOf(line, scope, args[0])
+	if errObj != nil {
+		return errObj
 	}
 
-	hk := hashable.HashKey()
-	if hashPair, ok := h.Pairs[hashable.HashKey()]; ok {
-		// remove the 'key' from 'Order' array of Hash.
-		for idx, k := range h.Order {
-			r := reflect.DeepEqual(hk, k)
-			if r {
-				h.Order = append(h.Order[:idx], h.Order[idx+1:]...)
-				break
-			}
-		}
-
-		delete(h.Pairs, hk)
+	if threaded.Load() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+	}
+	if hk, ok := h.probe(line, scope, hk, args[0]); ok {
+		hashPair := h.Pairs[hk]
+		h.remove(hk)
 		return hashPair.Value
 	}
 
 	return NIL
 }
 
-func (h *Hash) push(line string, args ...Object) Object {
+func (h *Hash) push(line string, scope *Scope, args ...Object) Object {
 	if len(args) != 2 {
 		return newError(line, ERR_ARGUMENT, "2", len(args))
 	}
-	if hashable, ok := args[0].(Hashable); ok {
-		hk := hashable.HashKey()
-		if _, exists := h.Pairs[hk]; !exists { //if key not exists
-			h.Order = append(h.Order, hk)
-		}
+	hk, errObj := hashKeyOf(line, scope, args[0])
+	if errObj != nil {
+		return errObj
+	}
 
-		h.Pairs[hashable.HashKey()] = HashPair{Key: args[0], Value: args[1]}
-	} else {
-		return newError(line, ERR_KEY, args[0].Type())
+	if threaded.Load() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+	}
+	hk, exists := h.probe(line, scope, hk, args[0])
+	if !exists { //if key not exists
+		h.Order = append(h.Order, hk)
 	}
 
+	h.Pairs[hk] = HashPair{Key: args[0], Value: args[1]}
 	return h
 }
 
-func (h *Hash) get(line string, args ...Object) Object {
+func (h *Hash) get(line string, scope *Scope, args ...Object) Object {
 	if len(args) != 1 {
 		return newError(line, ERR_ARGUMENT, "1", len(args))
 	}
-	hashable, ok := args[0].(Hashable)
-	if !ok {
-		return newError(line, ERR_KEY, args[0].Type())
+	hashPair, ok, errObj := h.lookup(line, scope, args[0])
+	if errObj != nil {
+		return errObj
 	}
-	if hashPair, ok := h.Pairs[hashable.HashKey()]; ok {
+	if ok {
 		return hashPair.Value
 	}
 	return NIL
 }
 
+// probe returns the slot of the key with the hash key 'hk' and whether the
+// key is there. The keys with the same hash are told apart by their equality
+// (including the structs' '__eq__'), a new key takes the first empty probe.
+// The caller holds the lock.
+func (h *Hash) probe(line string, scope *Scope, hk HashKey, key Object) (HashKey, bool) {
+	for ; ; hk.probe++ {
+		pair, ok := h.Pairs[hk]
+		if !ok {
+			return hk, false
+		}
+		if objectsEqual(line, scope, pair.Key, key) {
+			return hk, true
+		}
+	}
+}
+
+// lookup returns the key's pair
+func (h *Hash) lookup(line string, scope *Scope, key Object) (HashPair, bool, Object) {
+	hk, errObj := hashKeyOf(line, scope, key)
+	if errObj != nil {
+		return HashPair{}, false, errObj
+	}
+
+	if threaded.Load() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+	}
+	hk, ok := h.probe(line, scope, hk, key)
+	if !ok {
+		return HashPair{}, false, nil
+	}
+	return h.Pairs[hk], true, nil
+}
+
+// a copy of the pairs(in the insertion order if 'inOrder'), so they could be
+// used without the lock.
+func (h *Hash) pairs(inOrder bool) []HashPair {
+	if threaded.Load() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+	}
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	if inOrder {
+		for _, hk := range h.Order { //hk:hash key
+			pairs = append(pairs, h.Pairs[hk])
+		}
+	} else {
+		for _, pair := range h.Pairs {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// the number of the pairs
+func (h *Hash) count() int {
+	if threaded.Load() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+	}
+	return len(h.Pairs)
+}
+
+// remove deletes the pair at the slot, the last pair of the slot's probes is
+// moved to the slot, so there's no gap in the probes. The caller holds the
+// lock.
+func (h *Hash) remove(hk HashKey) {
+	last := hk
+	for next := hk; ; last = next {
+		next.probe++
+		if _, ok := h.Pairs[next]; !ok {
+			break
+		}
+	}
+
+	// remove the 'key' from 'Order' array of Hash.
+	for idx, k := range h.Order {
+		if k == hk {
+			h.Order = append(h.Order[:idx], h.Order[idx+1:]...)
+			break
+		}
+	}
+	if last != hk {
+		h.Pairs[hk] = h.Pairs[last]
+		for idx, k := range h.Order {
+			if k == last {
+				h.Order[idx] = hk
+				break
+			}
+		}
+	}
+	delete(h.Pairs, last)
+}
+
 func NewTuple(isMulti bool) *Tuple {
 	//we assume tuple has at least two members
 	return &Tuple{IsMulti: isMulti, Members: []Object{NIL, NIL}}
@@ -721,29 +835,12 @@ func (t *Tuple) empty(line string, args ...Object) Object {
 }
 
 func (t *Tuple) HashKey() HashKey {
-	// https://en.wikipedia.org/wiki/Jenkins_hash_function
-	var hash uint64 = 0
-	for _, v := range t.Members {
-		hashable, ok := v.(Hashable)
-		if !ok {
-			errStr := fmt.Sprintf(ERR_KEY, v.Type())
-			panic(errStr)
-		}
-
-		h := hashable.HashKey()
-
-		hash += h.Value
-		hash += hash << 10
-		hash ^= hash >> 6
-	}
-	hash += hash << 3
-	hash ^= hash >> 11
-	hash += hash << 15
-
-	return HashKey{Type: t.Type(), Value: hash}
+	return HashKey{Type: t.Type(), Value: hashMembers(t.Members)}
 }
 
-type Break struct{}
+type Break struct {
+	Label string //break label
+}
 
 func (b *Break) Inspect() string  { return "break" }
 func (b *Break) Type() ObjectType { return BREAK_OBJ }
@@ -751,7 +848,9 @@ func (b *Break) CallMethod(line string, scope *Scope, method string, args ...Obj
 	return newError(line, ERR_NOMETHOD, method, b.Type())
 }
 
-type Continue struct{}
+type Continue struct {
+	Label string //continue label
+}
 
 func (c *Continue) Inspect() string  { return "continue" }
 func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
@@ -767,7 +866,7 @@ func (f *Fallthrough) CallMethod(line string, scope *Scope, method string, args
 	return newError(line, ERR_NOMETHOD, method, f.Type())
 }
 
-//Whether the Object is iterable (HASH, ARRAY, STRING, TUPLE, Some of the GoObject)
+//Whether the Object is iterable (HASH, ARRAY, STRING, TUPLE, GENERATOR, Some of the GoObject)
 type Iterable interface {
 	iter() bool
 }
@@ -914,13 +1013,23 @@ func (re *RegEx) split(line string, args ...Object) Object {
 }
 
 type Struct struct {
-	Scope *Scope //struct's scope
+	Scope *Scope               //struct's scope
+	Stmt  *ast.StructStatement //struct's declaration
 }
 
 func (s *Struct) Inspect() string {
+	if s.hasProtocol(PROTO_STR) {
+		r := s.CallMethod("", nil, PROTO_STR)
+		if str, ok := r.(*String); ok {
+			return str.String
+		}
+		return r.Inspect()
+	}
+
 	var out bytes.Buffer
 	out.WriteString("( ")
-	for k, v := range s.Scope.store {
+	for _, k := range s.Scope.GetKeys() {
+		v, _ := s.Scope.getOwn(k)
 		out.WriteString(k)
 		out.WriteString("->")
 		out.WriteString(v.Inspect())
@@ -932,6 +1041,39 @@ func (s *Struct) Inspect() string {
 }
 
 func (s *Struct) Type() ObjectType { return STRUCT_OBJ }
+
+// If the struct defines '__hash__', we use its result as the hash value,
+// otherwise the struct object is hashed by its fields, as it's compared.
+// The failure of '__hash__' panics, 'hashKeyOf' returns it.
+func (s *Struct) HashKey() HashKey {
+	hk, errObj := s.hashKey("", s.Scope)
+	if errObj != nil {
+		panic(hashFailure{errObj})
+	}
+	return hk
+}
+
+func (s *Struct) hashKey(line string, scope *Scope) (HashKey, Object) {
+	if !s.hasProtocol(PROTO_HASH) {
+		return HashKey{Type: s.Type(), Value: hashFields(s)}, nil
+	}
+
+	r := s.CallMethod(line, scope, PROTO_HASH)
+	if failed(r) {
+		return HashKey{}, r
+	}
+	switch v := r.(type) {
+	case *Number:
+		return HashKey{Type: s.Type(), Value: hashFloat(v.Value)}, nil
+	case *Struct:
+		hk, errObj := v.hashKey(line, scope)
+		return HashKey{Type: s.Type(), Value: hk.Value}, errObj
+	}
+	if v, ok := hashable(r); ok {
+		return HashKey{Type: s.Type(), Value: v.HashKey().Value}, nil
+	}
+	return HashKey{}, newError(line, ERR_KEY, r.Type())
+}
 func (s *Struct) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
 	var fn2 Object
 	var fn *Function
@@ -941,16 +1083,41 @@ func (s *Struct) CallMethod(line string, scope *Scope, method string, args ...Ob
 		return newError(line, ERR_NOMETHOD, method, s.Type())
 	}
 
-	fn = fn2.(*Function)
+	if fn, ok = fn2.(*Function); !ok { //e.g. a method decorated by a builtin decorator
+		return applyFunction(line, scope, fn2, args)
+	}
+	if errObj := checkArgTypes(line, fn, args); errObj != nil {
+		return errObj
+	}
 	extendedScope := extendFunctionScope(fn, args)
 	extendedScope.Set("self", s)
-	obj := Eval(fn.Literal.Body, extendedScope)
-	return unwrapReturnValue(obj)
+	if fn.Literal.IsGenerator {
+		return newGenerator(fn, extendedScope)
+	}
+	if fn.Literal.IsAsync {
+		return callAsync(line, scope, fn, extendedScope)
+	}
+	if errObj := enterCall(line, scope, fn, extendedScope); errObj != nil {
+		return errObj
+	}
+	return extendedScope.defers.run(callBody(line, fn, extendedScope))
 }
 
 type Throw struct {
 	stmt  *ast.ThrowStmt
 	value Object
+	stack []string //the traceback of the 'throw' statement
+}
+
+// the error of the throw which is not caught, a thrown error is reported as
+// it is(with its cause)
+func (t *Throw) unhandled() *Error {
+	if re, ok := t.value.(*RuntimeError); ok {
+		return re.err
+	}
+	errObj := newError(t.stmt.Pos().Sline(), ERR_THROWNOTHANDLED, t.value.Inspect())
+	errObj.stack = t.stack
+	return errObj
 }
 
 func (t *Throw) Inspect() string  { return t.value.Inspect() }
@@ -959,8 +1126,12 @@ func (t *Throw) CallMethod(line string, scope *Scope, method string, args ...Obj
 	return newError(line, ERR_NOMETHOD, method, t.Type())
 }
 
+// TailCall is the result of 'tailcall f(x)' and 'return f(x)', the caller
+// runs the call in its own loop instead of nesting it.
 type TailCall struct {
-	tail *ast.TailCallStatement
+	call *ast.CallExpression
+	args []Object //the evaluated arguments
+	fn   Object   //the evaluated function, an error for a struct's name
 }
 
 func (tc *TailCall) Inspect() string  { return "tailcall" }
@@ -1006,6 +1177,7 @@ func initGlobalObj() {
 	SetGlobalObj("stdin", &FileObject{File: os.Stdin})
 	SetGlobalObj("stdout", &FileObject{File: os.Stdout})
 	SetGlobalObj("stderr", &FileObject{File: os.Stderr})
+	SetGlobalObj("Promise", &Promises{})
 }
 
 func init() {
@@ -0,0 +1,288 @@
+package eval
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"magpie/ast"
+	"strings"
+)
+
+// Opcode is an instruction of the bytecode. The operands are big-endian
+// uint16s following the opcode, a 'node' operand is an index into the
+// code's nodes, and it's always the first operand. A 'slot' operand is the
+// index of an object on the stack, 'base' is the stack depth which a
+// statement started at, and the other operands are counts and jump targets.
+type Opcode byte
+
+const (
+	opNull           Opcode = iota //push a nil result, e.g. the result of an empty block
+	opNil                          //push NIL
+	opTrue                         //push TRUE
+	opFalse                        //push FALSE
+	opNumber                       //node: push the number literal
+	opString                       //node: push the string literal, which has no interpolation
+	opInterpolate                  //node: push the interpolated string literal
+	opIdent                        //node: push the identifier's value, which is looked up by name
+	opGetLocal                     //node: push the resolved identifier's value, which is read from its slot
+	opSetLocal                     //node: assign the value to the resolved variable of 'x = value'
+	opFunction                     //node: push the function literal's closure
+	opRegex                        //node: push the regular expression
+	opCmd                          //node: run the command, push the result
+	opStruct                       //node: declare the struct
+	opInterface                    //node: declare the interface
+	opImport                       //node: import the module
+	opMacro                        //node: raise the error of a macro definition which is not expanded
+	opPrefix                       //node: pop the operand, push the result
+	opInfix                        //node: pop the two operands, push the result
+	opPostfix                      //node: pop the operand, push the result
+	opIndex                        //node: pop the object and the index, push the result
+	opArray                        //node, count: pop the members, push the array
+	opTuple                        //node, count: pop the members, push the tuple
+	opHash                         //node: push a new hash
+	opHashKey                      //node: check the key
+	opHashPair                     //node, target: pop the key and the value, put them in the hash, or jump if it fails
+	opCharge                       //node: charge the allocation of the node's result
+	opPop                          //pop the result
+	opOrNil                        //replace a nil result(of an empty block) with NIL
+	opUnbox                        //node, count: pop the arguments, push the unboxed ones of the variadic call
+	opNewStruct                    //node, count, target: pop the arguments and create the struct object, if it's a struct's call
+	opCall                         //node, count: pop the function and the arguments, call the function and push the result
+	opGoMember                     //node: push the Go variable
+	opGoCall                       //node, count: pop the arguments, call the Go function
+	opMethodCheck                  //node: check the receiver of the method call, push the hash's function
+	opMethodCall                   //node, count: pop the receiver, the function and the arguments, call the method
+	opMember                       //node: pop the object, push its member
+	opPipeCheck                    //node: check the function which the value is piped to
+	opPipeCall                     //node: pop the function and the piped value, call the function
+	opIsStruct                     //node, target: replace the object with the result of 'obj is StructName', and jump
+	opIs                           //node: pop the object and the interface, push the result of 'obj is InterfaceName'
+	opTailCall                     //node, count: pop the arguments and the function, push the tail call
+	opLet                          //node, count: pop the values, bind them to the names
+	opLetLocal                     //node: pop the value, bind it to the resolved name
+	opReturn                       //node, count: pop the values, push the return value
+	opAssign                       //node: pop the value, assign it and push the result
+	opSetIndex                     //node: pop the value, the object and the index, assign the value to the element
+	opAssignIndex                  //node: pop the value and the index, assign the value to the variable's element
+	opAssignMember                 //node: pop the value and the object, assign the value to the object's member
+	opMultiValues                  //node, count: pop the values of the multiple assignment, push the list of the names' values
+	opListItem                     //slot, index: push the list's item
+	opThrow                        //node: pop the value, push the thrown object
+	opRethrow                      //node: push the value which the catch clause caught
+	opBreak                        //node: push the break object
+	opContinue                     //node: push the continue object
+	opFallthrough                  //push the fallthrough object
+	opJump                         //target
+	opJumpIfFalse                  //node, target: pop the condition, jump if it's false
+	opStmtEnd                      //target: pop the statement's result, or jump if it's a control object(return, break, ...)
+	opProgStmtEnd                  //last: like opStmtEnd, but for the program's statements
+	opLeave                        //base: pop the result, leave the loops, the scopes and the catch clauses above the base, push the result
+	opLoop                         //node: push the state of the loop
+	opIter                         //node: pop the object, push the state of the loop which iterates it
+	opRangeIter                    //node: pop the range's start and end, push the state of the loop which iterates it
+	opNext                         //node, target, target: bind the next item to the loop's variables, jump if there are no more items, or to leave with the iterator's error
+	opDrop                         //pop the state and leave it
+	opLoopBody                     //node, target, target: pop the body's result, jump to break the loop, or to leave it with the result
+	opLoopResult                   //node: push the loop's result
+	opLoopElse                     //node: pop the result of the 'else' block, replace the loop's result with its control object
+	opNewScope                     //push the state of a new scope, which the following instructions run in
+	opComp                         //node: push the comprehension's new collection
+	opCompCond                     //node, target, target: pop the condition, jump to the next item if it's false, or to leave with the throw
+	opCompPush                     //node, slot, target: pop the value, add it to the collection, or jump to leave with the throw
+	opCompKey                      //node, target: check the key, or jump to leave with the throw
+	opCompPair                     //node, slot, target: pop the key and the value, put them in the hash, or jump to leave with the failure
+	opCatch                        //node: enter the catch clause which catches the try block's result, the jumps to the clauses follow
+	opCatchEnd                     //pop the clause's result and the clause's state, push the result
+	opTryEnd                       //node: raise the error which is not caught
+	opFinally                      //node: raise the limit error, before the 'finally' block
+	opFinallyEnd                   //node: pop the results of 'finally' and the try statement, push the statement's result
+	opSwitch                       //node, target: check the value, or jump with the throw
+	opCase                         //node, target, target: pop the case's value, jump to the case's block if it matches, or with the throw
+	opCaseEnd                      //node, target, target: jump to the next block for 'fallthrough', or to the end with the result
+	opSelectChan                   //node: check the channel of the select case
+	opSelect                       //node, count, target: pop the channels and the values, push the received values, the jumps to the cases follow
+	opDecorator                    //node: check the decorator
+	opDecorated                    //node: push the decorated function, or the decorated struct's constructor
+	opApplyDecorator               //node, target: pop the decorator and the decorated function, push the result, or jump with the throw
+	opDecorate                     //node: pop the result of the decorators, bind it to the decorated function's name
+	opCheck                        //node: check that 'defer' is in a function, or 'yield' is in a generator
+	opDefer                        //node, count: pop the function and the arguments, defer the call
+	opSpawn                        //node, count: pop the function and the arguments, spawn the call
+	opAwait                        //node: pop the value, push the awaited result
+	opYield                        //node: pop the value, yield it and push the sent value
+	opUnquote                      //node: pop the value of 'unquote(x)', push its node
+	opQuote                        //node, count: pop the nodes of the unquote calls, push the quoted expression
+)
+
+type opDef struct {
+	name     string
+	operands int
+	hasNode  bool
+}
+
+var opDefs = [...]opDef{
+	opNull:           {"NULL", 0, false},
+	opNil:            {"NIL", 0, false},
+	opTrue:           {"TRUE", 0, false},
+	opFalse:          {"FALSE", 0, false},
+	opNumber:         {"NUMBER", 1, true},
+	opString:         {"STRING", 1, true},
+	opInterpolate:    {"INTERPOLATE", 1, true},
+	opIdent:          {"IDENT", 1, true},
+	opGetLocal:       {"GET_LOCAL", 1, true},
+	opSetLocal:       {"SET_LOCAL", 1, true},
+	opFunction:       {"FUNCTION", 1, true},
+	opRegex:          {"REGEX", 1, true},
+	opCmd:            {"CMD", 1, true},
+	opStruct:         {"STRUCT", 1, true},
+	opInterface:      {"INTERFACE", 1, true},
+	opImport:         {"IMPORT", 1, true},
+	opMacro:          {"MACRO", 1, true},
+	opPrefix:         {"PREFIX", 1, true},
+	opInfix:          {"INFIX", 1, true},
+	opPostfix:        {"POSTFIX", 1, true},
+	opIndex:          {"INDEX", 1, true},
+	opArray:          {"ARRAY", 2, true},
+	opTuple:          {"TUPLE", 2, true},
+	opHash:           {"HASH", 1, true},
+	opHashKey:        {"HASH_KEY", 1, true},
+	opHashPair:       {"HASH_PAIR", 2, true},
+	opCharge:         {"CHARGE", 1, true},
+	opPop:            {"POP", 0, false},
+	opOrNil:          {"OR_NIL", 0, false},
+	opUnbox:          {"UNBOX", 2, true},
+	opNewStruct:      {"NEW_STRUCT", 3, true},
+	opCall:           {"CALL", 2, true},
+	opGoMember:       {"GO_MEMBER", 1, true},
+	opGoCall:         {"GO_CALL", 2, true},
+	opMethodCheck:    {"METHOD_CHECK", 1, true},
+	opMethodCall:     {"METHOD_CALL", 2, true},
+	opMember:         {"MEMBER", 1, true},
+	opPipeCheck:      {"PIPE_CHECK", 1, true},
+	opPipeCall:       {"PIPE_CALL", 1, true},
+	opIsStruct:       {"IS_STRUCT", 2, true},
+	opIs:             {"IS", 1, true},
+	opTailCall:       {"TAIL_CALL", 2, true},
+	opLet:            {"LET", 2, true},
+	opLetLocal:       {"LET_LOCAL", 1, true},
+	opReturn:         {"RETURN", 2, true},
+	opAssign:         {"ASSIGN", 1, true},
+	opSetIndex:       {"SET_INDEX", 1, true},
+	opAssignIndex:    {"ASSIGN_INDEX", 1, true},
+	opAssignMember:   {"ASSIGN_MEMBER", 1, true},
+	opMultiValues:    {"MULTI_VALUES", 2, true},
+	opListItem:       {"LIST_ITEM", 2, false},
+	opThrow:          {"THROW", 1, true},
+	opRethrow:        {"RETHROW", 1, true},
+	opBreak:          {"BREAK", 1, true},
+	opContinue:       {"CONTINUE", 1, true},
+	opFallthrough:    {"FALLTHROUGH", 0, false},
+	opJump:           {"JUMP", 1, false},
+	opJumpIfFalse:    {"JUMP_IF_FALSE", 2, true},
+	opStmtEnd:        {"STMT_END", 1, false},
+	opProgStmtEnd:    {"PROG_STMT_END", 1, false},
+	opLeave:          {"LEAVE", 1, false},
+	opLoop:           {"LOOP", 1, true},
+	opIter:           {"ITER", 1, true},
+	opRangeIter:      {"RANGE_ITER", 1, true},
+	opNext:           {"NEXT", 3, true},
+	opDrop:           {"DROP", 0, false},
+	opLoopBody:       {"LOOP_BODY", 3, true},
+	opLoopResult:     {"LOOP_RESULT", 1, true},
+	opLoopElse:       {"LOOP_ELSE", 1, true},
+	opNewScope:       {"NEW_SCOPE", 0, false},
+	opComp:           {"COMP", 1, true},
+	opCompCond:       {"COMP_COND", 3, true},
+	opCompPush:       {"COMP_PUSH", 3, true},
+	opCompKey:        {"COMP_KEY", 2, true},
+	opCompPair:       {"COMP_PAIR", 3, true},
+	opCatch:          {"CATCH", 1, true},
+	opCatchEnd:       {"CATCH_END", 0, false},
+	opTryEnd:         {"TRY_END", 1, true},
+	opFinally:        {"FINALLY", 1, true},
+	opFinallyEnd:     {"FINALLY_END", 1, true},
+	opSwitch:         {"SWITCH", 2, true},
+	opCase:           {"CASE", 3, true},
+	opCaseEnd:        {"CASE_END", 3, true},
+	opSelectChan:     {"SELECT_CHAN", 1, true},
+	opSelect:         {"SELECT", 3, true},
+	opDecorator:      {"DECORATOR", 1, true},
+	opDecorated:      {"DECORATED", 1, true},
+	opApplyDecorator: {"APPLY_DECORATOR", 2, true},
+	opDecorate:       {"DECORATE", 1, true},
+	opCheck:          {"CHECK", 1, true},
+	opDefer:          {"DEFER", 2, true},
+	opSpawn:          {"SPAWN", 2, true},
+	opAwait:          {"AWAIT", 1, true},
+	opYield:          {"YIELD", 1, true},
+	opUnquote:        {"UNQUOTE", 1, true},
+	opQuote:          {"QUOTE", 2, true},
+}
+
+func readOperand(ins []byte, offset int) int {
+	return int(binary.BigEndian.Uint16(ins[offset:]))
+}
+
+// String disassembles the code.
+func (c *Code) String() string {
+	var out bytes.Buffer
+	for ip := 0; ip < len(c.Instructions); {
+		op := Opcode(c.Instructions[ip])
+		def := opDefs[op]
+		operands := []string{}
+		for i := 0; i < def.operands; i++ {
+			operands = append(operands, fmt.Sprintf("%d", readOperand(c.Instructions, ip+1+2*i)))
+		}
+		fmt.Fprintf(&out, "%04d %-13s %s", ip, def.name, strings.Join(operands, " "))
+		if def.hasNode {
+			node := c.Nodes[readOperand(c.Instructions, ip+1)]
+			fmt.Fprintf(&out, "\t; %s", abbrev(node.String()))
+		}
+		out.WriteString("\n")
+		ip += 1 + 2*def.operands
+	}
+	for _, h := range c.handlers {
+		fmt.Fprintf(&out, "error handler: [%04d, %04d) -> %04d, stack depth %d\n", h.start, h.end, h.target, h.depth)
+	}
+	return out.String()
+}
+
+// one line of at most 40 characters
+func abbrev(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > 40 {
+		return s[:37] + "..."
+	}
+	return s
+}
+
+// Disassemble compiles the program, its functions' bodies and its structs'
+// blocks, and returns their bytecode.
+func Disassemble(program *ast.Program) string {
+	var out bytes.Buffer
+	unit := func(title string, node ast.Node) {
+		fmt.Fprintf(&out, "== %s ==\n", title)
+		code, err := Compile(node)
+		if err != nil {
+			fmt.Fprintf(&out, "%s, evaluated by the tree-walker\n\n", err)
+			return
+		}
+		fmt.Fprintf(&out, "%s\n", code)
+	}
+
+	unit("program", program)
+	ast.Inspect(program, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FunctionLiteral:
+			name := n.Name
+			if name == "" {
+				name = "<anonymous>"
+			}
+			unit(fmt.Sprintf("fn %s, line %d", name, n.Pos().Line), n.Body)
+		case *ast.StructStatement:
+			unit(fmt.Sprintf("struct %s, line %d", n.Name, n.Pos().Line), n.Block)
+		}
+		return true
+	})
+	return out.String()
+}
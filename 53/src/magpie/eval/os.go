@@ -11,6 +11,15 @@ const (
 
 type Os struct{}
 
+// the capabilities which the methods need
+var osCapabilities = map[string]Capability{
+	"getenv": CapEnv,
+	"setenv": CapEnv,
+	"chdir":  CapFile,
+	"mkdir":  CapFile,
+	"exit":   CapExit,
+}
+
 func NewOsObj() Object {
 	ret := &Os{}
 	SetGlobalObj(os_name, ret)
@@ -22,6 +31,10 @@ func (o *Os) Inspect() string  { return "<" + os_name + ">" }
 func (o *Os) Type() ObjectType { return OS_OBJ }
 
 func (o *Os) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	if errObj := scope.denied(line, osCapabilities[method]); errObj != nil {
+		return errObj
+	}
+
 	switch method {
 	case "getenv":
 		return o.getenv(line, args...)
@@ -0,0 +1,124 @@
+package eval
+
+import (
+	"magpie/ast"
+)
+
+// Protocol methods which a struct could define to overload the operators
+// and some of the builtin functions.
+const (
+	PROTO_STR      = "__str__"
+	PROTO_LEN      = "__len__"
+	PROTO_HASH     = "__hash__"
+	PROTO_CALL     = "__call__"
+	PROTO_INDEX    = "__index__"
+	PROTO_SETINDEX = "__setindex__"
+	PROTO_CONTAINS = "__contains__"
+	PROTO_NEG      = "__neg__"
+	PROTO_EQ       = "__eq__"
+	PROTO_NE       = "__ne__"
+)
+
+// binary operator => protocol method
+var binaryProtocols = map[string]string{
+	"+":  "__add__",
+	"-":  "__sub__",
+	"*":  "__mul__",
+	"/":  "__div__",
+	"%":  "__mod__",
+	"**": "__pow__",
+	"==": PROTO_EQ,
+	"!=": PROTO_NE,
+	"<":  "__lt__",
+	"<=": "__le__",
+	">":  "__gt__",
+	">=": "__ge__",
+}
+
+// if the left operand does not support the comparison operator,
+// we try the right operand with the reflected operator. e.g. a < b => b > a
+var reflectedOperators = map[string]string{
+	"==": "==",
+	"!=": "!=",
+	"<":  ">",
+	"<=": ">=",
+	">":  "<",
+	">=": "<=",
+}
+
+// get the protocol method defined in the struct's body(not the parent scope).
+func (s *Struct) protocolMethod(name string) (*Function, bool) {
+	obj, ok := s.Scope.getOwn(name)
+	if !ok {
+		return nil, false
+	}
+	fn, ok := obj.(*Function)
+	return fn, ok
+}
+
+func (s *Struct) hasProtocol(name string) bool {
+	_, ok := s.protocolMethod(name)
+	return ok
+}
+
+// call struct's protocol method if the struct has one.
+// the second return value reports whether the method was found.
+func callProtocol(line string, scope *Scope, obj Object, name string, args ...Object) (Object, bool) {
+	s, ok := obj.(*Struct)
+	if !ok || !s.hasProtocol(name) {
+		return nil, false
+	}
+	return s.CallMethod(line, scope, name, args...), true
+}
+
+// dispatch the infix operator to the struct's protocol method.
+// the second return value reports whether the operator was handled.
+func evalStructInfixExpression(node *ast.InfixExpression, left, right Object, scope *Scope) (Object, bool) {
+	line := node.Pos().Sline()
+	operator := node.Operator
+
+	if operator == "in" {
+		return callProtocol(line, scope, right, PROTO_CONTAINS, left)
+	}
+
+	method, ok := binaryProtocols[operator]
+	if !ok {
+		return nil, false
+	}
+
+	result, ok := callProtocol(line, scope, left, method, right)
+	if !ok {
+		if reflected, canReflect := reflectedOperators[operator]; canReflect {
+			result, ok = callProtocol(line, scope, right, binaryProtocols[reflected], left)
+		}
+	}
+
+	//'!=' falls back to the negation of '__eq__'
+	if !ok && operator == "!=" {
+		if result, ok = callProtocol(line, scope, left, PROTO_EQ, right); !ok {
+			result, ok = callProtocol(line, scope, right, PROTO_EQ, left)
+		}
+		if ok && !isError(result) {
+			result = nativeBoolToBooleanObject(!IsTrue(result))
+		}
+	}
+
+	if !ok || isError(result) {
+		return result, ok
+	}
+
+	//chained comparison, e.g. a < b < c
+	if node.HasNext && reflectedOperators[operator] != "" {
+		if !IsTrue(result) {
+			return FALSE, true
+		}
+		next := evalNext(node, scope)
+		if isError(next) {
+			return next, true
+		}
+		infixExpr := &ast.InfixExpression{Token: node.Token, Operator: node.NextOperator}
+		return evalInfixExpression(infixExpr, right, next, scope), true
+	}
+
+	return result, true
+}
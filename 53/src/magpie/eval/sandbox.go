@@ -0,0 +1,264 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"io"
+	"magpie/ast"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Capability is a set of the operations which an execution could deny.
+type Capability int
+
+const (
+	CapCommand Capability = 1 << iota //the backtick commands
+	CapFile                           //'open', the file objects, os.mkdir and os.chdir
+	CapEnv                            //os.getenv and os.setenv
+	CapExit                           //os.exit
+	CapGo                             //the registered Go functions and values
+
+	CapAll = CapCommand | CapFile | CapEnv | CapExit | CapGo
+)
+
+var capNames = []struct {
+	cap  Capability
+	name string
+	what string //for the error message
+}{
+	{CapCommand, "command", "command execution"},
+	{CapFile, "file", "file I/O"},
+	{CapEnv, "env", "environment access"},
+	{CapExit, "exit", "os.exit"},
+	{CapGo, "go", "Go interop"},
+}
+
+// ParseCapabilities parses a comma separated list of the capabilities'
+// names(command, file, env, exit, go, or all).
+func ParseCapabilities(s string) (Capability, error) {
+	var caps Capability
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "all":
+			caps |= CapAll
+			continue
+		}
+		found := false
+		for _, c := range capNames {
+			if c.name == name {
+				caps |= c.cap
+				found = true
+			}
+		}
+		if !found {
+			return 0, errors.New("unknown capability '" + name + "'")
+		}
+	}
+	return caps, nil
+}
+
+// The errors of the violated limits, an error object of a violated limit
+// wraps one of them(errors.Is(errObj, ErrStepLimit)). They could not be
+// caught by 'try/catch'.
+var (
+	ErrCanceled   = errors.New("execution canceled")
+	ErrTimeout    = errors.New("execution timed out")
+	ErrStepLimit  = errors.New("step limit exceeded")
+	ErrAllocLimit = errors.New("allocation limit exceeded")
+	ErrDenied     = errors.New("capability denied")
+)
+
+// Options are the limits and the capabilities of an execution, e.g. for
+// running the untrusted code. The zero value has no limits.
+type Options struct {
+	Context  context.Context //cancels the execution, or sets its deadline
+	MaxSteps int64           //the maximum number of the evaluated nodes, 0 for no limit
+	MaxAlloc int64           //the approximate maximum bytes of the created strings and collections, 0 for no limit
+	Deny     Capability      //the denied operations
+}
+
+const pollInterval = 1024 //the context is checked every 'pollInterval' steps
+
+// the state of an execution which has options, shared by all its scopes
+type sandbox struct {
+	opts     Options
+	deadline time.Time //checked by itself, the context's timer may not fire while the code runs(e.g. in wasm)
+	steps    int64
+	alloc    int64
+}
+
+// NewScopeWithOptions returns a new top level scope, the code evaluated in it
+// (and in the modules it imports) is limited by the options.
+func NewScopeWithOptions(w io.Writer, opts *Options) *Scope {
+	scope := NewScope(nil, w)
+	scope.sandbox = newSandbox(opts)
+	return scope
+}
+
+func newSandbox(opts *Options) *sandbox {
+	if opts == nil {
+		return nil
+	}
+	sb := &sandbox{opts: *opts}
+	if sb.opts.Context != nil {
+		sb.deadline, _ = sb.opts.Context.Deadline()
+	}
+	return sb
+}
+
+// count an evaluated node, check the step limit and the context
+func (sb *sandbox) step(node ast.Node) *Error {
+	n := atomic.AddInt64(&sb.steps, 1)
+	if sb.opts.MaxSteps > 0 && n > sb.opts.MaxSteps {
+		return limitError(node.Pos().Sline(), ErrStepLimit, ERR_STEPLIMIT, sb.opts.MaxSteps)
+	}
+	if n%pollInterval == 0 {
+		return sb.checkContext(node.Pos().Sline())
+	}
+	return nil
+}
+
+func (sb *sandbox) checkContext(line string) *Error {
+	ctx := sb.opts.Context
+	if ctx == nil {
+		return nil
+	}
+	err := ctx.Err()
+	if err == nil && !sb.deadline.IsZero() && time.Now().After(sb.deadline) {
+		err = context.DeadlineExceeded
+	}
+	switch err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return limitError(line, ErrTimeout, "%s", ERR_TIMEOUT)
+	default:
+		return limitError(line, ErrCanceled, "%s", ERR_CANCELED)
+	}
+}
+
+// account the object's size against the allocation budget, returns the
+// object, or the error if the budget is exceeded
+func (sb *sandbox) charge(node ast.Node, obj Object, size int64) Object {
+	if sb.opts.MaxAlloc <= 0 || size <= 0 {
+		return obj
+	}
+	if atomic.AddInt64(&sb.alloc, size) > sb.opts.MaxAlloc {
+		return limitError(node.Pos().Sline(), ErrAllocLimit, ERR_ALLOCLIMIT, sb.opts.MaxAlloc)
+	}
+	return obj
+}
+
+// check that the budget has room for an allocation of the size, which is
+// accounted after it's done
+func (sb *sandbox) reserve(node ast.Node, size int64) *Error {
+	if sb.opts.MaxAlloc > 0 && atomic.LoadInt64(&sb.alloc)+size > sb.opts.MaxAlloc {
+		return limitError(node.Pos().Sline(), ErrAllocLimit, ERR_ALLOCLIMIT, sb.opts.MaxAlloc)
+	}
+	return nil
+}
+
+// the estimated size of the repetitions('str * n', 'arr * n') and the
+// ranges('1..n'), which could be huge
+func infixSize(operator string, left, right Object) int64 {
+	var size float64
+	switch operator {
+	case "*":
+		if n, ok := right.(*Number); ok {
+			size = float64(sizeOf(left)) * math.Abs(n.Value)
+		} else if n, ok := left.(*Number); ok {
+			size = float64(sizeOf(right)) * math.Abs(n.Value)
+		}
+	case "..":
+		l, ok1 := left.(*Number)
+		r, ok2 := right.(*Number)
+		if ok1 && ok2 {
+			size = 16 * math.Abs(r.Value-l.Value)
+		}
+	}
+	if !(size < math.MaxInt64/2) { //don't overflow the budget's counter, NaN too
+		return math.MaxInt64 / 2
+	}
+	return int64(size)
+}
+
+// the approximate size of the object itself, the members are accounted
+// when they are created
+func sizeOf(obj Object) int64 {
+	switch o := obj.(type) {
+	case *String:
+		return int64(len(o.String))
+	case *Array:
+		return 16 * int64(o.count())
+	case *Tuple:
+		return 16 * int64(len(o.Members))
+	case *Hash:
+		return 48 * int64(o.count())
+	}
+	return 0
+}
+
+// the nodes whose results are new strings or collections
+func allocates(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.InfixExpression, *ast.ArrayLiteral, *ast.TupleLiteral, *ast.HashLiteral,
+		*ast.ArrayComprehension, *ast.TupleComprehension, *ast.HashComprehension, *ast.CmdExpression:
+		return true
+	case *ast.StringLiteral: //interpolated
+		return strings.Contains(n.Value, "$")
+	case *ast.AssignExpression: //e.g. 's += "x"'
+		return n.Token.Literal != "="
+	}
+	return false
+}
+
+// charge the method call's allocations: the receiver's growth(e.g. 'arr.push(x)'),
+// and the result if it's not the receiver. 'size' is the receiver's size before the call.
+func (s *Scope) chargeMethod(node ast.Node, recv Object, size int64, result Object) Object {
+	if s == nil || s.sandbox == nil {
+		return result
+	}
+	grown := sizeOf(recv) - size
+	if result != recv {
+		grown += sizeOf(result)
+	}
+	return s.sandbox.charge(node, result, grown)
+}
+
+// denied returns an error if the execution denies the operation.
+func (s *Scope) denied(line string, c Capability) *Error {
+	if s == nil || s.sandbox == nil || s.sandbox.opts.Deny&c == 0 {
+		return nil
+	}
+	for _, cn := range capNames {
+		if cn.cap == c {
+			errObj := newError(line, ERR_DENIED, cn.what)
+			errObj.limit = ErrDenied
+			return errObj
+		}
+	}
+	return nil
+}
+
+// the context of the execution, for the operations which could block
+func (s *Scope) context() context.Context {
+	if s == nil || s.sandbox == nil || s.sandbox.opts.Context == nil {
+		return context.Background()
+	}
+	return s.sandbox.opts.Context
+}
+
+func limitError(line string, limit error, format string, args ...interface{}) *Error {
+	errObj := newError(line, format, args...)
+	if errObj.kind == "" { //a message without arguments is passed with '%s'
+		errObj.kind = errKinds[errObj.text]
+	}
+	errObj.limit = limit
+	return errObj
+}
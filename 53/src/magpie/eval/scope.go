@@ -4,56 +4,130 @@ import (
 	"fmt"
 	"io"
 	"magpie/ast"
-	"unicode"
+	"sync"
+	"sync/atomic"
 )
 
+// threaded is set by the first 'spawn', the scopes are locked only after it,
+// so the single-threaded programs don't pay for the locks.
+var threaded atomic.Bool
+
 func NewScope(p *Scope, w io.Writer) *Scope {
-	s := make(map[string]Object)
-	ss := make(map[string]*ast.StructStatement)
-	ret := &Scope{store: s, parentScope: p, structStore: ss}
+	ret := &Scope{parentScope: p}
 	if p == nil {
 		ret.Writer = w
 	} else {
 		ret.Writer = p.Writer
+		ret.sandbox = p.sandbox
 	}
 
 	return ret
 }
 
+// The maps are created at the first use. A function call's scope keeps the
+// local variables which the resolver has laid out in 'slots', and the other
+// names in 'store'.
 type Scope struct {
 	store       map[string]Object
 	parentScope *Scope
 	Writer      io.Writer
 
 	structStore map[string]*ast.StructStatement
+
+	generator *genContext   //non-nil if it's a generator function's scope
+	async     *asyncContext //non-nil if it's an async function's scope
+	defers    *deferFrame   //non-nil if it's a function invocation's scope
+	call      *callFrame    //the function invocation, for the depth limit
+	sandbox   *sandbox      //the execution's limits, nil if it has no options
+
+	locals  *ast.Locals //the layout of the slots, nil if the function is not resolved
+	slots   []Object    //nil if the variable is not set
+	args    []Object    //the call's arguments, '$_' is created at the first use
+	allArgs Object
+
+	mu sync.Mutex //guards the variables once the program is threaded
 }
 
-//Get all exported to 'anotherScope'
-func (s *Scope) GetAllExported(anotherScope *Scope) {
-	for key, value := range s.store {
-		if unicode.IsUpper(rune(key[0])) { //only upppercase functions/variables are exported
-			anotherScope.Set(key, value)
+func (s *Scope) Get(name string) (Object, bool) {
+	for ; s != nil; s = s.parentScope {
+		if obj, ok := s.getOwn(name); ok {
+			return obj, true
 		}
 	}
+	return nil, false
+}
 
-	for key, value := range s.structStore {
-		if unicode.IsUpper(rune(key[0])) { //only upppercase struct name are exported
-			anotherScope.SetStruct(value)
+// get the variable from the scope itself, not the parent scopes
+func (s *Scope) getOwn(name string) (Object, bool) {
+	if threaded.Load() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if s.locals != nil {
+		if obj, ok := s.getLocal(name); ok {
+			return obj, true
 		}
 	}
+	obj, ok := s.store[name]
+	return obj, ok
 }
 
-func (s *Scope) Get(name string) (Object, bool) {
-	obj, ok := s.store[name]
-	if !ok && s.parentScope != nil {
-		obj, ok = s.parentScope.Get(name)
+func (s *Scope) getLocal(name string) (Object, bool) {
+	if idx, ok := s.locals.Index[name]; ok {
+		obj := s.slots[idx]
+		return obj, obj != nil
 	}
-	return obj, ok
+	if name == ALL_ARGS {
+		if s.allArgs == nil {
+			s.allArgs = &Array{Members: s.args}
+		}
+		return s.allArgs, true
+	}
+	return nil, false
+}
+
+// lookup gets the resolved identifier's value by its address. 'resolved' is
+// false if the identifier is not resolved, the scopes are not the ones which
+// the resolver expected, or the variable is not set yet.
+func (s *Scope) lookup(ident *ast.Identifier) (obj Object, ok bool, resolved bool) {
+	if ident.Frames == nil || threaded.Load() { //the threaded programs use the locked lookup
+		return nil, false, false
+	}
+	for _, locals := range ident.Frames[:ident.Depth] { //the scopes on the way have no such variable
+		if s == nil || s.locals != locals || len(s.store) != 0 {
+			return nil, false, false
+		}
+		s = s.parentScope
+	}
+
+	if ident.Slot < 0 {
+		if s == nil {
+			return nil, false, false
+		}
+		obj, ok = s.Get(ident.Value)
+		return obj, ok, true
+	}
+	if s == nil || s.locals != ident.Frames[ident.Depth] {
+		return nil, false, false
+	}
+	obj = s.slots[ident.Slot]
+	return obj, obj != nil, obj != nil
 }
 
 // Get all the keys of the scope.
 func (s *Scope) GetKeys() []string {
+	if threaded.Load() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
 	keys := make([]string, 0, len(s.store))
+	if s.locals != nil {
+		for i, name := range s.locals.Names {
+			if s.slots[i] != nil {
+				keys = append(keys, name)
+			}
+		}
+	}
 	for k := range s.store {
 		keys = append(keys, k)
 	}
@@ -62,7 +136,8 @@ func (s *Scope) GetKeys() []string {
 
 func (s *Scope) DebugPrint(indent string) {
 
-	for k, v := range s.store {
+	for _, k := range s.GetKeys() {
+		v, _ := s.Get(k)
 		fmt.Fprintf(s.Writer, "%s<%s> = <%s>  value.Type: %T\n", indent, k, v.Inspect(), v)
 	}
 
@@ -74,34 +149,125 @@ func (s *Scope) DebugPrint(indent string) {
 }
 
 func (s *Scope) Set(name string, val Object) Object {
+	if threaded.Load() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	return s.set(name, val)
+}
+
+func (s *Scope) set(name string, val Object) Object {
+	if s.locals != nil {
+		if idx, ok := s.locals.Index[name]; ok {
+			s.slots[idx] = val
+			return val
+		}
+		if name == ALL_ARGS {
+			s.allArgs = val
+			return val
+		}
+	}
+	if s.store == nil {
+		s.store = make(map[string]Object)
+	}
 	s.store[name] = val
 	return val
 }
 
 func (s *Scope) Del(name string) {
+	if threaded.Load() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if s.locals != nil {
+		if idx, ok := s.locals.Index[name]; ok {
+			s.slots[idx] = nil
+			return
+		}
+	}
 	delete(s.store, name)
 }
 
+// bind the call's arguments to the function's parameters, the scope's old
+// variables are removed.
+func (s *Scope) bindArgs(fl *ast.FunctionLiteral, args []Object) {
+	if fl.Variadic { //boxing
+		ellipsisArgs := args[len(fl.Parameters)-1:]
+		newArgs := make([]Object, 0, len(fl.Parameters)+1)
+		newArgs = append(newArgs, args[:len(fl.Parameters)-1]...)
+		args = append(newArgs, &Array{Members: ellipsisArgs})
+	}
+
+	if threaded.Load() { //a spawned closure may still use the scope of a tail call
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	s.store = nil
+	s.locals = fl.Locals
+	if s.locals == nil { //not resolved
+		s.slots, s.args, s.allArgs = nil, nil, nil
+		for i, param := range fl.Parameters {
+			s.set(param.Value, args[i])
+		}
+		s.set(ALL_ARGS, &Array{Members: args})
+		return
+	}
+
+	if n := len(s.locals.Names); cap(s.slots) >= n {
+		s.slots = s.slots[:n]
+		for i := range s.slots {
+			s.slots[i] = nil
+		}
+	} else {
+		s.slots = make([]Object, n)
+	}
+	s.args, s.allArgs = args, nil
+	for i, param := range fl.Parameters {
+		s.set(param.Value, args[i])
+	}
+}
+
 func (s *Scope) GetStruct(name string) (*ast.StructStatement, bool) {
-	obj, ok := s.structStore[name]
+	obj, ok := s.getOwnStruct(name)
 	if !ok && s.parentScope != nil {
 		obj, ok = s.parentScope.GetStruct(name)
 	}
 	return obj, ok
 }
 
+func (s *Scope) getOwnStruct(name string) (*ast.StructStatement, bool) {
+	if threaded.Load() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	obj, ok := s.structStore[name]
+	return obj, ok
+}
+
 func (s *Scope) SetStruct(structStmt *ast.StructStatement) *ast.StructStatement {
+	if threaded.Load() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if s.structStore == nil {
+		s.structStore = make(map[string]*ast.StructStatement)
+	}
 	s.structStore[structStmt.Name] = structStmt
 	return structStmt
 }
 
 var GlobalScopes map[string]Object = make(map[string]Object)
+var globalMu sync.RWMutex //guards GlobalScopes
 
 func GetGlobalObj(name string) (Object, bool) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	obj, ok := GlobalScopes[name]
 	return obj, ok
 }
 
 func SetGlobalObj(name string, Obj Object) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 	GlobalScopes[name] = Obj
 }
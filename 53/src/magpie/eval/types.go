@@ -0,0 +1,131 @@
+package eval
+
+import (
+	"fmt"
+	"magpie/ast"
+)
+
+// StrictTypes enables the runtime checks of the annotated parameter
+// and return types when calling functions('--strict-types').
+var StrictTypes bool
+
+// check if the object matches the type annotation. the type name is one of
+// 'type()' builtin's results, 'any', or the name of a struct or an interface.
+func typeMatches(line string, scope *Scope, obj Object, typ *ast.Identifier) (bool, Object) {
+	switch typ.Value {
+	case "any":
+		return true, nil
+	case "number":
+		return obj.Type() == NUMBER_OBJ, nil
+	case "string":
+		return obj.Type() == STRING_OBJ, nil
+	case "bool":
+		return obj.Type() == BOOLEAN_OBJ, nil
+	case "nil":
+		return obj.Type() == NIL_OBJ, nil
+	case "array":
+		return obj.Type() == ARRAY_OBJ, nil
+	case "tuple":
+		return obj.Type() == TUPLE_OBJ, nil
+	case "hash":
+		return obj.Type() == HASH_OBJ, nil
+	case "regex":
+		return obj.Type() == REGEX_OBJ, nil
+	case "file":
+		return obj.Type() == FILE_OBJ, nil
+	case "generator":
+		return obj.Type() == GENERATOR_OBJ, nil
+	case "module":
+		return obj.Type() == MODULE_OBJ, nil
+	case "task":
+		return obj.Type() == TASK_OBJ, nil
+	case "channel":
+		return obj.Type() == CHANNEL_OBJ, nil
+	case "mutex":
+		return obj.Type() == MUTEX_OBJ, nil
+	case "waitgroup":
+		return obj.Type() == WAITGROUP_OBJ, nil
+	case "promise":
+		return obj.Type() == PROMISE_OBJ, nil
+	case "function":
+		t := obj.Type()
+		return t == FUNCTION_OBJ || t == BUILTIN_OBJ || t == GFO_OBJ || t == BOUND_METHOD_OBJ, nil
+	}
+
+	if structStmt, ok := scope.GetStruct(typ.Value); ok {
+		s, ok := obj.(*Struct)
+		return ok && s.Stmt == structStmt, nil
+	}
+	if v, ok := scope.Get(typ.Value); ok {
+		if iface, ok := v.(*Interface); ok {
+			s, ok := obj.(*Struct)
+			return ok && structImplements(s, iface), nil
+		}
+	}
+	return false, newError(line, ERR_UNKNOWNTYPE, typ.Value)
+}
+
+// the type name of the object used in type mismatch errors.
+func typeNameOf(obj Object) string {
+	if s, ok := obj.(*Struct); ok {
+		return s.Stmt.Name
+	}
+	return typeBuiltin().Fn("", nil, obj).(*String).String
+}
+
+// check the annotated parameter types. for variadic functions,
+// the last parameter's type is checked against each of the rest arguments.
+func checkArgTypes(line string, fn *Function, args []Object) Object {
+	lit := fn.Literal
+	if !StrictTypes || lit.ParamTypes == nil {
+		return nil
+	}
+
+	for i, arg := range args {
+		idx := i
+		if idx >= len(lit.Parameters) {
+			if !lit.Variadic {
+				break
+			}
+			idx = len(lit.Parameters) - 1
+		}
+		typ := lit.ParamTypes[idx]
+		if typ == nil {
+			continue
+		}
+		ok, errObj := typeMatches(line, fn.Scope, arg, typ)
+		if errObj != nil {
+			return errObj
+		}
+		if !ok {
+			what := fmt.Sprintf("argument '%s' of function '%s'", lit.Parameters[idx].Value, funcName(lit))
+			return newError(line, ERR_TYPEMISMATCH, what, typ.Value, typeNameOf(arg))
+		}
+	}
+	return nil
+}
+
+// check the annotated return type, returns the result if it matches.
+func checkReturnType(line string, fn *Function, result Object) Object {
+	lit := fn.Literal
+	if !StrictTypes || lit.ReturnType == nil || isError(result) || result.Type() == THROW_OBJ {
+		return result
+	}
+
+	ok, errObj := typeMatches(line, fn.Scope, result, lit.ReturnType)
+	if errObj != nil {
+		return errObj
+	}
+	if !ok {
+		what := fmt.Sprintf("return value of function '%s'", funcName(lit))
+		return newError(line, ERR_TYPEMISMATCH, what, lit.ReturnType.Value, typeNameOf(result))
+	}
+	return result
+}
+
+func funcName(lit *ast.FunctionLiteral) string {
+	if lit.Name == "" {
+		return "<anonymous>"
+	}
+	return lit.Name
+}
@@ -0,0 +1,1034 @@
+package eval
+
+import (
+	"magpie/ast"
+	"sync"
+)
+
+// UseVM selects the bytecode VM instead of the tree-walker for running the
+// programs and the functions' bodies.
+var UseVM bool
+
+var codeCache sync.Map //ast.Node -> *Code, nil if the node could not be compiled
+
+// compiled returns the node's code, compiling it at the first use.
+func compiled(node ast.Node) *Code {
+	if code, ok := codeCache.Load(node); ok {
+		return code.(*Code)
+	}
+	code, _ := Compile(node)
+	codeCache.Store(node, code)
+	return code
+}
+
+// vmEval evaluates the node with the VM.
+func vmEval(node ast.Node, scope *Scope) Object {
+	code := compiled(node)
+	if code == nil {
+		return Eval(node, scope)
+	}
+	return code.run(scope)
+}
+
+// evaluate a function's body, or another node which runs apart from the
+// code around it, e.g. a struct's block or a deferred expression
+func evalBody(node ast.Node, scope *Scope) Object {
+	if UseVM {
+		return vmEval(node, scope)
+	}
+	return Eval(node, scope)
+}
+
+// evaluate the next operand of a chained comparison('a < b < c'), it's
+// evaluated only if the comparisons before it are true
+func evalNext(node *ast.InfixExpression, scope *Scope) Object {
+	return evalBody(node.Next, scope)
+}
+
+// a running code
+type vm struct {
+	code  *Code
+	scope *Scope //a comprehension's instructions run in its own scope
+	stack []Object
+	sp    int
+	ip    int //the next instruction
+	cur   int //the current instruction
+}
+
+var vmPool = sync.Pool{New: func() interface{} { return &vm{} }}
+
+func (c *Code) run(scope *Scope) Object {
+	m := vmPool.Get().(*vm)
+	m.code, m.scope, m.sp, m.ip = c, scope, 0, 0
+	if len(m.stack) < c.maxStack {
+		m.stack = make([]Object, c.maxStack)
+	}
+	defer func() {
+		m.unwind(0)                           //e.g. a limit leaves the loops
+		for i := range m.stack[:c.maxStack] { //don't keep the objects alive
+			m.stack[i] = nil
+		}
+		m.code, m.scope = nil, nil
+		vmPool.Put(m)
+	}()
+
+	for {
+		if result, done := m.exec(); done {
+			return result
+		}
+	}
+}
+
+// execute the instructions until the end of the code, or until a panic is
+// recovered and handled. 'done' is false if the execution should go on.
+func (m *vm) exec() (result Object, done bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, done = m.raise(panicToError(r, m.node()))
+		}
+	}()
+
+	ins := m.code.Instructions
+	nodes := m.code.Nodes
+	sb := m.scope.sandbox
+	for m.ip < len(ins) {
+		ip := m.ip
+		m.cur = ip
+		op := Opcode(ins[ip])
+		if sb != nil {
+			if errObj := sb.step(m.node()); errObj != nil {
+				return errObj, true //the handlers don't handle the limits
+			}
+		}
+		m.ip = ip + 1 + 2*opDefs[op].operands
+		scope := m.scope
+		var val Object //the instruction's result
+		switch op {
+		case opNull:
+			m.push(nil)
+			continue
+		case opNil:
+			m.push(NIL)
+			continue
+		case opTrue:
+			m.push(TRUE)
+			continue
+		case opFalse:
+			m.push(FALSE)
+			continue
+		case opNumber:
+			m.push(NewNumber(nodes[readOperand(ins, ip+1)].(*ast.NumberLiteral).Value))
+			continue
+		case opString:
+			m.push(NewString(nodes[readOperand(ins, ip+1)].(*ast.StringLiteral).Value))
+			continue
+		case opInterpolate:
+			val = evalStringLiteral(nodes[readOperand(ins, ip+1)].(*ast.StringLiteral), scope)
+		case opIdent:
+			val = evalIdentifier(nodes[readOperand(ins, ip+1)].(*ast.Identifier), scope)
+		case opGetLocal:
+			ident := nodes[readOperand(ins, ip+1)].(*ast.Identifier)
+			if scope.locals == ident.Frames[0] && !threaded.Load() {
+				if obj := scope.slots[ident.Slot]; obj != nil {
+					m.push(obj)
+					continue
+				}
+			}
+			val = evalIdentifier(ident, scope)
+		case opSetLocal:
+			a := nodes[readOperand(ins, ip+1)].(*ast.AssignExpression)
+			setLocal(a.Name.(*ast.Identifier), checked(m.stack[m.sp-1]), scope)
+			continue
+		case opFunction:
+			val = evalFunctionLiteral(nodes[readOperand(ins, ip+1)].(*ast.FunctionLiteral), scope)
+		case opRegex:
+			val = evalRegExLiteral(nodes[readOperand(ins, ip+1)].(*ast.RegExLiteral), scope)
+		case opCmd:
+			val = evalCmdExpression(nodes[readOperand(ins, ip+1)].(*ast.CmdExpression), scope)
+		case opStruct:
+			val = evalStructStatement(nodes[readOperand(ins, ip+1)].(*ast.StructStatement), scope)
+		case opInterface:
+			val = evalInterfaceStatement(nodes[readOperand(ins, ip+1)].(*ast.InterfaceStatement), scope)
+		case opImport:
+			val = evalImportStatement(nodes[readOperand(ins, ip+1)].(*ast.ImportStatement), scope)
+		case opMacro:
+			val = evalMacroLiteral(nodes[readOperand(ins, ip+1)].(*ast.MacroLiteral), scope)
+		case opPrefix:
+			right := m.pop()
+			val = evalPrefixExpression(nodes[readOperand(ins, ip+1)].(*ast.PrefixExpression), right, scope)
+		case opInfix:
+			right := m.pop()
+			left := m.pop()
+			node := nodes[readOperand(ins, ip+1)].(*ast.InfixExpression)
+			if r, ok := numberInfix(node, left, right); ok && sb == nil {
+				m.push(r)
+				continue
+			}
+			val = evalInfixExpression(node, left, right, scope)
+		case opPostfix:
+			left := checked(m.pop())
+			val = evalPostfixExpression(nodes[readOperand(ins, ip+1)].(*ast.PostfixExpression), left, scope)
+		case opIndex:
+			index := m.pop()
+			left := m.pop()
+			val = evalIndexExpression(nodes[readOperand(ins, ip+1)].(*ast.IndexExpression), left, index, scope)
+		case opArray:
+			val = &Array{Members: m.popN(readOperand(ins, ip+3))}
+		case opTuple:
+			val = &Tuple{Members: m.popN(readOperand(ins, ip+3))}
+		case opHash:
+			node := nodes[readOperand(ins, ip+1)].(*ast.HashLiteral)
+			hash := NewHash()
+			hash.IsOrdered = node.IsOrdered
+			val = hash
+		case opHashKey:
+			k := checked(m.stack[m.sp-1])
+			if _, ok := hashable(k); ok {
+				continue
+			}
+			val = newError(m.node().Pos().Sline(), ERR_KEY, k.Type())
+		case opHashPair:
+			v := checked(m.pop())
+			k := m.pop()
+			r := m.stack[m.sp-1].(*Hash).push(m.node().Pos().Sline(), scope, k, v)
+			if !failed(r) {
+				continue
+			}
+			if isError(r) {
+				val = r
+				break
+			}
+			m.stack[m.sp-1] = r //the throw is the hash literal's result
+			m.ip = readOperand(ins, ip+3)
+			continue
+		case opCharge:
+			val = m.pop()
+		case opPop:
+			m.pop()
+			continue
+		case opOrNil:
+			if m.stack[m.sp-1] == nil {
+				m.stack[m.sp-1] = NIL
+			}
+			continue
+		case opUnbox:
+			call := nodes[readOperand(ins, ip+1)].(*ast.CallExpression)
+			args := m.args(call, readOperand(ins, ip+3))
+			args = getVariadicArgs(call, args, scope)
+			if len(args) == 1 && isError(args[0]) {
+				val = args[0]
+				break
+			}
+			val = &vmList{items: args}
+		case opNewStruct:
+			idx := readOperand(ins, ip+1)
+			call := nodes[idx].(*ast.CallExpression)
+			structStmt, ok := scope.GetStruct(call.Function.String())
+			if !ok {
+				continue
+			}
+			args := m.callArgs(call, readOperand(ins, ip+3))
+			m.ip = readOperand(ins, ip+5)
+			val = callStruct(m.code.lines[idx], structStmt, args, scope)
+		case opCall:
+			idx := readOperand(ins, ip+1)
+			fn := m.pop()
+			args := m.callArgs(nodes[idx].(*ast.CallExpression), readOperand(ins, ip+3))
+			val = applyFunction(m.code.lines[idx], scope, fn, args)
+		case opGoMember:
+			val = goMember(nodes[readOperand(ins, ip+1)].(*ast.MethodCallExpression), scope)
+		case opGoCall:
+			args := m.popN(readOperand(ins, ip+3))
+			val = goMethodCall(nodes[readOperand(ins, ip+1)].(*ast.MethodCallExpression), args, scope)
+		case opMember:
+			obj := checked(m.pop())
+			val = evalMember(nodes[readOperand(ins, ip+1)].(*ast.MethodCallExpression), obj, scope)
+		case opMethodCheck:
+			call := nodes[readOperand(ins, ip+1)].(*ast.MethodCallExpression)
+			obj := checked(m.stack[m.sp-1])
+			if h, ok := obj.(*Hash); ok { //the hash's function is called like the other functions
+				o := call.Call.(*ast.CallExpression)
+				val = h.get(call.Call.Pos().Sline(), scope, NewString(o.Function.String()))
+				break
+			}
+			if errObj := checkMethodCall(call, obj); errObj != nil {
+				val = errObj
+				break
+			}
+			m.push(nil)
+			continue
+		case opMethodCall:
+			call := nodes[readOperand(ins, ip+1)].(*ast.MethodCallExpression)
+			o := call.Call.(*ast.CallExpression)
+			args := m.popN(readOperand(ins, ip+3))
+			fn := m.pop()
+			obj := m.pop()
+			if _, ok := obj.(*Hash); ok {
+				if isAllArgsCall(o) {
+					args = allArgs(scope)
+				}
+				val = applyCall(o.Pos().Sline(), o, fn, args, scope)
+				break
+			}
+			if isAllArgsCall(o) && isError(args[0]) {
+				val = args[0]
+				break
+			}
+			val = applyMethodCall(call, obj, args, scope)
+		case opPipeCheck:
+			node := nodes[readOperand(ins, ip+1)].(*ast.InfixExpression)
+			if ident, ok := node.Right.(*ast.Identifier); ok && pipedFuncCall(node, ident, m.stack[m.sp-1]) != nil {
+				continue
+			}
+			m.pop()
+			val = pipeError(node)
+		case opPipeCall:
+			node := nodes[readOperand(ins, ip+1)].(*ast.InfixExpression)
+			left := m.pop()
+			fn := m.pop()
+			call := pipedFuncCall(node, node.Right.(*ast.Identifier), fn)
+			args := []Object{left}
+			if isAllArgsCall(call) {
+				args = allArgs(scope)
+			}
+			val = applyCall(call.Pos().Sline(), call, fn, args, scope)
+		case opIsStruct:
+			node := nodes[readOperand(ins, ip+1)].(*ast.InfixExpression)
+			if r, ok := isStruct(node, m.stack[m.sp-1], scope); ok {
+				m.stack[m.sp-1] = r
+				m.ip = readOperand(ins, ip+3)
+			}
+			continue
+		case opIs:
+			right := m.pop()
+			left := m.pop()
+			val = isInterface(nodes[readOperand(ins, ip+1)].(*ast.InfixExpression), left, right)
+		case opTailCall:
+			fn := m.pop()
+			args := m.popN(readOperand(ins, ip+3))
+			val = &TailCall{call: nodes[readOperand(ins, ip+1)].(*ast.CallExpression), args: args, fn: fn}
+		case opLet:
+			values := m.popN(readOperand(ins, ip+3))
+			val = bindLetValues(nodes[readOperand(ins, ip+1)].(*ast.LetStatement), values, scope)
+		case opLetLocal:
+			l := nodes[readOperand(ins, ip+1)].(*ast.LetStatement)
+			value := m.pop()
+			if t, ok := value.(*Tuple); value == nil || isError(value) || ok && t.IsMulti {
+				val = bindLetValues(l, []Object{value}, scope)
+				break
+			}
+			setLocal(l.Names[0], value, scope)
+			val = value
+		case opReturn:
+			val = newReturnValue(m.popN(readOperand(ins, ip+3)))
+		case opAssign:
+			value := checked(m.pop())
+			val = _evalAssignExpression(nodes[readOperand(ins, ip+1)].(*ast.AssignExpression), value, scope)
+		case opSetIndex:
+			index := m.pop()
+			left := m.pop()
+			value := checked(m.pop())
+			val = setIndex(nodes[readOperand(ins, ip+1)].(*ast.AssignExpression), left, index, value, scope)
+		case opAssignIndex:
+			index := m.pop()
+			value := checked(m.pop())
+			val = assignVar(nodes[readOperand(ins, ip+1)].(*ast.AssignExpression), index, value, scope)
+		case opAssignMember:
+			obj := checked(m.pop())
+			value := checked(m.pop())
+			val = assignMember(nodes[readOperand(ins, ip+1)].(*ast.AssignExpression), obj, value, scope)
+		case opMultiValues:
+			vals := m.popN(readOperand(ins, ip+3))
+			for _, v := range vals {
+				checked(v)
+			}
+			values, errObj := multiAssignValues(nodes[readOperand(ins, ip+1)].(*ast.MultiAssignStatement), vals, scope)
+			if errObj != nil {
+				val = errObj
+				break
+			}
+			val = &vmList{items: values}
+		case opListItem:
+			m.push(m.stack[readOperand(ins, ip+1)].(*vmList).items[readOperand(ins, ip+3)])
+			continue
+		case opThrow:
+			stmt := nodes[readOperand(ins, ip+1)].(*ast.ThrowStmt)
+			val = &Throw{stmt: stmt, value: checked(m.pop()), stack: scope.traceback(stmt.Pos())}
+		case opRethrow:
+			val = rethrow(nodes[readOperand(ins, ip+1)].(*ast.ThrowStmt), scope)
+		case opBreak:
+			if label := nodes[readOperand(ins, ip+1)].(*ast.BreakExpression).Label; label != "" {
+				val = &Break{Label: label}
+			} else {
+				val = BREAK
+			}
+		case opContinue:
+			if label := nodes[readOperand(ins, ip+1)].(*ast.ContinueExpression).Label; label != "" {
+				val = &Continue{Label: label}
+			} else {
+				val = CONTINUE
+			}
+		case opFallthrough:
+			val = FALLTHROUGH
+		case opJump:
+			m.ip = readOperand(ins, ip+1)
+			continue
+		case opJumpIfFalse:
+			if !IsTrue(checked(m.pop())) {
+				m.ip = readOperand(ins, ip+3)
+			}
+			continue
+		case opStmtEnd:
+			if isControl(m.stack[m.sp-1]) { //the block returns it
+				m.ip = readOperand(ins, ip+1)
+				continue
+			}
+			m.sp--
+			continue
+		case opProgStmtEnd:
+			switch r := m.stack[m.sp-1].(type) {
+			case *ReturnValue:
+				return r.Value, true
+			case *Throw: //convert ThrowValue to Errors
+				return r.unhandled(), true
+			case nil:
+				m.stack[m.sp-1] = NIL
+			}
+			if readOperand(ins, ip+1) == 0 {
+				m.sp--
+			}
+			continue
+		case opLeave:
+			r := m.pop()
+			m.unwind(readOperand(ins, ip+1))
+			m.push(r)
+			continue
+		case opLoop:
+			val = &loopState{result: NIL}
+		case opIter:
+			node := nodes[readOperand(ins, ip+1)]
+			obj := m.pop()
+			it, errObj := iteratorOf(iterableOf(node), checked(obj), scope)
+			if errObj != nil {
+				val = errObj
+				break
+			}
+			val = newLoopState(node, it, scope)
+		case opRangeIter:
+			node := nodes[readOperand(ins, ip+1)]
+			right := m.pop()
+			left := m.pop()
+			ie, _ := rangeOf(iterableOf(node))
+			it, errObj := newRangeIterator(ie, left, right)
+			if errObj != nil {
+				val = errObj
+				break
+			}
+			val = newLoopState(node, it, scope)
+		case opNext:
+			st := m.stack[m.sp-1].(*loopState)
+			item, ok := st.it.Next()
+			if !ok {
+				m.ip = readOperand(ins, ip+3)
+				continue
+			}
+			if r := bindLoopVars(nodes[readOperand(ins, ip+1)], st, item, scope); r != nil {
+				if isError(r) {
+					val = r
+					break
+				}
+				m.push(r)
+				m.ip = readOperand(ins, ip+5)
+			}
+			continue
+		case opDrop:
+			m.pop().(vmState).leave(m)
+			continue
+		case opLoopBody:
+			node := nodes[readOperand(ins, ip+1)]
+			result := m.pop()
+			st := m.stack[m.sp-1].(*loopState)
+			switch getLoopAction(loopLabel(node), result) {
+			case loopReturn:
+				m.push(result)
+				m.ip = readOperand(ins, ip+5)
+			case loopBreak:
+				if st.it == nil {
+					st.result = NIL
+				}
+				m.ip = readOperand(ins, ip+3)
+			default:
+				if arr, ok := st.result.(*Array); ok && st.it != nil {
+					if checked(result).Type() != CONTINUE_OBJ {
+						arr.Members = append(arr.Members, result)
+					}
+				} else if _, ok := node.(*ast.CForLoop); ok { //the last result is the loop's result
+					if result == nil || result.Type() == CONTINUE_OBJ {
+						result = NIL
+					}
+					st.result = result
+				}
+			}
+			continue
+		case opLoopResult:
+			m.push(m.stack[m.sp-1].(*loopState).result)
+			continue
+		case opLoopElse:
+			if r := m.pop(); isOuterControl(r) { //control flow goes to the outer code
+				m.stack[m.sp-1] = r
+			}
+			continue
+		case opNewScope:
+			m.push(&scopeState{prev: scope})
+			m.scope = NewScope(scope, nil)
+			continue
+		case opComp:
+			switch nodes[readOperand(ins, ip+1)].(type) {
+			case *ast.ArrayComprehension:
+				val = &Array{Members: []Object{}}
+			case *ast.TupleComprehension:
+				val = &Tuple{Members: []Object{}}
+			default:
+				val = NewHash()
+			}
+		case opCompCond:
+			c := m.pop()
+			if isIterError(c) {
+				if isError(c) {
+					val = c
+					break
+				}
+				m.push(c)
+				m.ip = readOperand(ins, ip+5)
+				continue
+			}
+			if !IsTrue(c) {
+				m.ip = readOperand(ins, ip+3)
+			}
+			continue
+		case opCompPush:
+			value := m.pop()
+			if isIterError(value) {
+				if isError(value) {
+					val = value
+					break
+				}
+				m.push(value)
+				m.ip = readOperand(ins, ip+5)
+				continue
+			}
+			switch coll := m.stack[readOperand(ins, ip+3)].(type) {
+			case *Array:
+				coll.Members = append(coll.Members, value)
+			case *Tuple:
+				coll.Members = append(coll.Members, value)
+			}
+			continue
+		case opCompKey:
+			key := m.stack[m.sp-1]
+			if !isIterError(key) {
+				continue
+			}
+			if isError(key) {
+				val = m.pop()
+				break
+			}
+			m.ip = readOperand(ins, ip+3)
+			continue
+		case opCompPair:
+			hc := nodes[readOperand(ins, ip+1)].(*ast.HashComprehension)
+			value := m.pop()
+			key := m.pop()
+			r := value
+			if !isIterError(value) {
+				r = m.stack[readOperand(ins, ip+3)].(*Hash).push(hc.Key.Pos().Sline(), scope, key, value)
+			}
+			if !failed(r) {
+				continue
+			}
+			if isError(r) {
+				val = r
+				break
+			}
+			m.push(r)
+			m.ip = readOperand(ins, ip+5)
+			continue
+		case opCatch:
+			ts := nodes[readOperand(ins, ip+1)].(*ast.TryStmt)
+			rv := m.pop()
+			if isLimitError(rv) { //the violated limits could not be caught
+				val = rv
+				break
+			}
+			k := 0
+			if caught := caughtOf(rv); caught != nil {
+				for i, clause := range ts.Catches {
+					if catches(clause.Type, caught.value) {
+						rv = &catchState{vars: enterCatch(clause, caught, scope)}
+						k = i + 1
+						break
+					}
+				}
+			}
+			m.push(rv)
+			m.ip += 3 * k
+			continue
+		case opCatchEnd:
+			r := m.pop()
+			m.pop().(vmState).leave(m)
+			m.push(r)
+			continue
+		case opTryEnd: //the error which is not caught
+			val = m.pop()
+		case opFinally: //finally will always run, even after 'return' or an error
+			if !isLimitError(m.stack[m.sp-1]) {
+				continue
+			}
+			val = m.pop()
+		case opFinallyEnd:
+			frv := m.pop()
+			rv := m.pop()
+			val = finallyResult(rv, frv)
+		case opSwitch:
+			if checked(m.stack[m.sp-1]).Type() == THROW_OBJ {
+				m.ip = readOperand(ins, ip+3)
+			}
+			continue
+		case opCase:
+			out := checked(m.pop())
+			if out.Type() == THROW_OBJ {
+				m.stack[m.sp-1] = out
+				m.ip = readOperand(ins, ip+5)
+				continue
+			}
+			if caseMatches(m.stack[m.sp-1], out) {
+				m.pop()
+				m.ip = readOperand(ins, ip+3)
+			}
+			continue
+		case opCaseEnd:
+			switch r := m.stack[m.sp-1]; {
+			case r == FALLTHROUGH:
+				m.pop()
+				m.ip = readOperand(ins, ip+3)
+				continue
+			case !isOuterControl(r):
+				m.stack[m.sp-1] = NIL
+			}
+			m.ip = readOperand(ins, ip+5)
+			continue
+		case opSelectChan:
+			if _, errObj := selectChannel(nodes[readOperand(ins, ip+1)].(ast.Expression), m.stack[m.sp-1]); errObj != nil {
+				val = errObj
+				break
+			}
+			continue
+		case opSelect:
+			ss := nodes[readOperand(ins, ip+1)].(*ast.SelectStatement)
+			chosen, values, errObj := selectOn(ss, m.popN(readOperand(ins, ip+3)), scope)
+			if errObj != nil {
+				val = errObj
+				break
+			}
+			if chosen == len(ss.Cases) {
+				val = selectCanceled(ss, scope)
+				m.ip = readOperand(ins, ip+5)
+				break
+			}
+			val = &vmList{items: values}
+			m.ip += 3 * chosen
+		case opDecorator:
+			node := nodes[readOperand(ins, ip+1)].(*ast.DecoratorExpr)
+			if errObj := checkDecorator(node, m.stack[m.sp-1]); errObj != nil {
+				val = errObj
+				break
+			}
+			continue
+		case opDecorated:
+			val = decoratedValue(nodes[readOperand(ins, ip+1)].(*ast.DecoratorExpr), scope)
+		case opApplyDecorator:
+			node := nodes[readOperand(ins, ip+1)].(*ast.DecoratorExpr)
+			decorated := m.pop()
+			decorator := m.pop()
+			val = applyFunction(node.Pos().Sline(), scope, decorator, []Object{decorated})
+			if failed(val) && !isError(val) {
+				m.ip = readOperand(ins, ip+3)
+			}
+		case opDecorate:
+			fn := m.pop()
+			val = bindDecorated(nodes[readOperand(ins, ip+1)].(*ast.DecoratorExpr), fn, scope)
+		case opCheck:
+			var errObj Object
+			switch node := nodes[readOperand(ins, ip+1)].(type) {
+			case *ast.DeferStmt:
+				errObj = checkDefer(node, scope)
+			case *ast.YieldExpression:
+				errObj = checkYield(node, scope)
+			}
+			if errObj == nil {
+				continue
+			}
+			val = errObj
+		case opDefer:
+			ds := nodes[readOperand(ins, ip+1)].(*ast.DeferStmt)
+			fn, method, args, errObj := m.callee(ds.Expr, readOperand(ins, ip+3), scope)
+			if errObj != nil {
+				val = errObj
+				break
+			}
+			val = deferCall(ds, fn, method, args, scope)
+		case opSpawn:
+			se := nodes[readOperand(ins, ip+1)].(*ast.SpawnExpression)
+			fn, method, args, errObj := m.callee(se.Call, readOperand(ins, ip+3), scope)
+			if errObj != nil {
+				val = errObj
+				break
+			}
+			val = spawnCall(se, fn, method, args, scope)
+		case opAwait:
+			val = awaitValue(nodes[readOperand(ins, ip+1)].(*ast.AwaitExpression), m.pop(), scope)
+		case opYield:
+			val = yieldValue(nodes[readOperand(ins, ip+1)].(*ast.YieldExpression), m.pop(), scope)
+		case opUnquote:
+			unquote := nodes[readOperand(ins, ip+1)].(*ast.CallExpression)
+			n, errObj := objectToNode(unquote.Pos(), m.pop())
+			if errObj != nil {
+				val = errObj
+				break
+			}
+			val = &Quote{Node: n}
+		case opQuote:
+			call := nodes[readOperand(ins, ip+1)].(*ast.CallExpression)
+			if len(call.Arguments) != 1 {
+				val = newError(call.Pos().Sline(), ERR_QUOTE, len(call.Arguments))
+				break
+			}
+			var unquoted []*Quote
+			for _, q := range m.popN(readOperand(ins, ip+3)) {
+				unquoted = append(unquoted, q.(*Quote))
+			}
+			val = quoteWith(call, unquoted)
+		}
+
+		if sb != nil && allocatesOp(op) && allocates(m.node()) {
+			val = sb.charge(m.node(), val, sizeOf(val))
+		}
+		if errObj, ok := val.(*Error); ok {
+			if result, done := m.raise(errObj); done {
+				return result, true
+			}
+			continue
+		}
+		m.push(val)
+	}
+
+	if m.sp == 0 {
+		return nil, true
+	}
+	return m.stack[m.sp-1], true
+}
+
+// the error is handled by the innermost handler of the current instruction,
+// or it's the code's result.
+func (m *vm) raise(errObj *Error) (Object, bool) {
+	errObj.at(m.node())
+	if errObj.stack == nil {
+		errObj.stack = m.scope.traceback(errObj.pos)
+	}
+	for _, h := range m.code.handlers {
+		if m.cur >= h.start && m.cur < h.end {
+			m.unwind(h.depth)
+			m.push(errObj)
+			m.ip = h.target
+			return nil, false
+		}
+	}
+	return errObj, true
+}
+
+// pop the stack down to the depth, the states on the way are left
+func (m *vm) unwind(depth int) {
+	for m.sp > depth {
+		if st, ok := m.pop().(vmState); ok {
+			st.leave(m)
+		}
+	}
+}
+
+// the node of the current instruction, which an error is reported at
+func (m *vm) node() ast.Node {
+	ins := m.code.Instructions
+	if opDefs[ins[m.cur]].hasNode {
+		return m.code.Nodes[readOperand(ins, m.cur+1)]
+	}
+	return m.code.root
+}
+
+func (m *vm) push(obj Object) {
+	m.stack[m.sp] = obj
+	m.sp++
+}
+
+func (m *vm) pop() Object {
+	m.sp--
+	obj := m.stack[m.sp]
+	m.stack[m.sp] = nil
+	return obj
+}
+
+// pop n objects into a new slice, nil if n is 0
+func (m *vm) popN(n int) []Object {
+	if n == 0 {
+		return nil
+	}
+	objs := make([]Object, n)
+	copy(objs, m.stack[m.sp-n:m.sp])
+	for i := m.sp - n; i < m.sp; i++ {
+		m.stack[i] = nil
+	}
+	m.sp -= n
+	return objs
+}
+
+// pop the call's n arguments, 'f($_)' passes the current call's arguments
+func (m *vm) args(call *ast.CallExpression, n int) []Object {
+	if isAllArgsCall(call) {
+		return allArgs(m.scope)
+	}
+	return m.popN(n)
+}
+
+// pop the call's arguments, which are unboxed already if it's variadic
+func (m *vm) callArgs(call *ast.CallExpression, n int) []Object {
+	if call.Variadic {
+		return m.pop().(*vmList).items
+	}
+	return m.args(call, n)
+}
+
+// pop the function(or the method's receiver) and the n arguments of the call
+// which 'defer' or 'spawn' runs later, 'fn' is nil if it's not a call.
+func (m *vm) callee(expr ast.Expression, n int, scope *Scope) (fn Object, method string, args []Object, errObj Object) {
+	args = m.popN(n)
+	fn = m.pop()
+	_, method, call := calleeOf(expr)
+	if call != nil && call.Variadic {
+		args = getVariadicArgs(call, args, scope) //unboxing
+		if len(args) == 1 && isError(args[0]) {
+			return nil, "", nil, args[0]
+		}
+	}
+	return fn, method, args, nil
+}
+
+// set the resolved local variable, in its slot if the scope is the one which
+// the resolver laid out
+func setLocal(ident *ast.Identifier, val Object, scope *Scope) {
+	if scope.locals == ident.Frames[0] && !threaded.Load() {
+		scope.slots[ident.Slot] = val
+		return
+	}
+	scope.Set(ident.Value, val)
+}
+
+// the result of the arithmetic or the comparison of two numbers, which
+// doesn't need the tree-walker's checks. 'ok' is false for the others.
+func numberInfix(node *ast.InfixExpression, left, right Object) (Object, bool) {
+	l, ok := left.(*Number)
+	if !ok || node.HasNext {
+		return nil, false
+	}
+	r, ok := right.(*Number)
+	if !ok {
+		return nil, false
+	}
+	switch node.Operator {
+	case "+":
+		return &Number{Value: l.Value + r.Value}, true
+	case "-":
+		return &Number{Value: l.Value - r.Value}, true
+	case "*":
+		return &Number{Value: l.Value * r.Value}, true
+	case "<":
+		return nativeBoolToBooleanObject(l.Value < r.Value), true
+	case "<=":
+		return nativeBoolToBooleanObject(l.Value <= r.Value), true
+	case ">":
+		return nativeBoolToBooleanObject(l.Value > r.Value), true
+	case ">=":
+		return nativeBoolToBooleanObject(l.Value >= r.Value), true
+	case "==":
+		return nativeBoolToBooleanObject(l.Value == r.Value), true
+	case "!=":
+		return nativeBoolToBooleanObject(l.Value != r.Value), true
+	}
+	return nil, false
+}
+
+// a nil result(e.g. an empty block's) panics like in the tree-walker, which
+// checks the operand's type before using it
+func checked(obj Object) Object {
+	obj.Type()
+	return obj
+}
+
+// the instructions whose results are new strings or collections
+func allocatesOp(op Opcode) bool {
+	switch op {
+	case opInterpolate, opInfix, opArray, opTuple, opCmd, opAssign, opAssignMember, opCharge:
+		return true
+	}
+	return false
+}
+
+// the objects which end a block
+func isControl(obj Object) bool {
+	switch obj.(type) {
+	case *ReturnValue, *Error, *Throw, *TailCall, *Break, *Continue, *Fallthrough:
+		return true
+	}
+	return false
+}
+
+// vmState is a state on the VM's stack, which is left when the code leaves
+// it normally or by an error.
+type vmState interface {
+	Object
+	leave(m *vm)
+}
+
+// the VM's own objects on its stack, which the programs never see
+type vmObject struct{}
+
+func (o vmObject) Inspect() string  { return "<vm>" }
+func (o vmObject) Type() ObjectType { return VM_OBJ }
+func (o vmObject) CallMethod(line string, scope *Scope, method string, args ...Object) Object {
+	return newError(line, ERR_NOMETHOD, method, VM_OBJ)
+}
+
+// the objects which an instruction passes to the following ones, e.g. the
+// unboxed arguments, or the values of a multiple assignment
+type vmList struct {
+	vmObject
+	items []Object
+}
+
+// the state of a loop, or of a comprehension's clause
+type loopState struct {
+	vmObject
+	it     Iterator //nil if it's not a for-each loop
+	idx    int
+	scope  *Scope
+	vars   []string //deleted when the loop is left
+	result Object   //the for-each loop's array, or the C-style for loop's last result
+}
+
+func newLoopState(node ast.Node, it Iterator, scope *Scope) *loopState {
+	st := &loopState{it: it, scope: scope, result: &Array{}}
+	switch n := node.(type) {
+	case *ast.ForEachArrayLoop:
+		st.vars = []string{n.Var}
+	case *ast.ForEachMapLoop:
+		for _, name := range []string{n.Key, n.Value} {
+			if name != "_" {
+				st.vars = append(st.vars, name)
+			}
+		}
+	}
+	return st
+}
+
+func (st *loopState) leave(m *vm) {
+	for _, name := range st.vars {
+		st.scope.Del(name)
+	}
+	if st.it != nil {
+		closeIterator(st.it)
+	}
+}
+
+// the scope which the code ran in before a comprehension's own scope
+type scopeState struct {
+	vmObject
+	prev *Scope
+}
+
+func (st *scopeState) leave(m *vm) { m.scope = st.prev }
+
+// the catch clause's variables, which are restored when it's left
+type catchState struct {
+	vmObject
+	vars *catchVars
+}
+
+func (st *catchState) leave(m *vm) { st.vars.leave() }
+
+// the iterated expression of a for-each loop, or of a comprehension's clause
+func iterableOf(node ast.Node) ast.Expression {
+	switch n := node.(type) {
+	case *ast.ForEachArrayLoop:
+		return n.Value
+	case *ast.ForEachMapLoop:
+		return n.X
+	case *ast.ComprehensionClause:
+		return n.Iterable
+	}
+	return nil
+}
+
+// bind the iterator's next item to the loop's variables, returns the
+// iterator's failure(an error or a throw), which leaves the loop.
+func bindLoopVars(node ast.Node, st *loopState, item Object, scope *Scope) Object {
+	idx := st.idx
+	st.idx++
+	if isIterError(item) {
+		return item
+	}
+
+	switch n := node.(type) {
+	case *ast.ForEachArrayLoop:
+		scope.Set(n.Var, item)
+	case *ast.ForEachMapLoop:
+		key, value := keyValueOf(st.it, idx, item, n.Pos().Sline(), scope)
+		if failed(value) {
+			return value
+		}
+		if n.Key != "_" {
+			scope.Set(n.Key, key)
+		}
+		if n.Value != "_" {
+			scope.Set(n.Value, value)
+		}
+	case *ast.ComprehensionClause:
+		if len(n.Names) == 1 {
+			scope.Set(n.Names[0].Value, item)
+			break
+		}
+		key, value := keyValueOf(st.it, idx, item, n.Iterable.Pos().Sline(), scope)
+		if failed(value) {
+			return value
+		}
+		scope.Set(n.Names[0].Value, key)
+		scope.Set(n.Names[1].Value, value)
+	}
+	return nil
+}
+
+// the label of the loop which 'break' and 'continue' refer to
+func loopLabel(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.CForLoop:
+		return n.Label
+	case *ast.ForEverLoop:
+		return n.Label
+	case *ast.ForEachArrayLoop:
+		return n.Label
+	case *ast.ForEachMapLoop:
+		return n.Label
+	case *ast.DoLoop:
+		return n.Label
+	case *ast.WhileLoop:
+		return n.Label
+	}
+	return ""
+}
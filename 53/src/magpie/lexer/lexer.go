@@ -9,8 +9,6 @@ import (
 	"unicode"
 )
 
-var prevToken token.Token
-
 // Lexer
 type Lexer struct {
 	Filename     string
@@ -21,6 +19,8 @@ type Lexer struct {
 
 	line int
 	col  int
+
+	prevToken token.Token //the last token, imported files are lexed by their own lexers
 }
 
 func NewFileLexer(filename string) (*Lexer, error) {
@@ -76,6 +76,14 @@ func (l *Lexer) peek() rune {
 	return l.input[l.readPosition]
 }
 
+// the character 'n' characters after the next one
+func (l *Lexer) peekAt(n int) rune {
+	if l.readPosition+n >= len(l.input) {
+		return 0
+	}
+	return l.input[l.readPosition+n]
+}
+
 func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 	l.skipWhitespace()
@@ -100,6 +108,9 @@ func (l *Lexer) NextToken() token.Token {
 		} else if l.peek() == '=' {
 			tok = token.Token{Type: token.TOKEN_MINUS_A, Literal: string(l.ch) + string(l.peek())}
 			l.readNext()
+		} else if l.peek() == '>' {
+			tok = token.Token{Type: token.TOKEN_ARROW, Literal: string(l.ch) + string(l.peek())}
+			l.readNext()
 		} else {
 			tok = newToken(token.TOKEN_MINUS, l.ch)
 		}
@@ -132,10 +143,10 @@ func (l *Lexer) NextToken() token.Token {
 		}
 
 		// '/'通常表示除法，但是也可能是一个正则表达式
-		if prevToken.Type == token.TOKEN_RPAREN || // (a+c) / b
-			prevToken.Type == token.TOKEN_RBRACKET || // a[3] / b
-			prevToken.Type == token.TOKEN_IDENTIFIER || // a / b
-			prevToken.Type == token.TOKEN_NUMBER { // 3 / b,  3.5 / b
+		if l.prevToken.Type == token.TOKEN_RPAREN || // (a+c) / b
+			l.prevToken.Type == token.TOKEN_RBRACKET || // a[3] / b
+			l.prevToken.Type == token.TOKEN_IDENTIFIER || // a / b
+			l.prevToken.Type == token.TOKEN_NUMBER { // 3 / b,  3.5 / b
 			if l.peek() == '=' {
 				tok = token.Token{Type: token.TOKEN_SLASH_A, Literal: string(l.ch) + string(l.peek())}
 				l.readNext()
@@ -196,6 +207,9 @@ func (l *Lexer) NextToken() token.Token {
 		if l.peek() == '=' {
 			tok = token.Token{Type: token.TOKEN_LE, Literal: string(l.ch) + string(l.peek())}
 			l.readNext()
+		} else if l.peek() == '-' && !isDigit(l.peekAt(1)) { //the channel operator, except 'x<-1'('x < -1'). The parser splits it in 'if x<-y {}'
+			tok = token.Token{Type: token.TOKEN_RECV, Literal: string(l.ch) + string(l.peek())}
+			l.readNext()
 		} else {
 			tok = newToken(token.TOKEN_LT, l.ch)
 		}
@@ -216,6 +230,15 @@ func (l *Lexer) NextToken() token.Token {
 	case ',':
 		tok = newToken(token.TOKEN_COMMA, l.ch)
 	case '.':
+		//relative import path, e.g. 'import ./helpers', 'import ../shared/log'
+		if l.prevToken.Type == token.TOKEN_IMPORT || l.prevToken.Type == token.TOKEN_FROM {
+			tok.Literal = l.readImportPath()
+			tok.Type = token.TOKEN_IDENTIFIER
+			tok.Pos = pos
+			l.prevToken = tok
+			return tok
+		}
+
 		if l.peek() == '.' {
 			l.readNext()
 			if l.peek() == '.' {
@@ -255,20 +278,20 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Literal = l.readNumber()
 			tok.Type = token.TOKEN_NUMBER
 			tok.Pos = pos
-			prevToken = tok
+			l.prevToken = tok
 			return tok
 		} else if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Pos = pos
 			tok.Type = token.LookupIdent(tok.Literal)
-			prevToken = tok
+			l.prevToken = tok
 			return tok
 		} else if l.ch == 34 { //double quotes
 			if s, err := l.readString(l.ch); err == nil {
 				tok.Type = token.TOKEN_STRING
 				tok.Pos = pos
 				tok.Literal = s
-				prevToken = tok
+				l.prevToken = tok
 				return tok
 			} else {
 				tok.Type = token.TOKEN_ILLEGAL
@@ -279,6 +302,7 @@ func (l *Lexer) NextToken() token.Token {
 		} else if l.ch == '`' {
 			if s, err := l.readCommand(l.ch); err == nil {
 				tok.Type = token.TOKEN_CMD
+				tok.Pos = pos
 				tok.Literal = s
 				return tok
 			} else {
@@ -294,7 +318,7 @@ func (l *Lexer) NextToken() token.Token {
 
 	tok.Pos = pos
 	l.readNext()
-	prevToken = tok
+	l.prevToken = tok
 	return tok
 }
 
@@ -370,6 +394,14 @@ func (l *Lexer) readIdentifier() string {
 	return string(l.input[position:l.position])
 }
 
+func (l *Lexer) readImportPath() string {
+	position := l.position
+	for isLetter(l.ch) || isDigit(l.ch) || l.ch == '.' || l.ch == '/' || l.ch == '-' {
+		l.readNext()
+	}
+	return string(l.input[position:l.position])
+}
+
 func (l *Lexer) readString(r rune) (string, error) {
 	var ret []rune
 eos:
@@ -0,0 +1,246 @@
+// Package mod implements magpie's local package manager.
+//
+// A project's 'magpie.mod' declares the module's name, its version and the
+// dependencies, each pointing at a local directory(a plain directory or a
+// git checkout) or a tarball:
+//
+//	module app
+//	version 0.1.0
+//
+//	require greet 1.0.0 ../libs/greet
+//	require (
+//	    fmtx 1.0.0 ../libs/fmtx-1.0.0.tar.gz
+//	)
+//
+// The versions of the dependencies are selected using minimal version
+// selection, 'magpie.sum' records the content hash of each selected module,
+// and 'magpie mod vendor' copies them into the 'vendor' directory, which is
+// searched first by the import resolver. No network access is needed.
+package mod
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ModFile    = "magpie.mod"
+	SumFile    = "magpie.sum"
+	VendorDir  = "vendor"
+	ModulesTxt = "modules.txt" //the vendored modules, in the vendor directory
+)
+
+type Require struct {
+	Name    string
+	Version string
+	Source  string //directory or tarball, relative to the directory of the 'magpie.mod'
+	Line    int
+}
+
+type File struct {
+	Filename string
+	Module   string
+	Version  string
+	Requires []*Require
+
+	sourceDir string //the directory which the sources are relative to, if it's not the file's directory
+}
+
+// Dir returns the directory of the 'magpie.mod'.
+func (f *File) Dir() string {
+	return filepath.Dir(f.Filename)
+}
+
+// ParseFile parses the 'magpie.mod' file.
+func ParseFile(filename string) (*File, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(filename, data)
+}
+
+// Parse parses the contents of a 'magpie.mod' file.
+func Parse(filename string, data []byte) (*File, error) {
+	f := &File{Filename: filename}
+
+	inBlock := false //in 'require ( ... )'
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(stripComment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+
+		if inBlock {
+			if fields[0] == ")" {
+				inBlock = false
+				continue
+			}
+			if err := f.addRequire(fields, line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		switch fields[0] {
+		case "module":
+			if len(fields) != 2 || !validName(fields[1]) {
+				return nil, f.errorf(line, "usage: module <name>")
+			}
+			f.Module = fields[1]
+		case "version":
+			if len(fields) != 2 || !validVersion(fields[1]) {
+				return nil, f.errorf(line, "usage: version <major.minor.patch>")
+			}
+			f.Version = fields[1]
+		case "require":
+			if len(fields) == 2 && fields[1] == "(" {
+				inBlock = true
+				continue
+			}
+			if err := f.addRequire(fields[1:], line); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, f.errorf(line, "unknown directive '%s'", fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if inBlock {
+		return nil, f.errorf(0, "unterminated 'require' block")
+	}
+	if f.Module == "" {
+		return nil, f.errorf(0, "missing 'module' directive")
+	}
+	return f, nil
+}
+
+func (f *File) addRequire(fields []string, line int) error {
+	if len(fields) != 3 {
+		return f.errorf(line, "usage: require <name> <version> <path>")
+	}
+	if !validName(fields[0]) {
+		return f.errorf(line, "invalid module name '%s'", fields[0])
+	}
+	if !validVersion(fields[1]) {
+		return f.errorf(line, "invalid version '%s'", fields[1])
+	}
+	for _, r := range f.Requires {
+		if r.Name == fields[0] {
+			return f.errorf(line, "module '%s' is required twice", r.Name)
+		}
+	}
+
+	f.Requires = append(f.Requires, &Require{Name: fields[0], Version: fields[1], Source: fields[2], Line: line})
+	return nil
+}
+
+func (f *File) errorf(line int, format string, args ...interface{}) error {
+	if line == 0 {
+		return fmt.Errorf("%s: %s", f.Filename, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%s:%d: %s", f.Filename, line, fmt.Sprintf(format, args...))
+}
+
+// the source's absolute path
+func (f *File) sourcePath(r *Require) string {
+	if filepath.IsAbs(r.Source) {
+		return filepath.Clean(r.Source)
+	}
+	if f.sourceDir != "" {
+		return filepath.Join(f.sourceDir, r.Source)
+	}
+	return filepath.Join(f.Dir(), r.Source)
+}
+
+// Init creates the 'magpie.mod' of a new module in the directory.
+func Init(dir string, name string) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid module name '%s'", name)
+	}
+	filename := filepath.Join(dir, ModFile)
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("%s already exists", filename)
+	}
+	return ioutil.WriteFile(filename, []byte(fmt.Sprintf("module %s\nversion 0.1.0\n", name)), 0644)
+}
+
+// FindRoot returns the nearest directory which contains a 'magpie.mod',
+// starting from dir and walking up.
+func FindRoot(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ModFile)); err == nil {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// VendorDirs returns the vendor directories which the imports of the files
+// in dir are resolved in, the nearest module's first. A vendored module could
+// import its own dependencies which are vendored by the main module.
+func VendorDirs(dir string) []string {
+	var dirs []string
+	for {
+		root, ok := FindRoot(dir)
+		if !ok {
+			return dirs
+		}
+		vendor := filepath.Join(root, VendorDir)
+		if info, err := os.Stat(vendor); err == nil && info.IsDir() {
+			dirs = append(dirs, vendor)
+		}
+		dir = filepath.Dir(root)
+		if dir == root {
+			return dirs
+		}
+	}
+}
+
+// '#' and '//' start comments
+func stripComment(line string) string {
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
+
+// module names are used as import paths: 'team/greet' is imported by 'import team.greet'
+func validName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" {
+			return false
+		}
+		for i, ch := range part {
+			isLetter := ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+			isDigit := ch >= '0' && ch <= '9'
+			if !isLetter && !(isDigit && i > 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
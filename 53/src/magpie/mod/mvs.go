@@ -0,0 +1,110 @@
+package mod
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Module is a selected dependency.
+type Module struct {
+	Name    string
+	Version string
+	Source  string //absolute path of the directory or tarball
+}
+
+type modVersion struct {
+	name    string
+	version string
+}
+
+// BuildList reads the main module's 'magpie.mod' in root, and selects the
+// version of each dependency using minimal version selection: every module
+// reachable in the requirement graph is visited, and the highest of the
+// versions required for a module is selected. The result is sorted by name.
+func BuildList(root string) (*File, []Module, error) {
+	main, err := ParseFile(filepath.Join(root, ModFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sources := make(map[modVersion]string)
+	requiredBy := make(map[modVersion]string)
+	selected := make(map[string]string)
+
+	var walk func(f *File) error
+	walk = func(f *File) error {
+		for _, r := range f.Requires {
+			mv := modVersion{r.Name, r.Version}
+			source := f.sourcePath(r)
+			if prev, ok := sources[mv]; ok {
+				if prev != source {
+					return fmt.Errorf("%s %s is required from different sources:\n\t%s (%s)\n\t%s (%s:%d)",
+						r.Name, r.Version, prev, requiredBy[mv], source, f.Filename, r.Line)
+				}
+				continue
+			}
+			sources[mv] = source
+			requiredBy[mv] = fmt.Sprintf("%s:%d", f.Filename, r.Line)
+
+			if r.Name == main.Module { //a dependency requires the main module
+				continue
+			}
+			if v, ok := selected[r.Name]; !ok || CompareVersions(r.Version, v) > 0 {
+				selected[r.Name] = r.Version
+			}
+
+			dep, err := loadRequired(r, source)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", f.Filename, r.Line, err)
+			}
+			if dep != nil {
+				if err := walk(dep); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(main); err != nil {
+		return nil, nil, err
+	}
+
+	var list []Module
+	for name, version := range selected {
+		list = append(list, Module{Name: name, Version: version, Source: sources[modVersion{name, version}]})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return main, list, nil
+}
+
+// read the required module's 'magpie.mod', nil if the module has none. The
+// sources in a tarball's 'magpie.mod' are relative to the tarball's directory.
+func loadRequired(r *Require, source string) (*File, error) {
+	dir, cleanup, err := fetch(source)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	filename := filepath.Join(dir, ModFile)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil, nil
+	}
+	dep, err := ParseFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if dep.Module != r.Name {
+		return nil, fmt.Errorf("%s declares module '%s', but is required as '%s'", source, dep.Module, r.Name)
+	}
+	if dep.Version != "" && dep.Version != r.Version {
+		return nil, fmt.Errorf("%s declares version %s, but %s %s is required", source, dep.Version, r.Name, r.Version)
+	}
+
+	if isTarball(source) {
+		dep.sourceDir = filepath.Dir(source)
+	}
+	return dep, nil
+}
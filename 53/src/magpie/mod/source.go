@@ -0,0 +1,160 @@
+package mod
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func isTarball(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz") || strings.HasSuffix(path, ".tar")
+}
+
+// returns the directory which contains the module's files, tarballs are
+// extracted into a temporary directory which is removed by the cleanup function.
+func fetch(source string) (string, func(), error) {
+	nop := func() {}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return "", nop, fmt.Errorf("module source not found: %s", source)
+	}
+	if info.IsDir() { //a plain directory or a git checkout
+		return source, nop, nil
+	}
+	if !isTarball(source) {
+		return "", nop, fmt.Errorf("module source should be a directory or a tarball(.tar, .tar.gz, .tgz): %s", source)
+	}
+
+	tmp, err := ioutil.TempDir("", "magpie-mod-")
+	if err != nil {
+		return "", nop, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	if err := extract(source, tmp); err != nil {
+		cleanup()
+		return "", nop, fmt.Errorf("extracting %s: %s", source, err)
+	}
+
+	//a tarball usually contains a single top level directory, e.g. 'greet-1.0.0/'
+	entries, err := ioutil.ReadDir(tmp)
+	if err == nil && len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(tmp, entries[0].Name()), cleanup, nil
+	}
+	return tmp, cleanup, nil
+}
+
+func extract(tarball string, dest string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(tarball, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file name in tarball: %s", hdr.Name)
+		}
+		target := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeFile(target, tr); err != nil {
+				return err
+			}
+		} //links and other special files are ignored
+	}
+}
+
+func writeFile(target string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// the files of a module, in slash-separated paths relative to the module's
+// directory, sorted. '.git' directories and the module's own 'vendor'
+// directory are skipped.
+func moduleFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" || rel == VendorDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// copy the module's files into dest
+func copyModule(src string, dest string) error {
+	files, err := moduleFiles(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(src, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		err = writeFile(filepath.Join(dest, filepath.FromSlash(name)), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package mod
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sum holds the content hashes of the modules, the key is 'name version'.
+type Sum map[string]string
+
+func sumKey(name, version string) string {
+	return name + " " + version
+}
+
+// HashDir returns the content hash of the module's files: the sha256 of the
+// list of each file's sha256 and name.
+func HashDir(dir string) (string, error) {
+	files, err := moduleFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	summary := sha256.New()
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(summary, "%x  %s\n", h.Sum(nil), name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil)), nil
+}
+
+// ReadSum reads the 'magpie.sum' file, a missing file is an empty Sum.
+func ReadSum(filename string) (Sum, error) {
+	sum := Sum{}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return sum, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "h1:") {
+			return nil, fmt.Errorf("%s:%d: malformed line, expected '<name> <version> h1:<hash>'", filename, line)
+		}
+		sum[sumKey(fields[0], fields[1])] = fields[2]
+	}
+	return sum, scanner.Err()
+}
+
+// Write writes the sorted entries to the 'magpie.sum' file.
+func (sum Sum) Write(filename string) error {
+	keys := []string{}
+	for key := range sum {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&out, "%s %s\n", key, sum[key])
+	}
+	return ioutil.WriteFile(filename, out.Bytes(), 0644)
+}
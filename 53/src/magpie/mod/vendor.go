@@ -0,0 +1,157 @@
+package mod
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Vendor copies the selected dependencies of the main module in root into
+// its 'vendor' directory, and records their hashes in 'magpie.sum'. A module
+// whose content does not match the hash already in 'magpie.sum' is an error.
+func Vendor(root string, w io.Writer) error {
+	_, list, err := BuildList(root)
+	if err != nil {
+		return err
+	}
+
+	sumFile := filepath.Join(root, SumFile)
+	oldSum, err := ReadSum(sumFile)
+	if err != nil {
+		return err
+	}
+
+	//check all the modules before touching the vendor directory
+	sum := Sum{}
+	for _, m := range list {
+		dir, cleanup, err := fetch(m.Source)
+		if err != nil {
+			return err
+		}
+		hash, err := HashDir(dir)
+		cleanup()
+		if err != nil {
+			return err
+		}
+
+		key := sumKey(m.Name, m.Version)
+		if old, ok := oldSum[key]; ok && old != hash {
+			return fmt.Errorf("%s %s: checksum mismatch\n\t%s: %s\n\t%s: %s", m.Name, m.Version, m.Source, hash, SumFile, old)
+		}
+		sum[key] = hash
+	}
+
+	vendor := filepath.Join(root, VendorDir)
+	if err := os.RemoveAll(vendor); err != nil {
+		return err
+	}
+
+	var modules bytes.Buffer
+	for _, m := range list {
+		dir, cleanup, err := fetch(m.Source)
+		if err != nil {
+			return err
+		}
+		err = copyModule(dir, filepath.Join(vendor, filepath.FromSlash(m.Name)))
+		cleanup()
+		if err != nil {
+			return err
+		}
+
+		source := m.Source
+		if rel, err := filepath.Rel(root, source); err == nil {
+			source = filepath.ToSlash(rel)
+		}
+		fmt.Fprintf(&modules, "%s %s %s\n", m.Name, m.Version, source)
+		fmt.Fprintf(w, "vendored %s %s\n", m.Name, m.Version)
+	}
+
+	if len(list) > 0 {
+		if err := ioutil.WriteFile(filepath.Join(vendor, ModulesTxt), modules.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return sum.Write(sumFile)
+}
+
+// Verify checks that the selected dependencies of the main module in root,
+// and their vendored copies, match the hashes in 'magpie.sum'.
+func Verify(root string, w io.Writer) error {
+	_, list, err := BuildList(root)
+	if err != nil {
+		return err
+	}
+
+	sum, err := ReadSum(filepath.Join(root, SumFile))
+	if err != nil {
+		return err
+	}
+	vendored, err := readModulesTxt(filepath.Join(root, VendorDir, ModulesTxt))
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, m := range list {
+		want, ok := sum[sumKey(m.Name, m.Version)]
+		if !ok {
+			failed = append(failed, fmt.Sprintf("%s %s: missing in %s, run 'magpie mod vendor'", m.Name, m.Version, SumFile))
+			continue
+		}
+
+		//the source
+		dir, cleanup, err := fetch(m.Source)
+		if err == nil {
+			var hash string
+			if hash, err = HashDir(dir); err == nil && hash != want {
+				failed = append(failed, fmt.Sprintf("%s %s: %s has been modified", m.Name, m.Version, m.Source))
+			}
+		}
+		cleanup()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s: %s", m.Name, m.Version, err))
+		}
+
+		//the vendored copy
+		if version, ok := vendored[m.Name]; ok {
+			dir := filepath.Join(root, VendorDir, filepath.FromSlash(m.Name))
+			if version != m.Version {
+				failed = append(failed, fmt.Sprintf("%s: version %s is vendored, but %s is selected", m.Name, version, m.Version))
+			} else if hash, err := HashDir(dir); err != nil {
+				failed = append(failed, fmt.Sprintf("%s %s: %s", m.Name, m.Version, err))
+			} else if hash != want {
+				failed = append(failed, fmt.Sprintf("%s %s: %s has been modified", m.Name, m.Version, dir))
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("verification failed:\n\t%s", strings.Join(failed, "\n\t"))
+	}
+	fmt.Fprintf(w, "all %d module(s) verified\n", len(list))
+	return nil
+}
+
+// returns the vendored modules' versions
+func readModulesTxt(filename string) (map[string]string, error) {
+	versions := make(map[string]string)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			versions[fields[0]] = fields[1]
+		}
+	}
+	return versions, nil
+}
@@ -0,0 +1,67 @@
+package mod
+
+import (
+	"strconv"
+	"strings"
+)
+
+// versions are 'major.minor.patch', optionally prefixed with 'v' and followed
+// by a pre-release suffix, e.g. '1.2.0', 'v1.2.0', '1.3.0-beta'
+func validVersion(v string) bool {
+	nums, _ := splitVersion(v)
+	if len(nums) != 3 {
+		return false
+	}
+	for _, n := range nums {
+		if _, err := strconv.Atoi(n); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func splitVersion(v string) ([]string, string) {
+	v = strings.TrimPrefix(v, "v")
+	pre := ""
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	return strings.Split(v, "."), pre
+}
+
+// CompareVersions returns -1, 0 or 1 if version a is lower than, equal to
+// or higher than version b. A pre-release is lower than its release.
+func CompareVersions(a, b string) int {
+	numsA, preA := splitVersion(a)
+	numsB, preB := splitVersion(b)
+
+	for i := 0; i < len(numsA) && i < len(numsB); i++ {
+		x, _ := strconv.Atoi(numsA[i])
+		y, _ := strconv.Atoi(numsB[i])
+		if x != y {
+			return sign(x - y)
+		}
+	}
+	if len(numsA) != len(numsB) {
+		return sign(len(numsA) - len(numsB))
+	}
+
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return strings.Compare(preA, preB)
+}
+
+func sign(n int) int {
+	if n < 0 {
+		return -1
+	} else if n > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,321 @@
+// Package optimizer implements the optional optimization pass('magpie run -O')
+// over the program's AST, which runs after the macro expansion:
+//
+//   - the constant numeric, string and boolean expressions are folded,
+//     including the chained comparisons, e.g. '1 < 2 < 3'
+//   - the branches of 'if' whose conditions are constants, and the
+//     statements after 'return', 'tailcall' and 'throw' are removed
+//   - the regular expression literals are compiled once
+//   - the trivial immediately-invoked function literals are inlined,
+//     e.g. 'fn(x) { x * 2 }(3)' becomes '3 * 2', and then '6'
+//
+// The constants are evaluated by the evaluator itself, so the folded values
+// are the same as the ones computed at runtime. An expression whose
+// evaluation fails(e.g. '1 / 0') is kept, and reports the error at runtime.
+// They are evaluated in a sandbox without any capabilities, and the ranges
+// (e.g. '1..1e8') are never folded.
+package optimizer
+
+import (
+	"magpie/ast"
+	"magpie/eval"
+	"magpie/token"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxFoldedString = 4096 //longer strings are not folded, e.g. "-" * 100000
+
+type optimizer struct {
+	frozen map[ast.Node]bool            //the nodes which must not be changed, e.g. the quoted ones
+	calls  map[*ast.CallExpression]bool //the calls which must stay calls, e.g. 'defer f()'
+	seen   map[*ast.Program]bool        //the optimized programs
+}
+
+// the limits of evaluating a constant: a fold which would allocate more is
+// kept, and no operation which touches the outside is run
+var foldOptions = eval.Options{MaxAlloc: maxFoldedString, Deny: eval.CapAll}
+
+// Optimize optimizes the program and its imported modules in place.
+func Optimize(program *ast.Program) {
+	o := &optimizer{
+		frozen: make(map[ast.Node]bool),
+		calls:  make(map[*ast.CallExpression]bool),
+		seen:   make(map[*ast.Program]bool),
+	}
+	o.program(program)
+}
+
+func (o *optimizer) program(program *ast.Program) {
+	if o.seen[program] {
+		return
+	}
+	o.seen[program] = true
+
+	for _, imp := range program.Imports {
+		if imp.Program != nil {
+			o.program(imp.Program)
+		}
+	}
+
+	o.mark(program)
+	ast.Modify(program, o.optimize)
+}
+
+// find the nodes which must be kept as they are
+func (o *optimizer) mark(program *ast.Program) {
+	freeze := func(node ast.Node) {
+		ast.Inspect(node, func(n ast.Node) bool {
+			o.frozen[n] = true
+			return true
+		})
+	}
+	keepCall := func(expr ast.Expression) {
+		if call, ok := expr.(*ast.CallExpression); ok {
+			o.calls[call] = true
+		}
+	}
+
+	ast.Inspect(program, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.CallExpression:
+			if ident, ok := n.Function.(*ast.Identifier); ok && ident.Value == "quote" {
+				freeze(n)
+				return false
+			}
+		case *ast.MacroLiteral:
+			freeze(n)
+			return false
+		case *ast.TailCallStatement:
+			keepCall(n.Call)
+		case *ast.DeferStmt:
+			keepCall(n.Expr)
+		case *ast.SpawnExpression:
+			keepCall(n.Call)
+		case *ast.MethodCallExpression:
+			keepCall(n.Call)
+		case *ast.DecoratorExpr:
+			keepCall(n.Decorator)
+		case *ast.InfixExpression:
+			if n.Operator == "|>" { //the left operand becomes the call's first argument
+				keepCall(n.Right)
+			}
+		}
+		return true
+	})
+}
+
+// the modifier, which is called after the node's children are optimized
+func (o *optimizer) optimize(node ast.Node) ast.Node {
+	if o.frozen[node] {
+		return node
+	}
+
+	switch n := node.(type) {
+	case *ast.InfixExpression:
+		//'1..n' is evaluated lazily by 'for', and is not a scalar anyway
+		if n.Operator == "|>" || n.Operator == ".." || !isConst(n.Left) || !isConst(n.Right) || (n.HasNext && !isConst(n.Next)) {
+			return n
+		}
+		return o.fold(n)
+	case *ast.PrefixExpression:
+		if !isConst(n.Right) {
+			return n
+		}
+		return o.fold(n)
+	case *ast.IfExpression:
+		return o.ifExpression(n)
+	case *ast.BlockStatement:
+		n.Statements = reachable(n.Statements)
+	case *ast.Program:
+		n.Statements = reachable(n.Statements)
+	case *ast.RegExLiteral:
+		if re, err := regexp.Compile(n.Value); err == nil {
+			n.Regexp = re
+		}
+	case *ast.CallExpression:
+		if o.calls[n] {
+			return n
+		}
+		if expr, ok := inline(n); ok {
+			return ast.Modify(expr, o.optimize)
+		}
+	}
+	return node
+}
+
+// evaluate the constant expression, and replace it with the result if it is
+// a scalar(a number, a short string or a boolean)
+func (o *optimizer) fold(expr ast.Expression) ast.Expression {
+	pos := expr.Pos()
+	switch v := constEval(expr).(type) {
+	case *eval.Number:
+		literal := strconv.FormatFloat(v.Value, 'f', -1, 64)
+		return &ast.NumberLiteral{Token: token.Token{Pos: pos, Type: token.TOKEN_NUMBER, Literal: literal}, Value: v.Value}
+	case *eval.String:
+		if len(v.String) > maxFoldedString || strings.Contains(v.String, "$") { //'$' would be interpolated
+			return expr
+		}
+		return &ast.StringLiteral{Token: token.Token{Pos: pos, Type: token.TOKEN_STRING, Literal: v.String}, Value: v.String}
+	case *eval.Boolean:
+		return boolLiteral(pos, v.Bool)
+	}
+	return expr
+}
+
+// evaluate the constant in a new empty scope, whose allocation budget is
+// not shared with the other folds
+func constEval(expr ast.Expression) eval.Object {
+	return eval.Eval(expr, eval.NewScopeWithOptions(os.Stdout, &foldOptions))
+}
+
+// remove the branches whose conditions are constants: the false ones are
+// never taken, and the branches after a true one are never reached
+func (o *optimizer) ifExpression(ie *ast.IfExpression) ast.Expression {
+	var conds []*ast.IfConditionExpr
+	for _, c := range ie.Conditions {
+		if !isConst(c.Cond) {
+			conds = append(conds, c)
+			continue
+		}
+		if eval.IsTrue(constEval(c.Cond)) {
+			c.Cond = boolLiteral(c.Cond.Pos(), true)
+			ie.Conditions = append(conds, c)
+			ie.Alternative = nil
+			return ie
+		}
+	}
+
+	if len(conds) == 0 {
+		if ie.Alternative == nil {
+			return &ast.NilLiteral{Token: token.Token{Pos: ie.Pos(), Type: token.TOKEN_NIL, Literal: "nil"}}
+		}
+		//only the 'else' part is left
+		cond := &ast.IfConditionExpr{Token: ie.Token, Cond: boolLiteral(ie.Pos(), true), Body: ie.Alternative}
+		ie.Conditions, ie.Alternative = []*ast.IfConditionExpr{cond}, nil
+		return ie
+	}
+	ie.Conditions = conds
+	return ie
+}
+
+// the statements after 'return', 'tailcall' and 'throw' are never run
+func reachable(stmts []ast.Statement) []ast.Statement {
+	for i, stmt := range stmts {
+		switch stmt.(type) {
+		case *ast.ReturnStatement, *ast.TailCallStatement, *ast.ThrowStmt:
+			return stmts[:i+1]
+		}
+	}
+	return stmts
+}
+
+// inline the function literal which is called immediately with constant
+// arguments, if its body is a single expression which has no side effects
+// on the function's scope: 'fn(x) { x * 2 }(3)' => '3 * 2'
+func inline(call *ast.CallExpression) (ast.Expression, bool) {
+	fl, ok := call.Function.(*ast.FunctionLiteral)
+	if !ok || fl.Name != "" || fl.Variadic || fl.IsGenerator || fl.IsAsync || fl.ReturnType != nil || call.Variadic {
+		return nil, false
+	}
+	if len(call.Arguments) != len(fl.Parameters) || fl.Body == nil || len(fl.Body.Statements) != 1 {
+		return nil, false
+	}
+
+	params := make(map[string]ast.Expression)
+	for i, param := range fl.Parameters {
+		if fl.ParamTypes != nil && fl.ParamTypes[i] != nil {
+			return nil, false
+		}
+		if !isConst(call.Arguments[i]) {
+			return nil, false
+		}
+		params[param.Value] = call.Arguments[i]
+	}
+
+	var expr ast.Expression
+	switch stmt := fl.Body.Statements[0].(type) {
+	case *ast.ExpressionStatement:
+		expr = stmt.Expression
+	case *ast.ReturnStatement:
+		if len(stmt.ReturnValues) != 1 {
+			return nil, false
+		}
+		expr = stmt.ReturnValue
+	}
+	if expr == nil || !isSimple(expr, len(params) > 0) {
+		return nil, false
+	}
+	if len(params) == 0 {
+		return expr, true
+	}
+
+	//the members' names are looked up in the objects, not in the scope
+	members := make(map[ast.Node]bool)
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if m, ok := node.(*ast.MethodCallExpression); ok {
+			switch c := m.Call.(type) {
+			case *ast.Identifier:
+				members[c] = true
+			case *ast.CallExpression:
+				members[c.Function] = true
+			}
+		}
+		return true
+	})
+	return ast.Modify(expr, func(node ast.Node) ast.Node {
+		if ident, ok := node.(*ast.Identifier); ok && !members[ident] {
+			if arg, ok := params[ident.Value]; ok {
+				return ast.Copy(arg)
+			}
+		}
+		return node
+	}).(ast.Expression), true
+}
+
+// the expression only reads the scope's variables: no assignments, no new
+// scopes, no control flow which would leave the function and no '$_'.
+// The interpolated strings read the variables by name, so they could not
+// refer to the parameters.
+func isSimple(expr ast.Expression, hasParams bool) bool {
+	simple := true
+	ast.Inspect(expr, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.Identifier:
+			simple = simple && n.Value != "$_"
+		case *ast.StringLiteral:
+			simple = simple && !(hasParams && strings.Contains(n.Value, "$"))
+		case *ast.NumberLiteral, *ast.BooleanLiteral, *ast.NilLiteral, *ast.RegExLiteral,
+			*ast.ArrayLiteral, *ast.TupleLiteral, *ast.PrefixExpression, *ast.InfixExpression,
+			*ast.IndexExpression, *ast.MethodCallExpression:
+		case *ast.CallExpression:
+			if ident, ok := n.Function.(*ast.Identifier); ok && (ident.Value == "quote" || ident.Value == "unquote") {
+				simple = false
+			}
+		default:
+			simple = false
+		}
+		return simple
+	})
+	return simple
+}
+
+// a literal which is evaluated to the same value every time
+func isConst(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.NumberLiteral, *ast.BooleanLiteral, *ast.NilLiteral:
+		return true
+	case *ast.StringLiteral:
+		return !strings.Contains(e.Value, "$")
+	}
+	return false
+}
+
+func boolLiteral(pos token.Position, value bool) *ast.BooleanLiteral {
+	if value {
+		return &ast.BooleanLiteral{Token: token.Token{Pos: pos, Type: token.TOKEN_TRUE, Literal: "true"}, Value: true}
+	}
+	return &ast.BooleanLiteral{Token: token.Token{Pos: pos, Type: token.TOKEN_FALSE, Literal: "false"}, Value: false}
+}
@@ -7,9 +7,11 @@ import (
 	"io/ioutil"
 	"magpie/ast"
 	"magpie/lexer"
+	"magpie/mod"
 	"magpie/token"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -41,6 +43,7 @@ var precedences = map[token.TokenType]int{
 	token.TOKEN_MOD_A:      ASSIGN,
 
 	token.TOKEN_FATARROW: ASSIGN,
+	token.TOKEN_RECV:     ASSIGN, //ch <- a + b
 	token.TOKEN_OR:       CONDOR,
 	token.TOKEN_AND:      CONDAND,
 
@@ -52,6 +55,7 @@ var precedences = map[token.TokenType]int{
 	token.TOKEN_GT:   LESSGREATER,
 	token.TOKEN_GE:   LESSGREATER,
 	token.TOKEN_IN:   LESSGREATER,
+	token.TOKEN_IS:   LESSGREATER,
 	token.TOKEN_PIPE: LESSGREATER,
 
 	token.TOKEN_PLUS:     SUM,
@@ -100,16 +104,26 @@ type Parser struct {
 
 	curToken   token.Token
 	peekToken  token.Token
-	savedToken token.Token //used in anonymous functions parsing
+	savedToken token.Token  //used in anonymous functions parsing
+	splitToken *token.Token //the '-' of a '<-' which is split into '<' and '-'
+	sendable   bool         //the expression being parsed could be a send('ch <- v')
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
 
 	loopDepth        int // current loop depth (0 if not in any loops)
+	loopLabels       []string //labels of the enclosing loops('' if the loop has no label)
+	nextLabel        string   //label for the loop being parsed
 	fallthroughDepth int //current fallthrough depth (0 if not in switch cases)
+	functionDepth    int //current function depth (0 if not in any functions)
+	yieldFound       bool //'yield' found in current function's body
+	asyncFunction    bool //parsing an async function's body
+	asyncNext        bool //the function literal being parsed is declared with 'async'
+	macros           map[string]int //macro names and their parameter counts
 
 	Attachments *ember.Attachments
 	importLib   map[string]*ast.Program //for use with imported standard libs
+	importChain []string                //paths of the files being imported, used to detect import cycles
 }
 
 func (p *Parser) registerPrefix(tokenType token.TokenType, fn prefixParseFn) {
@@ -126,6 +140,7 @@ func NewParser(l *lexer.Lexer) *Parser {
 		errors:     []string{},
 		errorLines: []string{},
 		importLib:  make(map[string]*ast.Program),
+		macros:     map[string]int{"quote": 1}, //'quote { ... }' quotes a block
 	}
 
 	p.registerAction()
@@ -139,9 +154,11 @@ func (p *Parser) registerAction() {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.TOKEN_ILLEGAL, p.parsePrefixIllegalExpression)
 	p.registerPrefix(token.TOKEN_NUMBER, p.parseNumber)
-	p.registerPrefix(token.TOKEN_IDENTIFIER, p.parseIdentifier)
+	p.registerPrefix(token.TOKEN_IDENTIFIER, p.parseIdentifierExpression)
 	p.registerPrefix(token.TOKEN_STRING, p.parseStringLiteral)
 	p.registerPrefix(token.TOKEN_FUNCTION, p.parseFunctionLiteral)
+	p.registerPrefix(token.TOKEN_YIELD, p.parseYieldExpression)
+	p.registerPrefix(token.TOKEN_MACRO, p.parseMacroLiteral)
 	p.registerPrefix(token.TOKEN_TRUE, p.parseBooleanLiteral)
 	p.registerPrefix(token.TOKEN_FALSE, p.parseBooleanLiteral)
 	p.registerPrefix(token.TOKEN_LBRACKET, p.parseArrayLiteral)
@@ -163,6 +180,10 @@ func (p *Parser) registerAction() {
 	p.registerPrefix(token.TOKEN_CONTINUE, p.parseContinueExpression)
 	p.registerPrefix(token.TOKEN_AT, p.parseDecorator)
 	p.registerPrefix(token.TOKEN_CMD, p.parseCommand)
+	p.registerPrefix(token.TOKEN_RECV, p.parsePrefixExpression)
+	p.registerPrefix(token.TOKEN_SPAWN, p.parseSpawnExpression)
+	p.registerPrefix(token.TOKEN_ASYNC, p.parseAsyncFunction)
+	p.registerPrefix(token.TOKEN_AWAIT, p.parseAwaitExpression)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerPrefix(token.TOKEN_ILLEGAL, p.parseInfixIllegalExpression)
@@ -182,6 +203,7 @@ func (p *Parser) registerAction() {
 	p.registerInfix(token.TOKEN_EQ, p.parseInfixExpression)
 	p.registerInfix(token.TOKEN_NEQ, p.parseInfixExpression)
 	p.registerInfix(token.TOKEN_IN, p.parseInfixExpression)
+	p.registerInfix(token.TOKEN_IS, p.parseInfixExpression)
 	p.registerInfix(token.TOKEN_PIPE, p.parseInfixExpression)
 
 	p.registerInfix(token.TOKEN_AND, p.parseInfixExpression)
@@ -204,6 +226,7 @@ func (p *Parser) registerAction() {
 	p.registerInfix(token.TOKEN_MOD_A, p.parseAssignExpression)
 
 	p.registerInfix(token.TOKEN_FATARROW, p.parseFatArrow)
+	p.registerInfix(token.TOKEN_RECV, p.parseInfixExpression)
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
@@ -216,16 +239,17 @@ func (p *Parser) ParseProgram() *ast.Program {
 	program := &ast.Program{}
 
 	program.Statements = []ast.Statement{}
-	program.Imports = make(map[string]*ast.ImportStatement)
+	program.Imports = []*ast.ImportStatement{}
+	imported := make(map[string]bool)
 
 	for p.curToken.Type != token.TOKEN_EOF {
 		stmt := p.parseStatement()
 		if stmt != nil {
 			if importStmt, ok := stmt.(*ast.ImportStatement); ok {
-				importPath := importStmt.ImportPath
-				_, ok := program.Imports[importPath]
-				if !ok { //if not ok, we need to import it, or else we do not want to import twice
-					program.Imports[importPath] = importStmt
+				key := importStmt.String()
+				if !imported[key] { //we do not want to import twice
+					imported[key] = true
+					program.Imports = append(program.Imports, importStmt)
 				}
 			} else {
 				program.Statements = append(program.Statements, stmt)
@@ -241,6 +265,8 @@ func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
 	case token.TOKEN_IMPORT:
 		return p.parseImportStatement()
+	case token.TOKEN_FROM:
+		return p.parseFromImportStatement()
 	case token.TOKEN_LET:
 		return p.parseLetStatement()
 	case token.TOKEN_RETURN:
@@ -251,25 +277,110 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseBlockStatement()
 	case token.TOKEN_STRUCT:
 		return p.parseStructStatement()
+	case token.TOKEN_INTERFACE:
+		return p.parseInterfaceStatement()
 	case token.TOKEN_TRY:
 		return p.parseTryStatement()
 	case token.TOKEN_THROW:
 		return p.parseThrowStatement()
+	case token.TOKEN_DEFER:
+		return p.parseDeferStatement()
+	case token.TOKEN_SELECT:
+		return p.parseSelectStatement()
 	case token.TOKEN_IDENTIFIER:
+		if p.peekTokenIs(token.TOKEN_COLON) { //label: loop
+			return p.parseLabeledLoop()
+		}
+		p.sendable = true
 		stmt := p.parseExpressionStatement()
 		if p.peekTokenIs(token.TOKEN_COMMA) {
 			return p.parseMultiAssignStatement(stmt.Expression)
 		}
 		return stmt
 	default:
+		p.sendable = true
 		return p.parseExpressionStatement()
 	}
 }
 
+//import a.b.c [as alias]
 func (p *Parser) parseImportStatement() *ast.ImportStatement {
 	stmt := &ast.ImportStatement{Token: p.curToken}
 
 	p.nextToken()
+	stmt.ImportPath = p.parseImportPath()
+
+	if p.peekTokenIs(token.TOKEN_AS) {
+		p.nextToken()
+		if !p.expectPeek(token.TOKEN_IDENTIFIER) {
+			return stmt
+		}
+		stmt.Alias = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	}
+
+	p.loadImport(stmt)
+	return stmt
+}
+
+//from a.b.c import Name1, Name2
+func (p *Parser) parseFromImportStatement() *ast.ImportStatement {
+	stmt := &ast.ImportStatement{Token: p.curToken}
+
+	p.nextToken()
+	stmt.ImportPath = p.parseImportPath()
+
+	if !p.expectPeek(token.TOKEN_IMPORT) {
+		return stmt
+	}
+
+	for {
+		if !p.expectPeek(token.TOKEN_IDENTIFIER) {
+			return stmt
+		}
+		stmt.Names = append(stmt.Names, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+		if !p.peekTokenIs(token.TOKEN_COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+
+	p.loadImport(stmt)
+	if stmt.Program != nil { //the macros imported by name could be used with trailing blocks
+		macros := moduleMacros(stmt.Program)
+		for _, name := range stmt.Names {
+			if n, ok := macros[name.Value]; ok {
+				p.macros[name.Value] = n
+			}
+		}
+	}
+	return stmt
+}
+
+// the top level macros of the module, and their parameter counts
+func moduleMacros(program *ast.Program) map[string]int {
+	macros := make(map[string]int)
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.LetStatement:
+			if len(s.Names) == 1 && len(s.Values) == 1 {
+				if m, ok := s.Values[0].(*ast.MacroLiteral); ok {
+					macros[s.Names[0].Value] = len(m.Parameters)
+				}
+			}
+		case *ast.ExpressionStatement:
+			if m, ok := s.Expression.(*ast.MacroLiteral); ok && m.Name != "" {
+				macros[m.Name] = len(m.Parameters)
+			}
+		}
+	}
+	return macros
+}
+
+// parse the dotted path 'a.b.c', returns 'a/b/c'. relative paths are kept as written.
+func (p *Parser) parseImportPath() string {
+	if ast.IsRelativeImport(p.curToken.Literal) { //'./helpers', '../shared/log'
+		return p.curToken.Literal
+	}
 
 	paths := []string{}
 	paths = append(paths, p.curToken.Literal)
@@ -280,30 +391,84 @@ func (p *Parser) parseImportStatement() *ast.ImportStatement {
 		paths = append(paths, p.curToken.Literal)
 	}
 
-	path := strings.TrimSpace(strings.Join(paths, "/"))
-	stmt.ImportPath = filepath.Base(path)
+	return strings.TrimSpace(strings.Join(paths, "/"))
+}
 
-	program, err := p.getImportedStatements(path)
+// parse the imported module, and fill the statement's Path and Program
+func (p *Parser) loadImport(stmt *ast.ImportStatement) {
+	program, path, err := p.getImportedStatements(stmt.ImportPath)
 	if err != nil {
 		p.errors = append(p.errors, err.Error())
 		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
-		return stmt
+		return
 	}
 
 	if p.peekTokenIs(token.TOKEN_SEMICOLON) {
 		p.nextToken()
 	}
 
+	stmt.Path = path
 	stmt.Program = program
-	return stmt
 }
 
-func (p *Parser) getImportedStatements(importpath string) (*ast.Program, error) {
+// the entry file of a package directory, 'import pkg' loads 'pkg/mod.mp'
+const PackageEntry = "mod.mp"
+
+// SearchPath returns the root directories which the imported modules are
+// searched in after the vendor directories and the importing file's
+// directory: the colon-separated 'MAGPIE_PATH', then 'MAGPIE_ROOT'.
+func SearchPath() []string {
+	var roots []string
+	for _, root := range filepath.SplitList(os.Getenv("MAGPIE_PATH")) {
+		if root != "" {
+			roots = append(roots, root)
+		}
+	}
+	if root := os.Getenv("MAGPIE_ROOT"); root != "" {
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// StdLibs returns the names of the standard libs.
+func StdLibs() []string {
+	var names []string
+	for name := range stdlibs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the module in directory 'dir' could be 'dir/a/b.mp', or the package 'dir/a/b/mod.mp'
+func moduleFiles(dir string, importpath string) []string {
+	return []string{
+		filepath.Join(dir, importpath+".mp"),
+		filepath.Join(dir, importpath, PackageEntry),
+	}
+}
+
+// the path relative to the working directory if it is under it, used in error messages
+func displayPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(wd, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return rel
+}
+
+// returns the parsed module and its resolved absolute path, the path of
+// a standard lib is its name.
+func (p *Parser) getImportedStatements(importpath string) (*ast.Program, string, error) {
 	var f []byte
 	var fn string
 	if isStdLib(importpath) {
 		if imported, ok := p.importLib[importpath]; ok {
-			return imported, nil
+			return imported, importpath, nil
 		}
 
 		f, _ = stdlibs[importpath]
@@ -317,44 +482,67 @@ func (p *Parser) getImportedStatements(importpath string) (*ast.Program, error)
 			path = filepath.Dir(path)
 		}
 
-		var err error
-		fn = filepath.Join(path, importpath+".mp")
-		f, err = ioutil.ReadFile(fn)
-		if err != nil { //error occurred, maybe the file do not exists.
-			// Check for 'MAGPIE_ROOT' environment variable
-			importRoot := os.Getenv("MAGPIE_ROOT")
-			if len(importRoot) == 0 { //'MAGPIE_ROOT' environment variable is not set
-				//check embedded file
-				if p.Attachments == nil {
-					return nil, fmt.Errorf("Syntax Error:%v- no file or directory: %s.mp, %s", p.curToken.Pos, importpath, path)
-				}
+		//relative imports are only searched in the importing file's directory,
+		//others are searched in the vendor directories first
+		dirs := []string{path}
+		if !ast.IsRelativeImport(importpath) {
+			dirs = append(mod.VendorDirs(path), dirs...)
+			dirs = append(dirs, SearchPath()...)
+		}
 
-				//search in attachments
-				contents := p.Attachments.List()
-				iFound := false
-				for _, name := range contents {
-					if name == importpath {
-						iFound = true
-						break
-					}
-				}
-				if !iFound {
-					return nil, fmt.Errorf("Syntax Error:%v- no file or directory: %s.mp, %s", p.curToken.Pos, importpath, path)
+		var tried []string
+		found := false
+	search:
+		for _, dir := range dirs {
+			for _, candidate := range moduleFiles(dir, importpath) {
+				tried = append(tried, candidate)
+				if buf, err := ioutil.ReadFile(candidate); err == nil {
+					f, fn, found = buf, candidate, true
+					break search
 				}
+			}
+		}
 
-				buf, err := p.Attachments.GetResource(importpath)
-				if err != nil {
-					return nil, fmt.Errorf("Syntax Error:%v- no file or directory: %s.mp, %s", p.curToken.Pos, importpath, path)
+		//check embedded file
+		if !found && p.Attachments != nil && !ast.IsRelativeImport(importpath) {
+			tried = append(tried, "attachment '"+importpath+"'")
+			for _, name := range p.Attachments.List() {
+				if name != importpath {
+					continue
 				}
-				f = buf
-			} else {
-				fn = filepath.Join(importRoot, importpath+".mp")
-				e, err := ioutil.ReadFile(fn)
-				if err != nil {
-					return nil, fmt.Errorf("Syntax Error:%v- no file or directory: %s.mp, %s", p.curToken.Pos, importpath, importRoot)
+				if buf, err := p.Attachments.GetResource(importpath); err == nil {
+					f, fn, found = buf, filepath.Join(path, importpath+".mp"), true
 				}
-				f = e
+				break
+			}
+		}
+
+		if !found {
+			return nil, "", fmt.Errorf("Syntax Error:%v- cannot find module '%s', tried:\n\t%s", p.curToken.Pos, importpath, strings.Join(tried, "\n\t"))
+		}
+	}
+
+	abs := importpath //standard lib
+	if !isStdLib(importpath) {
+		var err error
+		if abs, err = filepath.Abs(fn); err != nil {
+			abs = fn
+		}
+	}
+
+	chain := p.importChain
+	if len(chain) == 0 && p.l.Filename != "" {
+		if root, err := filepath.Abs(p.l.Filename); err == nil {
+			chain = []string{root}
+		}
+	}
+	for _, path := range chain {
+		if path == abs {
+			cycle := []string{}
+			for _, path := range append(chain, abs) {
+				cycle = append(cycle, displayPath(path))
 			}
+			return nil, "", fmt.Errorf("Syntax Error:%v- import cycle: %s", p.curToken.Pos, strings.Join(cycle, " -> "))
 		}
 	}
 
@@ -363,17 +551,18 @@ func (p *Parser) getImportedStatements(importpath string) (*ast.Program, error)
 
 	ps := NewParser(l)
 	ps.Attachments = p.Attachments
+	ps.importChain = append(append([]string{}, chain...), abs)
 	parsed := ps.ParseProgram()
-	if len(ps.errors) != 0 {
-		p.errors = append(p.errors, ps.errors...)
-		p.errorLines = append(p.errorLines, ps.errorLines...)
+	for _, err := range ps.errors { //wrap the errors of the imported module with the import trace
+		p.errors = append(p.errors, fmt.Sprintf("%s\n\tin module '%s' imported at %s", err, importpath, strings.TrimSpace(p.curToken.Pos.String())))
 	}
+	p.errorLines = append(p.errorLines, ps.errorLines...)
 
 	if isStdLib(importpath) {
 		p.importLib[importpath] = parsed
 	}
 
-	return parsed, nil
+	return parsed, abs, nil
 }
 
 //let a,b,c = 1,2,3 (with assignment)
@@ -385,7 +574,7 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	for {
 		p.nextToken()
 		if !p.curTokenIs(token.TOKEN_IDENTIFIER) && p.curToken.Literal != "_" {
-			msg := fmt.Sprintf("Syntax Error:%v- expected token to be identifier|underscore, got %s instead.", p.curToken.Pos, p.curToken.Type)
+			msg := fmt.Sprintf("Syntax Error:%v- expected token to be identifier|underscore, got %s instead.%s", p.curToken.Pos, p.curToken.Type, reservedHint(p.curToken))
 			p.errors = append(p.errors, msg)
 			p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
 			return stmt
@@ -399,6 +588,14 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 		}
 		stmt.Names = append(stmt.Names, name)
 
+		var typ *ast.Identifier
+		if p.peekTokenIs(token.TOKEN_COLON) { //let x: number = 10
+			if typ = p.parseTypeAnnotation(); typ == nil {
+				return stmt
+			}
+		}
+		stmt.Types = append(stmt.Types, typ)
+
 		p.nextToken()
 		if p.curTokenIs(token.TOKEN_ASSIGN) || p.curTokenIs(token.TOKEN_SEMICOLON) {
 			break
@@ -427,6 +624,13 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 		p.nextToken()
 	}
 
+	//let unless = macro(cond, body) { ... }
+	if len(stmt.Names) == 1 && len(stmt.Values) == 1 {
+		if m, ok := stmt.Values[0].(*ast.MacroLiteral); ok {
+			p.macros[stmt.Names[0].Value] = len(m.Parameters)
+		}
+	}
+
 	return stmt
 }
 
@@ -547,6 +751,9 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 }
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
+	sendable := p.sendable
+	p.sendable = false //not the sub-expressions
+
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
 		p.noPrefixParseFnError(p.curToken.Type)
@@ -555,7 +762,13 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 	leftExp := prefix()
 
 	// Run the infix function until the next token has a higher precedence.
-	for precedence < p.peekPrecedence() {
+	for {
+		if !sendable {
+			p.splitRecv()
+		}
+		if precedence >= p.peekPrecedence() {
+			break
+		}
 		infix := p.infixParseFns[p.peekToken.Type]
 		if infix == nil {
 			return leftExp
@@ -624,19 +837,21 @@ func (p *Parser) parseFatArrow(left ast.Expression) ast.Expression {
 	}
 
 	p.nextToken()
-	if p.curTokenIs(token.TOKEN_LBRACE) { //if it's block, we use parseBlockStatement
-		fn.Body = p.parseBlockStatement()
-	} else { //not block, we use parseStatement
-		/* Note here, if we use parseExpressionStatement, then below is not correct:
+	p.parseFunctionBody(fn, func() *ast.BlockStatement {
+		if p.curTokenIs(token.TOKEN_LBRACE) { //if it's block, we use parseBlockStatement
+			return p.parseBlockStatement()
+		}
+		/* not block, we use parseStatement
+		   Note here, if we use parseExpressionStatement, then below is not correct:
 		    (x) => return x  //error: no prefix parse functions for 'RETURN' found
 		so we need to use parseStatement() here
 		*/
-		fn.Body = &ast.BlockStatement{
+		return &ast.BlockStatement{
 			Statements: []ast.Statement{
 				p.parseStatement(),
 			},
 		}
-	}
+	})
 	return fn
 }
 
@@ -717,6 +932,18 @@ func (p *Parser) parseGroupedExpression() ast.Expression {
 		return ret
 	}
 
+	if p.peekTokenIs(token.TOKEN_FOR) { //(x * 2 for x in xs if x > 0)
+		tc := &ast.TupleComprehension{Token: savedToken, Expr: exp}
+		if tc.Clauses = p.parseComprehensionClauses(); tc.Clauses == nil {
+			return nil
+		}
+		if !p.expectPeek(token.TOKEN_RPAREN) {
+			return nil
+		}
+		tc.EndToken = p.curToken
+		return tc
+	}
+
 	if !p.expectPeek(token.TOKEN_RPAREN) {
 		return nil
 	}
@@ -756,6 +983,70 @@ func (p *Parser) parseIdentifier() ast.Expression {
 	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+// an identifier, or a call to a one parameter macro with a block, e.g. 'measure { ... }'
+func (p *Parser) parseIdentifierExpression() ast.Expression {
+	ident := p.parseIdentifier()
+	call := &ast.CallExpression{Token: p.curToken, Function: ident}
+	if p.parseTrailingBlock(call) {
+		return call
+	}
+	return ident
+}
+
+// the block after a macro call becomes the macro's last argument if the call
+// lacks exactly one argument, e.g. 'retry(3) { ... }' for 'macro retry(n, body)'.
+// The block must start on the same line.
+func (p *Parser) parseTrailingBlock(call *ast.CallExpression) bool {
+	ident, ok := call.Function.(*ast.Identifier)
+	if !ok || !p.peekTokenIs(token.TOKEN_LBRACE) || p.peekToken.Pos.Line != p.curToken.Pos.Line {
+		return false
+	}
+	if n, ok := p.macros[ident.Value]; !ok || n != len(call.Arguments)+1 {
+		return false
+	}
+
+	p.nextToken()
+	block := &ast.BlockLiteral{Token: p.curToken, Block: p.parseBlockStatement()}
+	call.Arguments = append(call.Arguments, block)
+	return true
+}
+
+//macro(x, y) { body }, or macro name(x, y) { body }
+func (p *Parser) parseMacroLiteral() ast.Expression {
+	lit := &ast.MacroLiteral{Token: p.curToken}
+
+	if p.peekTokenIs(token.TOKEN_IDENTIFIER) {
+		p.nextToken()
+		lit.Name = p.curToken.Literal
+	}
+
+	if !p.expectPeek(token.TOKEN_LPAREN) {
+		return nil
+	}
+	fn := &ast.FunctionLiteral{Token: lit.Token}
+	if !p.parseFunctionParameters(fn) {
+		return nil
+	}
+	if fn.Variadic || fn.ParamTypes != nil || fn.ReturnType != nil {
+		msg := fmt.Sprintf("Syntax Error:%v- macro parameters could not be variadic or annotated", lit.Token.Pos)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, lit.Token.Pos.Sline())
+		return nil
+	}
+	lit.Parameters = fn.Parameters
+
+	if !p.expectPeek(token.TOKEN_LBRACE) {
+		return nil
+	}
+	p.parseFunctionBody(fn, p.parseBlockStatement)
+	lit.Body = fn.Body
+
+	if lit.Name != "" {
+		p.macros[lit.Name] = len(lit.Parameters)
+	}
+	return lit
+}
+
 func (p *Parser) parseBooleanLiteral() ast.Expression {
 	return &ast.BooleanLiteral{Token: p.curToken, Value: p.curTokenIs(token.TOKEN_TRUE)}
 }
@@ -766,14 +1057,30 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
-	array.Members, _ = p.parseExpressionList(token.TOKEN_RBRACKET)
+	if p.peekTokenIs(token.TOKEN_RBRACKET) {
+		array.Members, _ = p.parseExpressionList(token.TOKEN_RBRACKET)
+		return array
+	}
+
+	p.nextToken()
+	first := p.parseExpression(LOWEST)
+	if p.peekTokenIs(token.TOKEN_FOR) { //[x * 2 for x in xs if x > 0]
+		ac := &ast.ArrayComprehension{Token: array.Token, Expr: first}
+		if ac.Clauses = p.parseComprehensionClauses(); ac.Clauses == nil {
+			return nil
+		}
+		if !p.expectPeek(token.TOKEN_RBRACKET) {
+			return nil
+		}
+		ac.EndToken = p.curToken
+		return ac
+	}
+
+	array.Members, _ = p.parseExpressionListFrom(first, token.TOKEN_RBRACKET)
 	return array
 }
 
 func (p *Parser) parseExpressionList(end token.TokenType) ([]ast.Expression, bool) {
-	gotEllipsis := false
-	success := false
-
 	list := []ast.Expression{}
 	if p.peekTokenIs(end) {
 		p.nextToken()
@@ -781,7 +1088,37 @@ func (p *Parser) parseExpressionList(end token.TokenType) ([]ast.Expression, boo
 	}
 
 	p.nextToken()
-	list = append(list, p.parseExpression(LOWEST))
+	return p.parseExpressionListFrom(p.parseExpression(LOWEST), end)
+}
+
+// parse the rest of the expression list, 'first' is the already parsed first expression.
+func (p *Parser) parseExpressionListFrom(first ast.Expression, end token.TokenType) ([]ast.Expression, bool) {
+	gotEllipsis := false
+	success := false
+
+	list := []ast.Expression{}
+	var kwargs *ast.HashLiteral //a call's keyword arguments
+	add := func(arg ast.Expression) bool {
+		if _, ok := arg.(*ast.Identifier); ok && end == token.TOKEN_RPAREN && p.peekTokenIs(token.TOKEN_COLON) {
+			if kwargs == nil {
+				kwargs = &ast.HashLiteral{Token: p.peekToken, Pairs: make(map[ast.Expression]ast.Expression), Order: []ast.Expression{}}
+				list = append(list, kwargs)
+			}
+			return p.parseKeywordArg(kwargs, arg)
+		}
+		if kwargs != nil && arg != nil {
+			msg := fmt.Sprintf("Syntax Error:%v- positional argument follows keyword argument", arg.Pos())
+			p.errors = append(p.errors, msg)
+			p.errorLines = append(p.errorLines, arg.Pos().Sline())
+			return false
+		}
+		list = append(list, arg)
+		return true
+	}
+
+	if !add(first) {
+		return nil, false
+	}
 	gotEllipsis, success = p.checkEllipsis() //e.g. call(args...)
 	if !success {
 		return nil, false
@@ -790,7 +1127,9 @@ func (p *Parser) parseExpressionList(end token.TokenType) ([]ast.Expression, boo
 	for p.peekTokenIs(token.TOKEN_COMMA) {
 		p.nextToken()
 		p.nextToken()
-		list = append(list, p.parseExpression(LOWEST))
+		if !add(p.parseExpression(LOWEST)) {
+			return nil, false
+		}
 
 		gotEllipsis, success = p.checkEllipsis()
 		if !success {
@@ -805,6 +1144,26 @@ func (p *Parser) parseExpressionList(end token.TokenType) ([]ast.Expression, boo
 	return list, gotEllipsis
 }
 
+// 'name: value' in a call's arguments, the keyword arguments are passed as a
+// trailing hash, e.g. 'NewError("x", cause: e)' is 'NewError("x", {"cause": e})'.
+func (p *Parser) parseKeywordArg(kwargs *ast.HashLiteral, name ast.Expression) bool {
+	ident, ok := name.(*ast.Identifier)
+	if !ok {
+		msg := fmt.Sprintf("Syntax Error:%v- keyword argument's name must be an identifier, got '%s'", name.Pos(), name.String())
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, name.Pos().Sline())
+		return false
+	}
+	p.nextToken() //skip the name
+	p.nextToken() //skip ':'
+
+	key := &ast.StringLiteral{Token: ident.Token, Value: ident.Value}
+	kwargs.Pairs[key] = p.parseExpression(LOWEST)
+	kwargs.Order = append(kwargs.Order, key)
+	kwargs.RBraceToken = p.curToken
+	return true
+}
+
 /* first 'bool' means if we got Ellipsis or not
    second 'bool' means success or failure
 */
@@ -835,6 +1194,17 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 
 		p.nextToken()
 		value := p.parseExpression(LOWEST)
+		if len(hash.Order) == 0 && p.peekTokenIs(token.TOKEN_FOR) { //{k: v for k, v in h}
+			hc := &ast.HashComprehension{Token: hash.Token, Key: key, Value: value}
+			if hc.Clauses = p.parseComprehensionClauses(); hc.Clauses == nil {
+				return nil
+			}
+			if !p.expectPeek(token.TOKEN_RBRACE) {
+				return nil
+			}
+			hc.EndToken = p.curToken
+			return hc
+		}
 		hash.Pairs[key] = value
 		hash.Order = append(hash.Order, key)
 		if !p.peekTokenIs(token.TOKEN_RBRACE) && !p.expectPeek(token.TOKEN_COMMA) {
@@ -849,6 +1219,51 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	return hash
 }
 
+// parse the 'for names in iterable if cond' clauses of the comprehensions.
+// returns nil if there are any errors.
+func (p *Parser) parseComprehensionClauses() []*ast.ComprehensionClause {
+	clauses := []*ast.ComprehensionClause{}
+	for p.peekTokenIs(token.TOKEN_FOR) {
+		p.nextToken()
+		clause := &ast.ComprehensionClause{Token: p.curToken}
+		for {
+			p.nextToken()
+			if !p.curTokenIs(token.TOKEN_IDENTIFIER) && p.curToken.Literal != "_" {
+				msg := fmt.Sprintf("Syntax Error:%v- expected an identifier in comprehension, got %s instead", p.curToken.Pos, p.curToken.Type)
+				p.errors = append(p.errors, msg)
+				p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+				return nil
+			}
+			clause.Names = append(clause.Names, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+			if !p.peekTokenIs(token.TOKEN_COMMA) {
+				break
+			}
+			p.nextToken()
+		}
+
+		if len(clause.Names) > 2 {
+			msg := fmt.Sprintf("Syntax Error:%v- comprehension expects one or two loop variables", clause.Token.Pos)
+			p.errors = append(p.errors, msg)
+			p.errorLines = append(p.errorLines, clause.Token.Pos.Sline())
+			return nil
+		}
+
+		if !p.expectPeek(token.TOKEN_IN) {
+			return nil
+		}
+		p.nextToken()
+		clause.Iterable = p.parseExpression(LOWEST)
+
+		for p.peekTokenIs(token.TOKEN_IF) {
+			p.nextToken()
+			p.nextToken()
+			clause.Conds = append(clause.Conds, p.parseExpression(LOWEST))
+		}
+		clauses = append(clauses, clause)
+	}
+	return clauses
+}
+
 // parses a regular-expression
 func (p *Parser) parseRegexpLiteral() ast.Expression {
 	return &ast.RegExLiteral{Token: p.curToken, Value: p.curToken.Literal}
@@ -895,51 +1310,172 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	if !p.expectPeek(token.TOKEN_LPAREN) {
 		return nil
 	}
-	lit.Parameters, lit.Variadic = p.parseFunctionParameters()
+	if !p.parseFunctionParameters(lit) {
+		return nil
+	}
 	if !p.expectPeek(token.TOKEN_LBRACE) {
 		return nil
 	}
-	lit.Body = p.parseBlockStatement()
+	p.parseFunctionBody(lit, p.parseBlockStatement)
 	return lit
 }
 
-func (p *Parser) parseFunctionParameters() ([]*ast.Identifier, bool) {
+// parse the function's body, and mark the function as a generator
+// if its body contains 'yield'.
+func (p *Parser) parseFunctionBody(fn *ast.FunctionLiteral, parseBody func() *ast.BlockStatement) {
+	savedYieldFound, savedAsync := p.yieldFound, p.asyncFunction
+	savedLoopDepth, savedLoopLabels := p.loopDepth, p.loopLabels
+	p.yieldFound = false
+	p.asyncFunction, p.asyncNext = p.asyncNext, false
+	p.loopDepth, p.loopLabels = 0, nil //'break' and 'continue' can not cross the function boundary
+	p.functionDepth++
+
+	fn.Body = parseBody()
+	fn.IsGenerator = p.yieldFound
+
+	p.functionDepth--
+	p.yieldFound, p.asyncFunction = savedYieldFound, savedAsync
+	p.loopDepth, p.loopLabels = savedLoopDepth, savedLoopLabels
+}
+
+func (p *Parser) parseYieldExpression() ast.Expression {
+	if p.functionDepth == 0 {
+		msg := fmt.Sprintf("Syntax Error:%v- 'yield' outside of function", p.curToken.Pos)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+		return nil
+	}
+	p.yieldFound = true
+
+	ye := &ast.YieldExpression{Token: p.curToken}
+	if p.peekTokenIs(token.TOKEN_SEMICOLON) || p.peekTokenIs(token.TOKEN_RBRACE) || p.peekTokenIs(token.TOKEN_EOF) {
+		return ye
+	}
+	p.nextToken()
+	ye.Value = p.parseExpression(LOWEST)
+	return ye
+}
+
+//async fn name(args) { body }, async fn(args) { body }
+func (p *Parser) parseAsyncFunction() ast.Expression {
+	asyncToken := p.curToken
+	if !p.expectPeek(token.TOKEN_FUNCTION) {
+		return nil
+	}
+	p.asyncNext = true
+	fn, ok := p.parseFunctionLiteral().(*ast.FunctionLiteral)
+	p.asyncNext = false
+	if !ok {
+		return nil
+	}
+	if fn.IsGenerator {
+		msg := fmt.Sprintf("Syntax Error:%v- async function '%s' could not contain 'yield'", asyncToken.Pos, fn.Name)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, asyncToken.Pos.Sline())
+		return nil
+	}
+	fn.IsAsync = true
+	return fn
+}
+
+//'await' is allowed in the async functions and at the top level
+func (p *Parser) parseAwaitExpression() ast.Expression {
+	if p.functionDepth > 0 && !p.asyncFunction {
+		msg := fmt.Sprintf("Syntax Error:%v- 'await' outside of async function", p.curToken.Pos)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+		return nil
+	}
+
+	ae := &ast.AwaitExpression{Token: p.curToken}
+	p.nextToken()
+	ae.Value = p.parseExpression(PREFIX)
+	if ae.Value == nil {
+		return nil
+	}
+	return ae
+}
+
+func (p *Parser) parseFunctionParameters(fn *ast.FunctionLiteral) bool {
 	gotEllipsis := false
 	success := false
+	annotated := false
 
 	identifiers := []*ast.Identifier{}
+	types := []*ast.Identifier{}
 	if p.peekTokenIs(token.TOKEN_RPAREN) {
 		p.nextToken()
-		return identifiers, false
-	}
-	p.nextToken()
-	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	identifiers = append(identifiers, ident)
-	gotEllipsis, success = p.checkEllipsis() //e.g. fn xxx(args...)
-	if !success {
-		return nil, false
+		fn.Parameters = identifiers
+		return p.parseReturnType(fn)
 	}
 
-	for p.peekTokenIs(token.TOKEN_COMMA) {
-		p.nextToken()
+	for {
 		p.nextToken()
 		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 		identifiers = append(identifiers, ident)
-		gotEllipsis, success = p.checkEllipsis()
+
+		var typ *ast.Identifier
+		if p.peekTokenIs(token.TOKEN_COLON) { //e.g. fn xxx(x: number)
+			if typ = p.parseTypeAnnotation(); typ == nil {
+				return false
+			}
+			annotated = true
+		}
+		types = append(types, typ)
+
+		gotEllipsis, success = p.checkEllipsis() //e.g. fn xxx(args...)
 		if !success {
-			return nil, false
+			return false
+		}
+		if !p.peekTokenIs(token.TOKEN_COMMA) {
+			break
 		}
+		p.nextToken()
 	}
 
 	if !p.expectPeek(token.TOKEN_RPAREN) {
-		return nil, false
+		return false
+	}
+
+	fn.Parameters, fn.Variadic = identifiers, gotEllipsis
+	if annotated {
+		fn.ParamTypes = types
+	}
+	return p.parseReturnType(fn)
+}
+
+// fn xxx(args) -> type
+func (p *Parser) parseReturnType(fn *ast.FunctionLiteral) bool {
+	if !p.peekTokenIs(token.TOKEN_ARROW) {
+		return true
+	}
+	p.nextToken()
+	fn.ReturnType = p.parseTypeName()
+	return fn.ReturnType != nil
+}
+
+// parse the type annotation after a colon(e.g. 'x: number'), the current token is the name.
+func (p *Parser) parseTypeAnnotation() *ast.Identifier {
+	p.nextToken() //skip the name
+	return p.parseTypeName()
+}
+
+// type names are identifiers(number, string, struct names, etc.) or 'nil'
+func (p *Parser) parseTypeName() *ast.Identifier {
+	if !p.peekTokenIs(token.TOKEN_IDENTIFIER) && !p.peekTokenIs(token.TOKEN_NIL) {
+		msg := fmt.Sprintf("Syntax Error:%v- expected a type name, got %s instead.", p.peekToken.Pos, p.peekToken.Type)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, p.peekToken.Pos.Sline())
+		return nil
 	}
-	return identifiers, gotEllipsis
+	p.nextToken()
+	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
 	exp.Arguments, exp.Variadic = p.parseExpressionList(token.TOKEN_RPAREN)
+	p.parseTrailingBlock(exp)
 	return exp
 }
 
@@ -1036,6 +1572,9 @@ func (p *Parser) parseConditionalExpression() *ast.IfConditionExpr {
 func (p *Parser) parseMethodCallExpression(obj ast.Expression) ast.Expression {
 	methodCall := &ast.MethodCallExpression{Token: p.curToken, Object: obj}
 	p.nextToken()
+	if token.IsKeyword(p.curToken.Literal) { //a reserved word is a name after '.', e.g. 'opts.from'
+		p.curToken.Type = token.TOKEN_IDENTIFIER
+	}
 
 	name := p.parseIdentifier()
 	if !p.peekTokenIs(token.TOKEN_LPAREN) {
@@ -1056,19 +1595,20 @@ func (p *Parser) parsePostfixExpression(left ast.Expression) ast.Expression {
 }
 
 func (p *Parser) parseDoLoopExpression() ast.Expression {
-	p.loopDepth++
 	loop := &ast.DoLoop{Token: p.curToken}
+	loop.Label = p.enterLoop()
 
 	p.expectPeek(token.TOKEN_LBRACE)
 	loop.Block = p.parseBlockStatement()
 
-	p.loopDepth--
+	p.leaveLoop()
+	loop.Else = p.parseLoopElse()
 	return loop
 }
 
 func (p *Parser) parseWhileLoopExpression() ast.Expression {
-	p.loopDepth++
 	loop := &ast.WhileLoop{Token: p.curToken}
+	loop.Label = p.enterLoop()
 
 	p.nextToken()
 	loop.Condition = p.parseExpressionStatement().Expression
@@ -1084,28 +1624,30 @@ func (p *Parser) parseWhileLoopExpression() ast.Expression {
 		msg := fmt.Sprintf("Syntax Error:%v- for loop must be followed by a '{'", p.curToken.Pos)
 		p.errors = append(p.errors, msg)
 		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+		p.leaveLoop()
 		return nil
 	}
 
-	p.loopDepth--
+	p.leaveLoop()
+	loop.Else = p.parseLoopElse()
 	return loop
 }
 
 func (p *Parser) parseForLoopExpression() ast.Expression {
-	p.loopDepth++
+	label := p.enterLoop()
 	curToken := p.curToken //save current token
 
 	var r ast.Expression
 	if p.peekTokenIs(token.TOKEN_LBRACE) { //for { block }
 		r = p.parseForEverLoopExpression(curToken)
-		p.loopDepth--
-		return r
+		p.leaveLoop()
+		return p.finishForLoop(r, label)
 	}
 
 	if p.peekTokenIs(token.TOKEN_LPAREN) { //for (init; cond; updater) { block }
 		r = p.parseCForLoopExpression(curToken)
-		p.loopDepth--
-		return r
+		p.leaveLoop()
+		return p.finishForLoop(r, label)
 	}
 
 	p.nextToken()                  //skip 'for'
@@ -1121,13 +1663,113 @@ func (p *Parser) parseForLoopExpression() ast.Expression {
 		msg := fmt.Sprintf("Syntax Error:%v- for loop must be followed by an underscore or identifier. got %s", p.curToken.Pos, p.curToken.Literal)
 		p.errors = append(p.errors, msg)
 		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+		p.leaveLoop()
 		return nil
 	}
 
-	p.loopDepth--
+	p.leaveLoop()
+	return p.finishForLoop(r, label)
+}
+
+// set the for loop's label, and parse its 'else' block.
+func (p *Parser) finishForLoop(r ast.Expression, label string) ast.Expression {
+	switch loop := r.(type) {
+	case *ast.ForEverLoop:
+		if loop != nil {
+			loop.Label = label
+		}
+	case *ast.CForLoop:
+		if loop != nil {
+			loop.Label = label
+			loop.Else = p.parseLoopElse()
+		}
+	case *ast.ForEachArrayLoop:
+		if loop != nil {
+			loop.Label = label
+			loop.Else = p.parseLoopElse()
+		}
+	case *ast.ForEachMapLoop:
+		if loop != nil {
+			loop.Label = label
+			loop.Else = p.parseLoopElse()
+		}
+	}
 	return r
 }
 
+//label: for/while/do loop
+func (p *Parser) parseLabeledLoop() ast.Statement {
+	labelToken := p.curToken
+	p.nextToken() //skip label
+	p.nextToken() //skip ':'
+
+	if !p.curTokenIs(token.TOKEN_FOR) && !p.curTokenIs(token.TOKEN_WHILE) && !p.curTokenIs(token.TOKEN_DO) {
+		msg := fmt.Sprintf("Syntax Error:%v- label '%s' must be followed by a loop", labelToken.Pos, labelToken.Literal)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, labelToken.Pos.Sline())
+		return nil
+	}
+
+	for _, label := range p.loopLabels {
+		if label == labelToken.Literal {
+			msg := fmt.Sprintf("Syntax Error:%v- label '%s' already defined on an enclosing loop", labelToken.Pos, labelToken.Literal)
+			p.errors = append(p.errors, msg)
+			p.errorLines = append(p.errorLines, labelToken.Pos.Sline())
+			return nil
+		}
+	}
+
+	p.nextLabel = labelToken.Literal
+	return p.parseExpressionStatement()
+}
+
+// enter a loop's body, returns the loop's label.
+func (p *Parser) enterLoop() string {
+	label := p.nextLabel
+	p.nextLabel = ""
+	p.loopDepth++
+	p.loopLabels = append(p.loopLabels, label)
+	return label
+}
+
+func (p *Parser) leaveLoop() {
+	p.loopDepth--
+	p.loopLabels = p.loopLabels[:len(p.loopLabels)-1]
+}
+
+// 'else' block of a loop, runs when the loop finishes without 'break'
+func (p *Parser) parseLoopElse() *ast.BlockStatement {
+	if !p.peekTokenIs(token.TOKEN_ELSE) {
+		return nil
+	}
+	p.nextToken()
+	if !p.expectPeek(token.TOKEN_LBRACE) {
+		return nil
+	}
+	return p.parseBlockStatement()
+}
+
+// parse the label after 'break' or 'continue'(must be on the same line),
+// and check that it's the label of an enclosing loop.
+func (p *Parser) parseLoopLabel() (string, bool) {
+	if !p.peekTokenIs(token.TOKEN_IDENTIFIER) || p.peekToken.Pos.Line != p.curToken.Pos.Line {
+		return "", true
+	}
+	keyword := p.curToken.Literal
+	p.nextToken()
+
+	for _, label := range p.loopLabels {
+		if label == p.curToken.Literal {
+			return label, true
+		}
+	}
+
+	msg := fmt.Sprintf("Syntax Error:%v- %s label '%s' is not defined on an enclosing loop", p.curToken.Pos, keyword, p.curToken.Literal)
+	p.errors = append(p.errors, msg)
+	p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+	return "", false
+}
+
 //for (init; condition; update) {}
 //for (; condition; update) {}  --- init is empty
 //for (; condition;;) {}  --- init & update both empty
@@ -1277,7 +1919,13 @@ func (p *Parser) parseBreakExpression() ast.Expression {
 		return nil
 	}
 
-	return &ast.BreakExpression{Token: p.curToken}
+	be := &ast.BreakExpression{Token: p.curToken}
+	label, ok := p.parseLoopLabel()
+	if !ok {
+		return nil
+	}
+	be.Label = label
+	return be
 
 }
 
@@ -1290,7 +1938,13 @@ func (p *Parser) parseContinueExpression() ast.Expression {
 		return nil
 	}
 
-	return &ast.ContinueExpression{Token: p.curToken}
+	ce := &ast.ContinueExpression{Token: p.curToken}
+	label, ok := p.parseLoopLabel()
+	if !ok {
+		return nil
+	}
+	ce.Label = label
+	return ce
 }
 
 func (p *Parser) parseStructStatement() ast.Statement {
@@ -1301,6 +1955,21 @@ func (p *Parser) parseStructStatement() ast.Statement {
 	p.nextToken()
 	st.Name = p.curToken.Literal
 
+	//struct Name implements Interface1, Interface2 { block }
+	if p.peekTokenIs(token.TOKEN_IMPLEMENTS) {
+		p.nextToken()
+		for {
+			if !p.expectPeek(token.TOKEN_IDENTIFIER) {
+				return nil
+			}
+			st.Implements = append(st.Implements, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+			if !p.peekTokenIs(token.TOKEN_COMMA) {
+				break
+			}
+			p.nextToken()
+		}
+	}
+
 	if !p.expectPeek(token.TOKEN_LBRACE) {
 		return nil
 	}
@@ -1311,6 +1980,72 @@ func (p *Parser) parseStructStatement() ast.Statement {
 	return st
 }
 
+//interface Name { fn Method1(args) fn Method2(args) { default implementation } }
+func (p *Parser) parseInterfaceStatement() ast.Statement {
+	it := &ast.InterfaceStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.TOKEN_IDENTIFIER) {
+		return nil
+	}
+	it.Name = p.curToken.Literal
+
+	if !p.expectPeek(token.TOKEN_LBRACE) {
+		return nil
+	}
+	p.nextToken()
+
+	names := make(map[string]bool)
+	for !p.curTokenIs(token.TOKEN_RBRACE) {
+		if p.curTokenIs(token.TOKEN_EOF) {
+			msg := fmt.Sprintf("Syntax Error:%v- unterminated interface statement", p.curToken.Pos)
+			p.errors = append(p.errors, msg)
+			p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+			return nil
+		}
+
+		if !p.curTokenIs(token.TOKEN_FUNCTION) {
+			msg := fmt.Sprintf("Syntax Error:%v- expected 'fn' in interface body. got %s instead", p.curToken.Pos, p.curToken.Type)
+			p.errors = append(p.errors, msg)
+			p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+			return nil
+		}
+
+		method := &ast.FunctionLiteral{Token: p.curToken}
+		if !p.expectPeek(token.TOKEN_IDENTIFIER) {
+			return nil
+		}
+		method.Name = p.curToken.Literal
+		if names[method.Name] {
+			msg := fmt.Sprintf("Syntax Error:%v- duplicate method '%s' in interface '%s'", p.curToken.Pos, method.Name, it.Name)
+			p.errors = append(p.errors, msg)
+			p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+			return nil
+		}
+		names[method.Name] = true
+
+		if !p.expectPeek(token.TOKEN_LPAREN) {
+			return nil
+		}
+		if !p.parseFunctionParameters(method) {
+			return nil
+		}
+
+		if p.peekTokenIs(token.TOKEN_LBRACE) { //default implementation
+			p.nextToken()
+			p.parseFunctionBody(method, p.parseBlockStatement)
+		}
+		if p.peekTokenIs(token.TOKEN_SEMICOLON) {
+			p.nextToken()
+		}
+
+		it.Methods = append(it.Methods, method)
+		p.nextToken()
+	}
+	it.RBraceToken = p.curToken
+
+	return it
+}
+
 func (p *Parser) parseSwitchExpression() ast.Expression {
 	p.fallthroughDepth++
 	switchExpr := &ast.SwitchExpression{Token: p.curToken}
@@ -1440,19 +2175,13 @@ func (p *Parser) parseTryStatement() ast.Statement {
 	p.nextToken()
 	tryStmt.Try = p.parseBlockStatement()
 
-	if p.peekTokenIs(token.TOKEN_CATCH) {
+	for p.peekTokenIs(token.TOKEN_CATCH) {
 		p.nextToken() //skip '}'
-
-		if p.peekTokenIs(token.TOKEN_IDENTIFIER) {
-			p.nextToken()
-			tryStmt.Var = p.curToken.Literal
-		}
-
-		if !p.expectPeek(token.TOKEN_LBRACE) {
+		clause := p.parseCatchClause()
+		if clause == nil {
 			return nil
 		}
-
-		tryStmt.Catch = p.parseBlockStatement()
+		tryStmt.Catches = append(tryStmt.Catches, clause)
 	}
 
 	if p.peekTokenIs(token.TOKEN_FINALLY) {
@@ -1467,12 +2196,56 @@ func (p *Parser) parseTryStatement() ast.Statement {
 	return tryStmt
 }
 
+// catch { }, catch e { }, catch (e) { } or catch (e: Type) { }
+func (p *Parser) parseCatchClause() *ast.CatchClause {
+	clause := &ast.CatchClause{Token: p.curToken}
+
+	if p.peekTokenIs(token.TOKEN_LPAREN) {
+		p.nextToken()
+		if !p.expectPeek(token.TOKEN_IDENTIFIER) {
+			return nil
+		}
+		clause.Var = p.curToken.Literal
+		if p.peekTokenIs(token.TOKEN_COLON) {
+			typ := p.parseTypeAnnotation()
+			if typ == nil {
+				return nil
+			}
+			clause.Type = typ.Value
+		}
+		if !p.expectPeek(token.TOKEN_RPAREN) {
+			return nil
+		}
+	} else if p.peekTokenIs(token.TOKEN_IDENTIFIER) {
+		p.nextToken()
+		clause.Var = p.curToken.Literal
+	}
+
+	if !p.expectPeek(token.TOKEN_LBRACE) {
+		return nil
+	}
+
+	clause.Block = p.parseBlockStatement()
+	return clause
+}
+
 func (p *Parser) parseThrowStatement() *ast.ThrowStmt {
 	stmt := &ast.ThrowStmt{Token: p.curToken}
 	if p.peekTokenIs(token.TOKEN_SEMICOLON) {
 		p.nextToken()
 		return stmt
 	}
+	//a bare 'throw' rethrows the caught value, it must end the block, or be followed by ';'.
+	//the thrown value must be on the same line as 'throw'.
+	if p.peekTokenIs(token.TOKEN_RBRACE) || p.peekTokenIs(token.TOKEN_EOF) {
+		return stmt
+	}
+	if p.peekToken.Pos.Line != p.curToken.Pos.Line {
+		msg := fmt.Sprintf("Syntax Error:%v- the thrown value must be on the same line as 'throw', use 'throw;' to rethrow", p.curToken.Pos)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+		return stmt
+	}
 	p.nextToken()
 	stmt.Expr = p.parseExpressionStatement().Expression
 
@@ -1480,6 +2253,130 @@ func (p *Parser) parseThrowStatement() *ast.ThrowStmt {
 
 }
 
+func (p *Parser) parseDeferStatement() ast.Statement {
+	if p.functionDepth == 0 {
+		msg := fmt.Sprintf("Syntax Error:%v- 'defer' outside of function", p.curToken.Pos)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+		return nil
+	}
+
+	stmt := &ast.DeferStmt{Token: p.curToken}
+	p.nextToken()
+	stmt.Expr = p.parseExpressionStatement().Expression
+	if stmt.Expr == nil {
+		return nil
+	}
+	return stmt
+}
+
+//spawn f(args), spawn obj.method(args)
+func (p *Parser) parseSpawnExpression() ast.Expression {
+	se := &ast.SpawnExpression{Token: p.curToken}
+	p.nextToken()
+	se.Call = p.parseExpression(PREFIX)
+
+	isCall := false
+	switch e := se.Call.(type) {
+	case *ast.CallExpression:
+		isCall = true
+	case *ast.MethodCallExpression:
+		if c, ok := e.Call.(*ast.CallExpression); ok {
+			_, isCall = c.Function.(*ast.Identifier)
+		}
+	}
+	if !isCall {
+		msg := fmt.Sprintf("Syntax Error:%v- 'spawn' expects a function call", se.Token.Pos)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, se.Token.Pos.Sline())
+		return nil
+	}
+	return se
+}
+
+func (p *Parser) parseSelectStatement() ast.Statement {
+	stmt := &ast.SelectStatement{Token: p.curToken}
+	if !p.expectPeek(token.TOKEN_LBRACE) {
+		return nil
+	}
+	p.nextToken()
+
+	hasDefault := false
+	for !p.curTokenIs(token.TOKEN_RBRACE) {
+		if p.curTokenIs(token.TOKEN_EOF) {
+			msg := fmt.Sprintf("Syntax Error:%v- unterminated select statement", p.curToken.Pos)
+			p.errors = append(p.errors, msg)
+			p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+			return nil
+		}
+
+		sc := &ast.SelectCase{Token: p.curToken}
+		switch {
+		case p.curTokenIs(token.TOKEN_DEFAULT):
+			if hasDefault {
+				msg := fmt.Sprintf("Syntax Error:%v- more than one default are not allowed", p.curToken.Pos)
+				p.errors = append(p.errors, msg)
+				p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+				return nil
+			}
+			hasDefault = true
+			sc.Default = true
+		case p.curTokenIs(token.TOKEN_CASE):
+			p.nextToken() //skip 'case'
+			if !p.parseSelectComm(sc) {
+				return nil
+			}
+		default:
+			msg := fmt.Sprintf("Syntax Error:%v- expected 'case' or 'default'. got %s instead", p.curToken.Pos, p.curToken.Type)
+			p.errors = append(p.errors, msg)
+			p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
+			return nil
+		}
+
+		if !p.expectPeek(token.TOKEN_LBRACE) {
+			return nil
+		}
+		sc.Block = p.parseBlockStatement()
+		p.nextToken() //skip '}'
+		stmt.Cases = append(stmt.Cases, sc)
+	}
+	stmt.RBraceToken = p.curToken
+	return stmt
+}
+
+// the communication of a select case: '<-ch', 'v = <-ch', 'v, ok = <-ch'
+// or 'ch <- value'
+func (p *Parser) parseSelectComm(sc *ast.SelectCase) bool {
+	p.sendable = true
+	expr := p.parseExpression(LOWEST)
+	for p.peekTokenIs(token.TOKEN_COMMA) { //v, ok = <-ch
+		sc.Names = append(sc.Names, expr)
+		p.nextToken()
+		p.nextToken()
+		expr = p.parseExpression(LOWEST)
+	}
+	if a, ok := expr.(*ast.AssignExpression); ok && a.Token.Type == token.TOKEN_ASSIGN {
+		sc.Names = append(sc.Names, a.Name)
+		sc.AssignToken = a.Token
+		expr = a.Value
+	}
+	sc.Comm = expr
+
+	valid := false
+	switch e := expr.(type) {
+	case *ast.PrefixExpression:
+		valid = e.Token.Type == token.TOKEN_RECV && len(sc.Names) <= 2
+	case *ast.InfixExpression:
+		valid = e.Token.Type == token.TOKEN_RECV && len(sc.Names) == 0
+	}
+	if !valid {
+		msg := fmt.Sprintf("Syntax Error:%v- select case must be a receive('<-ch', 'v, ok = <-ch') or a send('ch <- v')", sc.Token.Pos)
+		p.errors = append(p.errors, msg)
+		p.errorLines = append(p.errorLines, sc.Token.Pos.Sline())
+	}
+	return valid
+}
+
 func (p *Parser) parseDecorator() ast.Expression {
 	if p.peekTokenIs(token.TOKEN_LBRACE) { //ordered hash
 		p.nextToken() //skip the '@'
@@ -1493,12 +2390,21 @@ func (p *Parser) parseDecorator() ast.Expression {
 	dc.Decorator = p.parseExpressionStatement().Expression
 
 	p.nextToken()
+	if p.curTokenIs(token.TOKEN_STRUCT) { //decorated struct
+		st, ok := p.parseStructStatement().(*ast.StructStatement)
+		if !ok {
+			return nil
+		}
+		dc.Decorated = st
+		return dc
+	}
+
 	expr := p.parseExpressionStatement().Expression
 	//check Decorated function, must be a FunctionLiteral or another Decorator
 	switch nodeType := expr.(type) {
 	case *ast.FunctionLiteral:
 		if nodeType.Name == "" {
-			msg := fmt.Sprintf("Syntax Error:%v- decorator must be followed by a named function or another decorator", p.curToken.Pos)
+			msg := fmt.Sprintf("Syntax Error:%v- decorator must be followed by a named function, a struct or another decorator", p.curToken.Pos)
 			p.errors = append(p.errors, msg)
 			p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
 			return nil
@@ -1507,7 +2413,7 @@ func (p *Parser) parseDecorator() ast.Expression {
 	case *ast.DecoratorExpr:
 		dc.Decorated = nodeType
 	default:
-		msg := fmt.Sprintf("Syntax Error:%v- decorator must be followed by a named function or another decorator", p.curToken.Pos)
+		msg := fmt.Sprintf("Syntax Error:%v- decorator must be followed by a named function, a struct or another decorator", p.curToken.Pos)
 		p.errors = append(p.errors, msg)
 		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
 		return nil
@@ -1522,12 +2428,20 @@ func (p *Parser) parseCommand() ast.Expression {
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
 	if t != token.TOKEN_EOF {
-		msg := fmt.Sprintf("Syntax Error:%v- no prefix parse functions for '%s' found", p.curToken.Pos, t)
+		msg := fmt.Sprintf("Syntax Error:%v- no prefix parse functions for '%s' found%s", p.curToken.Pos, t, reservedHint(p.curToken))
 		p.errors = append(p.errors, msg)
 		p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
 	}
 }
 
+// the hint for a reserved word used as a name, e.g. 'let from = 1'
+func reservedHint(tok token.Token) string {
+	if token.IsKeyword(tok.Literal) {
+		return fmt.Sprintf(" ('%s' is a reserved word)", tok.Literal)
+	}
+	return ""
+}
+
 func (p *Parser) curTokenIs(t token.TokenType) bool {
 	return p.curToken.Type == t
 }
@@ -1537,6 +2451,9 @@ func (p *Parser) peekTokenIs(t token.TokenType) bool {
 }
 
 func (p *Parser) peekPrecedence() int {
+	if p.peekTokenIs(token.TOKEN_RECV) && p.peekToken.Pos.Line != p.curToken.Pos.Line {
+		return LOWEST //a receiving statement('<-ch') on the next line is not a send
+	}
 	if p, ok := precedences[p.peekToken.Type]; ok {
 		return p
 	}
@@ -1552,9 +2469,27 @@ func (p *Parser) curPrecedence() int {
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
+	if p.splitToken != nil {
+		p.peekToken = *p.splitToken
+		p.splitToken = nil
+		return
+	}
 	p.peekToken = p.l.NextToken()
 }
 
+// a send('ch <- v') is only an expression statement or a select case, so an
+// infix '<-' elsewhere is split into '<' and '-', e.g. 'if x<-y {}'.
+func (p *Parser) splitRecv() {
+	if !p.peekTokenIs(token.TOKEN_RECV) || p.peekToken.Pos.Line != p.curToken.Pos.Line {
+		return
+	}
+	minus := token.Token{Type: token.TOKEN_MINUS, Literal: "-", Pos: p.peekToken.Pos}
+	minus.Pos.Offset++
+	minus.Pos.Col++
+	p.splitToken = &minus
+	p.peekToken = token.Token{Type: token.TOKEN_LT, Literal: "<", Pos: p.peekToken.Pos}
+}
+
 func (p *Parser) expectPeek(t token.TokenType) bool {
 	if p.peekTokenIs(t) {
 		p.nextToken()
@@ -1568,7 +2503,7 @@ func (p *Parser) peekError(t token.TokenType) {
 	newPos := p.curToken.Pos
 	newPos.Col = newPos.Col + utf8.RuneCountInString(p.curToken.Literal)
 
-	msg := fmt.Sprintf("Syntax Error:%v- expected next token to be %s, got %s instead", newPos, t, p.peekToken.Type)
+	msg := fmt.Sprintf("Syntax Error:%v- expected next token to be %s, got %s instead%s", newPos, t, p.peekToken.Type, reservedHint(p.peekToken))
 	p.errors = append(p.errors, msg)
 	p.errorLines = append(p.errorLines, p.curToken.Pos.Sline())
 }
@@ -0,0 +1,279 @@
+// Package resolver assigns the functions' local variables to slots.
+//
+// A function call's scope keeps the variables which are assigned in the
+// function's body in a slice, laid out by the function literal's 'Locals',
+// and each identifier which refers to such a variable gets its address: the
+// number of function scopes up and the slot. The scopes which the resolver
+// does not know about(the comprehensions', the structs' and the macros') stop
+// the resolution, and their identifiers are looked up by name as before.
+//
+// The addresses are hints: the evaluator checks the scopes' layouts on the way,
+// and falls back to the lookup by name if they are not the expected ones.
+//
+// The resolver also marks the 'return f(x)' statements in tail positions,
+// which the evaluator runs like 'tailcall f(x)', reusing the caller's scope.
+package resolver
+
+import (
+	"magpie/ast"
+)
+
+const allArgs = "$_" //the call's arguments, created lazily by the scope
+
+type frame struct {
+	locals *ast.Locals //nil if it's a scope which the resolver does not know about
+	chain  []*ast.Locals
+
+	tailCalls bool //the function's returns could be tail calls
+	tries     int  //the number of enclosing 'try' statements in the function
+}
+
+type resolver struct {
+	frames  []*frame
+	structs map[string]bool //the structs' names, a struct call assigns the name in the caller's scope
+}
+
+// Resolve resolves the variables of the program's functions. The program's
+// own(global) variables are always looked up by name.
+func Resolve(program *ast.Program) {
+	if program.Resolved {
+		return
+	}
+	program.Resolved = true
+
+	r := &resolver{structs: make(map[string]bool)}
+	ast.Inspect(program, func(node ast.Node) bool {
+		if s, ok := node.(*ast.StructStatement); ok {
+			r.structs[s.Name] = true
+		}
+		return true
+	})
+	r.walk(program)
+}
+
+func (r *resolver) walk(node ast.Node) {
+	ast.Inspect(node, r.visit)
+}
+
+// the innermost frame, nil at the program's top level
+func (r *resolver) top() *frame {
+	if len(r.frames) == 0 {
+		return nil
+	}
+	return r.frames[len(r.frames)-1]
+}
+
+// walk the node's children in a scope which the resolver does not know about
+func (r *resolver) walkUnknown(node ast.Node) {
+	r.frames = append(r.frames, &frame{})
+	ast.Inspect(node, func(n ast.Node) bool {
+		return n == node || r.visit(n)
+	})
+	r.frames = r.frames[:len(r.frames)-1]
+}
+
+func (r *resolver) visit(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.Identifier:
+		r.resolve(n)
+	case *ast.FunctionLiteral:
+		r.function(n, false)
+		return false
+	case *ast.MethodCallExpression:
+		r.walk(n.Object)
+		//the member's name is looked up in the object, only the arguments are resolved
+		if call, ok := n.Call.(*ast.CallExpression); ok {
+			for _, arg := range call.Arguments {
+				r.walk(arg)
+			}
+		}
+		return false
+	case *ast.CallExpression:
+		if isQuoteCall(n) {
+			return false
+		}
+	case *ast.ReturnStatement:
+		if f := r.top(); f != nil && f.tailCalls && f.tries == 0 {
+			n.IsTailCall = isTailCall(n)
+		}
+	case *ast.TryStmt:
+		//'catch' and 'finally' must see the call's result
+		if f := r.top(); f != nil {
+			f.tries++
+			defer func() { f.tries-- }()
+		}
+		ast.Inspect(n, func(m ast.Node) bool {
+			return m == n || r.visit(m)
+		})
+		return false
+	case *ast.ArrayComprehension, *ast.TupleComprehension, *ast.HashComprehension, *ast.MacroLiteral:
+		r.walkUnknown(n)
+		return false
+	case *ast.StructStatement:
+		//the methods' scope is the struct object's scope
+		r.frames = append(r.frames, &frame{})
+		ast.Inspect(n.Block, func(m ast.Node) bool {
+			if fl, ok := m.(*ast.FunctionLiteral); ok {
+				r.function(fl, true)
+				return false
+			}
+			return r.visit(m)
+		})
+		r.frames = r.frames[:len(r.frames)-1]
+		return false
+	case *ast.InterfaceStatement:
+		//the default methods are added to the structs' scopes
+		r.frames = append(r.frames, &frame{})
+		for _, m := range n.Methods {
+			r.function(m, true)
+		}
+		r.frames = r.frames[:len(r.frames)-1]
+		return false
+	}
+	return true
+}
+
+// resolve the function's body in a new frame, a method's 'self' is a local
+func (r *resolver) function(fl *ast.FunctionLiteral, isMethod bool) {
+	locals := &ast.Locals{Index: make(map[string]int)}
+	for _, param := range fl.Parameters {
+		locals.Add(param.Value)
+	}
+	if isMethod {
+		locals.Add("self")
+	}
+	if fl.Body != nil {
+		r.declare(locals, fl.Body)
+	}
+	fl.Locals = locals
+
+	//the generators' returns end the iteration, and the annotated return
+	//type must be checked on the function's own result
+	f := &frame{locals: locals, chain: []*ast.Locals{locals}, tailCalls: !fl.IsGenerator && fl.ReturnType == nil}
+	if outer := r.frames; len(outer) > 0 && outer[len(outer)-1].locals != nil {
+		f.chain = append(f.chain, outer[len(outer)-1].chain...)
+	}
+
+	r.frames = append(r.frames, f)
+	if fl.Body != nil {
+		r.walk(fl.Body)
+	}
+	r.frames = r.frames[:len(r.frames)-1]
+}
+
+// add the variables which are assigned in the function's body to its layout
+func (r *resolver) declare(locals *ast.Locals, body *ast.BlockStatement) {
+	add := func(name string) {
+		if name != "" && name != "_" && name != allArgs {
+			locals.Add(name)
+		}
+	}
+	target := func(expr ast.Expression) {
+		switch t := expr.(type) {
+		case *ast.Identifier: //x = 1
+			add(t.Value)
+		case *ast.IndexExpression: //arr[0] = 1
+			if ident, ok := t.Left.(*ast.Identifier); ok {
+				add(ident.Value)
+			}
+		}
+	}
+
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.FunctionLiteral, *ast.StructStatement, *ast.InterfaceStatement:
+			locals.Captured = true
+		}
+		return !locals.Captured
+	})
+
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FunctionLiteral:
+			add(n.Name)
+			return false
+		case *ast.InterfaceStatement:
+			add(n.Name)
+			return false
+		case *ast.StructStatement, *ast.MacroLiteral,
+			*ast.ArrayComprehension, *ast.TupleComprehension, *ast.HashComprehension:
+			return false
+		case *ast.LetStatement:
+			for _, name := range n.Names {
+				add(name.Value)
+			}
+		case *ast.AssignExpression:
+			target(n.Name)
+		case *ast.MultiAssignStatement:
+			for _, name := range n.Names {
+				target(name)
+			}
+		case *ast.PostfixExpression: //x++
+			target(n.Left)
+		case *ast.ForEachArrayLoop:
+			add(n.Var)
+		case *ast.ForEachMapLoop:
+			add(n.Key)
+			add(n.Value)
+		case *ast.TryStmt:
+			for _, c := range n.Catches {
+				add(c.Var)
+			}
+		case *ast.SelectStatement: //case v, ok = <-ch
+			for _, c := range n.Cases {
+				for _, name := range c.Names {
+					target(name)
+				}
+			}
+		case *ast.CallExpression:
+			if isQuoteCall(n) {
+				return false
+			}
+			if ident, ok := n.Function.(*ast.Identifier); ok && r.structs[ident.Value] {
+				add(ident.Value)
+			}
+		}
+		return true
+	})
+}
+
+// find the identifier in the enclosing functions' layouts
+func (r *resolver) resolve(ident *ast.Identifier) {
+	if len(r.frames) == 0 || ident.Value == allArgs {
+		return
+	}
+	f := r.frames[len(r.frames)-1]
+	if f.locals == nil {
+		return
+	}
+
+	for depth, locals := range f.chain {
+		if slot, ok := locals.Index[ident.Value]; ok {
+			ident.Depth, ident.Slot, ident.Frames = depth, slot, f.chain[:depth+1]
+			return
+		}
+	}
+
+	//not a local of the enclosing functions, it could be a global variable
+	//if no unknown scope is between them and the program's scope
+	if len(r.frames) == len(f.chain) {
+		ident.Depth, ident.Slot, ident.Frames = len(f.chain), -1, f.chain
+	}
+}
+
+// 'return f(x)', but not 'return f($_)' which passes the arguments
+func isTailCall(ret *ast.ReturnStatement) bool {
+	if len(ret.ReturnValues) != 1 {
+		return false
+	}
+	call, ok := ret.ReturnValues[0].(*ast.CallExpression)
+	if !ok || isQuoteCall(call) {
+		return false
+	}
+	return !(len(call.Arguments) == 1 && call.Arguments[0].TokenLiteral() == allArgs)
+}
+
+func isQuoteCall(call *ast.CallExpression) bool {
+	ident, ok := call.Function.(*ast.Identifier)
+	return ok && ident.Value == "quote"
+}
@@ -53,6 +53,8 @@ const (
 	TOKEN_NOTMATCH // !~
 	TOKEN_FATARROW // =>
 	TOKEN_PIPE     // |>
+	TOKEN_ARROW    // ->
+	TOKEN_RECV     // <-
 
 	TOKEN_AND // &&
 	TOKEN_OR  // ||
@@ -87,6 +89,18 @@ const (
 	TOKEN_FINALLY     //finally
 	TOKEN_THROW       //throw
 	TOKEN_TAIL        //tail call
+	TOKEN_INTERFACE   //interface
+	TOKEN_IMPLEMENTS  //implements
+	TOKEN_IS          //is
+	TOKEN_YIELD       //yield
+	TOKEN_DEFER       //defer
+	TOKEN_MACRO       //macro
+	TOKEN_FROM        //from
+	TOKEN_AS          //as
+	TOKEN_SPAWN       //spawn
+	TOKEN_SELECT      //select
+	TOKEN_ASYNC       //async
+	TOKEN_AWAIT       //await
 
 	TOKEN_REGEX // regular expression
 )
@@ -180,6 +194,10 @@ func (tt TokenType) String() string {
 		return "=>"
 	case TOKEN_PIPE:
 		return "|>"
+	case TOKEN_ARROW:
+		return "->"
+	case TOKEN_RECV:
+		return "<-"
 
 	case TOKEN_AND:
 		return "&&"
@@ -243,6 +261,30 @@ func (tt TokenType) String() string {
 		return "THROW"
 	case TOKEN_TAIL:
 		return "TAILCALL"
+	case TOKEN_INTERFACE:
+		return "INTERFACE"
+	case TOKEN_IMPLEMENTS:
+		return "IMPLEMENTS"
+	case TOKEN_IS:
+		return "IS"
+	case TOKEN_YIELD:
+		return "YIELD"
+	case TOKEN_DEFER:
+		return "DEFER"
+	case TOKEN_MACRO:
+		return "MACRO"
+	case TOKEN_FROM:
+		return "FROM"
+	case TOKEN_AS:
+		return "AS"
+	case TOKEN_SPAWN:
+		return "SPAWN"
+	case TOKEN_SELECT:
+		return "SELECT"
+	case TOKEN_ASYNC:
+		return "ASYNC"
+	case TOKEN_AWAIT:
+		return "AWAIT"
 	case TOKEN_REGEX:
 		return "<REGEX>"
 	default:
@@ -276,6 +318,18 @@ var keywords = map[string]TokenType{
 	"finally":     TOKEN_FINALLY,
 	"throw":       TOKEN_THROW,
 	"tailcall":    TOKEN_TAIL,
+	"interface":   TOKEN_INTERFACE,
+	"implements":  TOKEN_IMPLEMENTS,
+	"is":          TOKEN_IS,
+	"yield":       TOKEN_YIELD,
+	"defer":       TOKEN_DEFER,
+	"macro":       TOKEN_MACRO,
+	"from":        TOKEN_FROM,
+	"as":          TOKEN_AS,
+	"spawn":       TOKEN_SPAWN,
+	"select":      TOKEN_SELECT,
+	"async":       TOKEN_ASYNC,
+	"await":       TOKEN_AWAIT,
 }
 
 type Token struct {
@@ -320,6 +374,12 @@ func (p Position) Sline() string { //String line
 	return msg
 }
 
+// IsKeyword reports whether the name is a reserved word
+func IsKeyword(ident string) bool {
+	_, ok := keywords[ident]
+	return ok
+}
+
 func LookupIdent(ident string) TokenType {
 	if tok, ok := keywords[ident]; ok {
 		return tok
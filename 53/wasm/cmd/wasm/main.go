@@ -2,15 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	_ "fmt"
 	_ "strings"
 	"syscall/js"
+	"time"
 
 	"magpie/eval"
 	"magpie/lexer"
 	"magpie/parser"
 )
 
+// the limits of a snippet's execution
+const (
+	runTimeout = 5 * time.Second
+	maxSteps   = 50000000
+	maxAlloc   = 256 << 20
+)
+
 func runCode(this js.Value, i []js.Value) interface{} {
 	m := make(map[string]interface{})
 	var buf bytes.Buffer
@@ -27,7 +36,17 @@ func runCode(this js.Value, i []js.Value) interface{} {
 		return m
 	}
 
-	scope := eval.NewScope(nil, &buf)
+	//the snippets are untrusted
+	ctx, cancel := context.WithTimeout(context.Background(), runTimeout)
+	defer cancel()
+	opts := &eval.Options{Context: ctx, MaxSteps: maxSteps, MaxAlloc: maxAlloc, Deny: eval.CapAll}
+
+	if errObj := eval.ExpandMacrosWithOptions(program, opts); errObj != nil {
+		m["output"] = errObj.Inspect()
+		return m
+	}
+
+	scope := eval.NewScopeWithOptions(&buf, opts)
 	result := eval.Eval(program, scope)
 	if (string(result.Type()) == eval.ERROR_OBJ) {
 		m["output"] = buf.String() + result.Inspect()